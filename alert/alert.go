@@ -0,0 +1,306 @@
+package alert
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io.klector/klector/clock"
+	"io.klector/klector/storage"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	StateInactive = "inactive"
+	StatePending  = "pending"
+	StateFiring   = "firing"
+	StateResolved = "resolved"
+)
+
+const rulesFile = "alert_rules.json"
+
+var ErrUnknownRule = errors.New("unknown alert rule")
+
+type Manager interface {
+	Rules() []Rule
+	// AddRule adds rule or replaces the rule with the same name.
+	AddRule(rule *Rule) error
+	// RemoveRule returns ErrUnknownRule if there is no rule with name.
+	RemoveRule(name string) error
+	States() []State
+	Stop()
+}
+
+type AlertConfiguration struct {
+	DataFolder     string        `json:"dataFolder"` // the rules are kept in alert_rules.json
+	Tick           time.Duration `json:"tick"`       // time between checks for due rules
+	QueryTimeout   time.Duration `json:"queryTimeout"`
+	WebhookTimeout time.Duration `json:"webhookTimeout"`
+	WebhookRetries int           `json:"webhookRetries"`
+	WebhookBackoff time.Duration `json:"webhookBackoff"` // before the first retry, doubled for every further one
+}
+
+func NewDefaultAlertConfiguration() *AlertConfiguration {
+	return &AlertConfiguration{
+		DataFolder:     storage.NewDefaultStorageConfiguration().DataFolder,
+		Tick:           time.Second,
+		QueryTimeout:   30 * time.Second,
+		WebhookTimeout: 10 * time.Second,
+		WebhookRetries: 3,
+		WebhookBackoff: time.Second,
+	}
+}
+
+type State struct {
+	Rule           string  `json:"rule"`
+	State          string  `json:"state"`
+	Value          float64 `json:"value"`
+	Since          uint64  `json:"since,omitempty"` // when the state was entered in ms
+	LastEvaluation uint64  `json:"lastEvaluation,omitempty"`
+	Error          string  `json:"error,omitempty"`
+}
+
+type ruleState struct {
+	rule  Rule
+	state State
+	next  uint64 // time of the next evaluation in ms
+}
+
+type manager struct {
+	config  *AlertConfiguration
+	storage *storage.Storage
+	clock   clock.Clock
+	client  *http.Client
+	mu      sync.Mutex
+	rules   map[string]*ruleState
+	wg      sync.WaitGroup
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// Create loads the rules from the data folder and starts evaluating them.
+func Create(config *AlertConfiguration, storage *storage.Storage) (Manager, error) {
+	m := newManager(config, storage, clock.System())
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+	go m.run()
+	return m, nil
+}
+
+func newManager(config *AlertConfiguration, storage *storage.Storage, c clock.Clock) *manager {
+	return &manager{
+		config:  config,
+		storage: storage,
+		clock:   c,
+		client:  &http.Client{Timeout: config.WebhookTimeout},
+		rules:   map[string]*ruleState{},
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+func (m *manager) Stop() {
+	close(m.stop)
+	<-m.done
+	m.wg.Wait()
+}
+
+func (m *manager) run() {
+	defer close(m.done)
+	ticker := time.NewTicker(m.config.Tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			m.evaluate(clock.Milliseconds(m.clock.Now()))
+		}
+	}
+}
+
+// evaluate evaluates the rules which are due at now.
+func (m *manager) evaluate(now uint64) {
+	m.mu.Lock()
+	var due []*ruleState
+	for _, rs := range m.rules {
+		if rs.next <= now {
+			rs.next = now + rs.rule.Interval
+			due = append(due, rs)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, rs := range due {
+		ctx, cancel := m.queryContext()
+		value, met, err := rs.rule.evaluate(ctx, *m.storage, now)
+		cancel()
+
+		m.mu.Lock()
+		if m.rules[rs.rule.Name] != rs {
+			// removed or replaced during the evaluation
+			m.mu.Unlock()
+			continue
+		}
+		notification := rs.transition(now, value, met, err)
+		m.mu.Unlock()
+		if notification != nil {
+			log.Printf("alert %s is %s with value %v", notification.Rule, notification.State, notification.Value)
+			m.notify(rs.rule.Webhooks, notification)
+		}
+	}
+}
+
+func (m *manager) queryContext() (context.Context, context.CancelFunc) {
+	if m.config.QueryTimeout > 0 {
+		return context.WithTimeout(context.Background(), m.config.QueryTimeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// transition updates the state with an evaluation and returns the notification
+// of firing or resolved rules.
+func (rs *ruleState) transition(now uint64, value float64, met bool, err error) *Notification {
+	rs.state.LastEvaluation = now
+	if err != nil {
+		rs.state.Error = err.Error()
+		return nil
+	}
+	rs.state.Error = ""
+	rs.state.Value = value
+
+	previous := rs.state.State
+	switch {
+	case met && (previous == StateInactive || previous == StateResolved):
+		rs.state.State, rs.state.Since = StatePending, now
+		if rs.rule.For == 0 {
+			rs.state.State = StateFiring
+		}
+	case met && previous == StatePending && now-rs.state.Since >= rs.rule.For:
+		rs.state.State, rs.state.Since = StateFiring, now
+	case !met && previous == StatePending:
+		rs.state.State, rs.state.Since = StateInactive, now
+	case !met && previous == StateFiring:
+		rs.state.State, rs.state.Since = StateResolved, now
+	}
+	if rs.state.State == previous || rs.state.State != StateFiring && rs.state.State != StateResolved {
+		return nil
+	}
+	return &Notification{
+		Rule:      rs.rule.Name,
+		State:     rs.state.State,
+		Value:     value,
+		Timestamp: now,
+		Condition: rs.rule.Condition,
+	}
+}
+
+func (m *manager) Rules() []Rule {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.sortedRules()
+}
+
+func (m *manager) sortedRules() []Rule {
+	rules := make([]Rule, 0, len(m.rules))
+	for _, rs := range m.rules {
+		rules = append(rules, rs.rule)
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].Name < rules[j].Name
+	})
+	return rules
+}
+
+func (m *manager) AddRule(rule *Rule) error {
+	if err := rule.validate(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	previous := m.rules[rule.Name]
+	m.rules[rule.Name] = &ruleState{rule: *rule, state: State{Rule: rule.Name, State: StateInactive}}
+	if err := m.save(); err != nil {
+		if previous != nil {
+			m.rules[rule.Name] = previous
+		} else {
+			delete(m.rules, rule.Name)
+		}
+		return err
+	}
+	return nil
+}
+
+func (m *manager) RemoveRule(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	previous, found := m.rules[name]
+	if !found {
+		return fmt.Errorf("%w %q", ErrUnknownRule, name)
+	}
+	delete(m.rules, name)
+	if err := m.save(); err != nil {
+		m.rules[name] = previous
+		return err
+	}
+	return nil
+}
+
+func (m *manager) States() []State {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	states := make([]State, 0, len(m.rules))
+	for _, rs := range m.rules {
+		states = append(states, rs.state)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Rule < states[j].Rule
+	})
+	return states
+}
+
+func (m *manager) load() error {
+	data, err := os.ReadFile(filepath.Join(m.config.DataFolder, rulesFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var rules []Rule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return fmt.Errorf("invalid %s: %w", rulesFile, err)
+	}
+	for i := range rules {
+		if err := rules[i].validate(); err != nil {
+			return fmt.Errorf("invalid rule %q in %s: %w", rules[i].Name, rulesFile, err)
+		}
+		m.rules[rules[i].Name] = &ruleState{rule: rules[i], state: State{Rule: rules[i].Name, State: StateInactive}}
+	}
+	return nil
+}
+
+// save writes the rules to a temporary file which replaces the rules file, so
+// that a failed write keeps the previous rules.
+func (m *manager) save() error {
+	data, err := json.MarshalIndent(m.sortedRules(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(m.config.DataFolder, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(m.config.DataFolder, rulesFile)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
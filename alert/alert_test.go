@@ -0,0 +1,126 @@
+package alert
+
+import (
+	"context"
+	"encoding/json"
+	"io.klector/klector/clock"
+	"io.klector/klector/storage"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRule_evaluate(t *testing.T) {
+	s := storage.Create(storage.NewDefaultStorageConfiguration())
+	for _, ts := range []uint64{10_000, 70_000, 75_000, 130_000, 190_000, 200_000, 210_000, 220_000, 230_000} {
+		s.Write(&storage.Events{Events: []storage.Event{
+			{Attributes: map[string]string{"status": "500"}, Measures: map[string]float64{"ms": 100}, Timestamp: ts},
+		}})
+	}
+	query := storage.Query{Attributes: map[string]string{"status": "500"}}
+
+	tests := []struct {
+		name      string
+		rule      Rule
+		now       uint64
+		wantValue float64
+		wantMet   bool
+	}{
+		{"Count above threshold", Rule{Query: query, Window: 60_000, Condition: Condition{Type: ConditionThreshold, Operator: ">", Threshold: 4}}, 240_000, 5, true},
+		{"Measure below threshold", Rule{Query: query, Measure: "ms", Window: 60_000, Condition: Condition{Type: ConditionThreshold, Operator: "<", Threshold: 200}}, 180_000, 100, true},
+		{"Anomaly", Rule{Query: query, Window: 60_000, Condition: Condition{Type: ConditionAnomaly, Baseline: 3, Deviations: 3}}, 240_000, 5, true},
+		{"No anomaly", Rule{Query: query, Window: 60_000, Condition: Condition{Type: ConditionAnomaly, Baseline: 2, Deviations: 3}}, 180_000, 1, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.rule.Name, tt.rule.Interval = "errors", 60_000
+			if err := tt.rule.validate(); err != nil {
+				t.Fatalf("validate() error = %v", err)
+			}
+			value, met, err := tt.rule.evaluate(context.Background(), s, tt.now)
+			if err != nil {
+				t.Fatalf("evaluate() error = %v", err)
+			}
+			if value != tt.wantValue || met != tt.wantMet {
+				t.Errorf("evaluate() = %v, %v, want %v, %v", value, met, tt.wantValue, tt.wantMet)
+			}
+		})
+	}
+}
+
+func Test_manager_evaluate(t *testing.T) {
+	var mu sync.Mutex
+	var received []Notification
+	requests := 0
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if requests == 1 {
+			w.WriteHeader(500)
+			return
+		}
+		var notification Notification
+		json.NewDecoder(r.Body).Decode(&notification)
+		received = append(received, notification)
+	}))
+	defer webhook.Close()
+
+	s := storage.Create(storage.NewDefaultStorageConfiguration())
+	for _, ts := range []uint64{100_000, 101_000, 102_000, 150_000, 151_000, 152_000} {
+		s.Write(&storage.Events{Events: []storage.Event{{Attributes: map[string]string{"status": "500"}, Timestamp: ts}}})
+	}
+	config := NewDefaultAlertConfiguration()
+	config.DataFolder = t.TempDir()
+	config.WebhookBackoff = time.Millisecond
+	m := newManager(config, &s, clock.System())
+	rule := Rule{
+		Name:      "errors",
+		Query:     storage.Query{Attributes: map[string]string{"status": "500"}},
+		Condition: Condition{Type: ConditionThreshold, Operator: ">=", Threshold: 3},
+		Window:    60_000,
+		Interval:  60_000,
+		For:       60_000,
+		Webhooks:  []string{webhook.URL},
+	}
+	if err := m.AddRule(&rule); err != nil {
+		t.Fatalf("AddRule() error = %v", err)
+	}
+
+	for _, step := range []struct {
+		now       uint64
+		wantState string
+	}{
+		{120_000, StatePending},
+		{150_000, StatePending}, // not due yet
+		{180_000, StateFiring},
+		{240_000, StateResolved},
+		{300_000, StateResolved},
+	} {
+		m.evaluate(step.now)
+		m.wg.Wait()
+		if got := m.States()[0].State; got != step.wantState {
+			t.Fatalf("state at %d = %v, want %v", step.now, got, step.wantState)
+		}
+	}
+
+	want := []Notification{
+		{Rule: "errors", State: StateFiring, Value: 3, Timestamp: 180_000, Condition: rule.Condition},
+		{Rule: "errors", State: StateResolved, Value: 0, Timestamp: 240_000, Condition: rule.Condition},
+	}
+	if !reflect.DeepEqual(received, want) {
+		t.Errorf("notifications = %+v, want %+v", received, want)
+	}
+
+	loaded := newManager(config, &s, clock.System())
+	if err := loaded.load(); err != nil {
+		t.Fatalf("load() error = %v", err)
+	}
+	if !reflect.DeepEqual(loaded.Rules(), m.Rules()) {
+		t.Errorf("loaded rules = %+v, want %+v", loaded.Rules(), m.Rules())
+	}
+}
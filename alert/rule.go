@@ -0,0 +1,147 @@
+package alert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io.klector/klector/storage"
+	"math"
+	"net/url"
+)
+
+// resolution is the length of the smallest buckets of the storage in ms,
+// windows end with the last complete bucket.
+const resolution = 60_000
+
+const (
+	ConditionThreshold = "threshold"
+	ConditionAnomaly   = "anomaly"
+)
+
+// Rule evaluates its query over the window before every evaluation and alerts
+// while the condition holds for at least For milliseconds.
+type Rule struct {
+	Name      string        `json:"name"`
+	Query     storage.Query `json:"query"`             // the attributes, filters and measures, the range is set by the evaluation
+	Measure   string        `json:"measure,omitempty"` // measure compared, the count of events if empty
+	Condition Condition     `json:"condition"`
+	Window    uint64        `json:"window"`        // length of the evaluated range in ms, a multiple of a minute
+	Interval  uint64        `json:"interval"`      // time between evaluations in ms
+	For       uint64        `json:"for,omitempty"` // time the condition holds before the rule fires in ms
+	Webhooks  []string      `json:"webhooks,omitempty"`
+}
+
+// Condition compares the value of the window with a threshold or, for
+// anomalies, with the mean of the Baseline windows before it.
+type Condition struct {
+	Type       string  `json:"type"`
+	Operator   string  `json:"operator,omitempty"` // >, >=, < or <= for thresholds
+	Threshold  float64 `json:"threshold,omitempty"`
+	Baseline   int     `json:"baseline,omitempty"`   // previous windows of anomalies
+	Deviations float64 `json:"deviations,omitempty"` // standard deviations from the mean which are anomalies
+}
+
+func (r *Rule) validate() error {
+	if r.Name == "" {
+		return errors.New("the rule needs a name")
+	}
+	if r.Window == 0 || r.Interval == 0 {
+		return errors.New("the window and interval of the rule must be greater than 0")
+	}
+	if r.Window%resolution != 0 {
+		return fmt.Errorf("the window of the rule must be a multiple of %d ms", resolution)
+	}
+	switch r.Condition.Type {
+	case ConditionThreshold:
+		switch r.Condition.Operator {
+		case ">", ">=", "<", "<=":
+		default:
+			return fmt.Errorf("invalid threshold operator %q", r.Condition.Operator)
+		}
+	case ConditionAnomaly:
+		if r.Condition.Baseline < 2 {
+			return errors.New("anomalies need a baseline of at least 2 windows")
+		}
+		if r.Condition.Deviations <= 0 {
+			return errors.New("the deviations of anomalies must be greater than 0")
+		}
+	default:
+		return fmt.Errorf("invalid condition type %q, use threshold or anomaly", r.Condition.Type)
+	}
+	if r.Measure != "" {
+		r.Query.Measures = []string{r.Measure}
+	} else {
+		r.Query.Measures = nil
+	}
+	for _, webhook := range r.Webhooks {
+		u, err := url.Parse(webhook)
+		if err != nil || u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("invalid webhook url %q", webhook)
+		}
+	}
+	return nil
+}
+
+// evaluate returns the value of the window ending with the last complete minute
+// before now and whether it meets the condition.
+func (r *Rule) evaluate(ctx context.Context, s storage.Storage, now uint64) (float64, bool, error) {
+	end := now - now%resolution
+	if end < r.Window*uint64(r.Condition.Baseline+1) {
+		return 0, false, errors.New("the windows of the rule reach before the epoch")
+	}
+	query := r.Query
+	query.StartTimestamp = end - r.Window
+	query.EndTimestamp = end - 1
+	query.Step = 0
+	query.CompareTo = nil
+	if r.Condition.Type == ConditionAnomaly {
+		for i := 1; i <= r.Condition.Baseline; i++ {
+			query.CompareTo = append(query.CompareTo, uint64(i)*r.Window)
+		}
+	}
+	result, err := s.Query(ctx, &query)
+	if err != nil {
+		return 0, false, err
+	}
+
+	value := float64(result.Value)
+	if r.Measure != "" {
+		value = result.Measures[r.Measure]
+	}
+	switch r.Condition.Type {
+	case ConditionThreshold:
+		switch r.Condition.Operator {
+		case ">":
+			return value, value > r.Condition.Threshold, nil
+		case ">=":
+			return value, value >= r.Condition.Threshold, nil
+		case "<":
+			return value, value < r.Condition.Threshold, nil
+		default:
+			return value, value <= r.Condition.Threshold, nil
+		}
+	default:
+		baseline := make([]float64, len(result.Comparisons))
+		for i, comparison := range result.Comparisons {
+			baseline[i] = float64(comparison.Value)
+			if r.Measure != "" {
+				baseline[i] = comparison.Measures[r.Measure].Value
+			}
+		}
+		mean, deviation := meanAndDeviation(baseline)
+		return value, math.Abs(value-mean) > r.Condition.Deviations*deviation, nil
+	}
+}
+
+func meanAndDeviation(values []float64) (float64, float64) {
+	sum := 0.0
+	for _, value := range values {
+		sum += value
+	}
+	mean := sum / float64(len(values))
+	squares := 0.0
+	for _, value := range values {
+		squares += (value - mean) * (value - mean)
+	}
+	return mean, math.Sqrt(squares / float64(len(values)))
+}
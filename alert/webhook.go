@@ -0,0 +1,69 @@
+package alert
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Notification is posted as JSON to the webhooks of a rule when it fires and
+// when it resolves.
+type Notification struct {
+	Rule      string    `json:"rule"`
+	State     string    `json:"state"`
+	Value     float64   `json:"value"`
+	Timestamp uint64    `json:"timestamp"`
+	Condition Condition `json:"condition"`
+}
+
+// notify posts notification to every webhook in the background, retrying
+// failed deliveries with an exponential backoff.
+func (m *manager) notify(webhooks []string, notification *Notification) {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		log.Printf("alert notification of %s failed: %v", notification.Rule, err)
+		return
+	}
+	for _, webhook := range webhooks {
+		m.wg.Add(1)
+		go func(webhook string) {
+			defer m.wg.Done()
+			if err := m.deliver(webhook, body); err != nil {
+				log.Printf("alert notification of %s to %s failed: %v", notification.Rule, webhook, err)
+			}
+		}(webhook)
+	}
+}
+
+func (m *manager) deliver(webhook string, body []byte) error {
+	backoff := m.config.WebhookBackoff
+	var err error
+	for attempt := 0; attempt <= m.config.WebhookRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-m.stop:
+				return fmt.Errorf("stopped after %d attempts: %w", attempt, err)
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+		if err = m.post(webhook, body); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (m *manager) post(webhook string, body []byte) error {
+	response, err := m.client.Post(webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with status %d", response.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"io.klector/klector/storage"
+	"log"
+	"net/http"
+)
+
+// funnelRequest is a funnel query whose range may also be given as time
+// expressions, see queryRequest.
+type funnelRequest struct {
+	storage.FunnelQuery
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+func (s *server) funnel(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var request funnelRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err := resolveRange(request.Start, request.End, s.clock, &request.StartTimestamp, &request.EndTimestamp); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	query := request.FunnelQuery
+	log.Printf("received funnel query %v", query)
+
+	ctx, cancel := s.queryContext(r)
+	defer cancel()
+	result, err := (*s.storage).Funnel(ctx, &query)
+	if err != nil {
+		w.WriteHeader(queryErrorStatus(err, 400))
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// retentionRequest is a retention query whose range may also be given as time
+// expressions, see queryRequest.
+type retentionRequest struct {
+	storage.RetentionQuery
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+func (s *server) retention(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var request retentionRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err := resolveRange(request.Start, request.End, s.clock, &request.StartTimestamp, &request.EndTimestamp); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	query := request.RetentionQuery
+	log.Printf("received retention query %v", query)
+
+	ctx, cancel := s.queryContext(r)
+	defer cancel()
+	result, err := (*s.storage).Retention(ctx, &query)
+	if err != nil {
+		w.WriteHeader(queryErrorStatus(err, 400))
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
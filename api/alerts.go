@@ -0,0 +1,75 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/julienschmidt/httprouter"
+	"io.klector/klector/alert"
+	"log"
+	"net/http"
+)
+
+func (s *server) listAlertRules(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if s.alerts == nil {
+		w.WriteHeader(404)
+		w.Write([]byte("alerting is disabled"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.alerts.Rules())
+}
+
+func (s *server) addAlertRule(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if s.alerts == nil {
+		w.WriteHeader(404)
+		w.Write([]byte("alerting is disabled"))
+		return
+	}
+
+	var rule alert.Rule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err := s.alerts.AddRule(&rule); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	log.Printf("added alert rule %v", rule)
+
+	w.WriteHeader(201)
+}
+
+func (s *server) removeAlertRule(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if s.alerts == nil {
+		w.WriteHeader(404)
+		w.Write([]byte("alerting is disabled"))
+		return
+	}
+
+	if err := s.alerts.RemoveRule(ps.ByName("name")); err != nil {
+		if errors.Is(err, alert.ErrUnknownRule) {
+			w.WriteHeader(404)
+		} else {
+			w.WriteHeader(500)
+		}
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+func (s *server) listAlerts(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if s.alerts == nil {
+		w.WriteHeader(404)
+		w.Write([]byte("alerting is disabled"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.alerts.States())
+}
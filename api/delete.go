@@ -0,0 +1,47 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"io.klector/klector/storage"
+	"log"
+	"net/http"
+)
+
+// deleteRequest is a deletion whose range may also be given as time
+// expressions, like the range of queryRequest.
+type deleteRequest struct {
+	storage.Deletion
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// delete removes events from the series and rollups. Funnels, retention and
+// cohorts are computed from the events of actors, which still count deleted
+// events.
+func (s *server) delete(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var request deleteRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err := resolveRange(request.Start, request.End, s.clock, &request.StartTimestamp, &request.EndTimestamp); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	log.Printf("received deletion %v", request.Deletion)
+
+	ctx, cancel := s.queryContext(r)
+	defer cancel()
+	result, err := (*s.storage).Delete(ctx, &request.Deletion)
+	if err != nil {
+		w.WriteHeader(queryErrorStatus(err, 400))
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
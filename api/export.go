@@ -0,0 +1,152 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"io"
+	"io.klector/klector/storage"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+type importResult struct {
+	Imported uint64 `json:"imported"`
+	Error    string `json:"error,omitempty"`
+}
+
+// exportEnd is the last line of an export, {"end":{...}}, without it the
+// export was cut off. It holds the number of series or why the export failed.
+type exportEnd struct {
+	Series uint64 `json:"series"`
+	Error  string `json:"error,omitempty"`
+}
+
+// exportLine is a line of an export, a series or the end.
+type exportLine struct {
+	storage.SeriesDump
+	End *exportEnd `json:"end,omitempty"`
+}
+
+// export streams every series of the storage as one JSON object per line,
+// see storage.SeriesDump, and ends with an exportEnd line. An error after the
+// status was sent is only in the last line.
+func (s *server) export(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(200)
+	encoder := json.NewEncoder(w)
+	end := exportEnd{}
+	err := (*s.storage).Export(r.Context(), func(dump *storage.SeriesDump) error {
+		if err := encoder.Encode(dump); err != nil {
+			return err
+		}
+		end.Series++
+		return nil
+	})
+	if err != nil {
+		log.Printf("export failed: %v", err)
+		end.Error = err.Error()
+	}
+	encoder.Encode(map[string]*exportEnd{"end": &end})
+}
+
+// importSeries reads series written by export and adds them to the storage.
+// Series before an invalid one stay imported, their number is in the result.
+// The end line of an export is checked, so that a failed or cut off export is
+// not taken for a complete one, but it is not required.
+func (s *server) importSeries(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	body, err := decodeBody(r)
+	if err != nil {
+		w.WriteHeader(415)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	defer body.Close()
+
+	var result importResult
+	status := 200
+	decoder := json.NewDecoder(body)
+	series := uint64(0) // since the last end line
+	for {
+		var line exportLine
+		if err := decoder.Decode(&line); err != nil {
+			if err != io.EOF {
+				status = 400
+				result.Error = fmt.Sprintf("series %d: %s", result.Imported+1, err.Error())
+			}
+			break
+		}
+		if line.End != nil {
+			if line.End.Error != "" {
+				status = 400
+				result.Error = fmt.Sprintf("the export failed: %s", line.End.Error)
+				break
+			}
+			if line.End.Series != series {
+				status = 400
+				result.Error = fmt.Sprintf("the export has %d series, %d were read", line.End.Series, series)
+				break
+			}
+			series = 0
+			continue
+		}
+		if err := (*s.storage).Import(&line.SeriesDump); err != nil {
+			status = 400
+			result.Error = fmt.Sprintf("series %d: %s", result.Imported+1, err.Error())
+			break
+		}
+		result.Imported++
+		series++
+	}
+	log.Printf("imported %d series", result.Imported)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&result)
+}
+
+// backup streams the last snapshot and the write-ahead log after it up to its
+// current record, whose seq is in the X-Wal-Position header, while writes
+// continue.
+func (s *server) backup(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	reader, position, err := (*s.storage).Backup()
+	if err != nil {
+		if errors.Is(err, storage.ErrNoWal) {
+			w.WriteHeader(409)
+		} else {
+			w.WriteHeader(500)
+		}
+		w.Write([]byte(err.Error()))
+		return
+	}
+	defer reader.Close()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("X-Wal-Position", strconv.FormatUint(position, 10))
+	w.WriteHeader(200)
+	if _, err := io.Copy(w, reader); err != nil {
+		log.Printf("backup failed: %v", err)
+		return
+	}
+	log.Printf("backup up to record %d", position)
+}
+
+// snapshot writes a snapshot which replaces the write-ahead log up to its
+// current record, writes wait until it is written.
+func (s *server) snapshot(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	position, err := (*s.storage).Snapshot()
+	if err != nil {
+		if errors.Is(err, storage.ErrNoWal) {
+			w.WriteHeader(409)
+		} else {
+			w.WriteHeader(500)
+		}
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]uint64{"position": position})
+}
@@ -0,0 +1,149 @@
+package api
+
+import (
+	"encoding/json"
+	"io.klector/klector/storage"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_server_exportImport(t *testing.T) {
+	s := storage.Create(storage.NewDefaultStorageConfiguration())
+	server := newServer(NewDefaultApiConfiguration(), &s)
+	s.Write(&storage.Events{Events: []storage.Event{
+		{Attributes: map[string]string{"app": "checkout", "country": "de"}, Count: 2, Timestamp: 60_000},
+		{Attributes: map[string]string{"app": "search"}, Timestamp: 120_000},
+	}})
+
+	r := httptest.NewRequest("GET", "/api/v1/admin/export", nil)
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, r)
+	if w.Code != 200 {
+		t.Fatalf("export status = %v, want 200: %s", w.Code, w.Body.String())
+	}
+	exported := w.Body.String()
+	if lines := strings.Count(exported, "\n"); lines != 5 || !strings.HasSuffix(exported, `{"end":{"series":4}}`+"\n") {
+		t.Fatalf("export has %d lines, want 4 series and the end:\n%s", lines, exported)
+	}
+	firstSeries := exported[:strings.Index(exported, "\n")+1]
+
+	tests := []struct {
+		name         string
+		body         string
+		wantCode     int
+		wantImported uint64
+	}{
+		{"Export", exported, 200, 4},
+		{"Empty", "", 200, 0},
+		{"Invalid series", exported + `{"attributes":[]}`, 400, 4},
+		{"Invalid JSON", exported + "{", 400, 4},
+		{"Without end", firstSeries, 200, 1},
+		{"Failed export", firstSeries + `{"end":{"series":1,"error":"query canceled"}}`, 400, 1},
+		{"Cut off export", firstSeries + `{"end":{"series":4}}`, 400, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := storage.Create(storage.NewDefaultStorageConfiguration())
+			server := newServer(NewDefaultApiConfiguration(), &target)
+			r := httptest.NewRequest("POST", "/api/v1/admin/import", strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			server.router.ServeHTTP(w, r)
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %v, want %v: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+			var result importResult
+			json.Unmarshal(w.Body.Bytes(), &result)
+			if result.Imported != tt.wantImported {
+				t.Errorf("imported = %v, want %v", result.Imported, tt.wantImported)
+			}
+			if tt.wantCode != 200 {
+				return
+			}
+
+			r = httptest.NewRequest("GET", "/api/v1/admin/export", nil)
+			w = httptest.NewRecorder()
+			server.router.ServeHTTP(w, r)
+			if tt.wantImported == 4 && w.Body.String() != exported {
+				t.Errorf("export after import =\n%s\nwant\n%s", w.Body.String(), exported)
+			}
+		})
+	}
+}
+
+func Test_server_backup(t *testing.T) {
+	config := storage.NewDefaultStorageConfiguration()
+	config.DataFolder = t.TempDir()
+	config.Wal = true
+	logged, err := storage.Open(config)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	logged.Write(&storage.Events{Events: []storage.Event{
+		{Attributes: map[string]string{"app": "checkout"}, Timestamp: 60_000},
+	}})
+
+	tests := []struct {
+		name         string
+		storage      storage.Storage
+		wantCode     int
+		wantPosition string
+	}{
+		{"Write-ahead log", logged, 200, "1"},
+		{"No write-ahead log", storage.Create(storage.NewDefaultStorageConfiguration()), 409, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newServer(NewDefaultApiConfiguration(), &tt.storage)
+			r := httptest.NewRequest("GET", "/api/v1/admin/backup", nil)
+			w := httptest.NewRecorder()
+			server.router.ServeHTTP(w, r)
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %v, want %v: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+			if got := w.Header().Get("X-Wal-Position"); got != tt.wantPosition {
+				t.Errorf("X-Wal-Position = %q, want %q", got, tt.wantPosition)
+			}
+		})
+	}
+}
+
+func Test_server_snapshot(t *testing.T) {
+	config := storage.NewDefaultStorageConfiguration()
+	config.DataFolder = t.TempDir()
+	config.Wal = true
+	logged, err := storage.Open(config)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	logged.Write(&storage.Events{Events: []storage.Event{
+		{Attributes: map[string]string{"app": "checkout"}, Timestamp: 60_000},
+	}})
+
+	tests := []struct {
+		name     string
+		storage  storage.Storage
+		wantCode int
+		wantBody string
+	}{
+		{"Write-ahead log", logged, 200, "{\"position\":1}\n"},
+		{"No write-ahead log", storage.Create(storage.NewDefaultStorageConfiguration()), 409, storage.ErrNoWal.Error()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newServer(NewDefaultApiConfiguration(), &tt.storage)
+			r := httptest.NewRequest("POST", "/api/v1/admin/snapshot", nil)
+			w := httptest.NewRecorder()
+			server.router.ServeHTTP(w, r)
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %v, want %v: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+			if w.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
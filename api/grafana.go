@@ -0,0 +1,355 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"io.klector/klector/storage"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Endpoints of the Grafana JSON (SimpleJSON) datasource, served under /grafana.
+// A target is a comma separated list of attribute conditions, e.g.
+// app=checkout,status=~5..,country=* where key=* splits the result into one
+// series per value of key.
+
+const (
+	grafanaMinStep        = 60_000
+	grafanaMaxAnnotations = 1000
+)
+
+type grafanaRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+type grafanaFilter struct {
+	Key      string `json:"key"`
+	Operator string `json:"operator"`
+	Value    string `json:"value"`
+}
+
+type grafanaTarget struct {
+	Target string `json:"target"`
+	RefId  string `json:"refId"`
+	Type   string `json:"type"`
+}
+
+type grafanaQuery struct {
+	Range        grafanaRange    `json:"range"`
+	IntervalMs   uint64          `json:"intervalMs"`
+	Targets      []grafanaTarget `json:"targets"`
+	AdhocFilters []grafanaFilter `json:"adhocFilters"`
+}
+
+type grafanaTimeSeries struct {
+	Target     string      `json:"target"`
+	Datapoints [][2]uint64 `json:"datapoints"`
+}
+
+type grafanaColumn struct {
+	Text string `json:"text"`
+	Type string `json:"type"`
+}
+
+type grafanaTable struct {
+	Type    string          `json:"type"`
+	Columns []grafanaColumn `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+}
+
+type grafanaAnnotation struct {
+	Time  uint64   `json:"time"`
+	Title string   `json:"title"`
+	Text  string   `json:"text"`
+	Tags  []string `json:"tags"`
+}
+
+type grafanaText struct {
+	Type string `json:"type,omitempty"`
+	Text string `json:"text"`
+}
+
+func writeGrafanaResponse(w http.ResponseWriter, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(response)
+}
+
+func decodeGrafanaRequest(w http.ResponseWriter, r *http.Request, request interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return false
+	}
+	return true
+}
+
+// parseGrafanaTarget turns a target into the conditions of a storage query.
+func parseGrafanaTarget(target string, query *storage.Query) error {
+	query.Attributes = map[string]string{}
+	for _, condition := range strings.Split(target, ",") {
+		condition = strings.TrimSpace(condition)
+		if condition == "" {
+			continue
+		}
+		i := strings.IndexAny(condition, "=!")
+		if i <= 0 {
+			return fmt.Errorf("invalid condition %q, expected key=value", condition)
+		}
+		key := strings.TrimSpace(condition[:i])
+		operator := "="
+		for _, op := range []string{"!=", "=~", "!~"} {
+			if strings.HasPrefix(condition[i:], op) {
+				operator = op
+			}
+		}
+		if operator == "=" && condition[i] != '=' {
+			return fmt.Errorf("invalid condition %q, expected key=value", condition)
+		}
+		value := strings.TrimSpace(condition[i+len(operator):])
+
+		switch {
+		case operator == "=" && value == "*":
+			query.GroupBy = append(query.GroupBy, key)
+		case operator == "=":
+			query.Attributes[key] = value
+		default:
+			query.Filters = append(query.Filters, storage.Filter{Attribute: key, Operator: operator, Values: []string{value}})
+		}
+	}
+	if len(query.Attributes) == 0 && len(query.Filters) == 0 && len(query.GroupBy) == 0 {
+		return fmt.Errorf("target %q has no conditions", target)
+	}
+	return nil
+}
+
+func grafanaGroupName(group *storage.Group) string {
+	names := make([]string, 0, len(group.Attributes))
+	for name := range group.Attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, name+"="+group.Attributes[name])
+	}
+	return strings.Join(parts, ",")
+}
+
+func (s *server) grafanaHealth(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.WriteHeader(200)
+}
+
+// grafanaSearch lists attribute keys, or the key=value targets of a key when
+// the search target ends with "=".
+func (s *server) grafanaSearch(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var request struct {
+		Target string `json:"target"`
+	}
+	if !decodeGrafanaRequest(w, r, &request) {
+		return
+	}
+
+	result := []string{}
+	if strings.HasSuffix(request.Target, "=") {
+		key := strings.TrimSuffix(request.Target, "=")
+		values, err := (*s.storage).Values(key)
+		if err != nil {
+			w.WriteHeader(500)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		for _, value := range values {
+			result = append(result, key+"="+value)
+		}
+	} else {
+		keys, err := (*s.storage).Keys()
+		if err != nil {
+			w.WriteHeader(500)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		for _, key := range keys {
+			if strings.Contains(key, request.Target) {
+				result = append(result, key)
+			}
+		}
+	}
+	writeGrafanaResponse(w, result)
+}
+
+func (s *server) grafanaQuery(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var request grafanaQuery
+	if !decodeGrafanaRequest(w, r, &request) {
+		return
+	}
+
+	step := request.IntervalMs
+	if step < grafanaMinStep {
+		step = grafanaMinStep
+	}
+
+	ctx, cancel := s.queryContext(r)
+	defer cancel()
+	result := []interface{}{}
+	for _, target := range request.Targets {
+		query := &storage.Query{
+			Id:             target.RefId,
+			StartTimestamp: uint64(request.Range.From.UnixNano() / 1_000_000),
+			EndTimestamp:   uint64(request.Range.To.UnixNano() / 1_000_000),
+		}
+		if target.Type != "table" {
+			query.Step = step
+		}
+		if err := parseGrafanaTarget(target.Target, query); err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		for _, filter := range request.AdhocFilters {
+			query.Filters = append(query.Filters, storage.Filter{Attribute: filter.Key, Operator: filter.Operator, Values: []string{filter.Value}})
+		}
+
+		resultSet, err := (*s.storage).Query(ctx, query)
+		if err != nil {
+			w.WriteHeader(queryErrorStatus(err, 400))
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		if target.Type == "table" {
+			result = append(result, grafanaTableOf(query, resultSet))
+			continue
+		}
+		if len(query.GroupBy) == 0 {
+			result = append(result, grafanaTimeSeriesOf(target.Target, resultSet.Buckets))
+			continue
+		}
+		for i := range resultSet.Groups {
+			result = append(result, grafanaTimeSeriesOf(grafanaGroupName(&resultSet.Groups[i]), resultSet.Groups[i].Buckets))
+		}
+	}
+	writeGrafanaResponse(w, result)
+}
+
+func grafanaTimeSeriesOf(name string, buckets []storage.Bucket) *grafanaTimeSeries {
+	series := &grafanaTimeSeries{
+		Target:     name,
+		Datapoints: make([][2]uint64, 0, len(buckets)),
+	}
+	for _, bucket := range buckets {
+		series.Datapoints = append(series.Datapoints, [2]uint64{bucket.Value, bucket.Timestamp})
+	}
+	return series
+}
+
+func grafanaTableOf(query *storage.Query, resultSet *storage.ResultSet) *grafanaTable {
+	table := &grafanaTable{Type: "table", Rows: [][]interface{}{}}
+	for _, key := range query.GroupBy {
+		table.Columns = append(table.Columns, grafanaColumn{Text: key, Type: "string"})
+	}
+	table.Columns = append(table.Columns, grafanaColumn{Text: "count", Type: "number"})
+
+	if len(query.GroupBy) == 0 {
+		table.Rows = append(table.Rows, []interface{}{resultSet.Value})
+		return table
+	}
+	for _, group := range resultSet.Groups {
+		row := make([]interface{}, 0, len(query.GroupBy)+1)
+		for _, key := range query.GroupBy {
+			row = append(row, group.Attributes[key])
+		}
+		table.Rows = append(table.Rows, append(row, group.Value))
+	}
+	return table
+}
+
+// grafanaAnnotations marks the time buckets in which events of the annotation
+// query's target occurred.
+func (s *server) grafanaAnnotations(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var request struct {
+		Range      grafanaRange `json:"range"`
+		Annotation struct {
+			Name  string `json:"name"`
+			Query string `json:"query"`
+		} `json:"annotation"`
+	}
+	if !decodeGrafanaRequest(w, r, &request) {
+		return
+	}
+
+	query := &storage.Query{
+		StartTimestamp: uint64(request.Range.From.UnixNano() / 1_000_000),
+		EndTimestamp:   uint64(request.Range.To.UnixNano() / 1_000_000),
+	}
+	query.Step = grafanaMinStep
+	if query.EndTimestamp > query.StartTimestamp && (query.EndTimestamp-query.StartTimestamp)/grafanaMaxAnnotations > query.Step {
+		query.Step = (query.EndTimestamp - query.StartTimestamp) / grafanaMaxAnnotations
+	}
+	if err := parseGrafanaTarget(request.Annotation.Query, query); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	ctx, cancel := s.queryContext(r)
+	defer cancel()
+	resultSet, err := (*s.storage).Query(ctx, query)
+	if err != nil {
+		w.WriteHeader(queryErrorStatus(err, 400))
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	annotations := []grafanaAnnotation{}
+	for _, bucket := range resultSet.Buckets {
+		if bucket.Value == 0 {
+			continue
+		}
+		annotations = append(annotations, grafanaAnnotation{
+			Time:  bucket.Timestamp,
+			Title: request.Annotation.Name,
+			Text:  fmt.Sprintf("%d events matching %s", bucket.Value, request.Annotation.Query),
+			Tags:  []string{},
+		})
+	}
+	writeGrafanaResponse(w, annotations)
+}
+
+func (s *server) grafanaTagKeys(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	keys, err := (*s.storage).Keys()
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	result := make([]grafanaText, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, grafanaText{Type: "string", Text: key})
+	}
+	writeGrafanaResponse(w, result)
+}
+
+func (s *server) grafanaTagValues(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var request struct {
+		Key string `json:"key"`
+	}
+	if !decodeGrafanaRequest(w, r, &request) {
+		return
+	}
+	values, err := (*s.storage).Values(request.Key)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	result := make([]grafanaText, 0, len(values))
+	for _, value := range values {
+		result = append(result, grafanaText{Text: value})
+	}
+	writeGrafanaResponse(w, result)
+}
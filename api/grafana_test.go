@@ -0,0 +1,75 @@
+package api
+
+import (
+	"encoding/json"
+	"io.klector/klector/storage"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_server_grafana(t *testing.T) {
+	s := storage.Create(storage.NewDefaultStorageConfiguration())
+	server := newServer(NewDefaultApiConfiguration(), &s)
+	s.Write(&storage.Events{Events: []storage.Event{
+		{Attributes: map[string]string{"app": "checkout", "country": "de"}, Timestamp: 60_000},
+		{Attributes: map[string]string{"app": "checkout", "country": "de"}, Timestamp: 61_000},
+		{Attributes: map[string]string{"app": "checkout", "country": "fr"}, Timestamp: 120_000},
+		{Attributes: map[string]string{"app": "search", "country": "fr"}, Timestamp: 120_000},
+	}})
+
+	const timeRange = `"range":{"from":"1970-01-01T00:01:00Z","to":"1970-01-01T00:02:59Z"}`
+	tests := []struct {
+		name     string
+		url      string
+		body     string
+		wantCode int
+		want     string
+	}{
+		{"Search keys", "/grafana/search", `{"target":""}`, 200, `["app","country"]`},
+		{"Search values", "/grafana/search", `{"target":"app="}`, 200, `["app=checkout","app=search"]`},
+		{"Time series", "/grafana/query",
+			`{` + timeRange + `,"intervalMs":60000,"targets":[{"target":"app=checkout","refId":"A"}]}`, 200,
+			`[{"target":"app=checkout","datapoints":[[2,60000],[1,120000]]}]`},
+		{"Time series per value", "/grafana/query",
+			`{` + timeRange + `,"intervalMs":60000,"targets":[{"target":"app=~check.*,country=*","refId":"A"}]}`, 200,
+			`[{"target":"country=de","datapoints":[[2,60000],[0,120000]]},{"target":"country=fr","datapoints":[[0,60000],[1,120000]]}]`},
+		{"Ad hoc filters", "/grafana/query",
+			`{` + timeRange + `,"targets":[{"target":"country=fr"}],"adhocFilters":[{"key":"app","operator":"!=","value":"checkout"}]}`, 200,
+			`[{"target":"country=fr","datapoints":[[0,60000],[1,120000]]}]`},
+		{"Table", "/grafana/query",
+			`{` + timeRange + `,"targets":[{"target":"app=*","type":"table"}]}`, 200,
+			`[{"type":"table","columns":[{"text":"app","type":"string"},{"text":"count","type":"number"}],"rows":[["checkout",3],["search",1]]}]`},
+		{"Annotations", "/grafana/annotations",
+			`{` + timeRange + `,"annotation":{"name":"Search","query":"app=search"}}`, 200,
+			`[{"time":120000,"title":"Search","text":"1 events matching app=search","tags":[]}]`},
+		{"Tag keys", "/grafana/tag-keys", `{}`, 200,
+			`[{"type":"string","text":"app"},{"type":"string","text":"country"}]`},
+		{"Tag values", "/grafana/tag-values", `{"key":"country"}`, 200,
+			`[{"text":"de"},{"text":"fr"}]`},
+		{"Invalid target", "/grafana/query",
+			`{` + timeRange + `,"targets":[{"target":"app"}]}`, 400, ``},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", tt.url, strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			server.router.ServeHTTP(w, r)
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %v, want %v: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+			if tt.want == "" {
+				return
+			}
+
+			var got, want interface{}
+			json.Unmarshal(w.Body.Bytes(), &got)
+			json.Unmarshal([]byte(tt.want), &want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("response = %s, want %s", strings.TrimSpace(w.Body.String()), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,290 @@
+package api
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io.klector/klector/storage"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gRPC service of klector.proto over unencrypted HTTP/2, without generated
+// code: messages are framed by a compression flag and their length and the
+// status is sent in the grpc-status and grpc-message trailers.
+
+const (
+	grpcServicePrefix  = "/klector.v1.Klector/"
+	grpcMaxMessageSize = 4 << 20
+)
+
+// Status codes of gRPC.
+const (
+	grpcOk                = 0
+	grpcCanceled          = 1
+	grpcInvalidArgument   = 3
+	grpcDeadlineExceeded  = 4
+	grpcNotFound          = 5
+	grpcResourceExhausted = 8
+	grpcUnimplemented     = 12
+	grpcInternal          = 13
+)
+
+type grpcError struct {
+	code    int
+	message string
+}
+
+func (e *grpcError) Error() string {
+	return e.message
+}
+
+func (s *server) startGrpc() error {
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	grpcServer := &http.Server{
+		Addr:      s.config.GrpcAddress,
+		Handler:   http.HandlerFunc(s.grpc),
+		Protocols: &protocols,
+	}
+	log.Printf("gRPC listening on %s", s.config.GrpcAddress)
+	return grpcServer.ListenAndServe()
+}
+
+func (s *server) grpc(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		w.WriteHeader(415)
+		w.Write([]byte("expected a gRPC request"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+
+	response, err := s.grpcCall(r)
+	w.WriteHeader(200)
+	if err == nil {
+		err = writeGrpcMessage(w, response)
+	}
+	code := grpcOk
+	if err != nil {
+		code = grpcInternal
+		var status *grpcError
+		if errors.As(err, &status) {
+			code = status.code
+		}
+		w.Header().Set("Grpc-Message", grpcPercentEncode(err.Error()))
+	}
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+}
+
+func (s *server) grpcCall(r *http.Request) ([]byte, error) {
+	ctx, cancel, err := s.grpcContext(r)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+
+	method := strings.TrimPrefix(r.URL.Path, grpcServicePrefix)
+	if method == "WriteStream" {
+		return s.grpcWriteStream(r.Body)
+	}
+	request, err := readGrpcMessage(r.Body)
+	if errors.Is(err, io.EOF) {
+		return nil, &grpcError{grpcInvalidArgument, "missing request message"}
+	}
+	if err != nil {
+		return nil, err
+	}
+	message := newProtoReader(request)
+
+	switch method {
+	case "Write":
+		var events storage.Events
+		if err := decodeGrpcWriteRequest(message, &events); err != nil {
+			return nil, &grpcError{grpcInvalidArgument, err.Error()}
+		}
+		if err := (*s.storage).Write(&events); err != nil {
+			return nil, &grpcError{grpcInvalidArgument, err.Error()}
+		}
+		return appendProtoUint(nil, 1, uint64(len(events.Events))), nil
+	case "Query":
+		query, err := decodeQuery(message)
+		if err != nil {
+			return nil, &grpcError{grpcInvalidArgument, err.Error()}
+		}
+		result, err := s.grpcQuery(ctx, query)
+		if err != nil {
+			return nil, grpcQueryError(err)
+		}
+		return encodeResultSet(nil, result), nil
+	case "BatchQuery":
+		queries, err := decodeBatchQueryRequest(message)
+		if err != nil {
+			return nil, &grpcError{grpcInvalidArgument, err.Error()}
+		}
+		results := make([]*storage.ResultSet, len(queries))
+		errs := make([]error, len(queries))
+		for i := range queries {
+			if err := ctx.Err(); err != nil {
+				return nil, grpcQueryError(err)
+			}
+			results[i], errs[i] = s.grpcQuery(ctx, queries[i])
+		}
+		return encodeBatchQueryResponse(nil, results, errs), nil
+	case "Keys":
+		keys, err := (*s.storage).Keys()
+		if err != nil {
+			return nil, err
+		}
+		return encodeStrings(nil, keys), nil
+	case "Values":
+		key, err := decodeSingleString(message)
+		if err != nil {
+			return nil, &grpcError{grpcInvalidArgument, err.Error()}
+		}
+		values, err := (*s.storage).Values(key)
+		if err != nil {
+			return nil, err
+		}
+		return encodeStrings(nil, values), nil
+	}
+	return nil, &grpcError{grpcUnimplemented, fmt.Sprintf("unknown method %s", r.URL.Path)}
+}
+
+// grpcWriteStream writes the events of every message as it arrives.
+func (s *server) grpcWriteStream(body io.Reader) ([]byte, error) {
+	accepted := uint64(0)
+	for {
+		request, err := readGrpcMessage(body)
+		if errors.Is(err, io.EOF) {
+			return appendProtoUint(nil, 1, accepted), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var events storage.Events
+		if err := decodeGrpcWriteRequest(newProtoReader(request), &events); err != nil {
+			return nil, &grpcError{grpcInvalidArgument, fmt.Sprintf("%s, %d events accepted before", err.Error(), accepted)}
+		}
+		if err := (*s.storage).Write(&events); err != nil {
+			var writeErrors storage.WriteErrors
+			if errors.As(err, &writeErrors) {
+				accepted += uint64(len(events.Events) - len(writeErrors))
+			}
+			return nil, &grpcError{grpcInvalidArgument, fmt.Sprintf("%s, %d events accepted", err.Error(), accepted)}
+		}
+		accepted += uint64(len(events.Events))
+	}
+}
+
+func (s *server) grpcQuery(ctx context.Context, request queryRequest) (*storage.ResultSet, error) {
+	if err := request.resolve(s.clock); err != nil {
+		return nil, err
+	}
+	return (*s.storage).Query(ctx, &request.Query)
+}
+
+// grpcContext applies the grpc-timeout of the request, or the query timeout
+// if it is shorter.
+func (s *server) grpcContext(r *http.Request) (context.Context, context.CancelFunc, error) {
+	timeout := s.config.QueryTimeout
+	if header := r.Header.Get("Grpc-Timeout"); header != "" {
+		requested, err := parseGrpcTimeout(header)
+		if err != nil {
+			return nil, nil, &grpcError{grpcInvalidArgument, err.Error()}
+		}
+		if timeout == 0 || requested < timeout {
+			timeout = requested
+		}
+	}
+	if timeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		return ctx, cancel, nil
+	}
+	ctx, cancel := context.WithCancel(r.Context())
+	return ctx, cancel, nil
+}
+
+func parseGrpcTimeout(header string) (time.Duration, error) {
+	units := map[byte]time.Duration{
+		'H': time.Hour,
+		'M': time.Minute,
+		'S': time.Second,
+		'm': time.Millisecond,
+		'u': time.Microsecond,
+		'n': time.Nanosecond,
+	}
+	unit, found := units[header[len(header)-1]]
+	value, err := strconv.ParseInt(header[:len(header)-1], 10, 64)
+	if !found || err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid grpc-timeout %q", header)
+	}
+	return time.Duration(value) * unit, nil
+}
+
+func grpcQueryError(err error) error {
+	switch {
+	case errors.Is(err, storage.ErrQueryTimeout), errors.Is(err, context.DeadlineExceeded):
+		return &grpcError{grpcDeadlineExceeded, err.Error()}
+	case errors.Is(err, storage.ErrQueryCanceled), errors.Is(err, context.Canceled):
+		return &grpcError{grpcCanceled, err.Error()}
+	case errors.Is(err, storage.ErrQueryLimit):
+		return &grpcError{grpcResourceExhausted, err.Error()}
+	case errors.Is(err, storage.ErrUnknownRollup):
+		return &grpcError{grpcNotFound, err.Error()}
+	}
+	return &grpcError{grpcInvalidArgument, err.Error()}
+}
+
+// readGrpcMessage returns the next message of body, io.EOF at the end of the
+// stream.
+func readGrpcMessage(body io.Reader) ([]byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(body, header[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, &grpcError{grpcInvalidArgument, "gRPC message is truncated"}
+		}
+		return nil, err
+	}
+	if header[0] != 0 {
+		return nil, &grpcError{grpcUnimplemented, "compressed gRPC messages are not supported"}
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > grpcMaxMessageSize {
+		return nil, &grpcError{grpcResourceExhausted, fmt.Sprintf("gRPC message of %d bytes exceeds the maximum of %d", length, grpcMaxMessageSize)}
+	}
+	message := make([]byte, length)
+	if _, err := io.ReadFull(body, message); err != nil {
+		return nil, &grpcError{grpcInvalidArgument, "gRPC message is truncated"}
+	}
+	return message, nil
+}
+
+func writeGrpcMessage(w io.Writer, message []byte) error {
+	var header [5]byte
+	binary.BigEndian.PutUint32(header[1:], uint32(len(message)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(message)
+	return err
+}
+
+// grpcPercentEncode encodes a grpc-message, which may only contain printable
+// ASCII characters other than %.
+func grpcPercentEncode(message string) string {
+	var encoded strings.Builder
+	for i := 0; i < len(message); i++ {
+		if c := message[i]; c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&encoded, "%%%02X", c)
+		} else {
+			encoded.WriteByte(c)
+		}
+	}
+	return encoded.String()
+}
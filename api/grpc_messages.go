@@ -0,0 +1,346 @@
+package api
+
+import (
+	"io.klector/klector/storage"
+	"math"
+	"sort"
+)
+
+// Encoding and decoding of the messages of klector.proto. Fields with default
+// values are omitted and map entries are sorted by key, so that equal messages
+// have equal encodings.
+
+func decodeGrpcWriteRequest(r *protoReader, events *storage.Events) error {
+	return r.fields(func(field int, wireType int) (bool, error) {
+		if field != 1 || wireType != protoBytes {
+			return false, nil
+		}
+		message, err := r.message()
+		if err != nil {
+			return true, err
+		}
+		event, err := decodeEvent(message)
+		events.Events = append(events.Events, event)
+		return true, err
+	})
+}
+
+func decodeEvent(r *protoReader) (storage.Event, error) {
+	var event storage.Event
+	err := r.fields(func(field int, wireType int) (bool, error) {
+		var err error
+		switch {
+		case field == 1 && wireType == protoBytes:
+			event.Id, err = r.string()
+		case field == 2 && wireType == protoBytes:
+			if event.Attributes == nil {
+				event.Attributes = map[string]string{}
+			}
+			err = decodeStringEntry(r, event.Attributes)
+		case field == 3 && wireType == protoBytes:
+			if event.Measures == nil {
+				event.Measures = map[string]float64{}
+			}
+			err = decodeDoubleEntry(r, event.Measures)
+		case field == 4 && wireType == protoVarint:
+			event.Count, err = r.varint()
+		case field == 5 && wireType == protoVarint:
+			event.Timestamp, err = r.varint()
+		default:
+			return false, nil
+		}
+		return true, err
+	})
+	return event, err
+}
+
+func decodeQuery(r *protoReader) (queryRequest, error) {
+	var request queryRequest
+	query := &request.Query
+	err := r.fields(func(field int, wireType int) (bool, error) {
+		var err error
+		switch {
+		case field == 1 && wireType == protoBytes:
+			query.Id, err = r.string()
+		case field == 2 && wireType == protoBytes:
+			if query.Attributes == nil {
+				query.Attributes = map[string]string{}
+			}
+			err = decodeStringEntry(r, query.Attributes)
+		case field == 3 && wireType == protoBytes:
+			var filter storage.Filter
+			filter, err = decodeFilter(r)
+			query.Filters = append(query.Filters, filter)
+		case field == 4 && wireType == protoBytes:
+			var name string
+			name, err = r.string()
+			query.GroupBy = append(query.GroupBy, name)
+		case field == 5 && wireType == protoBytes:
+			var name string
+			name, err = r.string()
+			query.Measures = append(query.Measures, name)
+		case field == 6 && wireType == protoVarint:
+			query.StartTimestamp, err = r.varint()
+		case field == 7 && wireType == protoVarint:
+			query.EndTimestamp, err = r.varint()
+		case field == 8 && wireType == protoVarint:
+			query.Step, err = r.varint()
+		case field == 9 && wireType == protoVarint:
+			var offset uint64
+			offset, err = r.varint()
+			query.CompareTo = append(query.CompareTo, offset)
+		case field == 9 && wireType == protoBytes:
+			// packed
+			var packed *protoReader
+			if packed, err = r.message(); err != nil {
+				return true, err
+			}
+			for !packed.done() {
+				var offset uint64
+				if offset, err = packed.varint(); err != nil {
+					return true, err
+				}
+				query.CompareTo = append(query.CompareTo, offset)
+			}
+		case field == 10 && wireType == protoBytes:
+			query.Rollup, err = r.string()
+		case field == 11 && wireType == protoBytes:
+			request.Start, err = r.string()
+		case field == 12 && wireType == protoBytes:
+			request.End, err = r.string()
+		default:
+			return false, nil
+		}
+		return true, err
+	})
+	return request, err
+}
+
+func decodeFilter(r *protoReader) (storage.Filter, error) {
+	var filter storage.Filter
+	message, err := r.message()
+	if err != nil {
+		return filter, err
+	}
+	err = message.fields(func(field int, wireType int) (bool, error) {
+		var err error
+		switch {
+		case field == 1 && wireType == protoBytes:
+			filter.Attribute, err = message.string()
+		case field == 2 && wireType == protoBytes:
+			filter.Operator, err = message.string()
+		case field == 3 && wireType == protoBytes:
+			var value string
+			value, err = message.string()
+			filter.Values = append(filter.Values, value)
+		default:
+			return false, nil
+		}
+		return true, err
+	})
+	return filter, err
+}
+
+func decodeBatchQueryRequest(r *protoReader) ([]queryRequest, error) {
+	var requests []queryRequest
+	err := r.fields(func(field int, wireType int) (bool, error) {
+		if field != 1 || wireType != protoBytes {
+			return false, nil
+		}
+		message, err := r.message()
+		if err != nil {
+			return true, err
+		}
+		request, err := decodeQuery(message)
+		requests = append(requests, request)
+		return true, err
+	})
+	return requests, err
+}
+
+// decodeSingleString decodes messages with a single string field, such as
+// ValuesRequest.
+func decodeSingleString(r *protoReader) (string, error) {
+	var value string
+	err := r.fields(func(field int, wireType int) (bool, error) {
+		if field != 1 || wireType != protoBytes {
+			return false, nil
+		}
+		var err error
+		value, err = r.string()
+		return true, err
+	})
+	return value, err
+}
+
+func decodeStringEntry(r *protoReader, m map[string]string) error {
+	key, value, err := decodeLabel(r)
+	m[key] = value
+	return err
+}
+
+func decodeDoubleEntry(r *protoReader, m map[string]float64) error {
+	entry, err := r.message()
+	if err != nil {
+		return err
+	}
+	var key string
+	var value float64
+	err = entry.fields(func(field int, wireType int) (bool, error) {
+		switch {
+		case field == 1 && wireType == protoBytes:
+			key, err = entry.string()
+			return true, err
+		case field == 2 && wireType == protoFixed64:
+			value, err = entry.double()
+			return true, err
+		}
+		return false, nil
+	})
+	m[key] = value
+	return err
+}
+
+func encodeResultSet(buf []byte, result *storage.ResultSet) []byte {
+	buf = appendProtoString(buf, 1, result.Id)
+	buf = appendProtoStringMap(buf, 2, result.Attributes)
+	buf = appendProtoUint(buf, 3, result.Value)
+	buf = appendProtoDoubleMap(buf, 4, result.Measures)
+	for i := range result.Buckets {
+		buf = appendProtoBytes(buf, 5, encodeBucket(nil, &result.Buckets[i]))
+	}
+	for i := range result.Groups {
+		buf = appendProtoBytes(buf, 6, encodeGroup(nil, &result.Groups[i]))
+	}
+	for i := range result.Comparisons {
+		buf = appendProtoBytes(buf, 7, encodeComparison(nil, &result.Comparisons[i]))
+	}
+	return buf
+}
+
+func encodeBucket(buf []byte, bucket *storage.Bucket) []byte {
+	buf = appendProtoUint(buf, 1, bucket.Timestamp)
+	buf = appendProtoUint(buf, 2, bucket.Value)
+	buf = appendProtoDoubleMap(buf, 3, bucket.Measures)
+	for i := range bucket.Comparisons {
+		buf = appendProtoBytes(buf, 4, encodeComparison(nil, &bucket.Comparisons[i]))
+	}
+	return buf
+}
+
+func encodeGroup(buf []byte, group *storage.Group) []byte {
+	buf = appendProtoStringMap(buf, 1, group.Attributes)
+	buf = appendProtoUint(buf, 2, group.Value)
+	buf = appendProtoDoubleMap(buf, 3, group.Measures)
+	for i := range group.Buckets {
+		buf = appendProtoBytes(buf, 4, encodeBucket(nil, &group.Buckets[i]))
+	}
+	for i := range group.Comparisons {
+		buf = appendProtoBytes(buf, 5, encodeComparison(nil, &group.Comparisons[i]))
+	}
+	return buf
+}
+
+func encodeComparison(buf []byte, comparison *storage.Comparison) []byte {
+	buf = appendProtoUint(buf, 1, comparison.Offset)
+	buf = appendProtoUint(buf, 2, comparison.Value)
+	buf = appendProtoUint(buf, 3, uint64(comparison.Delta))
+	buf = appendProtoOptionalDouble(buf, 4, comparison.Change)
+	names := make([]string, 0, len(comparison.Measures))
+	for name := range comparison.Measures {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		measure := comparison.Measures[name]
+		var value []byte
+		value = appendProtoDouble(value, 1, measure.Value)
+		value = appendProtoDouble(value, 2, measure.Delta)
+		value = appendProtoOptionalDouble(value, 3, measure.Change)
+		entry := appendProtoString(nil, 1, name)
+		entry = appendProtoBytes(entry, 2, value)
+		buf = appendProtoBytes(buf, 5, entry)
+	}
+	return buf
+}
+
+func encodeBatchQueryResponse(buf []byte, results []*storage.ResultSet, errs []error) []byte {
+	for i := range results {
+		var result []byte
+		if errs[i] != nil {
+			result = appendProtoString(result, 2, errs[i].Error())
+		} else {
+			result = appendProtoBytes(result, 1, encodeResultSet(nil, results[i]))
+		}
+		buf = appendProtoBytes(buf, 1, result)
+	}
+	return buf
+}
+
+// encodeStrings encodes messages with a single repeated string field, such as
+// KeysResponse.
+func encodeStrings(buf []byte, values []string) []byte {
+	for _, value := range values {
+		buf = appendProtoBytes(buf, 1, []byte(value))
+	}
+	return buf
+}
+
+func appendProtoString(buf []byte, field int, value string) []byte {
+	if value == "" {
+		return buf
+	}
+	return appendProtoBytes(buf, field, []byte(value))
+}
+
+func appendProtoUint(buf []byte, field int, value uint64) []byte {
+	if value == 0 {
+		return buf
+	}
+	buf = appendProtoTag(buf, field, protoVarint)
+	return appendProtoVarint(buf, value)
+}
+
+func appendProtoDouble(buf []byte, field int, value float64) []byte {
+	if value == 0 {
+		return buf
+	}
+	buf = appendProtoTag(buf, field, protoFixed64)
+	return appendProtoFixed64(buf, math.Float64bits(value))
+}
+
+func appendProtoOptionalDouble(buf []byte, field int, value *float64) []byte {
+	if value == nil {
+		return buf
+	}
+	buf = appendProtoTag(buf, field, protoFixed64)
+	return appendProtoFixed64(buf, math.Float64bits(*value))
+}
+
+func appendProtoStringMap(buf []byte, field int, m map[string]string) []byte {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		entry := appendProtoString(nil, 1, key)
+		entry = appendProtoString(entry, 2, m[key])
+		buf = appendProtoBytes(buf, field, entry)
+	}
+	return buf
+}
+
+func appendProtoDoubleMap(buf []byte, field int, m map[string]float64) []byte {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		entry := appendProtoString(nil, 1, key)
+		entry = appendProtoDouble(entry, 2, m[key])
+		buf = appendProtoBytes(buf, field, entry)
+	}
+	return buf
+}
@@ -0,0 +1,107 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io.klector/klector/storage"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func grpcTestEvent(app string, timestamp uint64) []byte {
+	event := appendProtoStringMap(nil, 2, map[string]string{"app": app})
+	event = appendProtoDoubleMap(event, 3, map[string]float64{"ms": 12.5})
+	event = appendProtoUint(event, 5, timestamp)
+	return appendProtoBytes(nil, 1, event)
+}
+
+func Test_server_grpc(t *testing.T) {
+	s := storage.Create(storage.NewDefaultStorageConfiguration())
+	s.Write(&storage.Events{Events: []storage.Event{
+		{Attributes: map[string]string{"app": "checkout"}, Measures: map[string]float64{"ms": 10}, Timestamp: 61_000},
+		{Attributes: map[string]string{"app": "checkout"}, Measures: map[string]float64{"ms": 20}, Timestamp: 121_000},
+	}})
+	handler := newServer(NewDefaultApiConfiguration(), &s)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(handler.grpc))
+	server.Config.Protocols = &http.Protocols{}
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	defer server.Close()
+	protocols := &http.Protocols{}
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+
+	query := appendProtoStringMap(nil, 2, map[string]string{"app": "checkout"})
+	query = appendProtoBytes(query, 5, []byte("ms"))
+	query = appendProtoUint(query, 6, 60_000)
+	query = appendProtoUint(query, 7, 179_999)
+	query = appendProtoUint(query, 8, 60_000)
+	query = appendProtoBytes(query, 9, appendProtoVarint(nil, 60_000))
+	result, err := s.Query(context.Background(), &storage.Query{
+		Attributes:     map[string]string{"app": "checkout"},
+		Measures:       []string{"ms"},
+		StartTimestamp: 60_000,
+		EndTimestamp:   179_999,
+		Step:           60_000,
+		CompareTo:      []uint64{60_000},
+	})
+	if err != nil {
+		t.Fatalf("Query() error = %v", err)
+	}
+	unknownRollup := appendProtoString(query, 10, "unknown")
+
+	tests := []struct {
+		name        string
+		method      string
+		messages    [][]byte
+		wantStatus  string
+		wantMessage string
+		want        []byte
+	}{
+		{"Write", "Write", [][]byte{append(grpcTestEvent("search", 1_000), grpcTestEvent("search", 2_000)...)}, "0", "", appendProtoUint(nil, 1, 2)},
+		{"Write stream", "WriteStream", [][]byte{grpcTestEvent("search", 3_000), grpcTestEvent("search", 4_000)}, "0", "", appendProtoUint(nil, 1, 2)},
+		{"Invalid event", "Write", [][]byte{grpcTestEvent("search", 0)}, "3", "event 0: timestamp cannot be 0", nil},
+		{"Query", "Query", [][]byte{query}, "0", "", encodeResultSet(nil, result)},
+		{"Batch query", "BatchQuery", [][]byte{appendProtoBytes(appendProtoBytes(nil, 1, query), 1, unknownRollup)}, "0", "",
+			encodeBatchQueryResponse(nil, []*storage.ResultSet{result, nil}, []error{nil, fmt.Errorf("%w %q", storage.ErrUnknownRollup, "unknown")})},
+		{"Unknown rollup", "Query", [][]byte{unknownRollup}, "5", `unknown rollup "unknown"`, nil},
+		{"Values", "Values", [][]byte{appendProtoString(nil, 1, "app")}, "0", "", encodeStrings(nil, []string{"checkout", "search"})},
+		{"Unknown method", "Delete", [][]byte{nil}, "12", "unknown method /klector.v1.Klector/Delete", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body bytes.Buffer
+			for _, message := range tt.messages {
+				writeGrpcMessage(&body, message)
+			}
+			request, _ := http.NewRequest("POST", server.URL+grpcServicePrefix+tt.method, &body)
+			request.Header.Set("Content-Type", "application/grpc")
+			request.Header.Set("TE", "trailers")
+			response, err := client.Do(request)
+			if err != nil {
+				t.Fatalf("request error = %v", err)
+			}
+			defer response.Body.Close()
+			if response.ProtoMajor != 2 {
+				t.Fatalf("protocol = %v, want HTTP/2", response.Proto)
+			}
+
+			message, err := readGrpcMessage(response.Body)
+			if err != nil && err != io.EOF {
+				t.Fatalf("readGrpcMessage() error = %v", err)
+			}
+			io.Copy(io.Discard, response.Body)
+			if status := response.Trailer.Get("Grpc-Status"); status != tt.wantStatus || response.Trailer.Get("Grpc-Message") != grpcPercentEncode(tt.wantMessage) {
+				t.Fatalf("status = %v %q, want %v %q", status, response.Trailer.Get("Grpc-Message"), tt.wantStatus, tt.wantMessage)
+			}
+			if tt.want != nil && !reflect.DeepEqual(message, tt.want) {
+				t.Errorf("response = %x, want %x", message, tt.want)
+			}
+		})
+	}
+}
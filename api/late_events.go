@@ -0,0 +1,44 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"log"
+	"net/http"
+)
+
+func (s *server) lateEvents(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	stats, err := (*s.storage).LateEvents()
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+func (s *server) listQuarantine(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	events, err := (*s.storage).Quarantine()
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+func (s *server) clearQuarantine(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	n, err := (*s.storage).ClearQuarantine()
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	log.Printf("cleared %d quarantined events", n)
+
+	w.WriteHeader(204)
+}
@@ -0,0 +1,253 @@
+package api
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"io.klector/klector/storage"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const measurementAttribute = "_measurement"
+
+// nanoseconds in one unit of the supported line protocol precisions
+var lineProtocolPrecisions = map[string]int64{
+	"":   1,
+	"n":  1,
+	"ns": 1,
+	"u":  1_000,
+	"us": 1_000,
+	"ms": 1_000_000,
+	"s":  1_000_000_000,
+	"m":  60_000_000_000,
+	"h":  3_600_000_000_000,
+}
+
+// writeLineProtocol implements the InfluxDB /write endpoint. The measurement and
+// tags become event attributes, numeric fields become measures, string and
+// boolean fields are ignored.
+func (s *server) writeLineProtocol(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	precision, found := lineProtocolPrecisions[r.URL.Query().Get("precision")]
+	if !found {
+		w.WriteHeader(400)
+		w.Write([]byte("unsupported precision " + r.URL.Query().Get("precision")))
+		return
+	}
+
+	body, err := decodeBody(r)
+	if err != nil {
+		w.WriteHeader(415)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	defer body.Close()
+
+	now := uint64(time.Now().UnixNano() / 1_000_000)
+	var events storage.Events
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), ndjsonMaxLineSize)
+	line := 0
+	for scanner.Scan() {
+		line++
+		event, err := parseLineProtocol(scanner.Text(), precision, now)
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(fmt.Sprintf("line %d: %s", line, err.Error())))
+			return
+		}
+		if event != nil {
+			events.Events = append(events.Events, *event)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if len(events.Events) > 0 {
+		var writeErrors storage.WriteErrors
+		err := (*s.storage).Write(&events)
+		switch {
+		case errors.As(err, &writeErrors):
+			// like InfluxDB, the other points are written
+			w.WriteHeader(400)
+			w.Write([]byte(fmt.Sprintf("partial write: %s dropped=%d", writeErrors.Error(), len(writeErrors))))
+			return
+		case err != nil:
+			w.WriteHeader(500)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+
+	w.WriteHeader(204)
+}
+
+// parseLineProtocol parses one line of InfluxDB line protocol. precision is the
+// length of a timestamp unit in nanoseconds, now is used for lines without a
+// timestamp. Empty lines and comments produce a nil event.
+func parseLineProtocol(line string, precision int64, now uint64) (*storage.Event, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return nil, nil
+	}
+
+	measurement, pos := scanLineProtocolToken(line, 0, ", ")
+	measurement = unescapeLineProtocol(measurement)
+	if measurement == "" {
+		return nil, errors.New("missing measurement")
+	}
+	event := &storage.Event{
+		Attributes: map[string]string{measurementAttribute: measurement},
+		Timestamp:  now,
+	}
+
+	for pos < len(line) && line[pos] == ',' {
+		var tag string
+		tag, pos = scanLineProtocolToken(line, pos+1, ", ")
+		key, value, err := splitLineProtocolPair(tag)
+		if err != nil {
+			return nil, err
+		}
+		event.Attributes[key] = unescapeLineProtocol(value)
+	}
+
+	if pos >= len(line) || line[pos] != ' ' {
+		return nil, errors.New("missing fields")
+	}
+	for pos < len(line) && line[pos] == ' ' {
+		pos++
+	}
+	for {
+		var field string
+		field, pos = scanLineProtocolField(line, pos)
+		key, value, err := splitLineProtocolPair(field)
+		if err != nil {
+			return nil, err
+		}
+		measure, numeric, err := parseLineProtocolFieldValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %s", key, err.Error())
+		}
+		if numeric {
+			if event.Measures == nil {
+				event.Measures = map[string]float64{}
+			}
+			event.Measures[key] = measure
+		}
+		if pos >= len(line) || line[pos] != ',' {
+			break
+		}
+		pos++
+	}
+
+	if rest := strings.TrimSpace(line[pos:]); rest != "" {
+		ts, err := strconv.ParseInt(rest, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp %q", rest)
+		}
+		if ts <= 0 {
+			return nil, fmt.Errorf("timestamp %d is not positive", ts)
+		}
+		if precision >= 1_000_000 {
+			if ts > math.MaxInt64/(precision/1_000_000) {
+				return nil, fmt.Errorf("timestamp %d is out of range", ts)
+			}
+			event.Timestamp = uint64(ts * (precision / 1_000_000))
+		} else {
+			event.Timestamp = uint64(ts / (1_000_000 / precision))
+		}
+	}
+
+	return event, nil
+}
+
+// scanLineProtocolToken returns the raw token starting at pos up to the first
+// unescaped stop character and the position of that character.
+func scanLineProtocolToken(line string, pos int, stops string) (string, int) {
+	start := pos
+	for pos < len(line) && strings.IndexByte(stops, line[pos]) < 0 {
+		if line[pos] == '\\' {
+			pos++
+		}
+		pos++
+	}
+	if pos > len(line) {
+		pos = len(line)
+	}
+	return line[start:pos], pos
+}
+
+// scanLineProtocolField is scanLineProtocolToken for a key=value field, string
+// values in double quotes may contain unescaped commas and spaces.
+func scanLineProtocolField(line string, pos int) (string, int) {
+	start := pos
+	quoted := false
+	for pos < len(line) && (quoted || (line[pos] != ',' && line[pos] != ' ')) {
+		switch line[pos] {
+		case '\\':
+			pos++
+		case '"':
+			quoted = !quoted
+		}
+		pos++
+	}
+	if pos > len(line) {
+		pos = len(line)
+	}
+	return line[start:pos], pos
+}
+
+// splitLineProtocolPair splits a raw token on the first unescaped '=' and
+// unescapes the key.
+func splitLineProtocolPair(pair string) (string, string, error) {
+	_, i := scanLineProtocolToken(pair, 0, "=")
+	if i == 0 || i >= len(pair)-1 {
+		return "", "", fmt.Errorf("invalid key=value pair %q", pair)
+	}
+	return unescapeLineProtocol(pair[:i]), pair[i+1:], nil
+}
+
+func unescapeLineProtocol(token string) string {
+	if strings.IndexByte(token, '\\') < 0 {
+		return token
+	}
+	var unescaped strings.Builder
+	for i := 0; i < len(token); i++ {
+		if token[i] == '\\' && i+1 < len(token) {
+			i++
+		}
+		unescaped.WriteByte(token[i])
+	}
+	return unescaped.String()
+}
+
+// parseLineProtocolFieldValue returns the numeric value of a field and false for
+// string and boolean fields.
+func parseLineProtocolFieldValue(value string) (float64, bool, error) {
+	switch {
+	case value[0] == '"':
+		if len(value) < 2 || value[len(value)-1] != '"' {
+			return 0, false, errors.New("unterminated string value")
+		}
+		return 0, false, nil
+	case value == "t" || value == "T" || value == "true" || value == "True" || value == "TRUE" ||
+		value == "f" || value == "F" || value == "false" || value == "False" || value == "FALSE":
+		return 0, false, nil
+	case strings.HasSuffix(value, "i"):
+		v, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+		return float64(v), true, err
+	case strings.HasSuffix(value, "u"):
+		v, err := strconv.ParseUint(value[:len(value)-1], 10, 64)
+		return float64(v), true, err
+	default:
+		v, err := strconv.ParseFloat(value, 64)
+		return v, true, err
+	}
+}
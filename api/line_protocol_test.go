@@ -0,0 +1,72 @@
+package api
+
+import (
+	"io.klector/klector/storage"
+	"reflect"
+	"testing"
+)
+
+func Test_parseLineProtocol(t *testing.T) {
+	type args struct {
+		line      string
+		precision int64
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    *storage.Event
+		wantErr bool
+	}{
+		{"Measurement, tags, fields and timestamp", args{
+			"http,host=a,method=GET bytes=512i,latency=0.25 1000000000", 1,
+		}, &storage.Event{
+			Attributes: map[string]string{"_measurement": "http", "host": "a", "method": "GET"},
+			Measures:   map[string]float64{"bytes": 512, "latency": 0.25},
+			Timestamp:  1_000,
+		}, false},
+		{"Seconds precision", args{
+			"cpu value=1 1600000000", 1_000_000_000,
+		}, &storage.Event{
+			Attributes: map[string]string{"_measurement": "cpu"},
+			Measures:   map[string]float64{"value": 1},
+			Timestamp:  1_600_000_000_000,
+		}, false},
+		{"Missing timestamp uses now", args{
+			"cpu value=1u", 1,
+		}, &storage.Event{
+			Attributes: map[string]string{"_measurement": "cpu"},
+			Measures:   map[string]float64{"value": 1},
+			Timestamp:  42,
+		}, false},
+		{"Escaped characters", args{
+			`my\ measurement,tag\,key=tag\ value,eq\=key=v\=al value=1 1000000`, 1,
+		}, &storage.Event{
+			Attributes: map[string]string{"_measurement": "my measurement", "tag,key": "tag value", "eq=key": "v=al"},
+			Measures:   map[string]float64{"value": 1},
+			Timestamp:  1,
+		}, false},
+		{"String and boolean fields are ignored", args{
+			`log,level=error msg="a, b c",ok=true,count=3i 1000000`, 1,
+		}, &storage.Event{
+			Attributes: map[string]string{"_measurement": "log", "level": "error"},
+			Measures:   map[string]float64{"count": 3},
+			Timestamp:  1,
+		}, false},
+		{"Comment is skipped", args{"# comment", 1}, nil, false},
+		{"Missing fields", args{"cpu,host=a", 1}, nil, true},
+		{"Invalid field value", args{"cpu value=abc", 1}, nil, true},
+		{"Invalid timestamp", args{"cpu value=1 abc", 1}, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseLineProtocol(tt.args.line, tt.args.precision, 42)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseLineProtocol() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseLineProtocol() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"io"
+	"io.klector/klector/internal/zstd"
+	"io.klector/klector/storage"
+	"net/http"
+)
+
+const (
+	ndjsonChunkSize     = 1000
+	ndjsonMaxLineSize   = 1 << 20
+	ndjsonMaxErrorCount = 10
+)
+
+type streamResult struct {
+	Accepted uint64   `json:"accepted"`
+	Rejected uint64   `json:"rejected"`
+	Errors   []string `json:"errors,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+func (r *streamResult) reject(line uint64, err error) {
+	r.Rejected++
+	if len(r.Errors) < ndjsonMaxErrorCount {
+		r.Errors = append(r.Errors, fmt.Sprintf("line %d: %s", line, err.Error()))
+	}
+}
+
+func decodeBody(r *http.Request) (io.ReadCloser, error) {
+	switch r.Header.Get("Content-Encoding") {
+	case "", "identity":
+		return r.Body, nil
+	case "gzip":
+		return gzip.NewReader(r.Body)
+	case "zstd":
+		return io.NopCloser(zstd.NewReader(r.Body)), nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", r.Header.Get("Content-Encoding"))
+	}
+}
+
+// storeStream reads newline-delimited events one at a time and writes them to
+// the storage in chunks of ndjsonChunkSize, so the request body is never
+// buffered as a whole. Invalid lines are rejected without failing the request.
+func (s *server) storeStream(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	body, err := decodeBody(r)
+	if err != nil {
+		w.WriteHeader(415)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	defer body.Close()
+
+	var result streamResult
+	chunk := make([]storage.Event, 0, ndjsonChunkSize)
+	lines := make([]uint64, 0, ndjsonChunkSize)
+	flush := func() {
+		if len(chunk) == 0 {
+			return
+		}
+		var writeErrors storage.WriteErrors
+		err := (*s.storage).Write(&storage.Events{Events: chunk})
+		switch {
+		case err == nil:
+			result.Accepted += uint64(len(chunk))
+		case errors.As(err, &writeErrors):
+			for _, e := range writeErrors {
+				result.reject(lines[e.Index], e.Err)
+			}
+			result.Accepted += uint64(len(chunk) - len(writeErrors))
+		default:
+			result.Rejected += uint64(len(chunk))
+			if len(result.Errors) < ndjsonMaxErrorCount {
+				result.Errors = append(result.Errors, err.Error())
+			}
+		}
+		chunk = make([]storage.Event, 0, ndjsonChunkSize)
+		lines = make([]uint64, 0, ndjsonChunkSize)
+	}
+
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), ndjsonMaxLineSize)
+	var line uint64
+	for scanner.Scan() {
+		line++
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+
+		var event storage.Event
+		if err := json.Unmarshal(data, &event); err != nil {
+			result.reject(line, err)
+			continue
+		}
+		if err := event.Validate(); err != nil {
+			result.reject(line, err)
+			continue
+		}
+
+		chunk = append(chunk, event)
+		lines = append(lines, line)
+		if len(chunk) == ndjsonChunkSize {
+			flush()
+		}
+	}
+	flush()
+
+	status := 200
+	if err := scanner.Err(); err != nil {
+		status = 400
+		result.Error = fmt.Sprintf("line %d: %s", line+1, err.Error())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&result)
+}
@@ -0,0 +1,136 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io.klector/klector/storage"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func gzipped(s string) string {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(s))
+	zw.Close()
+	return buf.String()
+}
+
+func Test_server_storeStream(t *testing.T) {
+	type args struct {
+		body     string
+		encoding string
+	}
+	tests := []struct {
+		name       string
+		args       args
+		wantStatus int
+		wantResult streamResult
+		wantCount  uint64
+	}{
+		{"All events accepted", args{
+			`{"attributes":{"a":"a"},"timestamp":1000}
+{"attributes":{"a":"a"},"timestamp":2000}
+`, "",
+		}, 200, streamResult{Accepted: 2}, 2},
+		{"Invalid lines are rejected, the rest accepted", args{
+			`{"attributes":{"a":"a"},"timestamp":1000}
+not json
+
+{"attributes":{},"timestamp":1000}
+{"attributes":{"a":"a"},"timestamp":2000}`, "",
+		}, 200, streamResult{
+			Accepted: 2,
+			Rejected: 2,
+			Errors: []string{
+				"line 2: invalid character 'o' in literal null (expecting 'u')",
+				"line 4: attributes are not defined in event",
+			},
+		}, 2},
+		{"Gzip encoded body", args{
+			gzipped(`{"attributes":{"a":"a"},"timestamp":1000}`), "gzip",
+		}, 200, streamResult{Accepted: 1}, 1},
+		{"Zstd encoded body", args{
+			"\x28\xb5\x2f\xfd\x04\x68\x9d\x01\x00\xa2\xc2\x09\x11\xb0\xa9\x03\xc7\x29\x24\x88\xfd\x28\x86\x72\x02\x57\x3a\xc1\x4e\x0c\x60\x99\x99\xb8\x4d\xc1\xa2\x2c\xa4\x87\x35\x7e\xe3\xea\x46\xd9\x34\xc8\x69\x71\x15\x02\x00\x37\x15\x01\x65\x43\x55\x19\x2b\x6b\xf7\x74", "zstd",
+		}, 200, streamResult{Accepted: 4}, 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := storage.Create(storage.NewDefaultStorageConfiguration())
+			server := newServer(NewDefaultApiConfiguration(), &s)
+
+			r := httptest.NewRequest("POST", "/api/v1/event/stream", strings.NewReader(tt.args.body))
+			if tt.args.encoding != "" {
+				r.Header.Set("Content-Encoding", tt.args.encoding)
+			}
+			w := httptest.NewRecorder()
+			server.router.ServeHTTP(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %v, want %v", w.Code, tt.wantStatus)
+			}
+			var result streamResult
+			if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+				t.Fatalf("cannot decode response: %v", err)
+			}
+			if !reflect.DeepEqual(result, tt.wantResult) {
+				t.Errorf("result = %v, want %v", result, tt.wantResult)
+			}
+
+			resultSet, _ := s.Query(context.Background(), &storage.Query{
+				Attributes:     map[string]string{"a": "a"},
+				StartTimestamp: 1_000,
+				EndTimestamp:   2_000,
+			})
+			if resultSet.Value != tt.wantCount {
+				t.Errorf("Value = %v, want %v", resultSet.Value, tt.wantCount)
+			}
+		})
+	}
+}
+
+func Test_server_storeStream_outOfWindow(t *testing.T) {
+	config := storage.NewDefaultStorageConfiguration()
+	config.MaxLateness = time.Hour
+	s := storage.Create(config)
+	server := newServer(NewDefaultApiConfiguration(), &s)
+
+	now := time.Now().UnixNano() / 1_000_000
+	body := fmt.Sprintf(`{"attributes":{"a":"a"},"timestamp":%d}
+{"attributes":{"a":"a"},"timestamp":1000}
+{"attributes":{"a":"a"},"timestamp":%d}
+`, now, now)
+	r := httptest.NewRequest("POST", "/api/v1/event/stream", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, r)
+
+	var result streamResult
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatalf("cannot decode response: %v", err)
+	}
+	if result.Accepted != 2 || result.Rejected != 1 || len(result.Errors) != 1 || !strings.HasPrefix(result.Errors[0], "line 2: ") {
+		t.Errorf("result = %v, want 2 accepted and line 2 rejected", result)
+	}
+}
+
+func Test_server_storeStream_unsupportedEncoding(t *testing.T) {
+	s := storage.Create(storage.NewDefaultStorageConfiguration())
+	server := newServer(NewDefaultApiConfiguration(), &s)
+
+	r := httptest.NewRequest("POST", "/api/v1/event/stream", strings.NewReader("{}"))
+	r.Header.Set("Content-Encoding", "br")
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, r)
+
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("status = %v, want %v", w.Code, http.StatusUnsupportedMediaType)
+	}
+}
@@ -0,0 +1,585 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/julienschmidt/httprouter"
+	"io"
+	"io.klector/klector/storage"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	otlpMaxBodySize   = 64 << 20
+	metricAttribute   = "metric"
+	severityAttribute = "severity"
+	valueMeasure      = "value"
+)
+
+// OTLP messages, only the fields klector stores are decoded. The json tags
+// follow the OTLP/HTTP JSON encoding, protobuf decoding fills the same structs.
+
+type otlpUint64 uint64
+
+// OTLP JSON encodes 64 bit integers as strings, numbers are accepted as well.
+func (v *otlpUint64) UnmarshalJSON(data []byte) error {
+	value, err := strconv.ParseUint(strings.Trim(string(data), `"`), 10, 64)
+	*v = otlpUint64(value)
+	return err
+}
+
+type otlpInt64 int64
+
+func (v *otlpInt64) UnmarshalJSON(data []byte) error {
+	value, err := strconv.ParseInt(strings.Trim(string(data), `"`), 10, 64)
+	*v = otlpInt64(value)
+	return err
+}
+
+type otlpAnyValue struct {
+	StringValue *string    `json:"stringValue"`
+	BoolValue   *bool      `json:"boolValue"`
+	IntValue    *otlpInt64 `json:"intValue"`
+	DoubleValue *float64   `json:"doubleValue"`
+}
+
+// string returns the attribute value, arrays, maps and bytes are not supported.
+func (v *otlpAnyValue) string() (string, bool) {
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue, true
+	case v.BoolValue != nil:
+		return strconv.FormatBool(*v.BoolValue), true
+	case v.IntValue != nil:
+		return strconv.FormatInt(int64(*v.IntValue), 10), true
+	case v.DoubleValue != nil:
+		return strconv.FormatFloat(*v.DoubleValue, 'g', -1, 64), true
+	}
+	return "", false
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpLogRecord struct {
+	TimeUnixNano         otlpUint64     `json:"timeUnixNano"`
+	ObservedTimeUnixNano otlpUint64     `json:"observedTimeUnixNano"`
+	SeverityNumber       int            `json:"severityNumber"`
+	SeverityText         string         `json:"severityText"`
+	Attributes           []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeLogs struct {
+	LogRecords []otlpLogRecord `json:"logRecords"`
+}
+
+type otlpResourceLogs struct {
+	Resource  otlpResource    `json:"resource"`
+	ScopeLogs []otlpScopeLogs `json:"scopeLogs"`
+}
+
+type otlpLogsRequest struct {
+	ResourceLogs []otlpResourceLogs `json:"resourceLogs"`
+}
+
+type otlpNumberDataPoint struct {
+	Attributes   []otlpKeyValue `json:"attributes"`
+	TimeUnixNano otlpUint64     `json:"timeUnixNano"`
+	AsDouble     *float64       `json:"asDouble"`
+	AsInt        *otlpInt64     `json:"asInt"`
+}
+
+type otlpNumberData struct {
+	DataPoints []otlpNumberDataPoint `json:"dataPoints"`
+}
+
+type otlpMetric struct {
+	Name  string          `json:"name"`
+	Gauge *otlpNumberData `json:"gauge"`
+	Sum   *otlpNumberData `json:"sum"`
+}
+
+type otlpScopeMetrics struct {
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpMetricsRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpRequest interface {
+	decodeProto(r *protoReader) error
+}
+
+func (s *server) otlpLogs(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var request otlpLogsRequest
+	proto, ok := readOtlpRequest(w, r, &request)
+	if !ok {
+		return
+	}
+
+	var events []storage.Event
+	for _, resourceLogs := range request.ResourceLogs {
+		for _, scopeLogs := range resourceLogs.ScopeLogs {
+			for _, record := range scopeLogs.LogRecords {
+				event := storage.Event{
+					Attributes: map[string]string{severityAttribute: severity(&record)},
+					Timestamp:  otlpTimestamp(record.TimeUnixNano, record.ObservedTimeUnixNano),
+				}
+				s.addOtlpAttributes(event.Attributes, resourceLogs.Resource.Attributes)
+				s.addOtlpAttributes(event.Attributes, record.Attributes)
+				events = append(events, event)
+			}
+		}
+	}
+
+	s.writeOtlpEvents(w, proto, events, "rejectedLogRecords")
+}
+
+// otlpMetrics stores every data point of gauges and sums as an event with the
+// point value as the value measure. Delta sums add up over time, the sum of
+// gauges or cumulative sums divided by the count gives the average value.
+func (s *server) otlpMetrics(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var request otlpMetricsRequest
+	proto, ok := readOtlpRequest(w, r, &request)
+	if !ok {
+		return
+	}
+
+	var events []storage.Event
+	for _, resourceMetrics := range request.ResourceMetrics {
+		for _, scopeMetrics := range resourceMetrics.ScopeMetrics {
+			for _, metric := range scopeMetrics.Metrics {
+				data := metric.Gauge
+				if data == nil {
+					data = metric.Sum
+				}
+				if data == nil {
+					continue
+				}
+				for _, point := range data.DataPoints {
+					var value float64
+					switch {
+					case point.AsDouble != nil:
+						value = *point.AsDouble
+					case point.AsInt != nil:
+						value = float64(*point.AsInt)
+					}
+					event := storage.Event{
+						Attributes: map[string]string{metricAttribute: metric.Name},
+						Measures:   map[string]float64{valueMeasure: value},
+						Timestamp:  otlpTimestamp(point.TimeUnixNano, 0),
+					}
+					s.addOtlpAttributes(event.Attributes, resourceMetrics.Resource.Attributes)
+					s.addOtlpAttributes(event.Attributes, point.Attributes)
+					events = append(events, event)
+				}
+			}
+		}
+	}
+
+	s.writeOtlpEvents(w, proto, events, "rejectedDataPoints")
+}
+
+// readOtlpRequest decodes a JSON or protobuf request body, on failure the
+// error response is written and false returned.
+func readOtlpRequest(w http.ResponseWriter, r *http.Request, request otlpRequest) (bool, bool) {
+	proto := strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-protobuf")
+	if !proto && !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		w.WriteHeader(415)
+		w.Write([]byte("unsupported content type " + r.Header.Get("Content-Type")))
+		return proto, false
+	}
+
+	body, err := decodeBody(r)
+	if err != nil {
+		w.WriteHeader(415)
+		w.Write([]byte(err.Error()))
+		return proto, false
+	}
+	defer body.Close()
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, body, otlpMaxBodySize))
+	if err == nil {
+		if proto {
+			err = request.decodeProto(newProtoReader(data))
+		} else {
+			err = json.Unmarshal(data, request)
+		}
+	}
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return proto, false
+	}
+	return proto, true
+}
+
+// writeOtlpEvents writes the valid events and answers with an OTLP export
+// response, invalid events and events the storage did not write, e.g. outside
+// of the acceptance window, are reported as partial success.
+func (s *server) writeOtlpEvents(w http.ResponseWriter, proto bool, events []storage.Event, rejectedField string) {
+	var valid []storage.Event
+	var rejected uint64
+	var message string
+	for _, event := range events {
+		if err := event.Validate(); err != nil {
+			rejected++
+			message = err.Error()
+			continue
+		}
+		valid = append(valid, event)
+	}
+
+	if len(valid) > 0 {
+		var writeErrors storage.WriteErrors
+		err := (*s.storage).Write(&storage.Events{Events: valid})
+		switch {
+		case errors.As(err, &writeErrors):
+			rejected += uint64(len(writeErrors))
+			message = writeErrors[len(writeErrors)-1].Err.Error()
+		case err != nil:
+			w.WriteHeader(500)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+
+	if proto {
+		var response []byte
+		if rejected > 0 {
+			var partialSuccess []byte
+			partialSuccess = appendProtoTag(partialSuccess, 1, protoVarint)
+			partialSuccess = appendProtoVarint(partialSuccess, rejected)
+			partialSuccess = appendProtoBytes(partialSuccess, 2, []byte(message))
+			response = appendProtoBytes(response, 1, partialSuccess)
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.WriteHeader(200)
+		w.Write(response)
+		return
+	}
+
+	response := map[string]interface{}{}
+	if rejected > 0 {
+		response["partialSuccess"] = map[string]interface{}{
+			rejectedField:  strconv.FormatUint(rejected, 10),
+			"errorMessage": message,
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *server) addOtlpAttributes(dst map[string]string, attributes []otlpKeyValue) {
+	for _, attribute := range attributes {
+		if s.otlpAllowed != nil && !s.otlpAllowed[attribute.Key] {
+			continue
+		}
+		if value, ok := attribute.Value.string(); ok {
+			dst[attribute.Key] = value
+		}
+	}
+}
+
+func otlpTimestamp(timeUnixNano otlpUint64, observedTimeUnixNano otlpUint64) uint64 {
+	switch {
+	case timeUnixNano != 0:
+		return uint64(timeUnixNano) / 1_000_000
+	case observedTimeUnixNano != 0:
+		return uint64(observedTimeUnixNano) / 1_000_000
+	}
+	return uint64(time.Now().UnixNano() / 1_000_000)
+}
+
+var severityNames = []string{"TRACE", "DEBUG", "INFO", "WARN", "ERROR", "FATAL"}
+
+func severity(record *otlpLogRecord) string {
+	switch {
+	case record.SeverityText != "":
+		return record.SeverityText
+	case record.SeverityNumber >= 1 && record.SeverityNumber <= 24:
+		return severityNames[(record.SeverityNumber-1)/4]
+	}
+	return "UNSPECIFIED"
+}
+
+// protobuf decoding, field numbers are the ones of the opentelemetry-proto
+// definitions
+
+func (r *protoReader) otlpKeyValue() (otlpKeyValue, error) {
+	var kv otlpKeyValue
+	m, err := r.message()
+	if err != nil {
+		return kv, err
+	}
+	err = m.fields(func(field int, wireType int) (bool, error) {
+		switch {
+		case field == 1 && wireType == protoBytes:
+			kv.Key, err = m.string()
+			return true, err
+		case field == 2 && wireType == protoBytes:
+			value, err := m.message()
+			if err != nil {
+				return true, err
+			}
+			kv.Value, err = value.otlpAnyValue()
+			return true, err
+		}
+		return false, nil
+	})
+	return kv, err
+}
+
+func (r *protoReader) otlpAnyValue() (otlpAnyValue, error) {
+	var v otlpAnyValue
+	err := r.fields(func(field int, wireType int) (bool, error) {
+		switch {
+		case field == 1 && wireType == protoBytes:
+			value, err := r.string()
+			v.StringValue = &value
+			return true, err
+		case field == 2 && wireType == protoVarint:
+			value, err := r.varint()
+			b := value != 0
+			v.BoolValue = &b
+			return true, err
+		case field == 3 && wireType == protoVarint:
+			value, err := r.varint()
+			i := otlpInt64(value)
+			v.IntValue = &i
+			return true, err
+		case field == 4 && wireType == protoFixed64:
+			value, err := r.double()
+			v.DoubleValue = &value
+			return true, err
+		}
+		return false, nil
+	})
+	return v, err
+}
+
+func (r *protoReader) otlpResource() (otlpResource, error) {
+	var resource otlpResource
+	m, err := r.message()
+	if err != nil {
+		return resource, err
+	}
+	err = m.fields(func(field int, wireType int) (bool, error) {
+		if field == 1 && wireType == protoBytes {
+			kv, err := m.otlpKeyValue()
+			resource.Attributes = append(resource.Attributes, kv)
+			return true, err
+		}
+		return false, nil
+	})
+	return resource, err
+}
+
+func (request *otlpLogsRequest) decodeProto(r *protoReader) error {
+	return r.fields(func(field int, wireType int) (bool, error) {
+		if field != 1 || wireType != protoBytes {
+			return false, nil
+		}
+		m, err := r.message()
+		if err != nil {
+			return true, err
+		}
+		var resourceLogs otlpResourceLogs
+		err = m.fields(func(field int, wireType int) (bool, error) {
+			switch {
+			case field == 1 && wireType == protoBytes:
+				resourceLogs.Resource, err = m.otlpResource()
+				return true, err
+			case field == 2 && wireType == protoBytes:
+				scopeLogs, err := m.otlpScopeLogs()
+				resourceLogs.ScopeLogs = append(resourceLogs.ScopeLogs, scopeLogs)
+				return true, err
+			}
+			return false, nil
+		})
+		request.ResourceLogs = append(request.ResourceLogs, resourceLogs)
+		return true, err
+	})
+}
+
+func (r *protoReader) otlpScopeLogs() (otlpScopeLogs, error) {
+	var scopeLogs otlpScopeLogs
+	m, err := r.message()
+	if err != nil {
+		return scopeLogs, err
+	}
+	err = m.fields(func(field int, wireType int) (bool, error) {
+		if field != 2 || wireType != protoBytes {
+			return false, nil
+		}
+		record, err := m.otlpLogRecord()
+		scopeLogs.LogRecords = append(scopeLogs.LogRecords, record)
+		return true, err
+	})
+	return scopeLogs, err
+}
+
+func (r *protoReader) otlpLogRecord() (otlpLogRecord, error) {
+	var record otlpLogRecord
+	m, err := r.message()
+	if err != nil {
+		return record, err
+	}
+	err = m.fields(func(field int, wireType int) (bool, error) {
+		switch {
+		case field == 1 && wireType == protoFixed64:
+			value, err := m.fixed64()
+			record.TimeUnixNano = otlpUint64(value)
+			return true, err
+		case field == 2 && wireType == protoVarint:
+			value, err := m.varint()
+			record.SeverityNumber = int(value)
+			return true, err
+		case field == 3 && wireType == protoBytes:
+			record.SeverityText, err = m.string()
+			return true, err
+		case field == 6 && wireType == protoBytes:
+			kv, err := m.otlpKeyValue()
+			record.Attributes = append(record.Attributes, kv)
+			return true, err
+		case field == 11 && wireType == protoFixed64:
+			value, err := m.fixed64()
+			record.ObservedTimeUnixNano = otlpUint64(value)
+			return true, err
+		}
+		return false, nil
+	})
+	return record, err
+}
+
+func (request *otlpMetricsRequest) decodeProto(r *protoReader) error {
+	return r.fields(func(field int, wireType int) (bool, error) {
+		if field != 1 || wireType != protoBytes {
+			return false, nil
+		}
+		m, err := r.message()
+		if err != nil {
+			return true, err
+		}
+		var resourceMetrics otlpResourceMetrics
+		err = m.fields(func(field int, wireType int) (bool, error) {
+			switch {
+			case field == 1 && wireType == protoBytes:
+				resourceMetrics.Resource, err = m.otlpResource()
+				return true, err
+			case field == 2 && wireType == protoBytes:
+				scopeMetrics, err := m.otlpScopeMetrics()
+				resourceMetrics.ScopeMetrics = append(resourceMetrics.ScopeMetrics, scopeMetrics)
+				return true, err
+			}
+			return false, nil
+		})
+		request.ResourceMetrics = append(request.ResourceMetrics, resourceMetrics)
+		return true, err
+	})
+}
+
+func (r *protoReader) otlpScopeMetrics() (otlpScopeMetrics, error) {
+	var scopeMetrics otlpScopeMetrics
+	m, err := r.message()
+	if err != nil {
+		return scopeMetrics, err
+	}
+	err = m.fields(func(field int, wireType int) (bool, error) {
+		if field != 2 || wireType != protoBytes {
+			return false, nil
+		}
+		metric, err := m.otlpMetric()
+		scopeMetrics.Metrics = append(scopeMetrics.Metrics, metric)
+		return true, err
+	})
+	return scopeMetrics, err
+}
+
+func (r *protoReader) otlpMetric() (otlpMetric, error) {
+	var metric otlpMetric
+	m, err := r.message()
+	if err != nil {
+		return metric, err
+	}
+	err = m.fields(func(field int, wireType int) (bool, error) {
+		switch {
+		case field == 1 && wireType == protoBytes:
+			metric.Name, err = m.string()
+			return true, err
+		case field == 5 && wireType == protoBytes:
+			metric.Gauge, err = m.otlpNumberData()
+			return true, err
+		case field == 7 && wireType == protoBytes:
+			metric.Sum, err = m.otlpNumberData()
+			return true, err
+		}
+		return false, nil
+	})
+	return metric, err
+}
+
+// otlpNumberData decodes the data points of a Gauge or Sum message.
+func (r *protoReader) otlpNumberData() (*otlpNumberData, error) {
+	data := &otlpNumberData{}
+	m, err := r.message()
+	if err != nil {
+		return data, err
+	}
+	err = m.fields(func(field int, wireType int) (bool, error) {
+		if field != 1 || wireType != protoBytes {
+			return false, nil
+		}
+		point, err := m.otlpNumberDataPoint()
+		data.DataPoints = append(data.DataPoints, point)
+		return true, err
+	})
+	return data, err
+}
+
+func (r *protoReader) otlpNumberDataPoint() (otlpNumberDataPoint, error) {
+	var point otlpNumberDataPoint
+	m, err := r.message()
+	if err != nil {
+		return point, err
+	}
+	err = m.fields(func(field int, wireType int) (bool, error) {
+		switch {
+		case field == 3 && wireType == protoFixed64:
+			value, err := m.fixed64()
+			point.TimeUnixNano = otlpUint64(value)
+			return true, err
+		case field == 4 && wireType == protoFixed64:
+			value, err := m.double()
+			point.AsDouble = &value
+			return true, err
+		case field == 6 && wireType == protoFixed64:
+			value, err := m.fixed64()
+			i := otlpInt64(value)
+			point.AsInt = &i
+			return true, err
+		case field == 7 && wireType == protoBytes:
+			kv, err := m.otlpKeyValue()
+			point.Attributes = append(point.Attributes, kv)
+			return true, err
+		}
+		return false, nil
+	})
+	return point, err
+}
@@ -0,0 +1,162 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"io.klector/klector/storage"
+	"math"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func otlpTestKeyValue(key string, value string) []byte {
+	var anyValue, kv []byte
+	anyValue = appendProtoBytes(anyValue, 1, []byte(value))
+	kv = appendProtoBytes(kv, 1, []byte(key))
+	kv = appendProtoBytes(kv, 2, anyValue)
+	return kv
+}
+
+// otlpTestMetricsRequest encodes a gauge with one data point of value at
+// 1000ms with a service.name resource attribute and a host point attribute.
+func otlpTestMetricsRequest(name string, value float64) []byte {
+	var resource, point, gauge, metric, scopeMetrics, resourceMetrics, request []byte
+	resource = appendProtoBytes(resource, 1, otlpTestKeyValue("service.name", "checkout"))
+
+	point = appendProtoTag(point, 3, protoFixed64)
+	point = appendProtoFixed64(point, 1_000_000_000)
+	point = appendProtoTag(point, 4, protoFixed64)
+	point = appendProtoFixed64(point, math.Float64bits(value))
+	point = appendProtoBytes(point, 7, otlpTestKeyValue("host", "a"))
+
+	gauge = appendProtoBytes(gauge, 1, point)
+	metric = appendProtoBytes(metric, 1, []byte(name))
+	metric = appendProtoBytes(metric, 2, []byte("ignored description"))
+	metric = appendProtoBytes(metric, 5, gauge)
+	scopeMetrics = appendProtoBytes(scopeMetrics, 2, metric)
+	resourceMetrics = appendProtoBytes(resourceMetrics, 1, resource)
+	resourceMetrics = appendProtoBytes(resourceMetrics, 2, scopeMetrics)
+	request = appendProtoBytes(request, 1, resourceMetrics)
+	return request
+}
+
+func Test_server_otlp(t *testing.T) {
+	type args struct {
+		path        string
+		contentType string
+		body        []byte
+		allowed     []string
+	}
+	tests := []struct {
+		name       string
+		args       args
+		wantStatus int
+		query      *storage.Query
+		want       *storage.ResultSet
+	}{
+		{"JSON logs", args{
+			"/v1/logs", "application/json", []byte(`{"resourceLogs":[{
+				"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"checkout"}}]},
+				"scopeLogs":[{"logRecords":[
+					{"timeUnixNano":"1000000000","severityNumber":17,"attributes":[{"key":"status","value":{"intValue":"500"}}]},
+					{"timeUnixNano":"1000000000","severityText":"INFO","attributes":[{"key":"status","value":{"intValue":200}}]}
+				]}]
+			}]}`), nil,
+		}, 200, &storage.Query{
+			Attributes:     map[string]string{"service.name": "checkout", "severity": "ERROR", "status": "500"},
+			StartTimestamp: 1_000,
+			EndTimestamp:   1_000,
+		}, &storage.ResultSet{
+			Attributes: map[string]string{"service.name": "checkout", "severity": "ERROR", "status": "500"},
+			Value:      1,
+		}},
+		{"JSON logs with allow-list", args{
+			"/v1/logs", "application/json", []byte(`{"resourceLogs":[{
+				"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"checkout"}}]},
+				"scopeLogs":[{"logRecords":[
+					{"timeUnixNano":"1000000000","severityText":"INFO","attributes":[{"key":"user","value":{"stringValue":"u1"}}]}
+				]}]
+			}]}`), []string{"service.name"},
+		}, 200, &storage.Query{
+			Attributes:     map[string]string{"user": "u1"},
+			StartTimestamp: 1_000,
+			EndTimestamp:   1_000,
+		}, &storage.ResultSet{
+			Attributes: map[string]string{"user": "u1"},
+			Value:      0,
+		}},
+		{"Protobuf gauge", args{
+			"/v1/metrics", "application/x-protobuf", otlpTestMetricsRequest("cpu", 0.75), nil,
+		}, 200, &storage.Query{
+			Attributes:     map[string]string{"metric": "cpu", "service.name": "checkout", "host": "a"},
+			Measures:       []string{"value"},
+			StartTimestamp: 1_000,
+			EndTimestamp:   1_000,
+		}, &storage.ResultSet{
+			Attributes: map[string]string{"metric": "cpu", "service.name": "checkout", "host": "a"},
+			Value:      1,
+			Measures:   map[string]float64{"value": 0.75},
+		}},
+		{"Truncated protobuf", args{
+			"/v1/metrics", "application/x-protobuf", otlpTestMetricsRequest("cpu", 1)[:20], nil,
+		}, 400, nil, nil},
+		{"Unsupported content type", args{
+			"/v1/metrics", "text/plain", []byte("cpu"), nil,
+		}, 415, nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := storage.Create(storage.NewDefaultStorageConfiguration())
+			config := NewDefaultApiConfiguration()
+			config.OtlpAttributes = tt.args.allowed
+			server := newServer(config, &s)
+
+			r := httptest.NewRequest("POST", tt.args.path, bytes.NewReader(tt.args.body))
+			r.Header.Set("Content-Type", tt.args.contentType)
+			w := httptest.NewRecorder()
+			server.router.ServeHTTP(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %v, want %v: %s", w.Code, tt.wantStatus, strings.TrimSpace(w.Body.String()))
+			}
+			if tt.query == nil {
+				return
+			}
+			result, _ := s.Query(context.Background(), tt.query)
+			if !reflect.DeepEqual(result, tt.want) {
+				t.Errorf("ResultSet = %v, want %v", result, tt.want)
+			}
+		})
+	}
+}
+
+func Test_server_otlp_outOfWindow(t *testing.T) {
+	config := storage.NewDefaultStorageConfiguration()
+	config.MaxLateness = 0
+	config.MaxFutureSkew = time.Minute
+	s := storage.Create(config)
+	server := newServer(NewDefaultApiConfiguration(), &s)
+
+	r := httptest.NewRequest("POST", "/v1/logs", strings.NewReader(`{"resourceLogs":[{
+		"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"checkout"}}]},
+		"scopeLogs":[{"logRecords":[
+			{"timeUnixNano":"4102444800000000000","severityText":"INFO"},
+			{"timeUnixNano":"1000000000","severityText":"INFO"}
+		]}]
+	}]}`))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, r)
+
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"rejectedLogRecords":"1"`) {
+		t.Fatalf("response = %v %s, want 200 with 1 rejected log record", w.Code, strings.TrimSpace(w.Body.String()))
+	}
+	result, _ := s.Query(context.Background(), &storage.Query{Attributes: map[string]string{"service.name": "checkout"}, StartTimestamp: 1_000, EndTimestamp: 1_000})
+	if result.Value != 1 {
+		t.Errorf("count = %d, want the event inside of the window", result.Value)
+	}
+}
@@ -0,0 +1,344 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"io"
+	"io.klector/klector/clock"
+	"io.klector/klector/storage"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+const remoteWriteMaxBodySize = 32 << 20
+
+type promResponse struct {
+	Status    string      `json:"status"`
+	Data      interface{} `json:"data,omitempty"`
+	ErrorType string      `json:"errorType,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+type promMatrixSeries struct {
+	Metric map[string]string `json:"metric"`
+	Values [][]interface{}   `json:"values"`
+}
+
+type promVectorSample struct {
+	Metric map[string]string `json:"metric"`
+	Value  []interface{}     `json:"value"`
+}
+
+type promData struct {
+	ResultType string      `json:"resultType"`
+	Result     interface{} `json:"result"`
+}
+
+func writePromResponse(w http.ResponseWriter, status int, response *promResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+func writePromError(w http.ResponseWriter, status int, errorType string, err error) {
+	writePromResponse(w, status, &promResponse{Status: "error", ErrorType: errorType, Error: err.Error()})
+}
+
+// writePromQueryError writes errors of query evaluation with the error types of
+// Prometheus.
+func writePromQueryError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, storage.ErrQueryTimeout):
+		writePromError(w, 503, "timeout", err)
+	case errors.Is(err, storage.ErrQueryCanceled):
+		writePromError(w, 499, "canceled", err)
+	case errors.Is(err, storage.ErrQueryLimit):
+		writePromError(w, 422, "execution", err)
+	default:
+		writePromError(w, 400, "bad_data", err)
+	}
+}
+
+func promSample(ts uint64, value float64) []interface{} {
+	return []interface{}{float64(ts) / 1000, strconv.FormatFloat(value, 'f', -1, 64)}
+}
+
+// parsePromTime parses unix seconds with an optional fraction, RFC 3339
+// timestamps or time expressions like now-1h into milliseconds.
+func parsePromTime(s string, c clock.Clock) (uint64, error) {
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		if seconds < 0 || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+			return 0, errors.New("invalid timestamp " + s)
+		}
+		return uint64(math.Round(seconds * 1000)), nil
+	}
+	t, err := clock.Parse(s, c, false)
+	if err != nil || t.UnixNano() < 0 {
+		return 0, errors.New("invalid timestamp " + s)
+	}
+	return clock.Milliseconds(t), nil
+}
+
+func parsePromStep(s string) (uint64, error) {
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		if seconds <= 0 || math.IsInf(seconds, 0) {
+			return 0, errors.New("step must be greater than 0")
+		}
+		return uint64(math.Round(seconds * 1000)), nil
+	}
+	return parsePromDuration(s)
+}
+
+func (s *server) promQueryRange(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	r.ParseForm()
+	expr, err := parsePromQL(r.Form.Get("query"))
+	if err != nil {
+		writePromError(w, 400, "bad_data", err)
+		return
+	}
+	start, err := parsePromTime(r.Form.Get("start"), s.clock)
+	if err != nil {
+		writePromError(w, 400, "bad_data", err)
+		return
+	}
+	end, err := parsePromTime(r.Form.Get("end"), s.clock)
+	if err != nil {
+		writePromError(w, 400, "bad_data", err)
+		return
+	}
+	step, err := parsePromStep(r.Form.Get("step"))
+	if err != nil {
+		writePromError(w, 400, "bad_data", err)
+		return
+	}
+
+	ctx, cancel := s.queryContext(r)
+	defer cancel()
+	series, err := expr.eval(ctx, *s.storage, start, end, step)
+	if err != nil {
+		writePromQueryError(w, err)
+		return
+	}
+
+	result := make([]promMatrixSeries, 0, len(series))
+	for _, s := range series {
+		values := make([][]interface{}, 0, len(s.points))
+		for _, point := range s.points {
+			values = append(values, promSample(point.timestamp, point.value))
+		}
+		result = append(result, promMatrixSeries{Metric: s.labels, Values: values})
+	}
+	writePromResponse(w, 200, &promResponse{
+		Status: "success",
+		Data:   &promData{ResultType: "matrix", Result: result},
+	})
+}
+
+// promQuery is the instant query, a bare selector counts the events of the
+// minute before the evaluation time.
+func (s *server) promQuery(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	r.ParseForm()
+	expr, err := parsePromQL(r.Form.Get("query"))
+	if err != nil {
+		writePromError(w, 400, "bad_data", err)
+		return
+	}
+	ts := clock.Milliseconds(s.clock.Now())
+	if r.Form.Get("time") != "" {
+		if ts, err = parsePromTime(r.Form.Get("time"), s.clock); err != nil {
+			writePromError(w, 400, "bad_data", err)
+			return
+		}
+	}
+
+	ctx, cancel := s.queryContext(r)
+	defer cancel()
+	series, err := expr.eval(ctx, *s.storage, ts, ts, promInstantStep)
+	if err != nil {
+		writePromQueryError(w, err)
+		return
+	}
+
+	result := make([]promVectorSample, 0, len(series))
+	for _, s := range series {
+		for _, point := range s.points {
+			result = append(result, promVectorSample{Metric: s.labels, Value: promSample(point.timestamp, point.value)})
+		}
+	}
+	writePromResponse(w, 200, &promResponse{
+		Status: "success",
+		Data:   &promData{ResultType: "vector", Result: result},
+	})
+}
+
+func (s *server) promLabels(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	keys, err := (*s.storage).Keys()
+	if err != nil {
+		writePromError(w, 500, "internal", err)
+		return
+	}
+	labels := make([]string, 0, len(keys))
+	for _, key := range keys {
+		labels = append(labels, promLabel(key))
+	}
+	sort.Strings(labels)
+	writePromResponse(w, 200, &promResponse{Status: "success", Data: labels})
+}
+
+func (s *server) promLabelValues(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	values, err := (*s.storage).Values(promAttribute(ps.ByName("name")))
+	if err != nil {
+		writePromError(w, 500, "internal", err)
+		return
+	}
+	if values == nil {
+		values = []string{}
+	}
+	writePromResponse(w, 200, &promResponse{Status: "success", Data: values})
+}
+
+// remoteWrite receives Prometheus remote write requests. Every sample becomes an
+// event with the labels as attributes, __name__ stored as metric, and the
+// sample value as the value measure. Stale markers and other NaN samples are
+// skipped, as are samples which are not valid events, e.g. with timestamp 0.
+func (s *server) remoteWrite(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	compressed, err := io.ReadAll(http.MaxBytesReader(w, r.Body, remoteWriteMaxBodySize))
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	data, err := snappyDecode(compressed)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	var events storage.Events
+	if err := decodeWriteRequest(newProtoReader(data), &events); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	valid := events.Events[:0]
+	var invalid error
+	for _, event := range events.Events {
+		if err := event.Validate(); err != nil {
+			invalid = err
+			continue
+		}
+		valid = append(valid, event)
+	}
+	if dropped := len(events.Events) - len(valid); dropped > 0 {
+		log.Printf("Dropped %d invalid samples of remote write: %v", dropped, invalid)
+	}
+	events.Events = valid
+
+	if len(events.Events) > 0 {
+		var writeErrors storage.WriteErrors
+		err := (*s.storage).Write(&events)
+		switch {
+		case errors.As(err, &writeErrors):
+			// the other samples are written, a retry would not write these
+			w.WriteHeader(400)
+			w.Write([]byte(fmt.Sprintf("%d samples dropped: %s", len(writeErrors), writeErrors.Error())))
+			return
+		case err != nil:
+			w.WriteHeader(500)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+	w.WriteHeader(204)
+}
+
+// decodeWriteRequest decodes a prometheus.WriteRequest message into events.
+func decodeWriteRequest(r *protoReader, events *storage.Events) error {
+	return r.fields(func(field int, wireType int) (bool, error) {
+		if field != 1 || wireType != protoBytes {
+			return false, nil
+		}
+		series, err := r.message()
+		if err != nil {
+			return true, err
+		}
+
+		attributes := map[string]string{}
+		var samples []storage.Event
+		err = series.fields(func(field int, wireType int) (bool, error) {
+			switch {
+			case field == 1 && wireType == protoBytes:
+				name, value, err := decodeLabel(series)
+				attributes[promAttribute(name)] = value
+				return true, err
+			case field == 2 && wireType == protoBytes:
+				sample, err := decodeSample(series)
+				if err == nil && !math.IsNaN(sample.Measures[valueMeasure]) {
+					samples = append(samples, sample)
+				}
+				return true, err
+			}
+			return false, nil
+		})
+		for i := range samples {
+			samples[i].Attributes = attributes
+		}
+		events.Events = append(events.Events, samples...)
+		return true, err
+	})
+}
+
+func decodeLabel(r *protoReader) (string, string, error) {
+	var name, value string
+	label, err := r.message()
+	if err != nil {
+		return name, value, err
+	}
+	err = label.fields(func(field int, wireType int) (bool, error) {
+		switch {
+		case field == 1 && wireType == protoBytes:
+			name, err = label.string()
+			return true, err
+		case field == 2 && wireType == protoBytes:
+			value, err = label.string()
+			return true, err
+		}
+		return false, nil
+	})
+	return name, value, err
+}
+
+func decodeSample(r *protoReader) (storage.Event, error) {
+	var value float64
+	var timestamp uint64
+	sample, err := r.message()
+	if err != nil {
+		return storage.Event{}, err
+	}
+	err = sample.fields(func(field int, wireType int) (bool, error) {
+		switch {
+		case field == 1 && wireType == protoFixed64:
+			value, err = sample.double()
+			return true, err
+		case field == 2 && wireType == protoVarint:
+			ts, err := sample.varint()
+			if int64(ts) < 0 {
+				return true, errors.New("negative sample timestamp")
+			}
+			timestamp = ts
+			return true, err
+		}
+		return false, nil
+	})
+	return storage.Event{
+		Measures:  map[string]float64{valueMeasure: value},
+		Timestamp: timestamp,
+	}, err
+}
@@ -0,0 +1,604 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io.klector/klector/storage"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A subset of PromQL over event counts:
+//
+//	selector:     metric{label="value", label!="value", label=~"regex", label!~"regex"}
+//	functions:    rate(selector[range]), increase(selector[range])
+//	aggregation:  sum [by (label, ...)] (expression)
+//
+// A bare selector evaluates to the number of events within the step before
+// each evaluation timestamp, increase to the number of events within the range
+// and rate to that number per second, with a series for every set of labels of
+// the events unless they are summed. The metric name is stored in the metric
+// attribute, negative matchers only match events which have the label.
+
+const (
+	promMaxPoints   = 11000
+	promNameLabel   = "__name__"
+	promInstantStep = 60_000
+)
+
+type promMatcher struct {
+	name     string
+	operator string
+	value    string
+}
+
+type promExpr struct {
+	matchers []promMatcher
+	function string // "", rate or increase
+	rangeMs  uint64 // range of rate and increase
+	sum      bool
+	by       []string
+}
+
+type promSeries struct {
+	labels map[string]string
+	points []promPoint
+}
+
+type promPoint struct {
+	timestamp uint64
+	value     float64
+}
+
+const (
+	promEOF = iota
+	promIdent
+	promString
+	promNumber
+	promPunct
+)
+
+type promToken struct {
+	kind int
+	text string
+	pos  int
+}
+
+type promParser struct {
+	input string
+	pos   int
+	tok   promToken
+}
+
+func parsePromQL(input string) (*promExpr, error) {
+	p := &promParser{input: input}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	expr, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != promEOF {
+		return nil, p.unexpected()
+	}
+	return expr, nil
+}
+
+func (p *promParser) errorf(pos int, format string, args ...interface{}) error {
+	return fmt.Errorf("parse error at char %d: %s", pos+1, fmt.Sprintf(format, args...))
+}
+
+func (p *promParser) unexpected() error {
+	if p.tok.kind == promEOF {
+		return p.errorf(p.tok.pos, "unexpected end of input")
+	}
+	return p.errorf(p.tok.pos, "unexpected %q", p.tok.text)
+}
+
+// next moves to the next token.
+func (p *promParser) next() error {
+	for p.pos < len(p.input) && strings.IndexByte(" \t\r\n", p.input[p.pos]) >= 0 {
+		p.pos++
+	}
+	start := p.pos
+	if p.pos >= len(p.input) {
+		p.tok = promToken{kind: promEOF, pos: start}
+		return nil
+	}
+
+	c := p.input[p.pos]
+	switch {
+	case c == '_' || c == ':' || (c|0x20 >= 'a' && c|0x20 <= 'z'):
+		for p.pos < len(p.input) && isPromIdentChar(p.input[p.pos]) {
+			p.pos++
+		}
+		p.tok = promToken{kind: promIdent, text: p.input[start:p.pos], pos: start}
+	case c >= '0' && c <= '9':
+		for p.pos < len(p.input) && (isPromIdentChar(p.input[p.pos]) || p.input[p.pos] == '.') {
+			p.pos++
+		}
+		p.tok = promToken{kind: promNumber, text: p.input[start:p.pos], pos: start}
+	case c == '"' || c == '\'':
+		p.pos++
+		for p.pos < len(p.input) && p.input[p.pos] != c {
+			if p.input[p.pos] == '\\' {
+				p.pos++
+			}
+			p.pos++
+		}
+		if p.pos >= len(p.input) {
+			return p.errorf(start, "unterminated string")
+		}
+		p.pos++
+		raw := p.input[start+1 : p.pos-1]
+		if c == '\'' {
+			raw = strings.ReplaceAll(strings.ReplaceAll(raw, `\'`, `'`), `"`, `\"`)
+		}
+		text, err := strconv.Unquote(`"` + raw + `"`)
+		if err != nil {
+			return p.errorf(start, "invalid string %s", p.input[start:p.pos])
+		}
+		p.tok = promToken{kind: promString, text: text, pos: start}
+	case strings.HasPrefix(p.input[p.pos:], "!=") || strings.HasPrefix(p.input[p.pos:], "=~") || strings.HasPrefix(p.input[p.pos:], "!~"):
+		p.pos += 2
+		p.tok = promToken{kind: promPunct, text: p.input[start:p.pos], pos: start}
+	case strings.IndexByte("{}()[],=", c) >= 0:
+		p.pos++
+		p.tok = promToken{kind: promPunct, text: p.input[start:p.pos], pos: start}
+	default:
+		return p.errorf(start, "unexpected character %q", c)
+	}
+	return nil
+}
+
+func isPromIdentChar(c byte) bool {
+	return c == '_' || c == ':' || (c >= '0' && c <= '9') || (c|0x20 >= 'a' && c|0x20 <= 'z')
+}
+
+func (p *promParser) expect(punct string) error {
+	if p.tok.kind != promPunct || p.tok.text != punct {
+		return p.unexpected()
+	}
+	return p.next()
+}
+
+// peekPunct reports whether the token after the current one is punct.
+func (p *promParser) peekPunct(punct string) bool {
+	saved, savedPos := p.tok, p.pos
+	defer func() { p.tok, p.pos = saved, savedPos }()
+	return p.next() == nil && p.tok.kind == promPunct && p.tok.text == punct
+}
+
+func (p *promParser) parseExpr() (*promExpr, error) {
+	if p.tok.kind != promIdent || p.tok.text != "sum" || !(p.peekPunct("(") || p.peekIdent("by")) {
+		return p.parseFunction()
+	}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	var by []string
+	var err error
+	if p.tok.kind == promIdent && p.tok.text == "by" {
+		if by, err = p.parseBy(); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	expr, err := p.parseFunction()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	if by == nil && p.tok.kind == promIdent && p.tok.text == "by" {
+		if by, err = p.parseBy(); err != nil {
+			return nil, err
+		}
+	}
+	expr.sum = true
+	expr.by = by
+	return expr, nil
+}
+
+func (p *promParser) peekIdent(ident string) bool {
+	saved, savedPos := p.tok, p.pos
+	defer func() { p.tok, p.pos = saved, savedPos }()
+	return p.next() == nil && p.tok.kind == promIdent && p.tok.text == ident
+}
+
+func (p *promParser) parseBy() ([]string, error) {
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	by := []string{}
+	for p.tok.kind == promIdent {
+		by = append(by, p.tok.text)
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if p.tok.kind != promPunct || p.tok.text != "," {
+			break
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+	return by, p.expect(")")
+}
+
+func (p *promParser) parseFunction() (*promExpr, error) {
+	if p.tok.kind != promIdent || (p.tok.text != "rate" && p.tok.text != "increase") || !p.peekPunct("(") {
+		return p.parseSelector()
+	}
+	function := p.tok.text
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	expr, err := p.parseSelector()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.tok.kind != promPunct || p.tok.text != "[" {
+		return nil, p.errorf(p.tok.pos, "%s expects a range vector, e.g. metric[5m]", function)
+	}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	if p.tok.kind != promNumber {
+		return nil, p.unexpected()
+	}
+	rangeMs, err := parsePromDuration(p.tok.text)
+	if err != nil {
+		return nil, p.errorf(p.tok.pos, "%s", err.Error())
+	}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	if err := p.expect("]"); err != nil {
+		return nil, err
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+
+	expr.function = function
+	expr.rangeMs = rangeMs
+	return expr, nil
+}
+
+func (p *promParser) parseSelector() (*promExpr, error) {
+	expr := &promExpr{}
+	start := p.tok.pos
+	if p.tok.kind == promIdent {
+		expr.matchers = append(expr.matchers, promMatcher{name: promNameLabel, operator: "=", value: p.tok.text})
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.tok.kind == promPunct && p.tok.text == "{" {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		for p.tok.kind == promIdent {
+			matcher := promMatcher{name: p.tok.text}
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			if p.tok.kind != promPunct || (p.tok.text != "=" && p.tok.text != "!=" && p.tok.text != "=~" && p.tok.text != "!~") {
+				return nil, p.unexpected()
+			}
+			matcher.operator = p.tok.text
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			if p.tok.kind != promString {
+				return nil, p.unexpected()
+			}
+			matcher.value = p.tok.text
+			expr.matchers = append(expr.matchers, matcher)
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			if p.tok.kind != promPunct || p.tok.text != "," {
+				break
+			}
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+		}
+		if err := p.expect("}"); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(expr.matchers) == 0 {
+		if start == p.tok.pos {
+			return nil, p.unexpected()
+		}
+		return nil, p.errorf(start, "vector selector must contain at least one matcher")
+	}
+	return expr, nil
+}
+
+// parsePromDuration parses durations like 90s, 5m or 1h30m into milliseconds.
+func parsePromDuration(s string) (uint64, error) {
+	units := []struct {
+		suffix string
+		ms     uint64
+	}{
+		{"ms", 1},
+		{"s", 1_000},
+		{"m", 60_000},
+		{"h", 3_600_000},
+		{"d", 86_400_000},
+		{"w", 7 * 86_400_000},
+		{"y", 365 * 86_400_000},
+	}
+
+	var total uint64
+	rest := s
+	for rest != "" {
+		i := 0
+		for i < len(rest) && rest[i] >= '0' && rest[i] <= '9' {
+			i++
+		}
+		if i == 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		value, err := strconv.ParseUint(rest[:i], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		rest = rest[i:]
+
+		found := false
+		for _, unit := range units {
+			if strings.HasPrefix(rest, unit.suffix) && !(unit.suffix == "m" && strings.HasPrefix(rest, "ms")) {
+				total += value * unit.ms
+				rest = rest[len(unit.suffix):]
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+	}
+	if total == 0 {
+		return 0, errors.New("duration must be greater than 0")
+	}
+	return total, nil
+}
+
+func promAttribute(label string) string {
+	if label == promNameLabel {
+		return metricAttribute
+	}
+	return label
+}
+
+func promLabel(attribute string) string {
+	if attribute == metricAttribute {
+		return promNameLabel
+	}
+	return attribute
+}
+
+// query returns the storage query for the window [start, end] grouped by every
+// label of the expression, so that only existing series are returned.
+func (e *promExpr) query(start uint64, end uint64) *storage.Query {
+	query := &storage.Query{
+		Attributes:     map[string]string{},
+		StartTimestamp: start,
+		EndTimestamp:   end,
+	}
+	names := map[string]bool{}
+	for _, m := range e.matchers {
+		name := promAttribute(m.name)
+		names[name] = true
+		if _, found := query.Attributes[name]; m.operator == "=" && !found {
+			query.Attributes[name] = m.value
+			continue
+		}
+		query.Filters = append(query.Filters, storage.Filter{Attribute: name, Operator: m.operator, Values: []string{m.value}})
+	}
+	for _, label := range e.by {
+		names[promAttribute(label)] = true
+	}
+	for name := range names {
+		query.GroupBy = append(query.GroupBy, name)
+	}
+	sort.Strings(query.GroupBy)
+	return query
+}
+
+// labels returns the output labels of a storage group.
+func (e *promExpr) labels(group *storage.Group) map[string]string {
+	labels := map[string]string{}
+	if e.sum {
+		for _, label := range e.by {
+			if value, found := group.Attributes[promAttribute(label)]; found {
+				labels[label] = value
+			}
+		}
+		return labels
+	}
+	for name, value := range group.Attributes {
+		labels[promLabel(name)] = value
+	}
+	if e.function != "" {
+		delete(labels, promNameLabel)
+	}
+	return labels
+}
+
+// attributeSets returns the attribute sets of events which have every label of
+// the matchers, larger sets first.
+func (e *promExpr) attributeSets(s storage.Storage) ([][]string, error) {
+	all, err := s.AttributeSets()
+	if err != nil {
+		return nil, err
+	}
+	var sets [][]string
+	for _, names := range all {
+		matched := true
+		for _, m := range e.matchers {
+			if i := sort.SearchStrings(names, promAttribute(m.name)); i == len(names) || names[i] != promAttribute(m.name) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			sets = append(sets, names)
+		}
+	}
+	sort.SliceStable(sets, func(i, j int) bool {
+		return len(sets[i]) > len(sets[j])
+	})
+	return sets, nil
+}
+
+// seriesGroups returns a group for every label set with events in [start, end],
+// one series of a selector. A query grouped by the labels of a set also counts
+// the events of its supersets, so the groups of larger sets are subtracted.
+func (e *promExpr) seriesGroups(ctx context.Context, s storage.Storage, sets [][]string, start uint64, end uint64) ([]storage.Group, error) {
+	var groups []storage.Group
+	for _, names := range sets {
+		query := e.query(start, end)
+		query.GroupBy = names
+		result, err := s.Query(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		for _, group := range result.Groups {
+			value := group.Value
+			for _, larger := range groups {
+				if len(larger.Attributes) > len(group.Attributes) && containsLabels(larger.Attributes, group.Attributes) {
+					if larger.Value >= value {
+						value = 0
+						break
+					}
+					value -= larger.Value
+				}
+			}
+			if value > 0 {
+				groups = append(groups, storage.Group{Attributes: group.Attributes, Value: value})
+			}
+		}
+	}
+	return groups, nil
+}
+
+func containsLabels(attributes map[string]string, subset map[string]string) bool {
+	for name, value := range subset {
+		if v, found := attributes[name]; !found || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// eval evaluates the expression at start, start+step, ... up to end.
+func (e *promExpr) eval(ctx context.Context, s storage.Storage, start uint64, end uint64, step uint64) ([]promSeries, error) {
+	if step == 0 {
+		return nil, errors.New("step must be greater than 0")
+	}
+	if end < start {
+		return nil, errors.New("end timestamp must not be before start timestamp")
+	}
+	if (end-start)/step >= promMaxPoints {
+		return nil, fmt.Errorf("exceeded maximum resolution of %d points per series, increase the step", promMaxPoints)
+	}
+	window := e.rangeMs
+	if window == 0 {
+		window = step
+	}
+
+	var sets [][]string
+	if !e.sum {
+		var err error
+		if sets, err = e.attributeSets(s); err != nil {
+			return nil, err
+		}
+	}
+
+	seriesByKey := map[string]*promSeries{}
+	// ts < start once the timestamps wrap around
+	for ts := start; ts <= end && ts >= start; ts += step {
+		from := uint64(0)
+		if ts > window {
+			from = ts - window
+		}
+		var groups []storage.Group
+		if e.sum {
+			result, err := s.Query(ctx, e.query(from, ts-1))
+			if err != nil {
+				return nil, err
+			}
+			groups = result.Groups
+		} else {
+			var err error
+			if groups, err = e.seriesGroups(ctx, s, sets, from, ts-1); err != nil {
+				return nil, err
+			}
+		}
+
+		values := map[string]float64{}
+		for i := range groups {
+			labels := e.labels(&groups[i])
+			key := promLabelsKey(labels)
+			if _, found := seriesByKey[key]; !found {
+				seriesByKey[key] = &promSeries{labels: labels}
+			}
+			values[key] += float64(groups[i].Value)
+		}
+		for key, value := range values {
+			if e.function == "rate" {
+				value = value / (float64(window) / 1000)
+			}
+			seriesByKey[key].points = append(seriesByKey[key].points, promPoint{timestamp: ts, value: value})
+		}
+	}
+
+	keys := make([]string, 0, len(seriesByKey))
+	for key := range seriesByKey {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	series := make([]promSeries, 0, len(keys))
+	for _, key := range keys {
+		series = append(series, *seriesByKey[key])
+	}
+	return series, nil
+}
+
+func promLabelsKey(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var key strings.Builder
+	for _, name := range names {
+		key.WriteString(name)
+		key.WriteByte(0)
+		key.WriteString(labels[name])
+		key.WriteByte(0)
+	}
+	return key.String()
+}
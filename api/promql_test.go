@@ -0,0 +1,186 @@
+package api
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io.klector/klector/storage"
+	"math"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_parsePromQL(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		want    *promExpr
+		wantErr string
+	}{
+		{"Selector with matchers", `http_requests{status=~"5..", method!='GET'}`, &promExpr{
+			matchers: []promMatcher{
+				{"__name__", "=", "http_requests"},
+				{"status", "=~", "5.."},
+				{"method", "!=", "GET"},
+			},
+		}, ""},
+		{"Sum by of rate", `sum by (status) (rate(http_requests[5m]))`, &promExpr{
+			matchers: []promMatcher{{"__name__", "=", "http_requests"}},
+			function: "rate",
+			rangeMs:  300_000,
+			sum:      true,
+			by:       []string{"status"},
+		}, ""},
+		{"Trailing by clause", `sum(increase({app="checkout"}[1h30m])) by (country, browser)`, &promExpr{
+			matchers: []promMatcher{{"app", "=", "checkout"}},
+			function: "increase",
+			rangeMs:  5_400_000,
+			sum:      true,
+			by:       []string{"country", "browser"},
+		}, ""},
+		{"Metric named like a function", `rate`, &promExpr{
+			matchers: []promMatcher{{"__name__", "=", "rate"}},
+		}, ""},
+		{"Rate without range", `rate(http_requests)`, nil, "parse error at char 19: rate expects a range vector, e.g. metric[5m]"},
+		{"Empty selector", `{}`, nil, "parse error at char 1: vector selector must contain at least one matcher"},
+		{"Unsupported function", `avg(http_requests)`, nil, `parse error at char 4: unexpected "("`},
+		{"Unterminated string", `x{a="b}`, nil, "parse error at char 5: unterminated string"},
+		{"Invalid duration", `rate(x[5x])`, nil, `parse error at char 8: invalid duration "5x"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePromQL(tt.query)
+			if err != nil || tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("parsePromQL() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parsePromQL() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// snappyLiteral encodes src as a snappy block made of literals only.
+func snappyLiteral(src []byte) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	dst := append([]byte{}, tmp[:binary.PutUvarint(tmp[:], uint64(len(src)))]...)
+	for len(src) > 0 {
+		n := len(src)
+		if n > 60 {
+			n = 60
+		}
+		dst = append(dst, byte(n-1)<<2)
+		dst = append(dst, src[:n]...)
+		src = src[n:]
+	}
+	return dst
+}
+
+func Test_snappyDecode(t *testing.T) {
+	got, err := snappyDecode([]byte{10, 3 << 2, 'a', 'b', 'c', 'd', 2<<2 | 1, 3})
+	if err != nil || string(got) != "abcdbcdbcd" {
+		t.Errorf("snappyDecode() = %q, %v, want abcdbcdbcd", got, err)
+	}
+	long := strings.Repeat("klector", 20)
+	got, err = snappyDecode(snappyLiteral([]byte(long)))
+	if err != nil || string(got) != long {
+		t.Errorf("snappyDecode() = %q, %v, want %q", got, err, long)
+	}
+	if _, err := snappyDecode([]byte{10, 3 << 2, 'a', 'b', 'c', 'd', 2<<2 | 1, 9}); err == nil {
+		t.Errorf("snappyDecode() error = nil for an offset before the start")
+	}
+}
+
+func promTestTimeSeries(labels map[string]string, timestamps ...uint64) []byte {
+	var series []byte
+	for name, value := range labels {
+		var label []byte
+		label = appendProtoBytes(label, 1, []byte(name))
+		label = appendProtoBytes(label, 2, []byte(value))
+		series = appendProtoBytes(series, 1, label)
+	}
+	for _, ts := range timestamps {
+		var sample []byte
+		sample = appendProtoTag(sample, 1, protoFixed64)
+		sample = appendProtoFixed64(sample, math.Float64bits(1))
+		sample = appendProtoTag(sample, 2, protoVarint)
+		sample = appendProtoVarint(sample, ts)
+		series = appendProtoBytes(series, 2, sample)
+	}
+	return series
+}
+
+func Test_server_prometheus(t *testing.T) {
+	s := storage.Create(storage.NewDefaultStorageConfiguration())
+	server := newServer(NewDefaultApiConfiguration(), &s)
+
+	var request []byte
+	request = appendProtoBytes(request, 1, promTestTimeSeries(
+		map[string]string{"__name__": "http_requests", "status": "500"}, 61_000, 62_000, 130_000))
+	request = appendProtoBytes(request, 1, promTestTimeSeries(
+		map[string]string{"__name__": "http_requests", "status": "200"}, 61_000))
+	request = appendProtoBytes(request, 1, promTestTimeSeries(
+		map[string]string{"__name__": "http_requests", "status": "500", "instance": "b"}, 62_000))
+	request = appendProtoBytes(request, 1, promTestTimeSeries(
+		map[string]string{"__name__": "other", "status": "500"}, 61_000))
+	request = appendProtoBytes(request, 1, promTestTimeSeries(
+		map[string]string{"__name__": "other", "status": "400"}, 0))
+
+	r := httptest.NewRequest("POST", "/api/v1/write", bytes.NewReader(snappyLiteral(request)))
+	r.Header.Set("Content-Encoding", "snappy")
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, r)
+	if w.Code != 204 {
+		t.Fatalf("remote write status = %v: %s", w.Code, w.Body.String())
+	}
+
+	tests := []struct {
+		name string
+		url  string
+		want string
+	}{
+		{"Sum by status", `/api/v1/query_range?query=sum+by+(status)(increase(http_requests[1m]))&start=120&end=180&step=60`,
+			`{"status":"success","data":{"resultType":"matrix","result":[` +
+				`{"metric":{"status":"200"},"values":[[120,"1"],[180,"0"]]},` +
+				`{"metric":{"status":"500"},"values":[[120,"3"],[180,"1"]]}]}}`},
+		{"Rate with regular expression matcher", `/api/v1/query_range?query=rate(http_requests{status=~"5.."}[2m])&start=180&end=180&step=60`,
+			`{"status":"success","data":{"resultType":"matrix","result":[` +
+				`{"metric":{"instance":"b","status":"500"},"values":[[180,"0.008333333333333333"]]},` +
+				`{"metric":{"status":"500"},"values":[[180,"0.025"]]}]}}`},
+		{"Selector has a series for every label set", `/api/v1/query?query=http_requests&time=120`,
+			`{"status":"success","data":{"resultType":"vector","result":[` +
+				`{"metric":{"__name__":"http_requests","instance":"b","status":"500"},"value":[120,"1"]},` +
+				`{"metric":{"__name__":"http_requests","status":"200"},"value":[120,"1"]},` +
+				`{"metric":{"__name__":"http_requests","status":"500"},"value":[120,"2"]}]}}`},
+		{"Instant query", `/api/v1/query?query=sum(http_requests)&time=120`,
+			`{"status":"success","data":{"resultType":"vector","result":[` +
+				`{"metric":{},"value":[120,"4"]}]}}`},
+		{"Labels", `/api/v1/labels`,
+			`{"status":"success","data":["__name__","instance","status"]}`},
+		{"Label values", `/api/v1/label/__name__/values`,
+			`{"status":"success","data":["http_requests","other"]}`},
+		{"Syntax error", `/api/v1/query_range?query=sum(&start=0&end=60&step=60`,
+			`{"status":"error","errorType":"bad_data","error":"parse error at char 5: unexpected end of input"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.url, nil)
+			w := httptest.NewRecorder()
+			server.router.ServeHTTP(w, r)
+
+			var got, want interface{}
+			json.Unmarshal(w.Body.Bytes(), &got)
+			json.Unmarshal([]byte(tt.want), &want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("response = %s, want %s", strings.TrimSpace(w.Body.String()), tt.want)
+			}
+		})
+	}
+}
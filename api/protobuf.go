@@ -0,0 +1,154 @@
+package api
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Minimal protocol buffers wire format support, enough to decode the few
+// messages of the OTLP and Prometheus remote write protocols without
+// generated code.
+
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+var errProtoTruncated = errors.New("protobuf message is truncated")
+
+type protoReader struct {
+	buf []byte
+	pos int
+}
+
+func newProtoReader(buf []byte) *protoReader {
+	return &protoReader{buf: buf}
+}
+
+func (r *protoReader) done() bool {
+	return r.pos >= len(r.buf)
+}
+
+// next reads the tag of the next field.
+func (r *protoReader) next() (int, int, error) {
+	tag, err := r.varint()
+	if err != nil {
+		return 0, 0, err
+	}
+	if tag>>3 == 0 {
+		return 0, 0, errors.New("protobuf field number 0 is invalid")
+	}
+	return int(tag >> 3), int(tag & 7), nil
+}
+
+func (r *protoReader) varint() (uint64, error) {
+	value, n := binary.Uvarint(r.buf[r.pos:])
+	if n <= 0 {
+		return 0, errProtoTruncated
+	}
+	r.pos += n
+	return value, nil
+}
+
+func (r *protoReader) fixed64() (uint64, error) {
+	if len(r.buf)-r.pos < 8 {
+		return 0, errProtoTruncated
+	}
+	value := binary.LittleEndian.Uint64(r.buf[r.pos:])
+	r.pos += 8
+	return value, nil
+}
+
+func (r *protoReader) double() (float64, error) {
+	value, err := r.fixed64()
+	return math.Float64frombits(value), err
+}
+
+func (r *protoReader) bytes() ([]byte, error) {
+	length, err := r.varint()
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(r.buf)-r.pos) < length {
+		return nil, errProtoTruncated
+	}
+	value := r.buf[r.pos : r.pos+int(length)]
+	r.pos += int(length)
+	return value, nil
+}
+
+func (r *protoReader) message() (*protoReader, error) {
+	value, err := r.bytes()
+	return newProtoReader(value), err
+}
+
+func (r *protoReader) string() (string, error) {
+	value, err := r.bytes()
+	return string(value), err
+}
+
+// fields calls handle for every field of the message. Fields for which handle
+// returns false are skipped.
+func (r *protoReader) fields(handle func(field int, wireType int) (bool, error)) error {
+	for !r.done() {
+		field, wireType, err := r.next()
+		if err != nil {
+			return err
+		}
+		handled, err := handle(field, wireType)
+		if err != nil {
+			return err
+		}
+		if !handled {
+			if err := r.skip(wireType); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *protoReader) skip(wireType int) error {
+	var err error
+	switch wireType {
+	case protoVarint:
+		_, err = r.varint()
+	case protoFixed64:
+		_, err = r.fixed64()
+	case protoBytes:
+		_, err = r.bytes()
+	case protoFixed32:
+		if len(r.buf)-r.pos < 4 {
+			return errProtoTruncated
+		}
+		r.pos += 4
+	default:
+		err = fmt.Errorf("unsupported protobuf wire type %d", wireType)
+	}
+	return err
+}
+
+func appendProtoTag(buf []byte, field int, wireType int) []byte {
+	return appendProtoVarint(buf, uint64(field)<<3|uint64(wireType))
+}
+
+func appendProtoVarint(buf []byte, value uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutUvarint(tmp[:], value)]...)
+}
+
+func appendProtoFixed64(buf []byte, value uint64) []byte {
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], value)
+	return append(buf, tmp[:]...)
+}
+
+func appendProtoBytes(buf []byte, field int, value []byte) []byte {
+	buf = appendProtoTag(buf, field, protoBytes)
+	buf = appendProtoVarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
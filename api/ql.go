@@ -0,0 +1,51 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"io"
+	"io.klector/klector/ql"
+	"net/http"
+)
+
+const qlMaxQuerySize = 64 << 10
+
+// qlQuery runs a query of the SQL dialect given as the q parameter or as the
+// plain text request body.
+func (s *server) qlQuery(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	text := r.URL.Query().Get("q")
+	if r.Method == "POST" {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, qlMaxQuerySize))
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		text = string(body)
+	}
+
+	stmt, err := ql.Parse(text)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	plan, err := ql.NewPlan(stmt, s.clock)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	ctx, cancel := s.queryContext(r)
+	defer cancel()
+	result, err := plan.Execute(ctx, *s.storage)
+	if err != nil {
+		w.WriteHeader(queryErrorStatus(err, 400))
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,53 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/julienschmidt/httprouter"
+	"io.klector/klector/storage"
+	"log"
+	"net/http"
+)
+
+func (s *server) addRollup(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var rollup storage.Rollup
+	if err := json.NewDecoder(r.Body).Decode(&rollup); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err := (*s.storage).AddRollup(&rollup); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	log.Printf("added rollup %v", rollup)
+
+	w.WriteHeader(201)
+}
+
+func (s *server) listRollups(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	rollups, err := (*s.storage).Rollups()
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rollups)
+}
+
+func (s *server) removeRollup(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if err := (*s.storage).RemoveRollup(ps.ByName("name")); err != nil {
+		if errors.Is(err, storage.ErrUnknownRollup) {
+			w.WriteHeader(404)
+		} else {
+			w.WriteHeader(500)
+		}
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.WriteHeader(204)
+}
@@ -1,26 +1,69 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"github.com/julienschmidt/httprouter"
+	"io.klector/klector/alert"
+	"io.klector/klector/clock"
 	"io.klector/klector/storage"
 	"log"
 	"net/http"
+	"strings"
+	"time"
 )
 
 type Api interface {
 	Stop()
 }
 
+type ApiConfiguration struct {
+	Address        string        `json:"address"`
+	GrpcAddress    string        `json:"grpcAddress"`    // address of the gRPC API, disabled if empty
+	OtlpAttributes []string      `json:"otlpAttributes"` // attributes kept from OTLP resources and records, all if empty
+	QueryTimeout   time.Duration `json:"queryTimeout"`   // 0 means no timeout
+	StreamInterval time.Duration `json:"streamInterval"` // minimum time between results of query subscriptions
+}
+
+func NewDefaultApiConfiguration() *ApiConfiguration {
+	return &ApiConfiguration{
+		Address:        ":4479",
+		QueryTimeout:   30 * time.Second,
+		StreamInterval: time.Second,
+	}
+}
+
 type server struct {
-	router  *httprouter.Router
-	storage *storage.Storage
+	config      *ApiConfiguration
+	clock       clock.Clock
+	router      *httprouter.Router
+	storage     *storage.Storage
+	alerts      alert.Manager
+	otlpAllowed map[string]bool
 }
 
 func (s *server) Stop() {
 	// noop
 }
 
+// storeResult answers a write of which some events were rejected, the others
+// were written.
+type storeResult struct {
+	Accepted       uint64          `json:"accepted"`
+	Rejected       uint64          `json:"rejected"`
+	RejectedEvents []rejectedEvent `json:"rejectedEvents"`
+}
+
+// rejectedEvent is an event which was not written, Index is its position in
+// the request.
+type rejectedEvent struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+// store writes events and answers 204 if all of them were written, or 200 with
+// a storeResult if some were rejected.
 func (s *server) store(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	var events storage.Events
 	if err := json.NewDecoder(r.Body).Decode(&events); err != nil {
@@ -34,8 +77,22 @@ func (s *server) store(w http.ResponseWriter, r *http.Request, ps httprouter.Par
 		return
 	}
 
-	if err := (*s.storage).Write(&events); err != nil {
-		w.WriteHeader(400)
+	var writeErrors storage.WriteErrors
+	err := (*s.storage).Write(&events)
+	switch {
+	case errors.As(err, &writeErrors):
+		result := storeResult{
+			Accepted: uint64(len(events.Events) - len(writeErrors)),
+			Rejected: uint64(len(writeErrors)),
+		}
+		for _, e := range writeErrors {
+			result.RejectedEvents = append(result.RejectedEvents, rejectedEvent{Index: e.Index, Error: e.Err.Error()})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+		return
+	case err != nil:
+		w.WriteHeader(500)
 		w.Write([]byte(err.Error()))
 		return
 	}
@@ -43,18 +100,65 @@ func (s *server) store(w http.ResponseWriter, r *http.Request, ps httprouter.Par
 	w.WriteHeader(204)
 }
 
+// queryRequest is a query whose range may also be given as time expressions,
+// e.g. "start": "now-1d/d", "end": "now/d", see clock.Parse.
+type queryRequest struct {
+	storage.Query
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+func (r *queryRequest) resolve(c clock.Clock) error {
+	return resolveRange(r.Start, r.End, c, &r.StartTimestamp, &r.EndTimestamp)
+}
+
+// resolveRange sets the timestamps given as non-empty time expressions.
+func resolveRange(start string, end string, c clock.Clock, startTimestamp *uint64, endTimestamp *uint64) error {
+	if start != "" {
+		t, err := clock.Parse(start, c, false)
+		if err != nil {
+			return err
+		}
+		*startTimestamp = clock.Milliseconds(t)
+	}
+	if end != "" {
+		t, err := clock.Parse(end, c, true)
+		if err != nil {
+			return err
+		}
+		*endTimestamp = clock.Milliseconds(t)
+	}
+	return nil
+}
+
 func (s *server) query(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	var query storage.Query
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		s.promQuery(w, r, ps)
+		return
+	}
 
-	if err := json.NewDecoder(r.Body).Decode(&query); err != nil {
+	var request queryRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
 		w.WriteHeader(400)
 		w.Write([]byte(err.Error()))
+		return
+	}
+	if err := request.resolve(s.clock); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	query := request.Query
+	if r.URL.Query().Get("explain") == "true" {
+		query.Explain = true
 	}
 	log.Printf("received query %v", query)
 
-	resultSet, err := (*s.storage).Query(&query)
+	ctx, cancel := s.queryContext(r)
+	defer cancel()
+	resultSet, err := (*s.storage).Query(ctx, &query)
 	if err != nil {
-		w.WriteHeader(500)
+		w.WriteHeader(queryErrorStatus(err, 500))
 		w.Write([]byte(err.Error()))
 		return
 	}
@@ -65,17 +169,148 @@ func (s *server) query(w http.ResponseWriter, r *http.Request, ps httprouter.Par
 	}
 }
 
-func (s *server) start() error {
+func (s *server) keys(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	keys, err := (*s.storage).Keys()
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if keys == nil {
+		keys = []string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+func (s *server) values(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	values, err := (*s.storage).Values(ps.ByName("key"))
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if values == nil {
+		values = []string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(values)
+}
+
+// queryContext returns the context of a query request, done when the client
+// disconnects or the query timeout passes.
+func (s *server) queryContext(r *http.Request) (context.Context, context.CancelFunc) {
+	if s.config.QueryTimeout > 0 {
+		return context.WithTimeout(r.Context(), s.config.QueryTimeout)
+	}
+	return context.WithCancel(r.Context())
+}
+
+// queryErrorStatus returns the response status of a failed query, status for
+// errors other than timeouts, cancellation, exceeded limits and unknown rollups.
+func queryErrorStatus(err error, status int) int {
+	switch {
+	case errors.Is(err, storage.ErrQueryTimeout):
+		return 503
+	case errors.Is(err, storage.ErrQueryCanceled):
+		return 499 // client closed request
+	case errors.Is(err, storage.ErrQueryLimit):
+		return 422
+	case errors.Is(err, storage.ErrUnknownRollup):
+		return 404
+	}
+	return status
+}
+
+func (s *server) routes() {
 	s.router.POST("/api/v1/event", s.store)
+	s.router.POST("/api/v1/event/stream", s.storeStream)
+	s.router.GET("/api/v1/event/tail", s.tail)
 	s.router.POST("/api/v1/query", s.query)
+	s.router.GET("/api/v1/query/stream", s.subscribe)
+	s.router.POST("/api/v1/query/stream", s.subscribe)
+	s.router.POST("/api/v1/delete", s.delete)
+	s.router.GET("/api/v1/late-events", s.lateEvents)
+	s.router.GET("/api/v1/quarantine", s.listQuarantine)
+	s.router.DELETE("/api/v1/quarantine", s.clearQuarantine)
+	s.router.GET("/api/v1/keys", s.keys)
+	s.router.GET("/api/v1/values/:key", s.values)
+	s.router.POST("/api/v1/funnel", s.funnel)
+	s.router.POST("/api/v1/retention", s.retention)
+	s.router.GET("/api/v1/alerts", s.listAlerts)
+	s.router.GET("/api/v1/alerts/rules", s.listAlertRules)
+	s.router.POST("/api/v1/alerts/rules", s.addAlertRule)
+	s.router.DELETE("/api/v1/alerts/rules/:name", s.removeAlertRule)
+	s.router.GET("/api/v1/rollups", s.listRollups)
+	s.router.POST("/api/v1/rollups", s.addRollup)
+	s.router.DELETE("/api/v1/rollups/:name", s.removeRollup)
+	s.router.GET("/api/v1/admin/export", s.export)
+	s.router.POST("/api/v1/admin/import", s.importSeries)
+	s.router.GET("/api/v1/admin/backup", s.backup)
+	s.router.POST("/api/v1/admin/snapshot", s.snapshot)
+	s.router.GET("/api/v1/sql", s.qlQuery)
+	s.router.POST("/api/v1/sql", s.qlQuery)
+	s.router.POST("/write", s.writeLineProtocol)
+	s.router.POST("/api/v2/write", s.writeLineProtocol)
+	s.router.POST("/v1/logs", s.otlpLogs)
+	s.router.POST("/v1/metrics", s.otlpMetrics)
+	s.router.POST("/api/v1/write", s.remoteWrite)
+	s.router.GET("/api/v1/query", s.promQuery)
+	s.router.GET("/api/v1/query_range", s.promQueryRange)
+	s.router.POST("/api/v1/query_range", s.promQueryRange)
+	s.router.GET("/api/v1/labels", s.promLabels)
+	s.router.POST("/api/v1/labels", s.promLabels)
+	s.router.GET("/api/v1/label/:name/values", s.promLabelValues)
+	s.router.GET("/grafana/", s.grafanaHealth)
+	s.router.POST("/grafana/search", s.grafanaSearch)
+	s.router.POST("/grafana/query", s.grafanaQuery)
+	s.router.POST("/grafana/annotations", s.grafanaAnnotations)
+	s.router.POST("/grafana/tag-keys", s.grafanaTagKeys)
+	s.router.POST("/grafana/tag-values", s.grafanaTagValues)
+}
 
-	return http.ListenAndServe(":4479", s.router)
+func (s *server) start() error {
+	return http.ListenAndServe(s.config.Address, s.router)
 }
 
-func Create(storage *storage.Storage) error {
-	server := server{
+func newServer(config *ApiConfiguration, storage *storage.Storage) *server {
+	server := &server{
+		config:  config,
+		clock:   clock.System(),
 		router:  httprouter.New(),
 		storage: storage,
 	}
-	return server.start()
+	if len(config.OtlpAttributes) > 0 {
+		server.otlpAllowed = make(map[string]bool, len(config.OtlpAttributes))
+		for _, name := range config.OtlpAttributes {
+			server.otlpAllowed[name] = true
+		}
+	}
+	server.routes()
+	return server
+}
+
+// NewHandler returns the handler of the HTTP API, e.g. to embed it into another
+// server.
+func NewHandler(config *ApiConfiguration, storage *storage.Storage) http.Handler {
+	return newServer(config, storage).router
+}
+
+// Create serves the api, alerts may be nil if alerting is disabled.
+func Create(config *ApiConfiguration, storage *storage.Storage, alerts alert.Manager) error {
+	server := newServer(config, storage)
+	server.alerts = alerts
+	if config.GrpcAddress == "" {
+		return server.start()
+	}
+	errs := make(chan error, 2)
+	go func() {
+		errs <- server.start()
+	}()
+	go func() {
+		errs <- server.startGrpc()
+	}()
+	return <-errs
 }
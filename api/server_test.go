@@ -0,0 +1,97 @@
+package api
+
+import (
+	"encoding/json"
+	"io.klector/klector/clock"
+	"io.klector/klector/storage"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_server_query(t *testing.T) {
+	s := storage.Create(storage.NewDefaultStorageConfiguration())
+	server := newServer(NewDefaultApiConfiguration(), &s)
+	server.clock = clock.Fixed(time.Date(2021, 3, 17, 15, 42, 0, 0, time.UTC))
+	s.Write(&storage.Events{Events: []storage.Event{
+		{Attributes: map[string]string{"app": "checkout"}, Timestamp: uint64(time.Date(2021, 3, 16, 23, 59, 0, 0, time.UTC).UnixNano() / 1_000_000)},
+		{Attributes: map[string]string{"app": "checkout"}, Timestamp: uint64(time.Date(2021, 3, 17, 0, 0, 0, 0, time.UTC).UnixNano() / 1_000_000)},
+		{Attributes: map[string]string{"app": "checkout"}, Timestamp: uint64(time.Date(2021, 3, 17, 15, 0, 0, 0, time.UTC).UnixNano() / 1_000_000)},
+	}})
+
+	tests := []struct {
+		name      string
+		body      string
+		wantCode  int
+		wantValue uint64
+	}{
+		{"Absolute range", `{"attributes":{"app":"checkout"},"startTimestamp":1615939140000,"endTimestamp":1615939200000}`, 200, 2},
+		{"Today", `{"attributes":{"app":"checkout"},"start":"now/d","end":"now/d"}`, 200, 2},
+		{"Yesterday", `{"attributes":{"app":"checkout"},"start":"now-1d/d","end":"now-1d/d"}`, 200, 1},
+		{"Last hour", `{"attributes":{"app":"checkout"},"start":"PT1H","end":"now"}`, 200, 1},
+		{"ISO-8601 start", `{"attributes":{"app":"checkout"},"start":"2021-03-16T23:59:00Z","end":"now"}`, 200, 3},
+		{"Invalid expression", `{"attributes":{"app":"checkout"},"start":"yesterday"}`, 400, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/api/v1/query", strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			server.router.ServeHTTP(w, r)
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %v, want %v: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+			if w.Code != 200 {
+				return
+			}
+			var result storage.ResultSet
+			json.Unmarshal(w.Body.Bytes(), &result)
+			if result.Value != tt.wantValue {
+				t.Errorf("value = %v, want %v", result.Value, tt.wantValue)
+			}
+		})
+	}
+}
+
+func Test_server_store(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		wantCode int
+		want     storeResult
+	}{
+		{"Written", `{"events":[{"attributes":{"app":"a"},"timestamp":1000}]}`, 204, storeResult{}},
+		{"Partially written", `{"events":[{"attributes":{"app":"a"}},{"attributes":{"app":"a"},"timestamp":1000},{"timestamp":1000}]}`, 200, storeResult{
+			Accepted: 1,
+			Rejected: 2,
+			RejectedEvents: []rejectedEvent{
+				{Index: 0, Error: "timestamp cannot be 0"},
+				{Index: 2, Error: "attributes are not defined in event"},
+			},
+		}},
+		{"No events", `{"events":[]}`, 400, storeResult{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := storage.Create(storage.NewDefaultStorageConfiguration())
+			server := newServer(NewDefaultApiConfiguration(), &s)
+			r := httptest.NewRequest("POST", "/api/v1/event", strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			server.router.ServeHTTP(w, r)
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %v, want %v: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+			if w.Code != 200 {
+				return
+			}
+			var result storeResult
+			json.Unmarshal(w.Body.Bytes(), &result)
+			if !reflect.DeepEqual(result, tt.want) {
+				t.Errorf("result = %+v, want %+v", result, tt.want)
+			}
+		})
+	}
+}
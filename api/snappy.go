@@ -0,0 +1,86 @@
+package api
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const snappyMaxDecodedSize = 64 << 20
+
+var errSnappyCorrupt = errors.New("snappy: corrupt input")
+
+// snappyDecode decodes the snappy block format used by Prometheus remote write.
+func snappyDecode(src []byte) ([]byte, error) {
+	length, n := binary.Uvarint(src)
+	if n <= 0 {
+		return nil, errSnappyCorrupt
+	}
+	if length > snappyMaxDecodedSize {
+		return nil, errors.New("snappy: decoded block is too large")
+	}
+	dst := make([]byte, 0, length)
+
+	for s := n; s < len(src); {
+		tag := src[s]
+		s++
+		var literal, offset, copyLength int
+		switch tag & 3 {
+		case 0:
+			literal = int(tag>>2) + 1
+			if literal > 60 {
+				extra := literal - 60
+				if len(src)-s < extra {
+					return nil, errSnappyCorrupt
+				}
+				literal = 0
+				for i := extra - 1; i >= 0; i-- {
+					literal = literal<<8 | int(src[s+i])
+				}
+				literal++
+				s += extra
+			}
+		case 1:
+			if len(src)-s < 1 {
+				return nil, errSnappyCorrupt
+			}
+			copyLength = 4 + int(tag>>2)&7
+			offset = int(tag&0xe0)<<3 | int(src[s])
+			s++
+		case 2:
+			if len(src)-s < 2 {
+				return nil, errSnappyCorrupt
+			}
+			copyLength = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[s:]))
+			s += 2
+		case 3:
+			if len(src)-s < 4 {
+				return nil, errSnappyCorrupt
+			}
+			copyLength = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[s:]))
+			s += 4
+		}
+
+		if literal > 0 {
+			if literal < 0 || len(src)-s < literal || uint64(len(dst)+literal) > length {
+				return nil, errSnappyCorrupt
+			}
+			dst = append(dst, src[s:s+literal]...)
+			s += literal
+			continue
+		}
+		if offset <= 0 || offset > len(dst) || uint64(len(dst)+copyLength) > length {
+			return nil, errSnappyCorrupt
+		}
+		// byte by byte as source and destination may overlap
+		for i := 0; i < copyLength; i++ {
+			dst = append(dst, dst[len(dst)-offset])
+		}
+	}
+
+	if uint64(len(dst)) != length {
+		return nil, errSnappyCorrupt
+	}
+	return dst, nil
+}
@@ -0,0 +1,136 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"io.klector/klector/storage"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const sseKeepAliveInterval = 15 * time.Second
+
+// subscribe streams the result of a query as Server-Sent Events: a result
+// event right away and another one after matching events were written, at
+// most one per StreamInterval however fast events arrive, or one after every
+// write if it is 0. Time expressions of the range are resolved again for every
+// result. EventSource clients pass the query as JSON in the q parameter, other
+// clients may post it.
+func (s *server) subscribe(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var request queryRequest
+	var err error
+	if r.Method == "POST" {
+		err = json.NewDecoder(r.Body).Decode(&request)
+	} else {
+		err = json.NewDecoder(strings.NewReader(r.URL.Query().Get("q"))).Decode(&request)
+	}
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(500)
+		w.Write([]byte("streaming is not supported"))
+		return
+	}
+
+	// subscribes first, so that no write after the first result is missed
+	sub, err := (*s.storage).Subscribe(&request.Query)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	defer sub.Close()
+	result, err := s.subscriptionResult(r.Context(), request)
+	if err != nil {
+		w.WriteHeader(queryErrorStatus(err, 400))
+		w.Write([]byte(err.Error()))
+		return
+	}
+	log.Printf("subscribed to query %v", request.Query)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	if err := writeServerSentEvent(w, "result", result); err != nil {
+		return
+	}
+	flusher.Flush()
+
+	var throttle <-chan time.Time
+	if s.config.StreamInterval > 0 {
+		ticker := time.NewTicker(s.config.StreamInterval)
+		defer ticker.Stop()
+		throttle = ticker.C
+	}
+	keepAlive := time.NewTicker(sseKeepAliveInterval)
+	defer keepAlive.Stop()
+	updated := false
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-sub.Updates():
+			if throttle != nil {
+				updated = true
+				continue
+			}
+			if err := s.writeSubscriptionResult(r.Context(), w, request); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepAlive.C:
+			if _, err := w.Write([]byte(": keep-alive\n\n")); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-throttle:
+			if !updated {
+				continue
+			}
+			updated = false
+			if err := s.writeSubscriptionResult(r.Context(), w, request); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// writeSubscriptionResult writes the current result of the query, or the error
+// of the query, as an event.
+func (s *server) writeSubscriptionResult(ctx context.Context, w http.ResponseWriter, request queryRequest) error {
+	result, err := s.subscriptionResult(ctx, request)
+	if err != nil {
+		return writeServerSentEvent(w, "error", err.Error())
+	}
+	return writeServerSentEvent(w, "result", result)
+}
+
+func (s *server) subscriptionResult(ctx context.Context, request queryRequest) (*storage.ResultSet, error) {
+	if err := request.resolve(s.clock); err != nil {
+		return nil, err
+	}
+	if s.config.QueryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.config.QueryTimeout)
+		defer cancel()
+	}
+	return (*s.storage).Query(ctx, &request.Query)
+}
+
+func writeServerSentEvent(w http.ResponseWriter, event string, data interface{}) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, encoded)
+	return err
+}
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"io.klector/klector/storage"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_server_subscribe(t *testing.T) {
+	s := storage.Create(storage.NewDefaultStorageConfiguration())
+	config := NewDefaultApiConfiguration()
+	config.StreamInterval = 20 * time.Millisecond
+	server := httptest.NewServer(newServer(config, &s).router)
+	defer server.Close()
+	event := storage.Event{Attributes: map[string]string{"app": "checkout"}, Timestamp: 60_000}
+	s.Write(&storage.Events{Events: []storage.Event{event}})
+
+	query := url.QueryEscape(`{"attributes":{"app":"checkout"},"startTimestamp":0,"endTimestamp":120000,"step":60000}`)
+	response, err := http.Get(server.URL + "/api/v1/query/stream?q=" + query)
+	if err != nil {
+		t.Fatalf("GET error = %v", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != 200 || response.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("status = %v, content type = %v", response.StatusCode, response.Header.Get("Content-Type"))
+	}
+
+	results := make(chan storage.ResultSet, 100)
+	go func() {
+		defer close(results)
+		scanner := bufio.NewScanner(response.Body)
+		for scanner.Scan() {
+			if data := strings.TrimPrefix(scanner.Text(), "data: "); data != scanner.Text() {
+				var result storage.ResultSet
+				json.Unmarshal([]byte(data), &result)
+				results <- result
+			}
+		}
+	}()
+	next := func() storage.ResultSet {
+		select {
+		case result := <-results:
+			return result
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no result received")
+			return storage.ResultSet{}
+		}
+	}
+
+	if result := next(); result.Value != 1 || len(result.Buckets) != 3 {
+		t.Fatalf("initial result = %+v, want a value of 1 in 3 buckets", result)
+	}
+	for i := 0; i < 100; i++ {
+		s.Write(&storage.Events{Events: []storage.Event{event}})
+	}
+	received := 0
+	for {
+		result := next()
+		received++
+		if result.Value == 101 {
+			if result.Buckets[1].Value != 101 {
+				t.Errorf("bucket value = %v, want 101", result.Buckets[1].Value)
+			}
+			break
+		}
+	}
+	if received > 10 {
+		t.Errorf("received %d results for 100 writes, want them coalesced", received)
+	}
+}
+
+func Test_server_subscribe_noThrottle(t *testing.T) {
+	s := storage.Create(storage.NewDefaultStorageConfiguration())
+	config := NewDefaultApiConfiguration()
+	config.StreamInterval = 0
+	server := httptest.NewServer(newServer(config, &s).router)
+	defer server.Close()
+	event := storage.Event{Attributes: map[string]string{"app": "checkout"}, Timestamp: 60_000}
+
+	query := url.QueryEscape(`{"attributes":{"app":"checkout"},"startTimestamp":0,"endTimestamp":120000}`)
+	response, err := http.Get(server.URL + "/api/v1/query/stream?q=" + query)
+	if err != nil {
+		t.Fatalf("GET error = %v", err)
+	}
+	defer response.Body.Close()
+
+	values := make(chan uint64, 10)
+	go func() {
+		defer close(values)
+		scanner := bufio.NewScanner(response.Body)
+		for scanner.Scan() {
+			if data := strings.TrimPrefix(scanner.Text(), "data: "); data != scanner.Text() {
+				var result storage.ResultSet
+				json.Unmarshal([]byte(data), &result)
+				values <- result.Value
+			}
+		}
+	}()
+
+	for want := uint64(0); want <= 2; want++ {
+		select {
+		case value := <-values:
+			if value != want {
+				t.Fatalf("result = %d, want %d", value, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no result %d received", want)
+		}
+		s.Write(&storage.Events{Events: []storage.Event{event}})
+	}
+}
@@ -0,0 +1,101 @@
+package api
+
+import (
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"io.klector/klector/storage"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	tailDefaultBufferSize = 1000
+	tailMaxBufferSize     = 100_000
+	tailDroppedInterval   = time.Second
+)
+
+// tail streams the written events as Server-Sent Events named accepted or
+// rejected. The filter parameter selects events with the target syntax of the
+// Grafana endpoints, e.g. app=checkout,status=~5.., sample keeps a share of
+// them and buffer is the number of events held for a slow client before
+// further events are dropped, which is reported in dropped events.
+func (s *server) tail(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var query storage.Query
+	if filter := r.URL.Query().Get("filter"); filter != "" {
+		if err := parseGrafanaTarget(filter, &query); err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+	sampleRate := 1.0
+	if sample := r.URL.Query().Get("sample"); sample != "" {
+		var err error
+		if sampleRate, err = strconv.ParseFloat(sample, 64); err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(fmt.Sprintf("invalid sample %q", sample)))
+			return
+		}
+	}
+	bufferSize := tailDefaultBufferSize
+	if buffer := r.URL.Query().Get("buffer"); buffer != "" {
+		var err error
+		if bufferSize, err = strconv.Atoi(buffer); err != nil || bufferSize > tailMaxBufferSize {
+			w.WriteHeader(400)
+			w.Write([]byte(fmt.Sprintf("invalid buffer %q, the maximum is %d", buffer, tailMaxBufferSize)))
+			return
+		}
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(500)
+		w.Write([]byte("streaming is not supported"))
+		return
+	}
+
+	t, err := (*s.storage).Tail(&query, sampleRate, bufferSize)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	defer t.Close()
+	log.Printf("tailing events %v", query)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	flusher.Flush()
+
+	ticker := time.NewTicker(tailDroppedInterval)
+	defer ticker.Stop()
+	keepAlive := time.NewTicker(sseKeepAliveInterval)
+	defer keepAlive.Stop()
+	dropped := uint64(0)
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-t.Events():
+			name := "accepted"
+			if !event.Accepted {
+				name = "rejected"
+			}
+			err = writeServerSentEvent(w, name, event)
+		case <-ticker.C:
+			if total := t.Dropped(); total > dropped {
+				dropped = total
+				err = writeServerSentEvent(w, "dropped", map[string]uint64{"dropped": dropped})
+			}
+		case <-keepAlive.C:
+			_, err = w.Write([]byte(": keep-alive\n\n"))
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,50 @@
+package api
+
+import (
+	"bufio"
+	"io.klector/klector/storage"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_server_tail(t *testing.T) {
+	s := storage.Create(storage.NewDefaultStorageConfiguration())
+	server := httptest.NewServer(newServer(NewDefaultApiConfiguration(), &s).router)
+	defer server.Close()
+
+	response, err := http.Get(server.URL + "/api/v1/event/tail?filter=" + url.QueryEscape("app=checkout"))
+	if err != nil {
+		t.Fatalf("GET error = %v", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		t.Fatalf("status = %v", response.StatusCode)
+	}
+
+	s.Write(&storage.Events{Events: []storage.Event{
+		{Attributes: map[string]string{"app": "search"}, Timestamp: 1_000},
+		{Attributes: map[string]string{"app": "checkout"}, Timestamp: 1_000},
+		{Attributes: map[string]string{"app": "checkout"}},
+	}})
+
+	var got []string
+	scanner := bufio.NewScanner(response.Body)
+	for len(got) < 4 && scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			got = append(got, line)
+		}
+	}
+	want := []string{
+		"event: accepted",
+		`data: {"event":{"id":"","attributes":{"app":"checkout"},"timestamp":1000},"accepted":true}`,
+		"event: rejected",
+		`data: {"event":{"id":"","attributes":{"app":"checkout"},"timestamp":0},"accepted":false,"error":"timestamp cannot be 0"}`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("events =\n%v\nwant\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
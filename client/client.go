@@ -0,0 +1,498 @@
+// Package client writes events to and queries a klector server over its HTTP
+// API.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io.klector/klector/storage"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrBufferFull is returned by Add when BufferSize events wait to be sent.
+var ErrBufferFull = errors.New("client buffer is full")
+
+// ErrClosed is returned by Add after Close.
+var ErrClosed = errors.New("client is closed")
+
+// ClientConfiguration configures a Client, a BatchSize, BufferSize or
+// FlushInterval which is not positive is replaced by the default.
+type ClientConfiguration struct {
+	Address       string        `json:"address"`       // base url of the server, e.g. http://localhost:4479
+	BatchSize     int           `json:"batchSize"`     // events sent in one request
+	BufferSize    int           `json:"bufferSize"`    // events which may wait to be sent
+	FlushInterval time.Duration `json:"flushInterval"` // maximum time events wait to be sent
+	Retries       int           `json:"retries"`       // of failed requests
+	Backoff       time.Duration `json:"backoff"`       // before the first retry, doubled for every further one
+	Timeout       time.Duration `json:"timeout"`       // of a single request
+	// RetryWrites retries failed writes of events too. A write whose response
+	// was lost is counted twice unless the server was started with
+	// --max-event-ids, which drops the events it already wrote.
+	RetryWrites bool `json:"retryWrites"`
+	// OnError is called with the events of a batch written by Add which were
+	// not written, they are logged if it is nil.
+	OnError func(err error, events []storage.Event) `json:"-"`
+}
+
+func NewDefaultClientConfiguration() *ClientConfiguration {
+	return &ClientConfiguration{
+		Address:       "http://localhost:4479",
+		BatchSize:     1000,
+		BufferSize:    100_000,
+		FlushInterval: time.Second,
+		Retries:       3,
+		Backoff:       100 * time.Millisecond,
+		Timeout:       10 * time.Second,
+	}
+}
+
+// Error is a response of the server with a status other than 2xx.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("klector responded with status %d: %s", e.StatusCode, e.Message)
+}
+
+// RejectedEvent is an event which the server did not write, Index is its
+// position in the written events.
+type RejectedEvent struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+// WriteError is returned by Write if the server rejected some of the events,
+// it wrote the others.
+type WriteError struct {
+	Rejected []RejectedEvent
+}
+
+func (e *WriteError) Error() string {
+	return fmt.Sprintf("klector rejected %d events, event %d: %s", len(e.Rejected), e.Rejected[0].Index, e.Rejected[0].Error)
+}
+
+// retryable returns whether a request which failed with the status may succeed
+// when it is sent again.
+func (e *Error) retryable() bool {
+	switch e.StatusCode {
+	case 429, 502, 503, 504:
+		return true
+	}
+	return false
+}
+
+// Client is safe for concurrent use. Events given to Add are sent in batches
+// in the background, Write, Query, Keys and Values send requests right away.
+// Events without an id get a random one before they are sent the first time,
+// so that with RetryWrites a server started with --max-event-ids drops events
+// of retried requests which it already wrote.
+type Client struct {
+	config  *ClientConfiguration
+	http    *http.Client
+	mu      sync.Mutex
+	buffer  []storage.Event
+	closed  bool
+	full    chan struct{} // signals a full batch
+	flushes chan chan error
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func New(config *ClientConfiguration) *Client {
+	defaults := NewDefaultClientConfiguration()
+	configured := *config
+	if configured.BatchSize <= 0 {
+		configured.BatchSize = defaults.BatchSize
+	}
+	if configured.BufferSize <= 0 {
+		configured.BufferSize = defaults.BufferSize
+	}
+	if configured.FlushInterval <= 0 {
+		configured.FlushInterval = defaults.FlushInterval
+	}
+	c := &Client{
+		config:  &configured,
+		http:    &http.Client{Timeout: configured.Timeout},
+		full:    make(chan struct{}, 1),
+		flushes: make(chan chan error),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+// Add buffers event to be sent with the next batch.
+func (c *Client) Add(event storage.Event) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	if len(c.buffer) >= c.config.BufferSize {
+		return ErrBufferFull
+	}
+	if event.Id == "" {
+		event.Id = newId()
+	}
+	c.buffer = append(c.buffer, event)
+	if len(c.buffer) == c.config.BatchSize {
+		select {
+		case c.full <- struct{}{}:
+		default:
+			// already signaled
+		}
+	}
+	return nil
+}
+
+// Flush sends the buffered events and returns the error of the first failed
+// batch.
+func (c *Client) Flush(ctx context.Context) error {
+	result := make(chan error, 1)
+	select {
+	case c.flushes <- result:
+	case <-c.done:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close sends the buffered events and stops the client, closing it again does
+// nothing.
+func (c *Client) Close(ctx context.Context) error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.mu.Unlock()
+	err := c.Flush(ctx)
+	close(c.stop)
+	<-c.done
+	return err
+}
+
+func (c *Client) run() {
+	defer close(c.done)
+	ticker := time.NewTicker(c.config.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			c.flush()
+		case <-c.full:
+			c.flush()
+		case result := <-c.flushes:
+			result <- c.flush()
+		}
+	}
+}
+
+func (c *Client) flush() error {
+	var first error
+	for {
+		c.mu.Lock()
+		n := len(c.buffer)
+		if n > c.config.BatchSize {
+			n = c.config.BatchSize
+		}
+		batch := c.buffer[:n:n]
+		c.buffer = c.buffer[n:]
+		c.mu.Unlock()
+		if n == 0 {
+			return first
+		}
+
+		if err := c.write(context.Background(), batch); err != nil {
+			if first == nil {
+				first = err
+			}
+			failed := batch
+			var writeError *WriteError
+			if errors.As(err, &writeError) {
+				failed = make([]storage.Event, 0, len(writeError.Rejected))
+				for _, rejected := range writeError.Rejected {
+					failed = append(failed, batch[rejected.Index])
+				}
+			}
+			if c.config.OnError != nil {
+				c.config.OnError(err, failed)
+			} else {
+				log.Printf("klector client dropped %d events: %v", len(failed), err)
+			}
+		}
+	}
+}
+
+// Write sends events right away. If the server rejected some of them, it
+// returns a *WriteError and the others were written.
+func (c *Client) Write(ctx context.Context, events ...storage.Event) error {
+	batch := make([]storage.Event, len(events))
+	for i, event := range events {
+		if event.Id == "" {
+			event.Id = newId()
+		}
+		batch[i] = event
+	}
+	return c.write(ctx, batch)
+}
+
+func (c *Client) write(ctx context.Context, events []storage.Event) error {
+	body, err := json.Marshal(&storage.Events{Events: events})
+	if err != nil {
+		return err
+	}
+	retries := 0
+	if c.config.RetryWrites {
+		retries = c.config.Retries
+	}
+	var result struct {
+		Rejected []RejectedEvent `json:"rejectedEvents"`
+	}
+	if err := c.do(ctx, "POST", "/api/v1/event", body, &result, retries); err != nil {
+		return err
+	}
+	if len(result.Rejected) > 0 {
+		return &WriteError{Rejected: result.Rejected}
+	}
+	return nil
+}
+
+func (c *Client) Query(ctx context.Context, query *storage.Query) (*storage.ResultSet, error) {
+	body, err := json.Marshal(query)
+	if err != nil {
+		return nil, err
+	}
+	var result storage.ResultSet
+	if err := c.do(ctx, "POST", "/api/v1/query", body, &result, c.config.Retries); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Delete removes events from the server, see storage.Deletion.
+func (c *Client) Delete(ctx context.Context, deletion *storage.Deletion) (*storage.DeleteResult, error) {
+	body, err := json.Marshal(deletion)
+	if err != nil {
+		return nil, err
+	}
+	var result storage.DeleteResult
+	if err := c.do(ctx, "POST", "/api/v1/delete", body, &result, c.config.Retries); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (c *Client) Keys(ctx context.Context) ([]string, error) {
+	var keys []string
+	if err := c.do(ctx, "GET", "/api/v1/keys", nil, &keys, c.config.Retries); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Values returns the values of the attribute key.
+func (c *Client) Values(ctx context.Context, key string) ([]string, error) {
+	var values []string
+	if err := c.do(ctx, "GET", "/api/v1/values/"+url.PathEscape(key), nil, &values, c.config.Retries); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// ErrExportIncomplete is returned by Export if the export was cut off.
+var ErrExportIncomplete = errors.New("export is incomplete")
+
+// Export copies the series of the server as NDJSON to w, with the line which
+// ends the export. It returns an error if the server did not end the export
+// or ended it with an error, then w holds part of the series only. It is not
+// retried, as part of the series may be written already.
+func (c *Client) Export(ctx context.Context, w io.Writer) error {
+	response, err := c.request(ctx, "GET", "/api/v1/admin/export", nil, "")
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	reader := bufio.NewReaderSize(response.Body, 64<<10)
+	series := uint64(0)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return ErrExportIncomplete
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(line); err != nil {
+			return err
+		}
+		if !bytes.HasPrefix(line, []byte(`{"end":`)) {
+			series++
+			continue
+		}
+
+		var end struct {
+			End struct {
+				Series uint64 `json:"series"`
+				Error  string `json:"error"`
+			} `json:"end"`
+		}
+		if err := json.Unmarshal(line, &end); err != nil {
+			return err
+		}
+		if end.End.Error != "" {
+			return fmt.Errorf("export failed: %s", end.End.Error)
+		}
+		if end.End.Series != series {
+			return fmt.Errorf("%w, %d of %d series received", ErrExportIncomplete, series, end.End.Series)
+		}
+		return nil
+	}
+}
+
+// Import sends series written by Export and returns the number the server
+// imported. It is not retried, as importing a series twice doubles its counts.
+func (c *Client) Import(ctx context.Context, r io.Reader) (uint64, error) {
+	var result struct {
+		Imported uint64 `json:"imported"`
+	}
+	response, err := c.request(ctx, "POST", "/api/v1/admin/import", r, "application/x-ndjson")
+	if err != nil {
+		var status *Error
+		if errors.As(err, &status) {
+			json.Unmarshal([]byte(status.Message), &result)
+		}
+		return result.Imported, err
+	}
+	defer response.Body.Close()
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return 0, err
+	}
+	return result.Imported, nil
+}
+
+// Backup copies the last snapshot and the write-ahead log of the server to w
+// and returns the seq of its last record.
+func (c *Client) Backup(ctx context.Context, w io.Writer) (uint64, error) {
+	response, err := c.request(ctx, "GET", "/api/v1/admin/backup", nil, "")
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	position, err := strconv.ParseUint(response.Header.Get("X-Wal-Position"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid X-Wal-Position header: %w", err)
+	}
+	if _, err := io.Copy(w, response.Body); err != nil {
+		return 0, err
+	}
+	return position, nil
+}
+
+// Snapshot makes the server write a snapshot which replaces its write-ahead
+// log up to the current record, and returns the seq of the record.
+func (c *Client) Snapshot(ctx context.Context) (uint64, error) {
+	var result struct {
+		Position uint64 `json:"position"`
+	}
+	if err := c.do(ctx, "POST", "/api/v1/admin/snapshot", nil, &result, 0); err != nil {
+		return 0, err
+	}
+	return result.Position, nil
+}
+
+// do sends a request and decodes the response into result if it is not nil,
+// retrying network errors and responses of an overloaded server up to retries
+// times.
+func (c *Client) do(ctx context.Context, method string, path string, body []byte, result interface{}, retries int) error {
+	backoff := c.config.Backoff
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("%w after %d attempts: %s", ctx.Err(), attempt, err.Error())
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+		err = c.send(ctx, method, path, body, result)
+		var status *Error
+		if err == nil || ctx.Err() != nil || errors.As(err, &status) && !status.retryable() {
+			return err
+		}
+	}
+	return err
+}
+
+func (c *Client) send(ctx context.Context, method string, path string, body []byte, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	response, err := c.request(ctx, method, path, reader, "application/json")
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if result == nil || response.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+// request sends a request with body of contentType if body is not nil, the
+// body of the response must be closed if there is no error.
+func (c *Client) request(ctx context.Context, method string, path string, body io.Reader, contentType string) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, method, c.config.Address+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", contentType)
+	}
+	response, err := c.http.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		defer response.Body.Close()
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 4096))
+		return nil, &Error{StatusCode: response.StatusCode, Message: string(message)}
+	}
+	return response, nil
+}
+
+func newId() string {
+	var id [16]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
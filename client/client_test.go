@@ -0,0 +1,217 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io.klector/klector/api"
+	"io.klector/klector/storage"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testServer runs the api handlers with dropping of events written again, the
+// first failures writes are answered with 503 after they were written, as if
+// the response was lost.
+func testServer(failures int) (*httptest.Server, storage.Storage, func() int) {
+	config := storage.NewDefaultStorageConfiguration()
+	config.MaxEventIds = 1_000
+	s := storage.Create(config)
+	handler := api.NewHandler(api.NewDefaultApiConfiguration(), &s)
+	var mu sync.Mutex
+	writes := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/event" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		mu.Lock()
+		writes++
+		fail := writes <= failures
+		mu.Unlock()
+		if fail {
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+			w.WriteHeader(503)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	return server, s, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return writes
+	}
+}
+
+func testConfiguration(address string) *ClientConfiguration {
+	config := NewDefaultClientConfiguration()
+	config.Address = address
+	config.Backoff = time.Millisecond
+	return config
+}
+
+func TestClient_Write(t *testing.T) {
+	tests := []struct {
+		name        string
+		retryWrites bool
+		failures    int
+		events      []storage.Event
+		wantErr     bool
+		wantWrites  int
+		wantValue   uint64
+	}{
+		{"Write", true, 0, []storage.Event{{Attributes: map[string]string{"app": "checkout"}, Timestamp: 1_000}}, false, 1, 1},
+		{"Retried write counted once", true, 2, []storage.Event{{Attributes: map[string]string{"app": "checkout"}, Timestamp: 1_000}}, false, 3, 1},
+		{"Too many failures", true, 5, []storage.Event{{Attributes: map[string]string{"app": "checkout"}, Timestamp: 1_000}}, true, 4, 1},
+		{"Invalid event not retried", true, 0, []storage.Event{{Attributes: map[string]string{"app": "checkout"}}}, true, 1, 0},
+		{"Partial write", true, 0, []storage.Event{{Attributes: map[string]string{"app": "checkout"}}, {Attributes: map[string]string{"app": "checkout"}, Timestamp: 1_000}}, true, 1, 1},
+		{"Write not retried by default", false, 1, []storage.Event{{Attributes: map[string]string{"app": "checkout"}, Timestamp: 1_000}}, true, 1, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, _, writes := testServer(tt.failures)
+			defer server.Close()
+			config := testConfiguration(server.URL)
+			config.RetryWrites = tt.retryWrites
+			c := New(config)
+			defer c.Close(context.Background())
+
+			err := c.Write(context.Background(), tt.events...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Write() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if writes() != tt.wantWrites {
+				t.Errorf("requests = %v, want %v", writes(), tt.wantWrites)
+			}
+			result, err := c.Query(context.Background(), &storage.Query{Attributes: map[string]string{"app": "checkout"}, StartTimestamp: 0, EndTimestamp: 60_000})
+			if err != nil {
+				t.Fatalf("Query() error = %v", err)
+			}
+			if result.Value != tt.wantValue {
+				t.Errorf("value = %v, want %v", result.Value, tt.wantValue)
+			}
+		})
+	}
+}
+
+func TestClient_Add(t *testing.T) {
+	server, s, writes := testServer(0)
+	defer server.Close()
+	config := testConfiguration(server.URL)
+	config.BatchSize = 2
+	config.FlushInterval = time.Hour
+	var failed []storage.Event
+	config.OnError = func(err error, events []storage.Event) {
+		failed = append(failed, events...)
+	}
+	c := New(config)
+
+	c.Add(storage.Event{Attributes: map[string]string{"app": "checkout"}, Timestamp: 1_000})
+	c.Add(storage.Event{Attributes: map[string]string{"app": "checkout"}, Timestamp: 2_000})
+	for deadline := time.Now().Add(5 * time.Second); writes() == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("a full batch was not sent")
+		}
+	}
+	c.Add(storage.Event{Attributes: map[string]string{"app": "checkout"}, Timestamp: 3_000})
+	c.Add(storage.Event{Attributes: map[string]string{"app": "checkout"}})
+	c.Close(context.Background())
+	if err := c.Close(context.Background()); err != nil {
+		t.Errorf("second Close() error = %v", err)
+	}
+	if err := c.Add(storage.Event{Attributes: map[string]string{"app": "checkout"}, Timestamp: 1_000}); !errors.Is(err, ErrClosed) {
+		t.Errorf("Add() after Close() error = %v, want %v", err, ErrClosed)
+	}
+
+	result, err := s.Query(context.Background(), &storage.Query{Attributes: map[string]string{"app": "checkout"}, StartTimestamp: 0, EndTimestamp: 60_000})
+	if err != nil {
+		t.Fatalf("Query() error = %v", err)
+	}
+	if result.Value != 3 || writes() != 2 || len(failed) != 1 || failed[0].Timestamp != 0 {
+		t.Errorf("value = %v, requests = %v, failed = %+v, want 3 events in 2 requests and the invalid event failed", result.Value, writes(), failed)
+	}
+}
+
+func TestClient_Add_bufferFull(t *testing.T) {
+	config := testConfiguration("http://localhost:0")
+	config.BufferSize = 1
+	config.FlushInterval = time.Hour
+	c := New(config)
+	defer c.Close(context.Background())
+
+	if err := c.Add(storage.Event{Attributes: map[string]string{"app": "checkout"}, Timestamp: 1_000}); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	if err := c.Add(storage.Event{Attributes: map[string]string{"app": "checkout"}, Timestamp: 1_000}); !errors.Is(err, ErrBufferFull) {
+		t.Errorf("Add() error = %v, want %v", err, ErrBufferFull)
+	}
+}
+
+func TestClient_New_zeroConfiguration(t *testing.T) {
+	server, s, _ := testServer(0)
+	defer server.Close()
+	c := New(&ClientConfiguration{Address: server.URL})
+
+	if err := c.Add(storage.Event{Attributes: map[string]string{"app": "checkout"}, Timestamp: 1_000}); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	if err := c.Close(context.Background()); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	result, _ := s.Query(context.Background(), &storage.Query{Attributes: map[string]string{"app": "checkout"}, StartTimestamp: 0, EndTimestamp: 60_000})
+	if result.Value != 1 {
+		t.Errorf("value = %v, want the event sent with the default batch size", result.Value)
+	}
+}
+
+func TestClient_Keys(t *testing.T) {
+	server, s, _ := testServer(0)
+	defer server.Close()
+	s.Write(&storage.Events{Events: []storage.Event{{Attributes: map[string]string{"app": "checkout"}, Timestamp: 1_000}}})
+	c := New(testConfiguration(server.URL))
+	defer c.Close(context.Background())
+
+	keys, err := c.Keys(context.Background())
+	if err != nil || !reflect.DeepEqual(keys, []string{"app"}) {
+		t.Errorf("Keys() = %v, %v, want [app]", keys, err)
+	}
+	values, err := c.Values(context.Background(), "app")
+	if err != nil || !reflect.DeepEqual(values, []string{"checkout"}) {
+		t.Errorf("Values() = %v, %v, want [checkout]", values, err)
+	}
+}
+
+func TestClient_Export(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wantErr bool
+	}{
+		{"Complete", `{"attributes":[{"name":"app","value":"a"}],"buckets":[]}` + "\n" + `{"end":{"series":1}}` + "\n", false},
+		{"Cut off", `{"attributes":[{"name":"app","value":"a"}],"buckets":[]}` + "\n", true},
+		{"Cut off in a line", `{"attributes":[{"name":"app","va`, true},
+		{"Failed", `{"end":{"series":0,"error":"query canceled"}}` + "\n", true},
+		{"Series missing", `{"end":{"series":2}}` + "\n", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+			c := New(testConfiguration(server.URL))
+			defer c.Close(context.Background())
+
+			var exported bytes.Buffer
+			if err := c.Export(context.Background(), &exported); (err != nil) != tt.wantErr {
+				t.Errorf("Export() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
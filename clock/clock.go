@@ -0,0 +1,43 @@
+package clock
+
+import (
+	"time"
+)
+
+// Clock provides the current time to relative time expressions. Rounding, as in
+// now/d, happens in the location of the returned time.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now().UTC()
+}
+
+// System returns the clock of the system in UTC.
+func System() Clock {
+	return systemClock{}
+}
+
+type fixedClock struct {
+	now time.Time
+}
+
+func (c fixedClock) Now() time.Time {
+	return c.now
+}
+
+// Fixed returns a clock which is always at now.
+func Fixed(now time.Time) Clock {
+	return fixedClock{now: now}
+}
+
+// Milliseconds returns t as milliseconds since the epoch, 0 for earlier times.
+func Milliseconds(t time.Time) uint64 {
+	if ms := t.UnixNano() / 1_000_000; ms > 0 {
+		return uint64(ms)
+	}
+	return 0
+}
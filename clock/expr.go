@@ -0,0 +1,250 @@
+package clock
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Time expressions are one of
+//
+//	milliseconds since the epoch     1609459200000
+//	ISO-8601 dates and times         2021-01-01, 2021-01-01T12:00:00+01:00
+//	now with offsets and rounding    now, now-24h, now-1d/d, now/w+1h
+//	durations before now             24h, 1h30m, P7D, PT36H
+//
+// Offsets use the units ms, s, m, h, d, w, M (months) and y, or ISO-8601
+// durations such as P1DT12H. /unit rounds to the start of the second, minute,
+// hour, day, week (starting on Monday), month or year.
+
+var isoLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// Parse returns the time of expr. roundUp moves rounded times to the last
+// millisecond of their unit instead of its start, so that now/d as the end of
+// an inclusive range covers the whole day.
+func Parse(expr string, c Clock, roundUp bool) (time.Time, error) {
+	expr = strings.TrimSpace(expr)
+	now := c.Now()
+	switch {
+	case expr == "":
+		return time.Time{}, fmt.Errorf("empty time expression")
+	case strings.HasPrefix(expr, "now"):
+		return parseRelative(expr, now, roundUp)
+	}
+	if ms, err := strconv.ParseUint(expr, 10, 64); err == nil {
+		return time.Unix(int64(ms/1000), int64(ms%1000)*1_000_000).In(now.Location()), nil
+	}
+	for _, layout := range isoLayouts {
+		if t, err := time.ParseInLocation(layout, expr, now.Location()); err == nil {
+			return t, nil
+		}
+	}
+	if t, rest, err := addDuration(now, expr, -1); err == nil && rest == "" {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time expression %q", expr)
+}
+
+// ParseRange returns the inclusive range from start to end in milliseconds since
+// the epoch, an empty end is now.
+func ParseRange(start string, end string, c Clock) (uint64, uint64, error) {
+	if end == "" {
+		end = "now"
+	}
+	from, err := Parse(start, c, false)
+	if err != nil {
+		return 0, 0, err
+	}
+	to, err := Parse(end, c, true)
+	if err != nil {
+		return 0, 0, err
+	}
+	if to.Before(from) {
+		return 0, 0, fmt.Errorf("end %q is before start %q", end, start)
+	}
+	return Milliseconds(from), Milliseconds(to), nil
+}
+
+func parseRelative(expr string, now time.Time, roundUp bool) (time.Time, error) {
+	t := now
+	rest := expr[len("now"):]
+	for rest != "" {
+		var err error
+		switch rest[0] {
+		case '+', '-':
+			sign := 1
+			if rest[0] == '-' {
+				sign = -1
+			}
+			if t, rest, err = addDuration(t, rest[1:], sign); err != nil {
+				return time.Time{}, fmt.Errorf("invalid time expression %q: %s", expr, err.Error())
+			}
+		case '/':
+			if len(rest) < 2 {
+				return time.Time{}, fmt.Errorf("invalid time expression %q: missing rounding unit", expr)
+			}
+			if t, err = round(t, rest[1:2], roundUp); err != nil {
+				return time.Time{}, fmt.Errorf("invalid time expression %q: %s", expr, err.Error())
+			}
+			rest = rest[2:]
+		default:
+			return time.Time{}, fmt.Errorf("invalid time expression %q: unexpected %q", expr, rest)
+		}
+	}
+	return t, nil
+}
+
+// addDuration adds sign times the duration at the start of s to t and returns
+// the rest of s.
+func addDuration(t time.Time, s string, sign int) (time.Time, string, error) {
+	if strings.HasPrefix(s, "P") {
+		return addISODuration(t, s, sign)
+	}
+
+	found := false
+	for s != "" && s[0] >= '0' && s[0] <= '9' {
+		i := 0
+		for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+			i++
+		}
+		value, err := strconv.Atoi(s[:i])
+		if err != nil {
+			return t, s, fmt.Errorf("invalid number %q", s[:i])
+		}
+		value *= sign
+		s = s[i:]
+
+		switch {
+		case strings.HasPrefix(s, "ms"):
+			t = t.Add(time.Duration(value) * time.Millisecond)
+			s = s[2:]
+		case strings.HasPrefix(s, "s"):
+			t = t.Add(time.Duration(value) * time.Second)
+			s = s[1:]
+		case strings.HasPrefix(s, "m"):
+			t = t.Add(time.Duration(value) * time.Minute)
+			s = s[1:]
+		case strings.HasPrefix(s, "h"):
+			t = t.Add(time.Duration(value) * time.Hour)
+			s = s[1:]
+		case strings.HasPrefix(s, "d"):
+			t = t.AddDate(0, 0, value)
+			s = s[1:]
+		case strings.HasPrefix(s, "w"):
+			t = t.AddDate(0, 0, 7*value)
+			s = s[1:]
+		case strings.HasPrefix(s, "M"):
+			t = t.AddDate(0, value, 0)
+			s = s[1:]
+		case strings.HasPrefix(s, "y"):
+			t = t.AddDate(value, 0, 0)
+			s = s[1:]
+		default:
+			return t, s, fmt.Errorf("missing unit after %d", value*sign)
+		}
+		found = true
+	}
+	if !found {
+		return t, s, fmt.Errorf("expected a duration")
+	}
+	return t, s, nil
+}
+
+// addISODuration adds an ISO-8601 duration, e.g. P1Y2M3W4DT5H6M7.5S, and
+// returns the rest of s.
+func addISODuration(t time.Time, s string, sign int) (time.Time, string, error) {
+	s = s[1:]
+	inTime := false
+	found := false
+	for s != "" {
+		if s[0] == 'T' && !inTime {
+			inTime = true
+			s = s[1:]
+			continue
+		}
+		i := 0
+		for i < len(s) && (s[i] >= '0' && s[i] <= '9' || s[i] == '.') {
+			i++
+		}
+		if i == 0 || i == len(s) {
+			break
+		}
+		value, err := strconv.ParseFloat(s[:i], 64)
+		if err != nil {
+			return t, s, fmt.Errorf("invalid number %q", s[:i])
+		}
+		value *= float64(sign)
+		whole := int(value)
+
+		switch unit := s[i]; {
+		case unit == 'Y' && !inTime:
+			t = t.AddDate(whole, 0, 0)
+		case unit == 'M' && !inTime:
+			t = t.AddDate(0, whole, 0)
+		case unit == 'W' && !inTime:
+			t = t.AddDate(0, 0, 7*whole)
+		case unit == 'D' && !inTime:
+			t = t.AddDate(0, 0, whole)
+		case unit == 'H' && inTime:
+			t = t.Add(time.Duration(value * float64(time.Hour)))
+		case unit == 'M' && inTime:
+			t = t.Add(time.Duration(value * float64(time.Minute)))
+		case unit == 'S' && inTime:
+			t = t.Add(time.Duration(value * float64(time.Second)))
+		default:
+			return t, s, fmt.Errorf("invalid ISO-8601 duration unit %q", unit)
+		}
+		if !inTime && float64(whole) != value {
+			return t, s, fmt.Errorf("fractions are only supported for hours, minutes and seconds")
+		}
+		s = s[i+1:]
+		found = true
+	}
+	if !found {
+		return t, s, fmt.Errorf("empty ISO-8601 duration")
+	}
+	return t, s, nil
+}
+
+// round moves t to the start of its unit, or the last millisecond of the unit
+// if up is set.
+func round(t time.Time, unit string, up bool) (time.Time, error) {
+	var start, next time.Time
+	switch unit {
+	case "s":
+		start = t.Truncate(time.Second)
+		next = start.Add(time.Second)
+	case "m":
+		start = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, t.Location())
+		next = start.Add(time.Minute)
+	case "h":
+		start = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+		next = start.Add(time.Hour)
+	case "d":
+		start = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+		next = start.AddDate(0, 0, 1)
+	case "w":
+		daysSinceMonday := (int(t.Weekday()) + 6) % 7
+		start = time.Date(t.Year(), t.Month(), t.Day()-daysSinceMonday, 0, 0, 0, 0, t.Location())
+		next = start.AddDate(0, 0, 7)
+	case "M":
+		start = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+		next = start.AddDate(0, 1, 0)
+	case "y":
+		start = time.Date(t.Year(), 1, 1, 0, 0, 0, 0, t.Location())
+		next = start.AddDate(1, 0, 0)
+	default:
+		return t, fmt.Errorf("invalid rounding unit %q", unit)
+	}
+	if up {
+		return next.Add(-time.Millisecond), nil
+	}
+	return start, nil
+}
@@ -0,0 +1,50 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	// Wednesday
+	c := Fixed(time.Date(2021, 3, 17, 15, 42, 10, 500_000_000, time.UTC))
+
+	tests := []struct {
+		name    string
+		expr    string
+		roundUp bool
+		want    time.Time
+		wantErr bool
+	}{
+		{"Now", "now", false, c.Now(), false},
+		{"Offset", "now-24h", false, time.Date(2021, 3, 16, 15, 42, 10, 500_000_000, time.UTC), false},
+		{"Combined offsets", "now-1h30m+15s", false, time.Date(2021, 3, 17, 14, 12, 25, 500_000_000, time.UTC), false},
+		{"Months", "now-1M", false, time.Date(2021, 2, 17, 15, 42, 10, 500_000_000, time.UTC), false},
+		{"Start of day", "now/d", false, time.Date(2021, 3, 17, 0, 0, 0, 0, time.UTC), false},
+		{"End of day", "now/d", true, time.Date(2021, 3, 17, 23, 59, 59, 999_000_000, time.UTC), false},
+		{"Yesterday", "now-1d/d", false, time.Date(2021, 3, 16, 0, 0, 0, 0, time.UTC), false},
+		{"Start of week", "now/w", false, time.Date(2021, 3, 15, 0, 0, 0, 0, time.UTC), false},
+		{"Start of year", "now/y+1h", false, time.Date(2021, 1, 1, 1, 0, 0, 0, time.UTC), false},
+		{"ISO-8601 duration offset", "now-P1DT1H30M", false, time.Date(2021, 3, 16, 14, 12, 10, 500_000_000, time.UTC), false},
+		{"ISO-8601 duration", "PT36H", false, time.Date(2021, 3, 16, 3, 42, 10, 500_000_000, time.UTC), false},
+		{"Duration", "7d", false, time.Date(2021, 3, 10, 15, 42, 10, 500_000_000, time.UTC), false},
+		{"Milliseconds", "1609459200123", false, time.Date(2021, 1, 1, 0, 0, 0, 123_000_000, time.UTC), false},
+		{"ISO-8601 date", "2021-01-01", false, time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC), false},
+		{"ISO-8601 time", "2021-01-01T12:00:00+01:00", false, time.Date(2021, 1, 1, 11, 0, 0, 0, time.UTC), false},
+		{"Missing unit", "now-5", false, time.Time{}, true},
+		{"Invalid rounding", "now/q", false, time.Time{}, true},
+		{"Garbage", "yesterday", false, time.Time{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.expr, c, tt.roundUp)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("Parse() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package commands
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"io.klector/klector/clock"
+	"io.klector/klector/storage"
+	"math"
+	"os"
+)
+
+var (
+	backupCmd = &cobra.Command{
+		Use:     "backup file",
+		Example: "klector backup klector-2021-03-17.wal",
+		Short:   "Copy the last snapshot and the write-ahead log of a running klector to a file",
+		Long: "Copy the last snapshot and the write-ahead log of a running klector to a file.\n\n" +
+			"The log holds every change since the last snapshot, so a backup grows until klector snapshot " +
+			"is run.",
+		Args: cobra.ExactArgs(1),
+		RunE: backup,
+	}
+	snapshotCmd = &cobra.Command{
+		Use:   "snapshot",
+		Short: "Write a snapshot of a running klector which replaces its write-ahead log",
+		Long: "Write a snapshot of a running klector to its data folder and start an empty write-ahead log, " +
+			"so that starting it and backups do not take longer with every change. Writes wait until the " +
+			"snapshot is written. Restoring a backup to a point in time before its snapshot is not possible.",
+		Args: cobra.NoArgs,
+		RunE: snapshot,
+	}
+	restoreCmd = &cobra.Command{
+		Use:     "restore backup",
+		Example: "klector restore klector-2021-03-17.wal --data-folder ./restored --until 2021-03-16T14:00:00Z",
+		Short:   "Create the snapshot and write-ahead log of a data folder from a backup, up to a point in time",
+		Args:    cobra.ExactArgs(1),
+		RunE:    restore,
+	}
+
+	restoreUntil string
+)
+
+func init() {
+	restoreCmd.Flags().StringVar(&dataFolder, "data-folder", storage.NewDefaultStorageConfiguration().DataFolder, "folder to restore to, it must not have a snapshot or write-ahead log")
+	restoreCmd.Flags().StringVar(&restoreUntil, "until", "", "time expression, records written later are not restored, all if empty")
+}
+
+func backup(cmd *cobra.Command, args []string) error {
+	file, err := os.Create(args[0])
+	if err != nil {
+		return err
+	}
+	c := newAdminClient()
+	defer c.Close(cmd.Context())
+	position, err := c.Backup(cmd.Context(), file)
+	if err != nil {
+		file.Close()
+		os.Remove(args[0])
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.OutOrStdout(), "backup up to record %d written to %s\n", position, args[0])
+	return nil
+}
+
+func snapshot(cmd *cobra.Command, args []string) error {
+	c := newAdminClient()
+	defer c.Close(cmd.Context())
+	position, err := c.Snapshot(cmd.Context())
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.OutOrStdout(), "snapshot up to record %d written\n", position)
+	return nil
+}
+
+func restore(cmd *cobra.Command, args []string) error {
+	until := uint64(math.MaxUint64)
+	if restoreUntil != "" {
+		t, err := clock.Parse(restoreUntil, clock.System(), false)
+		if err != nil {
+			return err
+		}
+		until = clock.Milliseconds(t)
+	}
+	file, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	position, err := storage.Restore(file, dataFolder, until)
+	if err != nil {
+		return fmt.Errorf("%s: %w", args[0], err)
+	}
+	fmt.Fprintf(cmd.OutOrStdout(), "restored up to record %d to %s, start klector run --wal --data-folder %s\n", position, dataFolder, dataFolder)
+	return nil
+}
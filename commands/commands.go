@@ -2,8 +2,11 @@ package commands
 
 import (
 	"github.com/spf13/cobra"
+	"io.klector/klector/alert"
 	"io.klector/klector/api"
+	"io.klector/klector/statsd"
 	"io.klector/klector/storage"
+	"time"
 )
 
 var (
@@ -18,22 +21,136 @@ var (
 		Short:   "Start klector",
 		RunE:    runServer,
 	}
+
+	statsdUdpAddress   string
+	statsdUnixgramPath string
+	otlpAttributes     []string
+	actorAttributes    []string
+	maxActorEvents     int
+	actorRetention     time.Duration
+	maxQueryCost       uint64
+	maxSeries          uint64
+	maxRows            uint64
+	maxEventIds        uint64
+	wal                bool
+	walSync            bool
+	maxLateness        time.Duration
+	maxFutureSkew      time.Duration
+	outOfWindowPolicy  string
+	maxQuarantine      int
+	queryTimeout       time.Duration
+	streamInterval     time.Duration
+	grpcAddress        string
+	dataFolder         string
+	alertTick          time.Duration
+	webhookRetries     int
 )
 
+func init() {
+	runCmd.Flags().StringVar(&statsdUdpAddress, "statsd-udp", "", "address of the StatsD UDP listener, e.g. :8125, disabled if empty")
+	runCmd.Flags().StringVar(&statsdUnixgramPath, "statsd-unixgram", "", "path of the StatsD unix datagram socket, disabled if empty")
+	runCmd.Flags().Uint64Var(&maxQueryCost, "max-query-cost", storage.NewDefaultStorageConfiguration().MaxQueryCost, "estimated number of buckets a query may read, unlimited if 0")
+	runCmd.Flags().Uint64Var(&maxSeries, "max-series", storage.NewDefaultStorageConfiguration().MaxSeries, "series a query may match, unlimited if 0")
+	runCmd.Flags().Uint64Var(&maxRows, "max-rows", storage.NewDefaultStorageConfiguration().MaxRows, "groups times buckets a query may return, unlimited if 0")
+	runCmd.Flags().StringSliceVar(&actorAttributes, "actor-attributes", nil, "attributes identifying actors, e.g. user_id, whose events are kept for funnels and retention")
+	runCmd.Flags().IntVar(&maxActorEvents, "max-actor-events", storage.NewDefaultStorageConfiguration().MaxActorEvents, "events kept per actor for funnels, the oldest are dropped, unlimited if 0")
+	runCmd.Flags().DurationVar(&actorRetention, "actor-retention", storage.NewDefaultStorageConfiguration().ActorRetention, "how long the events and activity of actors are kept for funnels and retention, unlimited if 0")
+	runCmd.Flags().Uint64Var(&maxEventIds, "max-event-ids", storage.NewDefaultStorageConfiguration().MaxEventIds, "ids of written events remembered to drop events written again, disabled if 0")
+	runCmd.Flags().BoolVar(&wal, "wal", storage.NewDefaultStorageConfiguration().Wal, "log writes to a write-ahead log in the data folder and replay it on start")
+	runCmd.Flags().BoolVar(&walSync, "wal-sync", storage.NewDefaultStorageConfiguration().WalSync, "sync the write-ahead log to disk before writes return")
+	runCmd.Flags().DurationVar(&maxLateness, "max-lateness", storage.NewDefaultStorageConfiguration().MaxLateness, "how far before the time of writing an event's timestamp may be, unlimited if 0")
+	runCmd.Flags().DurationVar(&maxFutureSkew, "max-future-skew", storage.NewDefaultStorageConfiguration().MaxFutureSkew, "how far after the time of writing an event's timestamp may be, unlimited if 0")
+	runCmd.Flags().StringVar(&outOfWindowPolicy, "out-of-window", storage.NewDefaultStorageConfiguration().OutOfWindowPolicy, "reject, clamp or quarantine events outside of the max lateness and future skew")
+	runCmd.Flags().IntVar(&maxQuarantine, "max-quarantine", storage.NewDefaultStorageConfiguration().MaxQuarantine, "quarantined events kept in memory, the oldest are dropped")
+	runCmd.Flags().DurationVar(&queryTimeout, "query-timeout", api.NewDefaultApiConfiguration().QueryTimeout, "maximum duration of a query, unlimited if 0")
+	runCmd.Flags().StringVar(&grpcAddress, "grpc-address", api.NewDefaultApiConfiguration().GrpcAddress, "address of the gRPC API, such as :4480, disabled if empty")
+	runCmd.Flags().DurationVar(&streamInterval, "stream-interval", api.NewDefaultApiConfiguration().StreamInterval, "minimum time between results of query subscriptions, 0 sends a result after every write")
+	runCmd.Flags().StringVar(&dataFolder, "data-folder", storage.NewDefaultStorageConfiguration().DataFolder, "folder of the persisted data such as alert rules and the write-ahead log")
+	runCmd.Flags().DurationVar(&alertTick, "alert-tick", alert.NewDefaultAlertConfiguration().Tick, "time between checks for due alert rules, alerting is disabled if 0")
+	runCmd.Flags().IntVar(&webhookRetries, "webhook-retries", alert.NewDefaultAlertConfiguration().WebhookRetries, "retries of failed alert notifications")
+	runCmd.Flags().StringSliceVar(&otlpAttributes, "otlp-attributes", nil, "OTLP resource and record attributes stored as event attributes, all if empty")
+}
+
 func runServer(cmd *cobra.Command, args []string) error {
 	config := updateStorageConfigFromCommandLine(
 		storage.NewDefaultStorageConfiguration(),
 	)
-	storage := storage.Create(config)
-	return api.Create(&storage)
+	storage, err := storage.Open(config)
+	if err != nil {
+		return err
+	}
+
+	statsdConfig := updateStatsdConfigFromCommandLine(
+		statsd.NewDefaultStatsdConfiguration(),
+	)
+	if statsdConfig.Enabled() {
+		listener, err := statsd.Create(statsdConfig, &storage)
+		if err != nil {
+			return err
+		}
+		defer listener.Stop()
+	}
+
+	var alerts alert.Manager
+	alertConfig := updateAlertConfigFromCommandLine(
+		alert.NewDefaultAlertConfiguration(),
+	)
+	if alertConfig.Tick > 0 {
+		var err error
+		if alerts, err = alert.Create(alertConfig, &storage); err != nil {
+			return err
+		}
+		defer alerts.Stop()
+	}
+
+	apiConfig := updateApiConfigFromCommandLine(
+		api.NewDefaultApiConfiguration(),
+	)
+	return api.Create(apiConfig, &storage, alerts)
 }
 
 func updateStorageConfigFromCommandLine(config *storage.StorageConfiguration) *storage.StorageConfiguration {
+	config.DataFolder = dataFolder
+	config.MaxQueryCost = maxQueryCost
+	config.MaxSeries = maxSeries
+	config.MaxRows = maxRows
+	config.MaxEventIds = maxEventIds
+	config.Wal = wal
+	config.WalSync = walSync
+	config.MaxLateness = maxLateness
+	config.MaxFutureSkew = maxFutureSkew
+	config.OutOfWindowPolicy = outOfWindowPolicy
+	config.MaxQuarantine = maxQuarantine
+	config.ActorAttributes = actorAttributes
+	config.MaxActorEvents = maxActorEvents
+	config.ActorRetention = actorRetention
+	return config
+}
+
+func updateApiConfigFromCommandLine(config *api.ApiConfiguration) *api.ApiConfiguration {
+	config.OtlpAttributes = otlpAttributes
+	config.QueryTimeout = queryTimeout
+	config.StreamInterval = streamInterval
+	config.GrpcAddress = grpcAddress
+	return config
+}
+
+func updateAlertConfigFromCommandLine(config *alert.AlertConfiguration) *alert.AlertConfiguration {
+	config.DataFolder = dataFolder
+	config.Tick = alertTick
+	config.QueryTimeout = queryTimeout
+	config.WebhookRetries = webhookRetries
+	return config
+}
+
+func updateStatsdConfigFromCommandLine(config *statsd.StatsdConfiguration) *statsd.StatsdConfiguration {
+	config.UdpAddress = statsdUdpAddress
+	config.UnixgramPath = statsdUnixgramPath
 	return config
 }
 
 func Execute() int {
-	rootCmd.AddCommand(runCmd)
+	rootCmd.AddCommand(runCmd, ingestCmd, queryCmd, keysCmd, valuesCmd, exportCmd, importCmd, backupCmd, snapshotCmd, restoreCmd, deleteCmd)
 
 	if err := rootCmd.Execute(); err != nil {
 		return 1
@@ -0,0 +1,53 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/spf13/cobra"
+	"io.klector/klector/client"
+	"io.klector/klector/clock"
+	"io.klector/klector/storage"
+)
+
+var (
+	deleteCmd = &cobra.Command{
+		Use:     "delete",
+		Example: "klector delete --attributes app=checkout --start 2021-03-16 --end 2021-03-16T23:59:59Z",
+		Short:   "Delete events of a running klector by attributes and time range",
+		Args:    cobra.NoArgs,
+		RunE:    deleteEvents,
+	}
+
+	deleteAttributes map[string]string
+	deleteStart      string
+	deleteEnd        string
+)
+
+func init() {
+	deleteCmd.Flags().StringToStringVar(&deleteAttributes, "attributes", nil, "attribute values of the events, e.g. app=checkout")
+	deleteCmd.Flags().StringVar(&deleteStart, "start", "", "start of the range, a time expression such as now-1d/d or 2021-03-01")
+	deleteCmd.Flags().StringVar(&deleteEnd, "end", "", "end of the range, a time expression")
+}
+
+func deleteEvents(cmd *cobra.Command, args []string) error {
+	if len(deleteAttributes) == 0 || deleteStart == "" || deleteEnd == "" {
+		return errors.New("--attributes, --start and --end are required")
+	}
+	start, end, err := clock.ParseRange(deleteStart, deleteEnd, clock.System())
+	if err != nil {
+		return err
+	}
+	c := client.New(newClientConfiguration())
+	defer c.Close(context.Background())
+	result, err := c.Delete(cmd.Context(), &storage.Deletion{
+		Attributes:     deleteAttributes,
+		StartTimestamp: start,
+		EndTimestamp:   end,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.OutOrStdout(), "%d events deleted, %d series changed\n", result.Deleted, result.Series)
+	return nil
+}
@@ -0,0 +1,85 @@
+package commands
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"io"
+	"io.klector/klector/client"
+	"os"
+)
+
+var (
+	exportCmd = &cobra.Command{
+		Use:     "export [file]",
+		Example: "klector export backup.ndjson\nklector export --address http://staging:4479 | klector import",
+		Short:   "Write the series of a running klector as NDJSON to a file or stdout",
+		Args:    cobra.MaximumNArgs(1),
+		RunE:    export,
+	}
+	importCmd = &cobra.Command{
+		Use:     "import [files]",
+		Example: "klector import backup.ndjson",
+		Short:   "Add series written by export from files or stdin to a running klector",
+		RunE:    importSeries,
+	}
+)
+
+// newAdminClient returns a client without request timeout, exports and
+// imports take as long as the database is large.
+func newAdminClient() *client.Client {
+	config := newClientConfiguration()
+	config.Timeout = 0
+	return client.New(config)
+}
+
+func export(cmd *cobra.Command, args []string) error {
+	c := newAdminClient()
+	defer c.Close(cmd.Context())
+	if len(args) == 0 {
+		return c.Export(cmd.Context(), cmd.OutOrStdout())
+	}
+
+	file, err := os.Create(args[0])
+	if err != nil {
+		return err
+	}
+	if err := c.Export(cmd.Context(), file); err != nil {
+		// an incomplete export is not kept as a backup
+		file.Close()
+		os.Remove(args[0])
+		return fmt.Errorf("%s: %w", args[0], err)
+	}
+	return file.Close()
+}
+
+func importSeries(cmd *cobra.Command, args []string) error {
+	c := newAdminClient()
+	defer c.Close(cmd.Context())
+	imported := uint64(0)
+	importFrom := func(name string, r io.Reader) error {
+		n, err := c.Import(cmd.Context(), r)
+		imported += n
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		return nil
+	}
+
+	var err error
+	if len(args) == 0 {
+		err = importFrom("stdin", cmd.InOrStdin())
+	}
+	for _, path := range args {
+		if err != nil {
+			break
+		}
+		var file *os.File
+		if file, err = os.Open(path); err != nil {
+			break
+		}
+		err = importFrom(path, file)
+		file.Close()
+	}
+	fmt.Fprintf(cmd.OutOrStdout(), "%d series imported\n", imported)
+	return err
+}
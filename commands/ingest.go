@@ -0,0 +1,211 @@
+package commands
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/spf13/cobra"
+	"io"
+	"io.klector/klector/client"
+	"io.klector/klector/clock"
+	"io.klector/klector/storage"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	ingestCmd = &cobra.Command{
+		Use:     "ingest [files]",
+		Example: "klector ingest events.ndjson\ncat events.csv | klector ingest --format csv --measures bytes",
+		Short:   "Write events from JSON, NDJSON or CSV files or stdin to a running klector",
+		RunE:    ingest,
+	}
+
+	ingestFormat      string
+	ingestMeasures    []string
+	ingestRetryWrites bool
+)
+
+func init() {
+	ingestCmd.Flags().StringVar(&ingestFormat, "format", "", "json, ndjson or csv, by default the file extension or ndjson for stdin")
+	ingestCmd.Flags().StringSliceVar(&ingestMeasures, "measures", nil, "CSV columns which are measures, the columns other than id, timestamp and count are attributes")
+	ingestCmd.Flags().BoolVar(&ingestRetryWrites, "retry-writes", false, "retry failed writes, events may be counted twice unless klector runs with --max-event-ids")
+}
+
+func ingest(cmd *cobra.Command, args []string) error {
+	config := newClientConfiguration()
+	config.RetryWrites = ingestRetryWrites
+	var mu sync.Mutex
+	failed := 0
+	config.OnError = func(err error, events []storage.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		failed += len(events)
+		fmt.Fprintf(cmd.ErrOrStderr(), "%d events failed: %v\n", len(events), err)
+	}
+	c := client.New(config)
+
+	read := 0
+	add := func(event storage.Event) error {
+		read++
+		err := c.Add(event)
+		if errors.Is(err, client.ErrBufferFull) {
+			// reading is faster than writing
+			c.Flush(cmd.Context())
+			err = c.Add(event)
+		}
+		return err
+	}
+	if len(args) == 0 {
+		format := ingestFormat
+		if format == "" {
+			format = "ndjson"
+		}
+		if err := readEvents(cmd.InOrStdin(), format, ingestMeasures, add); err != nil {
+			c.Close(context.Background())
+			return fmt.Errorf("stdin: %w", err)
+		}
+	}
+	for _, path := range args {
+		if err := ingestFile(path, add); err != nil {
+			c.Close(context.Background())
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	c.Close(context.Background())
+
+	fmt.Fprintf(cmd.OutOrStdout(), "%d events written, %d failed\n", read-failed, failed)
+	if failed > 0 {
+		return errors.New("not all events were written")
+	}
+	return nil
+}
+
+func ingestFile(path string, add func(storage.Event) error) error {
+	format := ingestFormat
+	if format == "" {
+		format = strings.TrimPrefix(filepath.Ext(path), ".")
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return readEvents(file, format, ingestMeasures, add)
+}
+
+// readEvents calls add for every event of r. JSON is a request body of the
+// event endpoint or an array of events, NDJSON has an event per line and CSV a
+// header line naming the columns.
+func readEvents(r io.Reader, format string, measures []string, add func(storage.Event) error) error {
+	switch format {
+	case "json":
+		var body json.RawMessage
+		if err := json.NewDecoder(r).Decode(&body); err != nil {
+			return err
+		}
+		var events storage.Events
+		if strings.HasPrefix(strings.TrimSpace(string(body)), "[") {
+			if err := json.Unmarshal(body, &events.Events); err != nil {
+				return err
+			}
+		} else if err := json.Unmarshal(body, &events); err != nil {
+			return err
+		}
+		for _, event := range events.Events {
+			if err := add(event); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "ndjson":
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64<<10), 1<<20)
+		for line := 1; scanner.Scan(); line++ {
+			if strings.TrimSpace(scanner.Text()) == "" {
+				continue
+			}
+			var event storage.Event
+			if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+				return fmt.Errorf("line %d: %w", line, err)
+			}
+			if err := add(event); err != nil {
+				return err
+			}
+		}
+		return scanner.Err()
+	case "csv":
+		return readCsvEvents(r, measures, add)
+	}
+	return fmt.Errorf("unsupported format %q, use json, ndjson or csv", format)
+}
+
+func readCsvEvents(r io.Reader, measures []string, add func(storage.Event) error) error {
+	isMeasure := make(map[string]bool, len(measures))
+	for _, name := range measures {
+		isMeasure[name] = true
+	}
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("header: %w", err)
+	}
+	hasTimestamp := false
+	for _, name := range header {
+		hasTimestamp = hasTimestamp || name == "timestamp"
+	}
+	if !hasTimestamp {
+		return errors.New("header: missing the timestamp column")
+	}
+
+	c := clock.System()
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		event := storage.Event{Attributes: map[string]string{}}
+		for i, value := range record {
+			if value == "" {
+				continue
+			}
+			switch name := header[i]; {
+			case name == "id":
+				event.Id = value
+			case name == "timestamp":
+				t, err := clock.Parse(value, c, false)
+				if err != nil {
+					return fmt.Errorf("line %d: %w", line, err)
+				}
+				event.Timestamp = clock.Milliseconds(t)
+			case name == "count":
+				if event.Count, err = strconv.ParseUint(value, 10, 64); err != nil {
+					return fmt.Errorf("line %d: invalid count %q", line, value)
+				}
+			case isMeasure[name]:
+				measure, err := strconv.ParseFloat(value, 64)
+				if err != nil {
+					return fmt.Errorf("line %d: invalid measure %s %q", line, name, value)
+				}
+				if event.Measures == nil {
+					event.Measures = map[string]float64{}
+				}
+				event.Measures[name] = measure
+			default:
+				event.Attributes[name] = value
+			}
+		}
+		if err := add(event); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package commands
+
+import (
+	"io.klector/klector/storage"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_readEvents(t *testing.T) {
+	want := []storage.Event{
+		{Id: "1", Attributes: map[string]string{"app": "checkout"}, Measures: map[string]float64{"bytes": 10}, Timestamp: 1_000},
+		{Attributes: map[string]string{"app": "search", "country": "de"}, Count: 2, Timestamp: 1_609_459_200_000},
+	}
+
+	tests := []struct {
+		name    string
+		format  string
+		input   string
+		want    []storage.Event
+		wantErr bool
+	}{
+		{"JSON body", "json", `{"events":[{"id":"1","attributes":{"app":"checkout"},"measures":{"bytes":10},"timestamp":1000},{"attributes":{"app":"search","country":"de"},"count":2,"timestamp":1609459200000}]}`, want, false},
+		{"JSON array", "json", `[{"id":"1","attributes":{"app":"checkout"},"measures":{"bytes":10},"timestamp":1000},{"attributes":{"app":"search","country":"de"},"count":2,"timestamp":1609459200000}]`, want, false},
+		{"NDJSON", "ndjson", "{\"id\":\"1\",\"attributes\":{\"app\":\"checkout\"},\"measures\":{\"bytes\":10},\"timestamp\":1000}\n\n{\"attributes\":{\"app\":\"search\",\"country\":\"de\"},\"count\":2,\"timestamp\":1609459200000}\n", want, false},
+		{"CSV", "csv", "id,timestamp,app,country,bytes,count\n1,1000,checkout,,10,\n,2021-01-01T00:00:00Z,search,de,,2\n", want, false},
+		{"CSV without timestamp", "csv", "app\ncheckout\n", nil, true},
+		{"Invalid NDJSON line", "ndjson", "{}\n{\n", []storage.Event{{}}, true},
+		{"Unknown format", "xml", "", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []storage.Event
+			err := readEvents(strings.NewReader(tt.input), tt.format, []string{"bytes"}, func(event storage.Event) error {
+				got = append(got, event)
+				return nil
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readEvents() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readEvents() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
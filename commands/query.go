@@ -0,0 +1,183 @@
+package commands
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/cobra"
+	"io"
+	"io.klector/klector/client"
+	"io.klector/klector/clock"
+	"io.klector/klector/storage"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var (
+	queryCmd = &cobra.Command{
+		Use:     "query",
+		Example: "klector query --attributes app=checkout --group-by country --start now-1d/d --step 1h",
+		Short:   "Query a running klector",
+		Args:    cobra.NoArgs,
+		RunE:    query,
+	}
+	keysCmd = &cobra.Command{
+		Use:   "keys",
+		Short: "List the attribute names of a running klector",
+		Args:  cobra.NoArgs,
+		RunE:  keys,
+	}
+	valuesCmd = &cobra.Command{
+		Use:     "values key",
+		Example: "klector values country",
+		Short:   "List the values of an attribute of a running klector",
+		Args:    cobra.ExactArgs(1),
+		RunE:    values,
+	}
+
+	serverAddress   string
+	queryAttributes map[string]string
+	queryGroupBy    []string
+	queryMeasures   []string
+	queryStart      string
+	queryEnd        string
+	queryStep       time.Duration
+	queryOutput     string
+)
+
+func init() {
+	for _, cmd := range []*cobra.Command{ingestCmd, queryCmd, keysCmd, valuesCmd, exportCmd, importCmd, backupCmd, snapshotCmd, deleteCmd} {
+		cmd.Flags().StringVar(&serverAddress, "address", client.NewDefaultClientConfiguration().Address, "url of the klector server")
+	}
+	queryCmd.Flags().StringToStringVar(&queryAttributes, "attributes", nil, "attribute values of the events, e.g. app=checkout,country=de")
+	queryCmd.Flags().StringSliceVar(&queryGroupBy, "group-by", nil, "attributes to group by")
+	queryCmd.Flags().StringSliceVar(&queryMeasures, "measures", nil, "measures to sum")
+	queryCmd.Flags().StringVar(&queryStart, "start", "now-1h", "start of the range, a time expression such as now-1d/d or 2021-03-01")
+	queryCmd.Flags().StringVar(&queryEnd, "end", "now", "end of the range, a time expression")
+	queryCmd.Flags().DurationVar(&queryStep, "step", 0, "length of the time buckets, e.g. 1h, no buckets if 0")
+	queryCmd.Flags().StringVarP(&queryOutput, "output", "o", "table", "table, json or csv")
+}
+
+func newClientConfiguration() *client.ClientConfiguration {
+	config := client.NewDefaultClientConfiguration()
+	config.Address = strings.TrimSuffix(serverAddress, "/")
+	return config
+}
+
+func query(cmd *cobra.Command, args []string) error {
+	start, end, err := clock.ParseRange(queryStart, queryEnd, clock.System())
+	if err != nil {
+		return err
+	}
+	q := &storage.Query{
+		Attributes:     queryAttributes,
+		GroupBy:        queryGroupBy,
+		Measures:       queryMeasures,
+		StartTimestamp: start,
+		EndTimestamp:   end,
+		Step:           uint64(queryStep / time.Millisecond),
+	}
+	c := client.New(newClientConfiguration())
+	defer c.Close(context.Background())
+	result, err := c.Query(cmd.Context(), q)
+	if err != nil {
+		return err
+	}
+	return writeResult(cmd.OutOrStdout(), queryOutput, q, result)
+}
+
+// writeResult writes the result as JSON or as rows with the group attributes,
+// the bucket time if the query has a step, the count and the measures.
+func writeResult(w io.Writer, output string, q *storage.Query, result *storage.ResultSet) error {
+	if output == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(result)
+	}
+
+	header := append([]string(nil), q.GroupBy...)
+	if q.Step > 0 {
+		header = append(header, "time")
+	}
+	header = append(header, "count")
+	measures := append([]string(nil), q.Measures...)
+	sort.Strings(measures)
+	header = append(header, measures...)
+
+	groups := result.Groups
+	if len(q.GroupBy) == 0 {
+		groups = []storage.Group{{Value: result.Value, Measures: result.Measures, Buckets: result.Buckets}}
+	}
+	var rows [][]string
+	row := func(group *storage.Group, bucket *storage.Bucket) {
+		var cells []string
+		for _, name := range q.GroupBy {
+			cells = append(cells, group.Attributes[name])
+		}
+		value, values := group.Value, group.Measures
+		if bucket != nil {
+			cells = append(cells, time.Unix(0, int64(bucket.Timestamp)*int64(time.Millisecond)).UTC().Format(time.RFC3339))
+			value, values = bucket.Value, bucket.Measures
+		}
+		cells = append(cells, strconv.FormatUint(value, 10))
+		for _, name := range measures {
+			cells = append(cells, strconv.FormatFloat(values[name], 'g', -1, 64))
+		}
+		rows = append(rows, cells)
+	}
+	for i := range groups {
+		if q.Step == 0 {
+			row(&groups[i], nil)
+			continue
+		}
+		for j := range groups[i].Buckets {
+			row(&groups[i], &groups[i].Buckets[j])
+		}
+	}
+
+	switch output {
+	case "csv":
+		writer := csv.NewWriter(w)
+		writer.Write(header)
+		writer.WriteAll(rows)
+		return writer.Error()
+	case "table":
+		writer := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(writer, strings.ToUpper(strings.Join(header, "\t")))
+		for _, cells := range rows {
+			fmt.Fprintln(writer, strings.Join(cells, "\t"))
+		}
+		return writer.Flush()
+	}
+	return fmt.Errorf("unsupported output %q, use table, json or csv", output)
+}
+
+func keys(cmd *cobra.Command, args []string) error {
+	c := client.New(newClientConfiguration())
+	defer c.Close(context.Background())
+	keys, err := c.Keys(cmd.Context())
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		fmt.Fprintln(cmd.OutOrStdout(), key)
+	}
+	return nil
+}
+
+func values(cmd *cobra.Command, args []string) error {
+	c := client.New(newClientConfiguration())
+	defer c.Close(context.Background())
+	values, err := c.Values(cmd.Context(), args[0])
+	if err != nil {
+		return err
+	}
+	for _, value := range values {
+		fmt.Fprintln(cmd.OutOrStdout(), value)
+	}
+	return nil
+}
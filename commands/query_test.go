@@ -0,0 +1,48 @@
+package commands
+
+import (
+	"bytes"
+	"io.klector/klector/storage"
+	"testing"
+)
+
+func Test_writeResult(t *testing.T) {
+	result := &storage.ResultSet{
+		Value:    3,
+		Measures: map[string]float64{"bytes": 30},
+		Groups: []storage.Group{
+			{Attributes: map[string]string{"country": "de"}, Value: 2, Measures: map[string]float64{"bytes": 25.5}, Buckets: []storage.Bucket{
+				{Timestamp: 0, Value: 2, Measures: map[string]float64{"bytes": 25.5}},
+				{Timestamp: 3_600_000, Value: 0, Measures: map[string]float64{"bytes": 0}},
+			}},
+			{Attributes: map[string]string{"country": "fr"}, Value: 1, Measures: map[string]float64{"bytes": 4.5}, Buckets: []storage.Bucket{
+				{Timestamp: 0, Value: 0, Measures: map[string]float64{"bytes": 0}},
+				{Timestamp: 3_600_000, Value: 1, Measures: map[string]float64{"bytes": 4.5}},
+			}},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		output string
+		query  storage.Query
+		want   string
+	}{
+		{"Table", "table", storage.Query{GroupBy: []string{"country"}, Measures: []string{"bytes"}}, "COUNTRY  COUNT  BYTES\nde       2      25.5\nfr       1      4.5\n"},
+		{"CSV with buckets", "csv", storage.Query{GroupBy: []string{"country"}, Measures: []string{"bytes"}, Step: 3_600_000}, "country,time,count,bytes\n" +
+			"de,1970-01-01T00:00:00Z,2,25.5\nde,1970-01-01T01:00:00Z,0,0\nfr,1970-01-01T00:00:00Z,0,0\nfr,1970-01-01T01:00:00Z,1,4.5\n"},
+		{"Total", "csv", storage.Query{}, "count\n3\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var w bytes.Buffer
+			if err := writeResult(&w, tt.output, &tt.query, result); err != nil {
+				t.Fatalf("writeResult() error = %v", err)
+			}
+			if w.String() != tt.want {
+				t.Errorf("writeResult() =\n%s\nwant\n%s", w.String(), tt.want)
+			}
+		})
+	}
+}
@@ -1,6 +1,6 @@
 module io.klector/klector
 
-go 1.16
+go 1.24
 
 require (
 	github.com/go-kit/log v0.2.0
@@ -8,3 +8,9 @@ require (
 	github.com/spf13/cobra v1.2.1
 	github.com/spf13/viper v1.9.0 // indirect
 )
+
+require (
+	github.com/go-logfmt/logfmt v0.5.1 // indirect
+	github.com/inconshreveable/mousetrap v1.0.0 // indirect
+	github.com/spf13/pflag v1.0.5 // indirect
+)
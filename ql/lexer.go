@@ -0,0 +1,192 @@
+package ql
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	tokEOF = iota
+	tokIdent
+	tokKeyword
+	tokString
+	tokNumber
+	tokDuration
+	tokPunct
+)
+
+var keywords = map[string]bool{
+	"SELECT": true, "FROM": true, "WHERE": true, "AND": true, "OR": true, "NOT": true,
+	"IN": true, "LIKE": true, "BETWEEN": true, "GROUP": true, "ORDER": true, "BY": true,
+	"ASC": true, "DESC": true, "LIMIT": true, "AS": true,
+}
+
+type token struct {
+	kind int
+	text string // keywords are upper case, strings and quoted identifiers unquoted
+	pos  int
+}
+
+// Error is a syntax or planning error at a position of the query text.
+type Error struct {
+	Line    int
+	Column  int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Message)
+}
+
+func newError(input string, pos int, format string, args ...interface{}) *Error {
+	line, column := 1, 1
+	for _, c := range input[:pos] {
+		if c == '\n' {
+			line++
+			column = 1
+		} else {
+			column++
+		}
+	}
+	return &Error{Line: line, Column: column, Message: fmt.Sprintf(format, args...)}
+}
+
+type lexer struct {
+	input string
+	pos   int
+}
+
+// next returns the next token of the input.
+func (l *lexer) next() (token, error) {
+	for l.pos < len(l.input) {
+		if strings.IndexByte(" \t\r\n", l.input[l.pos]) >= 0 {
+			l.pos++
+		} else if strings.HasPrefix(l.input[l.pos:], "--") {
+			for l.pos < len(l.input) && l.input[l.pos] != '\n' {
+				l.pos++
+			}
+		} else {
+			break
+		}
+	}
+	start := l.pos
+	if l.pos >= len(l.input) {
+		return token{kind: tokEOF, pos: start}, nil
+	}
+
+	c := l.input[l.pos]
+	switch {
+	case isIdentStart(c):
+		for l.pos < len(l.input) && isIdentChar(l.input[l.pos]) {
+			l.pos++
+		}
+		text := l.input[start:l.pos]
+		if keywords[strings.ToUpper(text)] {
+			return token{kind: tokKeyword, text: strings.ToUpper(text), pos: start}, nil
+		}
+		return token{kind: tokIdent, text: text, pos: start}, nil
+	case c >= '0' && c <= '9':
+		for l.pos < len(l.input) && (l.input[l.pos] >= '0' && l.input[l.pos] <= '9' || l.input[l.pos] == '.') {
+			l.pos++
+		}
+		if l.pos < len(l.input) && isIdentStart(l.input[l.pos]) {
+			for l.pos < len(l.input) && isIdentChar(l.input[l.pos]) {
+				l.pos++
+			}
+			return token{kind: tokDuration, text: l.input[start:l.pos], pos: start}, nil
+		}
+		return token{kind: tokNumber, text: l.input[start:l.pos], pos: start}, nil
+	case c == '\'' || c == '"' || c == '`':
+		// '' inside a quoted text stands for a single quote
+		var text strings.Builder
+		l.pos++
+		for {
+			if l.pos >= len(l.input) {
+				return token{}, newError(l.input, start, "unterminated %s", map[byte]string{'\'': "string", '"': "identifier", '`': "identifier"}[c])
+			}
+			if l.input[l.pos] == c {
+				if l.pos+1 < len(l.input) && l.input[l.pos+1] == c {
+					text.WriteByte(c)
+					l.pos += 2
+					continue
+				}
+				l.pos++
+				break
+			}
+			text.WriteByte(l.input[l.pos])
+			l.pos++
+		}
+		if c == '\'' {
+			return token{kind: tokString, text: text.String(), pos: start}, nil
+		}
+		return token{kind: tokIdent, text: text.String(), pos: start}, nil
+	}
+
+	for _, punct := range []string{"!=", "<>", "=~", "!~", "<=", ">="} {
+		if strings.HasPrefix(l.input[l.pos:], punct) {
+			l.pos += 2
+			return token{kind: tokPunct, text: punct, pos: start}, nil
+		}
+	}
+	if strings.IndexByte("(),*=<>+-;", c) >= 0 {
+		l.pos++
+		return token{kind: tokPunct, text: string(c), pos: start}, nil
+	}
+	return token{}, newError(l.input, start, "unexpected character %q", c)
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c|0x20 >= 'a' && c|0x20 <= 'z')
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || c == '.' || (c >= '0' && c <= '9')
+}
+
+// parseDuration parses durations like 90s, 7d or 1h30m into milliseconds.
+func parseDuration(s string) (uint64, error) {
+	units := []struct {
+		suffix string
+		ms     uint64
+	}{
+		{"ms", 1},
+		{"s", 1_000},
+		{"m", 60_000},
+		{"h", 3_600_000},
+		{"d", 86_400_000},
+		{"w", 7 * 86_400_000},
+	}
+
+	var total uint64
+	rest := s
+	for rest != "" {
+		i := 0
+		for i < len(rest) && rest[i] >= '0' && rest[i] <= '9' {
+			i++
+		}
+		value, err := strconv.ParseUint(rest[:i], 10, 64)
+		if i == 0 || err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		rest = rest[i:]
+
+		found := false
+		for _, unit := range units {
+			if strings.HasPrefix(rest, unit.suffix) && !(unit.suffix == "m" && strings.HasPrefix(rest, "ms")) {
+				total += value * unit.ms
+				rest = rest[len(unit.suffix):]
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+	}
+	if total == 0 {
+		return 0, errors.New("duration must be greater than 0")
+	}
+	return total, nil
+}
@@ -0,0 +1,586 @@
+// Package ql implements a small SQL dialect over the event storage:
+//
+//	SELECT count(), sum(bytes), avg(bytes), browser, time
+//	FROM events
+//	WHERE country IN ('de', 'fr') AND browser != 'bot' AND ts > now() - 7d
+//	GROUP BY browser, time(1h)
+//	ORDER BY 1 DESC
+//	LIMIT 10
+//
+// Attribute conditions are =, != (or <>), =~ and !~ for regular expressions,
+// [NOT] IN and [NOT] LIKE, combined with AND. The time columns ts, time and
+// timestamp compare with <, <=, >, >= or BETWEEN against now() plus or minus
+// durations, milliseconds since the epoch or time expressions like
+// '2021-01-01' or 'now-1d/d', resolved against the clock of the plan.
+package ql
+
+import (
+	"io.klector/klector/clock"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Statement is a parsed query.
+type Statement struct {
+	Fields     []Field
+	Conditions []Condition
+	Start      *TimeBound
+	End        *TimeBound
+	GroupBy    []string
+	Interval   uint64 // GROUP BY time(interval) in milliseconds
+	OrderBy    []Order
+	Limit      int // 0 means no limit
+
+	input       string
+	intervalPos int
+	groupByPos  []int
+}
+
+// Field is a column of the result: an aggregate (count, sum, avg), an attribute
+// or the time bucket.
+type Field struct {
+	Function string // count, sum, avg, or "" for attributes and time
+	Name     string // aggregated measure, attribute or time
+	Alias    string
+	pos      int
+}
+
+// Column returns the name of the field in the result.
+func (f *Field) Column() string {
+	switch {
+	case f.Alias != "":
+		return f.Alias
+	case f.Function == "count":
+		return "count()"
+	case f.Function != "":
+		return f.Function + "(" + f.Name + ")"
+	}
+	return f.Name
+}
+
+// Condition restricts the values of an attribute.
+type Condition struct {
+	Attribute string
+	Operator  string // =, !=, =~, !~, in, not in
+	Values    []string
+	pos       int
+}
+
+// TimeBound is an inclusive bound of the time range: Value, now if Now is set or
+// the time expression Expr, plus Offset milliseconds.
+type TimeBound struct {
+	Now     bool
+	Value   uint64 // milliseconds since the epoch
+	Expr    string // see clock.Parse
+	RoundUp bool   // round Expr to the end of its unit
+	Offset  int64
+}
+
+// Order sorts the result by a column, given by its 1-based position or name.
+type Order struct {
+	Column int
+	Name   string
+	Desc   bool
+	pos    int
+}
+
+type parser struct {
+	lexer
+	tok token
+}
+
+// Parse parses a query.
+func Parse(input string) (*Statement, error) {
+	p := &parser{lexer: lexer{input: input}}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	stmt, err := p.parseStatement()
+	if err != nil {
+		return nil, err
+	}
+	if p.isPunct(";") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.unexpected("end of query")
+	}
+	return stmt, nil
+}
+
+func (p *parser) next() error {
+	tok, err := p.lexer.next()
+	p.tok = tok
+	return err
+}
+
+func (p *parser) errorf(pos int, format string, args ...interface{}) error {
+	return newError(p.input, pos, format, args...)
+}
+
+func (p *parser) unexpected(expected string) error {
+	if p.tok.kind == tokEOF {
+		return p.errorf(p.tok.pos, "expected %s, found end of query", expected)
+	}
+	return p.errorf(p.tok.pos, "expected %s, found %q", expected, p.input[p.tok.pos:p.pos])
+}
+
+func (p *parser) isKeyword(keyword string) bool {
+	return p.tok.kind == tokKeyword && p.tok.text == keyword
+}
+
+func (p *parser) isPunct(punct string) bool {
+	return p.tok.kind == tokPunct && p.tok.text == punct
+}
+
+func (p *parser) expectKeyword(keyword string) error {
+	if !p.isKeyword(keyword) {
+		return p.unexpected(keyword)
+	}
+	return p.next()
+}
+
+func (p *parser) expectPunct(punct string) error {
+	if !p.isPunct(punct) {
+		return p.unexpected(strconv.Quote(punct))
+	}
+	return p.next()
+}
+
+func (p *parser) ident(what string) (string, int, error) {
+	if p.tok.kind != tokIdent {
+		return "", p.tok.pos, p.unexpected(what)
+	}
+	text, pos := p.tok.text, p.tok.pos
+	return text, pos, p.next()
+}
+
+func (p *parser) parseStatement() (*Statement, error) {
+	stmt := &Statement{input: p.input}
+	if err := p.expectKeyword("SELECT"); err != nil {
+		return nil, err
+	}
+	for {
+		field, err := p.parseField()
+		if err != nil {
+			return nil, err
+		}
+		if p.isKeyword("AS") {
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			if field.Alias, _, err = p.ident("alias"); err != nil {
+				return nil, err
+			}
+		}
+		stmt.Fields = append(stmt.Fields, *field)
+		if !p.isPunct(",") {
+			break
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.isKeyword("FROM") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		table, pos, err := p.ident("table")
+		if err != nil {
+			return nil, err
+		}
+		if !strings.EqualFold(table, "events") {
+			return nil, p.errorf(pos, "unknown table %q, only events can be queried", table)
+		}
+	}
+
+	if p.isKeyword("WHERE") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if err := p.parseConditions(stmt); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.isKeyword("GROUP") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if err := p.expectKeyword("BY"); err != nil {
+			return nil, err
+		}
+		if err := p.parseGroupBy(stmt); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.isKeyword("ORDER") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if err := p.expectKeyword("BY"); err != nil {
+			return nil, err
+		}
+		if err := p.parseOrderBy(stmt); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.isKeyword("LIMIT") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		limit, err := strconv.Atoi(p.tok.text)
+		if p.tok.kind != tokNumber || err != nil || limit <= 0 {
+			return nil, p.unexpected("a positive number")
+		}
+		stmt.Limit = limit
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+	return stmt, nil
+}
+
+// parseField parses an aggregate, an attribute or time.
+func (p *parser) parseField() (*Field, error) {
+	name, pos, err := p.ident("column")
+	if err != nil {
+		return nil, err
+	}
+	if !p.isPunct("(") {
+		return &Field{Name: name, pos: pos}, nil
+	}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	field := &Field{Function: strings.ToLower(name), pos: pos}
+	switch field.Function {
+	case "count":
+		if p.isPunct("*") {
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+		}
+	case "sum", "avg":
+		if field.Name, _, err = p.ident("measure"); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, p.errorf(pos, "unknown function %s, expected count, sum or avg", name)
+	}
+	return field, p.expectPunct(")")
+}
+
+func (p *parser) parseConditions(stmt *Statement) error {
+	for {
+		name, pos, err := p.ident("attribute")
+		if err != nil {
+			return err
+		}
+		if isTimeColumn(name) {
+			err = p.parseTimeCondition(stmt)
+		} else {
+			err = p.parseCondition(stmt, name, pos)
+		}
+		if err != nil {
+			return err
+		}
+
+		if p.isKeyword("OR") {
+			return p.errorf(p.tok.pos, "OR is not supported, use IN or a regular expression")
+		}
+		if !p.isKeyword("AND") {
+			return nil
+		}
+		if err := p.next(); err != nil {
+			return err
+		}
+	}
+}
+
+func isTimeColumn(name string) bool {
+	switch strings.ToLower(name) {
+	case "ts", "time", "timestamp":
+		return true
+	}
+	return false
+}
+
+func (p *parser) parseCondition(stmt *Statement, name string, pos int) error {
+	condition := Condition{Attribute: name, pos: pos}
+	negate := false
+	if p.isKeyword("NOT") {
+		negate = true
+		if err := p.next(); err != nil {
+			return err
+		}
+		if !p.isKeyword("IN") && !p.isKeyword("LIKE") {
+			return p.unexpected("IN or LIKE")
+		}
+	}
+
+	switch {
+	case p.isKeyword("IN"):
+		condition.Operator = "in"
+		if negate {
+			condition.Operator = "not in"
+		}
+		if err := p.next(); err != nil {
+			return err
+		}
+		if err := p.expectPunct("("); err != nil {
+			return err
+		}
+		for {
+			if p.tok.kind != tokString {
+				return p.unexpected("string")
+			}
+			condition.Values = append(condition.Values, p.tok.text)
+			if err := p.next(); err != nil {
+				return err
+			}
+			if !p.isPunct(",") {
+				break
+			}
+			if err := p.next(); err != nil {
+				return err
+			}
+		}
+		if err := p.expectPunct(")"); err != nil {
+			return err
+		}
+		stmt.Conditions = append(stmt.Conditions, condition)
+		return nil
+	case p.isKeyword("LIKE"):
+		condition.Operator = "=~"
+		if negate {
+			condition.Operator = "!~"
+		}
+	case p.tok.kind == tokPunct && (p.tok.text == "=" || p.tok.text == "!=" || p.tok.text == "<>" || p.tok.text == "=~" || p.tok.text == "!~"):
+		condition.Operator = p.tok.text
+		if condition.Operator == "<>" {
+			condition.Operator = "!="
+		}
+	default:
+		return p.unexpected("comparison operator")
+	}
+	like := p.isKeyword("LIKE")
+	if err := p.next(); err != nil {
+		return err
+	}
+
+	if p.tok.kind != tokString {
+		return p.unexpected("string")
+	}
+	value := p.tok.text
+	if like {
+		value = likePattern(value)
+	}
+	condition.Values = []string{value}
+	stmt.Conditions = append(stmt.Conditions, condition)
+	return p.next()
+}
+
+// likePattern translates a LIKE pattern, % matches any text and _ any
+// character, into a regular expression.
+func likePattern(pattern string) string {
+	var re strings.Builder
+	for _, c := range pattern {
+		switch c {
+		case '%':
+			re.WriteString(".*")
+		case '_':
+			re.WriteString(".")
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return re.String()
+}
+
+func (p *parser) parseTimeCondition(stmt *Statement) error {
+	if p.isKeyword("BETWEEN") {
+		if err := p.next(); err != nil {
+			return err
+		}
+		start, err := p.parseTimeBound()
+		if err != nil {
+			return err
+		}
+		if err := p.expectKeyword("AND"); err != nil {
+			return err
+		}
+		end, err := p.parseTimeBound()
+		if err != nil {
+			return err
+		}
+		end.RoundUp = true
+		stmt.Start, stmt.End = start, end
+		return nil
+	}
+
+	if p.tok.kind != tokPunct || (p.tok.text != "<" && p.tok.text != "<=" && p.tok.text != ">" && p.tok.text != ">=") {
+		return p.unexpected("<, <=, >, >= or BETWEEN")
+	}
+	operator := p.tok.text
+	if err := p.next(); err != nil {
+		return err
+	}
+	bound, err := p.parseTimeBound()
+	if err != nil {
+		return err
+	}
+
+	// bounds are inclusive, ts > 'now/d' starts after the end of the day and
+	// ts <= 'now/d' ends with it
+	switch operator {
+	case ">":
+		bound.RoundUp = true
+		bound.Offset++
+		stmt.Start = bound
+	case ">=":
+		stmt.Start = bound
+	case "<":
+		bound.Offset--
+		stmt.End = bound
+	case "<=":
+		bound.RoundUp = true
+		stmt.End = bound
+	}
+	return nil
+}
+
+// parseTimeBound parses now() with optional durations added or subtracted,
+// milliseconds since the epoch or a time expression string, such as an
+// ISO-8601 date or time or now-1d/d.
+func (p *parser) parseTimeBound() (*TimeBound, error) {
+	switch {
+	case p.tok.kind == tokNumber:
+		value, err := strconv.ParseUint(p.tok.text, 10, 64)
+		if err != nil {
+			return nil, p.errorf(p.tok.pos, "invalid timestamp %s", p.tok.text)
+		}
+		return &TimeBound{Value: value}, p.next()
+	case p.tok.kind == tokString:
+		bound := &TimeBound{Expr: p.tok.text}
+		if _, err := clock.Parse(bound.Expr, clock.System(), false); err != nil {
+			return nil, p.errorf(p.tok.pos, "%s", err.Error())
+		}
+		return bound, p.next()
+	case p.tok.kind != tokIdent || !strings.EqualFold(p.tok.text, "now"):
+		return nil, p.unexpected("now(), a timestamp or a time expression")
+	}
+
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	if err := p.expectPunct("("); err != nil {
+		return nil, err
+	}
+	if err := p.expectPunct(")"); err != nil {
+		return nil, err
+	}
+	bound := &TimeBound{Now: true}
+	for p.isPunct("+") || p.isPunct("-") {
+		sign := int64(1)
+		if p.tok.text == "-" {
+			sign = -1
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if p.tok.kind != tokDuration {
+			return nil, p.unexpected("duration")
+		}
+		duration, err := parseDuration(p.tok.text)
+		if err != nil {
+			return nil, p.errorf(p.tok.pos, "%s", err.Error())
+		}
+		bound.Offset += sign * int64(duration)
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+	return bound, nil
+}
+
+func (p *parser) parseGroupBy(stmt *Statement) error {
+	for {
+		name, pos, err := p.ident("attribute or time(interval)")
+		if err != nil {
+			return err
+		}
+		if isTimeColumn(name) && p.isPunct("(") {
+			if err := p.next(); err != nil {
+				return err
+			}
+			if p.tok.kind != tokDuration {
+				return p.unexpected("interval")
+			}
+			if stmt.Interval, err = parseDuration(p.tok.text); err != nil {
+				return p.errorf(p.tok.pos, "%s", err.Error())
+			}
+			stmt.intervalPos = pos
+			if err := p.next(); err != nil {
+				return err
+			}
+			if err := p.expectPunct(")"); err != nil {
+				return err
+			}
+		} else {
+			stmt.GroupBy = append(stmt.GroupBy, name)
+			stmt.groupByPos = append(stmt.groupByPos, pos)
+		}
+
+		if !p.isPunct(",") {
+			return nil
+		}
+		if err := p.next(); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *parser) parseOrderBy(stmt *Statement) error {
+	for {
+		order := Order{pos: p.tok.pos}
+		if p.tok.kind == tokNumber {
+			column, err := strconv.Atoi(p.tok.text)
+			if err != nil {
+				return p.unexpected("column")
+			}
+			order.Column = column
+			if err := p.next(); err != nil {
+				return err
+			}
+		} else {
+			field, err := p.parseField()
+			if err != nil {
+				return err
+			}
+			order.Name = field.Column()
+		}
+
+		if p.isKeyword("ASC") || p.isKeyword("DESC") {
+			order.Desc = p.tok.text == "DESC"
+			if err := p.next(); err != nil {
+				return err
+			}
+		}
+		stmt.OrderBy = append(stmt.OrderBy, order)
+
+		if !p.isPunct(",") {
+			return nil
+		}
+		if err := p.next(); err != nil {
+			return err
+		}
+	}
+}
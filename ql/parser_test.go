@@ -0,0 +1,68 @@
+package ql
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    *Statement
+		wantErr string
+	}{
+		{"Full query", "SELECT count(), sum(bytes) AS traffic, browser FROM events\n" +
+			"WHERE country IN ('de','fr') AND browser != 'bot' AND ts > now()-7d\n" +
+			"GROUP BY browser, time(1h) ORDER BY 1 DESC, browser LIMIT 10;", &Statement{
+			Fields: []Field{
+				{Function: "count", pos: 7},
+				{Function: "sum", Name: "bytes", Alias: "traffic", pos: 16},
+				{Name: "browser", pos: 39},
+			},
+			Conditions: []Condition{
+				{Attribute: "country", Operator: "in", Values: []string{"de", "fr"}, pos: 65},
+				{Attribute: "browser", Operator: "!=", Values: []string{"bot"}, pos: 92},
+			},
+			Start:       &TimeBound{Now: true, RoundUp: true, Offset: -7*86_400_000 + 1},
+			GroupBy:     []string{"browser"},
+			Interval:    3_600_000,
+			OrderBy:     []Order{{Column: 1, Desc: true, pos: 163}, {Name: "browser", pos: 171}},
+			Limit:       10,
+			intervalPos: 145,
+			groupByPos:  []int{136},
+		}, ""},
+		{"Like and time range", `select count(*) where "user agent" not like 'Moz%.5' and ts between '2021-01-01' and 1609545600000`, &Statement{
+			Fields: []Field{{Function: "count", pos: 7}},
+			Conditions: []Condition{
+				{Attribute: "user agent", Operator: "!~", Values: []string{`Moz.*\.5`}, pos: 22},
+			},
+			Start: &TimeBound{Expr: "2021-01-01"},
+			End:   &TimeBound{Value: 1609545600000, RoundUp: true},
+		}, ""},
+		{"Missing select", "count()", nil, `line 1, column 1: expected SELECT, found "count"`},
+		{"Or", "SELECT count() WHERE a = 'x' OR a = 'y'", nil, "line 1, column 30: OR is not supported, use IN or a regular expression"},
+		{"Unknown function", "SELECT max(bytes)", nil, "line 1, column 8: unknown function max, expected count, sum or avg"},
+		{"Unterminated string", "SELECT count()\nWHERE a = 'x", nil, "line 2, column 11: unterminated string"},
+		{"Unknown table", "SELECT count() FROM users", nil, `line 1, column 21: unknown table "users", only events can be queried`},
+		{"Invalid time", "SELECT count() WHERE ts > 'yesterday'", nil, `line 1, column 27: invalid time expression "yesterday"`},
+		{"Invalid duration", "SELECT count() WHERE ts > now() - 5x", nil, `line 1, column 35: invalid duration "5x"`},
+		{"Trailing input", "SELECT count() LIMIT 5 5", nil, `line 1, column 24: expected end of query, found "5"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.input)
+			if err != nil || tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("Parse() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			tt.want.input = tt.input
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,271 @@
+package ql
+
+import (
+	"context"
+	"io.klector/klector/clock"
+	"io.klector/klector/storage"
+	"sort"
+	"strings"
+)
+
+// DefaultRange is the time range in milliseconds before the end of a query
+// without a lower time bound and without GROUP BY time(...).
+const DefaultRange = 24 * 60 * 60 * 1000
+
+// Plan maps a statement onto a storage query: conditions become attributes and
+// filters of the tree path, grouped attributes its group keys, and the time
+// range and interval select the buckets of the time series aggregators.
+type Plan struct {
+	Query   *storage.Query
+	columns []column
+	orderBy []Order
+	limit   int
+}
+
+const (
+	columnCount = iota
+	columnSum
+	columnAvg
+	columnAttribute
+	columnTime
+)
+
+type column struct {
+	name string
+	kind int
+	key  string // measure or attribute
+}
+
+// Result holds the rows of an executed plan.
+type Result struct {
+	Columns []string        `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+}
+
+// NewPlan plans stmt with c providing the value of now().
+func NewPlan(stmt *Statement, c clock.Clock) (*Plan, error) {
+	now := clock.Milliseconds(c.Now())
+	query := &storage.Query{
+		Attributes: map[string]string{},
+		GroupBy:    stmt.GroupBy,
+		Step:       stmt.Interval,
+	}
+	for _, condition := range stmt.Conditions {
+		if _, found := query.Attributes[condition.Attribute]; condition.Operator == "=" && !found {
+			query.Attributes[condition.Attribute] = condition.Values[0]
+			continue
+		}
+		query.Filters = append(query.Filters, storage.Filter{
+			Attribute: condition.Attribute,
+			Operator:  condition.Operator,
+			Values:    condition.Values,
+		})
+	}
+
+	var err error
+	query.EndTimestamp = now
+	if stmt.End != nil {
+		if query.EndTimestamp, err = stmt.End.resolve(c); err != nil {
+			return nil, newError(stmt.input, 0, "%s", err.Error())
+		}
+	}
+	switch {
+	case stmt.Start != nil:
+		if query.StartTimestamp, err = stmt.Start.resolve(c); err != nil {
+			return nil, newError(stmt.input, 0, "%s", err.Error())
+		}
+	case stmt.Interval > 0:
+		return nil, newError(stmt.input, stmt.intervalPos, "GROUP BY time(...) needs a lower time bound, e.g. ts > now() - 1d")
+	case query.EndTimestamp > DefaultRange:
+		query.StartTimestamp = query.EndTimestamp - DefaultRange
+	}
+	if query.StartTimestamp > query.EndTimestamp {
+		return nil, newError(stmt.input, 0, "the time range is empty")
+	}
+
+	plan := &Plan{Query: query, orderBy: stmt.OrderBy, limit: stmt.Limit}
+	grouped := map[string]bool{}
+	for _, name := range stmt.GroupBy {
+		grouped[name] = true
+	}
+	measures := map[string]bool{}
+	for _, field := range stmt.Fields {
+		c := column{name: field.Column(), key: field.Name}
+		switch {
+		case field.Function == "count":
+			c.kind = columnCount
+		case field.Function == "sum" || field.Function == "avg":
+			c.kind = columnSum
+			if field.Function == "avg" {
+				c.kind = columnAvg
+			}
+			if !measures[field.Name] {
+				measures[field.Name] = true
+				query.Measures = append(query.Measures, field.Name)
+			}
+		case isTimeColumn(field.Name):
+			if stmt.Interval == 0 {
+				return nil, newError(stmt.input, field.pos, "%s needs GROUP BY time(interval)", field.Name)
+			}
+			c.kind = columnTime
+		case grouped[field.Name]:
+			c.kind = columnAttribute
+		default:
+			return nil, newError(stmt.input, field.pos, "%s must appear in GROUP BY or be used in an aggregate", field.Name)
+		}
+		plan.columns = append(plan.columns, c)
+	}
+
+	if len(query.Attributes) == 0 && len(query.Filters) == 0 && len(query.GroupBy) == 0 {
+		return nil, newError(stmt.input, 0, "the query must have a condition on an attribute or group by an attribute")
+	}
+
+	for _, order := range stmt.OrderBy {
+		if order.Column != 0 && (order.Column < 1 || order.Column > len(plan.columns)) {
+			return nil, newError(stmt.input, order.pos, "ORDER BY position %d is not in the select list", order.Column)
+		}
+		if order.Column == 0 && plan.column(order.Name) < 0 {
+			return nil, newError(stmt.input, order.pos, "ORDER BY %s is not in the select list", order.Name)
+		}
+	}
+	return plan, nil
+}
+
+func (b *TimeBound) resolve(c clock.Clock) (uint64, error) {
+	ts := int64(b.Value)
+	switch {
+	case b.Now:
+		ts = int64(clock.Milliseconds(c.Now()))
+	case b.Expr != "":
+		t, err := clock.Parse(b.Expr, c, b.RoundUp)
+		if err != nil {
+			return 0, err
+		}
+		ts = int64(clock.Milliseconds(t))
+	}
+	ts += b.Offset
+	if ts < 0 {
+		return 0, nil
+	}
+	return uint64(ts), nil
+}
+
+func (p *Plan) column(name string) int {
+	for i, c := range p.columns {
+		if strings.EqualFold(c.name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Execute runs the plan against s. Groups and time buckets without events are
+// left out of the result unless the query neither groups nor has an interval.
+func (p *Plan) Execute(ctx context.Context, s storage.Storage) (*Result, error) {
+	resultSet, err := s.Query(ctx, p.Query)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{Columns: make([]string, 0, len(p.columns)), Rows: [][]interface{}{}}
+	for _, c := range p.columns {
+		result.Columns = append(result.Columns, c.name)
+	}
+
+	groups := resultSet.Groups
+	if len(p.Query.GroupBy) == 0 {
+		groups = []storage.Group{{
+			Value:    resultSet.Value,
+			Measures: resultSet.Measures,
+			Buckets:  resultSet.Buckets,
+		}}
+	}
+	for _, group := range groups {
+		if p.Query.Step == 0 {
+			if group.Value > 0 || len(p.Query.GroupBy) == 0 {
+				result.Rows = append(result.Rows, p.row(group.Attributes, 0, group.Value, group.Measures))
+			}
+			continue
+		}
+		for _, bucket := range group.Buckets {
+			if bucket.Value > 0 {
+				result.Rows = append(result.Rows, p.row(group.Attributes, bucket.Timestamp, bucket.Value, bucket.Measures))
+			}
+		}
+	}
+
+	p.sort(result.Rows)
+	if p.limit > 0 && len(result.Rows) > p.limit {
+		result.Rows = result.Rows[:p.limit]
+	}
+	return result, nil
+}
+
+func (p *Plan) row(attributes map[string]string, ts uint64, count uint64, measures map[string]float64) []interface{} {
+	row := make([]interface{}, 0, len(p.columns))
+	for _, c := range p.columns {
+		switch c.kind {
+		case columnCount:
+			row = append(row, count)
+		case columnSum:
+			row = append(row, measures[c.key])
+		case columnAvg:
+			if count == 0 {
+				row = append(row, nil)
+			} else {
+				row = append(row, measures[c.key]/float64(count))
+			}
+		case columnAttribute:
+			row = append(row, attributes[c.key])
+		case columnTime:
+			row = append(row, ts)
+		}
+	}
+	return row
+}
+
+func (p *Plan) sort(rows [][]interface{}) {
+	if len(p.orderBy) == 0 {
+		return
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		for _, order := range p.orderBy {
+			c := order.Column - 1
+			if order.Column == 0 {
+				c = p.column(order.Name)
+			}
+			cmp := compareValues(rows[i][c], rows[j][c])
+			if cmp == 0 {
+				continue
+			}
+			return (cmp < 0) != order.Desc
+		}
+		return false
+	})
+}
+
+// compareValues orders nil first, then numbers, then strings.
+func compareValues(a interface{}, b interface{}) int {
+	rank := func(v interface{}) (int, float64, string) {
+		switch v := v.(type) {
+		case uint64:
+			return 1, float64(v), ""
+		case float64:
+			return 1, v, ""
+		case string:
+			return 2, 0, v
+		}
+		return 0, 0, ""
+	}
+	rankA, numberA, textA := rank(a)
+	rankB, numberB, textB := rank(b)
+	switch {
+	case rankA != rankB:
+		return rankA - rankB
+	case numberA < numberB || textA < textB:
+		return -1
+	case numberA > numberB || textA > textB:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,76 @@
+package ql
+
+import (
+	"context"
+	"io.klector/klector/clock"
+	"io.klector/klector/storage"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPlan_Execute(t *testing.T) {
+	s := storage.Create(storage.NewDefaultStorageConfiguration())
+	s.Write(&storage.Events{Events: []storage.Event{
+		{Attributes: map[string]string{"country": "de", "browser": "firefox"}, Measures: map[string]float64{"bytes": 100}, Timestamp: 3_600_000},
+		{Attributes: map[string]string{"country": "de", "browser": "chrome"}, Measures: map[string]float64{"bytes": 10}, Timestamp: 3_600_000},
+		{Attributes: map[string]string{"country": "fr", "browser": "chrome"}, Measures: map[string]float64{"bytes": 30}, Count: 2, Timestamp: 7_200_000},
+		{Attributes: map[string]string{"country": "us", "browser": "chrome"}, Timestamp: 7_200_000},
+	}})
+	now := clock.Fixed(time.Unix(10_800, 0))
+
+	tests := []struct {
+		name    string
+		query   string
+		want    *Result
+		wantErr string
+	}{
+		{"Totals", "SELECT count(), sum(bytes), avg(bytes) FROM events WHERE country IN ('de', 'fr')", &Result{
+			Columns: []string{"count()", "sum(bytes)", "avg(bytes)"},
+			Rows:    [][]interface{}{{uint64(4), float64(170), float64(42.5)}},
+		}, ""},
+		{"Group by and order", "SELECT browser, count() AS c FROM events WHERE country != 'us' GROUP BY browser ORDER BY c DESC, browser", &Result{
+			Columns: []string{"browser", "c"},
+			Rows:    [][]interface{}{{"chrome", uint64(3)}, {"firefox", uint64(1)}},
+		}, ""},
+		{"Time buckets", "SELECT time, count() WHERE browser = 'chrome' AND ts >= now() - 3h GROUP BY time(1h) ORDER BY time DESC LIMIT 1", &Result{
+			Columns: []string{"time", "count()"},
+			Rows:    [][]interface{}{{uint64(7_200_000), uint64(3)}},
+		}, ""},
+		{"Time range", "SELECT count() WHERE browser LIKE 'chr%' AND ts < 7200000", &Result{
+			Columns: []string{"count()"},
+			Rows:    [][]interface{}{{uint64(1)}},
+		}, ""},
+		{"Relative time expression", "SELECT count() WHERE browser = 'chrome' AND ts >= 'now-1h/h'", &Result{
+			Columns: []string{"count()"},
+			Rows:    [][]interface{}{{uint64(3)}},
+		}, ""},
+		{"Attribute not grouped", "SELECT browser, count() WHERE country = 'de'", nil, "line 1, column 8: browser must appear in GROUP BY or be used in an aggregate"},
+		{"Interval without lower bound", "SELECT count() WHERE country = 'de' GROUP BY time(1h)", nil, "line 1, column 46: GROUP BY time(...) needs a lower time bound, e.g. ts > now() - 1d"},
+		{"Order by unknown column", "SELECT count() WHERE country = 'de' ORDER BY 2", nil, "line 1, column 46: ORDER BY position 2 is not in the select list"},
+		{"No attribute", "SELECT count()", nil, "line 1, column 1: the query must have a condition on an attribute or group by an attribute"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stmt, err := Parse(tt.query)
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			var got *Result
+			plan, err := NewPlan(stmt, now)
+			if err == nil {
+				got, err = plan.Execute(context.Background(), s)
+			}
+			if err != nil || tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Execute() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package statsd
+
+import (
+	"errors"
+	"fmt"
+	"io.klector/klector/storage"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const metricAttribute = "metric"
+
+type metric struct {
+	attributes map[string]string
+	count      uint64
+	timestamp  uint64
+}
+
+// parseLine parses one StatsD/DogStatsD line, e.g.
+// page.view:1|c|@0.5|#country:de,beta. Lines of other metric types than
+// counters are skipped and return nil.
+func parseLine(line string, now uint64) (*metric, error) {
+	colon := strings.IndexByte(line, ':')
+	if colon <= 0 {
+		return nil, fmt.Errorf("invalid metric %q", line)
+	}
+	name := line[:colon]
+	sections := strings.Split(line[colon+1:], "|")
+	if len(sections) < 2 {
+		return nil, fmt.Errorf("missing metric type in %q", line)
+	}
+	if sections[1] != "c" {
+		return nil, nil
+	}
+
+	value, err := strconv.ParseFloat(sections[0], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value in %q", line)
+	}
+
+	m := &metric{
+		attributes: map[string]string{metricAttribute: name},
+		timestamp:  now,
+	}
+	sampleRate := 1.0
+	for _, section := range sections[2:] {
+		if section == "" {
+			continue
+		}
+		switch section[0] {
+		case '@':
+			sampleRate, err = strconv.ParseFloat(section[1:], 64)
+			if err != nil || sampleRate <= 0 || sampleRate > 1 {
+				return nil, fmt.Errorf("invalid sample rate in %q", line)
+			}
+		case '#':
+			for _, tag := range strings.Split(section[1:], ",") {
+				if tag == "" {
+					continue
+				}
+				if i := strings.IndexByte(tag, ':'); i >= 0 {
+					m.attributes[tag[:i]] = tag[i+1:]
+				} else {
+					m.attributes[tag] = ""
+				}
+			}
+		case 'T':
+			seconds, err := strconv.ParseUint(section[1:], 10, 64)
+			if err != nil || seconds == 0 {
+				return nil, fmt.Errorf("invalid timestamp in %q", line)
+			}
+			m.timestamp = seconds * 1000
+		}
+	}
+
+	count := math.Round(value / sampleRate)
+	if count < 0 || count > float64(storage.MaxEventCount) {
+		return nil, fmt.Errorf("counter value out of range in %q", line)
+	}
+	m.count = uint64(count)
+	return m, nil
+}
+
+// parsePacket parses all newline separated lines of a datagram, invalid lines
+// are reported but do not prevent the rest from being parsed.
+func parsePacket(packet []byte, now uint64) ([]*metric, error) {
+	var metrics []*metric
+	var errs []string
+	for _, line := range strings.Split(string(packet), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		m, err := parseLine(line, now)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if m != nil && m.count > 0 {
+			metrics = append(metrics, m)
+		}
+	}
+	if len(errs) > 0 {
+		return metrics, errors.New(strings.Join(errs, "; "))
+	}
+	return metrics, nil
+}
+
+func (m *metric) toEvent() storage.Event {
+	return storage.Event{
+		Attributes: m.attributes,
+		Count:      m.count,
+		Timestamp:  m.timestamp,
+	}
+}
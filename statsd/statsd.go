@@ -0,0 +1,154 @@
+package statsd
+
+import (
+	"errors"
+	"io.klector/klector/storage"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const maxPacketSize = 65535
+
+type Listener interface {
+	Stop()
+}
+
+type StatsdConfiguration struct {
+	UdpAddress    string        `json:"udpAddress"`
+	UnixgramPath  string        `json:"unixgramPath"`
+	FlushInterval time.Duration `json:"flushInterval"`
+	BatchSize     int           `json:"batchSize"`
+}
+
+func NewDefaultStatsdConfiguration() *StatsdConfiguration {
+	return &StatsdConfiguration{
+		FlushInterval: time.Second,
+		BatchSize:     1000,
+	}
+}
+
+func (c *StatsdConfiguration) Enabled() bool {
+	return c.UdpAddress != "" || c.UnixgramPath != ""
+}
+
+type listener struct {
+	config  *StatsdConfiguration
+	storage *storage.Storage
+	conns   []net.PacketConn
+	metrics chan *metric
+	wg      sync.WaitGroup
+	done    chan struct{}
+}
+
+func (l *listener) Stop() {
+	for _, conn := range l.conns {
+		conn.Close()
+	}
+	l.wg.Wait()
+	close(l.metrics)
+	<-l.done
+}
+
+func (l *listener) listen(network string, address string) error {
+	if network == "unixgram" {
+		if err := os.Remove(address); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	conn, err := net.ListenPacket(network, address)
+	if err != nil {
+		return err
+	}
+	log.Printf("statsd listening on %s %s", network, conn.LocalAddr())
+	l.conns = append(l.conns, conn)
+
+	l.wg.Add(1)
+	go l.read(conn)
+	return nil
+}
+
+func (l *listener) read(conn net.PacketConn) {
+	defer l.wg.Done()
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("statsd read failed: %v", err)
+			}
+			return
+		}
+
+		metrics, err := parsePacket(buf[:n], uint64(time.Now().UnixNano()/1_000_000))
+		if err != nil {
+			log.Printf("statsd received invalid metrics: %v", err)
+		}
+		for _, m := range metrics {
+			l.metrics <- m
+		}
+	}
+}
+
+// flush collects parsed metrics and writes them to the storage once
+// BatchSize events are pending or FlushInterval has passed, so the storage is
+// not locked for every single packet.
+func (l *listener) flush() {
+	defer close(l.done)
+	ticker := time.NewTicker(l.config.FlushInterval)
+	defer ticker.Stop()
+
+	events := make([]storage.Event, 0, l.config.BatchSize)
+	write := func() {
+		if len(events) == 0 {
+			return
+		}
+		if err := (*l.storage).Write(&storage.Events{Events: events}); err != nil {
+			log.Printf("statsd write failed: %v", err)
+		}
+		events = make([]storage.Event, 0, l.config.BatchSize)
+	}
+
+	for {
+		select {
+		case m, ok := <-l.metrics:
+			if !ok {
+				write()
+				return
+			}
+			events = append(events, m.toEvent())
+			if len(events) >= l.config.BatchSize {
+				write()
+			}
+		case <-ticker.C:
+			write()
+		}
+	}
+}
+
+func Create(config *StatsdConfiguration, storage *storage.Storage) (Listener, error) {
+	l := &listener{
+		config:  config,
+		storage: storage,
+		metrics: make(chan *metric, config.BatchSize),
+		done:    make(chan struct{}),
+	}
+	go l.flush()
+
+	if config.UdpAddress != "" {
+		if err := l.listen("udp", config.UdpAddress); err != nil {
+			l.Stop()
+			return nil, err
+		}
+	}
+	if config.UnixgramPath != "" {
+		if err := l.listen("unixgram", config.UnixgramPath); err != nil {
+			l.Stop()
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
@@ -0,0 +1,94 @@
+package statsd
+
+import (
+	"context"
+	"io.klector/klector/storage"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_parseLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    *metric
+		wantErr bool
+	}{
+		{"Plain counter", "page.view:1|c", &metric{
+			attributes: map[string]string{"metric": "page.view"},
+			count:      1,
+			timestamp:  42,
+		}, false},
+		{"Counter with tags", "page.view:3|c|#country:de,beta", &metric{
+			attributes: map[string]string{"metric": "page.view", "country": "de", "beta": ""},
+			count:      3,
+			timestamp:  42,
+		}, false},
+		{"Sample rate scales the count", "page.view:2|c|@0.1", &metric{
+			attributes: map[string]string{"metric": "page.view"},
+			count:      20,
+			timestamp:  42,
+		}, false},
+		{"Timestamp in seconds", "page.view:1|c|T1600000000", &metric{
+			attributes: map[string]string{"metric": "page.view"},
+			count:      1,
+			timestamp:  1_600_000_000_000,
+		}, false},
+		{"Gauge is skipped", "cpu:0.5|g", nil, false},
+		{"Missing type", "page.view:1", nil, true},
+		{"Invalid value", "page.view:x|c", nil, true},
+		{"Invalid sample rate", "page.view:1|c|@2", nil, true},
+		{"Negative counter", "page.view:-1|c", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseLine(tt.line, 42)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseLine() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseLine() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_listener(t *testing.T) {
+	s := storage.Create(storage.NewDefaultStorageConfiguration())
+	config := NewDefaultStatsdConfiguration()
+	config.UdpAddress = "127.0.0.1:0"
+	config.FlushInterval = 10 * time.Millisecond
+
+	l, err := Create(config, &s)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+
+	conn, err := net.Dial("udp", l.(*listener).conns[0].LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	conn.Write([]byte("page.view:1|c|#country:de|T1600000000\npage.view:2|c|#country:fr|T1600000000"))
+	conn.Write([]byte("page.view:1|c|#country:de|T1600000000"))
+	conn.Close()
+
+	query := &storage.Query{
+		Attributes:     map[string]string{"metric": "page.view", "country": "de"},
+		StartTimestamp: 1_600_000_000_000,
+		EndTimestamp:   1_600_000_000_000,
+	}
+	result, _ := s.Query(context.Background(), query)
+	deadline := time.Now().Add(5 * time.Second)
+	for result.Value < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		result, _ = s.Query(context.Background(), query)
+	}
+	l.Stop()
+
+	if result.Value != 2 {
+		t.Errorf("Value = %v, want 2", result.Value)
+	}
+}
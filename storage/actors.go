@@ -0,0 +1,194 @@
+package storage
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// actorStore keeps the events of every actor, the value of one attribute such
+// as user_id, in time order. It answers questions about sequences of events of
+// the same actor which the counting tree cannot. It keeps up to maxEvents
+// events per actor and the events of the last retention ms, 0 means
+// unlimited, and forgets the actors without events.
+type actorStore struct {
+	attribute string
+	maxEvents int
+	retention uint64
+	nextPrune uint64 // time of the next hourly removal of old events, in ms
+	mu        sync.RWMutex
+	actors    map[string]*actorTimeline
+}
+
+type actorTimeline struct {
+	mu     sync.RWMutex
+	events []actorEvent // sorted by timestamp
+}
+
+type actorEvent struct {
+	ts         uint64
+	attributes map[string]string
+}
+
+func newActorStore(attribute string, maxEvents int, retention uint64) *actorStore {
+	return &actorStore{
+		attribute: attribute,
+		maxEvents: maxEvents,
+		retention: retention,
+		actors:    map[string]*actorTimeline{},
+	}
+}
+
+// add adds event to the timeline of its actor at now, the time in ms, unless
+// it is older than the retention.
+func (s *actorStore) add(event *Event, now uint64) {
+	actor, found := event.Attributes[s.attribute]
+	if !found {
+		return
+	}
+	cutoff := s.cutoff(now)
+	if event.Timestamp < cutoff {
+		return
+	}
+	if next := atomic.LoadUint64(&s.nextPrune); s.retention > 0 && now >= next && atomic.CompareAndSwapUint64(&s.nextPrune, next, now+milliSecondsInHour) {
+		s.prune(cutoff)
+	}
+
+	attributes := make(map[string]string, len(event.Attributes))
+	for name, value := range event.Attributes {
+		attributes[name] = value
+	}
+	// the timeline is changed under the lock of the store, so that prune
+	// does not remove it meanwhile
+	s.mu.RLock()
+	timeline, found := s.actors[actor]
+	if found {
+		timeline.add(actorEvent{ts: event.Timestamp, attributes: attributes}, s.maxEvents)
+		s.mu.RUnlock()
+		return
+	}
+	s.mu.RUnlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	timeline, found = s.actors[actor]
+	if !found {
+		timeline = &actorTimeline{}
+		s.actors[actor] = timeline
+	}
+	timeline.add(actorEvent{ts: event.Timestamp, attributes: attributes}, s.maxEvents)
+}
+
+// cutoff returns the timestamp of the oldest event kept at now.
+func (s *actorStore) cutoff(now uint64) uint64 {
+	if s.retention == 0 || now < s.retention {
+		return 0
+	}
+	return now - s.retention
+}
+
+// prune removes the events before cutoff and the actors without events.
+func (s *actorStore) prune(cutoff uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for actor, timeline := range s.actors {
+		if timeline.prune(cutoff) == 0 {
+			delete(s.actors, actor)
+		}
+	}
+}
+
+// timelines calls visit for the timeline of every actor until visit returns an
+// error.
+func (s *actorStore) timelines(visit func(actor string, timeline *actorTimeline) error) error {
+	s.mu.RLock()
+	timelines := make(map[string]*actorTimeline, len(s.actors))
+	for actor, timeline := range s.actors {
+		timelines[actor] = timeline
+	}
+	s.mu.RUnlock()
+
+	for actor, timeline := range timelines {
+		if err := visit(actor, timeline); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add inserts event in time order and drops the oldest event if there are
+// more than maxEvents, 0 means unlimited. Events mostly arrive in order so the
+// position is searched from the end.
+func (t *actorTimeline) add(event actorEvent, maxEvents int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	i := len(t.events)
+	for i > 0 && t.events[i-1].ts > event.ts {
+		i--
+	}
+	t.events = append(t.events, actorEvent{})
+	copy(t.events[i+1:], t.events[i:])
+	t.events[i] = event
+	if maxEvents > 0 && len(t.events) > maxEvents {
+		t.events[0] = actorEvent{}
+		t.events = t.events[1:]
+	}
+}
+
+// prune removes the events before cutoff and returns the number of the
+// remaining events.
+func (t *actorTimeline) prune(cutoff uint64) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	first := sort.Search(len(t.events), func(i int) bool {
+		return t.events[i].ts >= cutoff
+	})
+	if first > 0 {
+		t.events = append([]actorEvent(nil), t.events[first:]...)
+	}
+	return len(t.events)
+}
+
+// visit calls visit for the events from startTs to endTs, both inclusive, in
+// time order.
+func (t *actorTimeline) visit(startTs uint64, endTs uint64, visit func(event *actorEvent)) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	first := sort.Search(len(t.events), func(i int) bool {
+		return t.events[i].ts >= startTs
+	})
+	for i := first; i < len(t.events) && t.events[i].ts <= endTs; i++ {
+		visit(&t.events[i])
+	}
+}
+
+// actorDump holds the events of an actor in a snapshot.
+type actorDump struct {
+	Attribute string           `json:"attribute"`
+	Actor     string           `json:"actor"`
+	Events    []actorEventDump `json:"events"`
+}
+
+type actorEventDump struct {
+	Timestamp  uint64            `json:"ts"`
+	Attributes map[string]string `json:"attributes"`
+}
+
+func (t *actorTimeline) dump(attribute string, actor string) *actorDump {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	dump := &actorDump{Attribute: attribute, Actor: actor, Events: make([]actorEventDump, len(t.events))}
+	for i, event := range t.events {
+		dump.Events[i] = actorEventDump{Timestamp: event.ts, Attributes: event.attributes}
+	}
+	return dump
+}
+
+func (s *actorStore) restore(dump *actorDump, now uint64) {
+	for _, event := range dump.Events {
+		s.add(&Event{Attributes: event.Attributes, Timestamp: event.Timestamp}, now)
+	}
+}
@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_actorStore_add(t *testing.T) {
+	event := func(user string, ts uint64) *Event {
+		return &Event{Attributes: map[string]string{"user": user}, Timestamp: ts}
+	}
+	tests := []struct {
+		name      string
+		maxEvents int
+		retention uint64
+		events    []*Event
+		now       uint64
+		want      map[string][]uint64
+	}{
+		{"Unlimited", 0, 0, []*Event{event("a", 3_000), event("a", 1_000), event("b", 2_000)}, 10_000,
+			map[string][]uint64{"a": {1_000, 3_000}, "b": {2_000}}},
+		{"Max events", 2, 0, []*Event{event("a", 3_000), event("a", 1_000), event("a", 4_000), event("a", 2_000)}, 10_000,
+			map[string][]uint64{"a": {3_000, 4_000}}},
+		{"Retention", 0, 5_000, []*Event{event("a", 6_000), event("a", 4_000), event("b", 7_000)}, 10_000,
+			map[string][]uint64{"a": {6_000}, "b": {7_000}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newActorStore("user", tt.maxEvents, tt.retention)
+			for _, event := range tt.events {
+				s.add(event, tt.now)
+			}
+			if got := actorTimestamps(s); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("timestamps = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_actorStore_prune(t *testing.T) {
+	s := newActorStore("user", 0, milliSecondsInDay)
+	s.add(&Event{Attributes: map[string]string{"user": "a"}, Timestamp: 1_000}, 1_000)
+	s.add(&Event{Attributes: map[string]string{"user": "b"}, Timestamp: 2_000}, 2_000)
+	s.add(&Event{Attributes: map[string]string{"user": "b"}, Timestamp: milliSecondsInDay}, milliSecondsInDay)
+
+	// the first write an hour after the last removal removes the old events
+	now := milliSecondsInDay + 2*milliSecondsInHour
+	s.add(&Event{Attributes: map[string]string{"user": "c"}, Timestamp: now}, now)
+	want := map[string][]uint64{"b": {milliSecondsInDay}, "c": {now}}
+	if got := actorTimestamps(s); !reflect.DeepEqual(got, want) {
+		t.Errorf("timestamps = %v, want %v", got, want)
+	}
+}
+
+func actorTimestamps(s *actorStore) map[string][]uint64 {
+	timestamps := map[string][]uint64{}
+	s.timelines(func(actor string, timeline *actorTimeline) error {
+		for _, event := range timeline.events {
+			timestamps[actor] = append(timestamps[actor], event.ts)
+		}
+		return nil
+	})
+	return timestamps
+}
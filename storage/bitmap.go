@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"math/bits"
+)
+
+// bitmap is a set of small integers such as actor ids.
+type bitmap []uint64
+
+func (b *bitmap) set(i uint32) {
+	word := int(i / 64)
+	if word >= len(*b) {
+		grown := make(bitmap, word+1)
+		copy(grown, *b)
+		*b = grown
+	}
+	(*b)[word] |= 1 << (i % 64)
+}
+
+func (b bitmap) contains(i uint32) bool {
+	word := int(i / 64)
+	return word < len(b) && b[word]&(1<<(i%64)) != 0
+}
+
+// or adds the elements of other to b.
+func (b *bitmap) or(other bitmap) {
+	if len(other) > len(*b) {
+		grown := make(bitmap, len(other))
+		copy(grown, *b)
+		*b = grown
+	}
+	for i, word := range other {
+		(*b)[i] |= word
+	}
+}
+
+// andCount returns the number of elements in both b and other.
+func (b bitmap) andCount(other bitmap) uint64 {
+	if len(other) < len(b) {
+		b, other = other, b
+	}
+	count := 0
+	for i, word := range b {
+		count += bits.OnesCount64(word & other[i])
+	}
+	return uint64(count)
+}
+
+func (b bitmap) count() uint64 {
+	count := 0
+	for _, word := range b {
+		count += bits.OnesCount64(word)
+	}
+	return uint64(count)
+}
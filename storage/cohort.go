@@ -0,0 +1,241 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// MaxRetentionPeriods limits the cohorts, and so the periods, of a retention
+// query.
+const MaxRetentionPeriods = 366
+
+// RetentionQuery groups the actors by the period in which they were first seen,
+// starting at StartTimestamp, and counts for every cohort how many of its
+// actors were active in each following period until EndTimestamp. Activity is
+// recorded per UTC day, so Period is a multiple of a day and StartTimestamp is
+// rounded down to the start of its day.
+type RetentionQuery struct {
+	Id             string `json:"id"`
+	Actor          string `json:"actor"`
+	Period         uint64 `json:"period"` // e.g. 604800000 for weekly cohorts
+	StartTimestamp uint64 `json:"startTimestamp"`
+	EndTimestamp   uint64 `json:"endTimestamp"`
+}
+
+// RetentionResult is the triangle of the cohorts, the first cohort has a value
+// for every period of the range and the last one only for its own period.
+type RetentionResult struct {
+	Id      string   `json:"id"`
+	Cohorts []Cohort `json:"cohorts"`
+}
+
+type Cohort struct {
+	Timestamp uint64    `json:"timestamp"` // start of the period the actors were first seen in
+	Actors    uint64    `json:"actors"`
+	Retained  []uint64  `json:"retained"` // actors active k periods after the first one
+	Rates     []float64 `json:"rates"`    // retained as a share of the actors
+}
+
+// cohortStore records when the actors of an attribute were first seen and on
+// which days they were active. Actors get dense ids so that the activity of a
+// day is a bitmap. It keeps the activity of the last retention ms, 0 means
+// unlimited, and forgets the actors without activity, which count as new when
+// seen again.
+type cohortStore struct {
+	attribute string
+	retention uint64
+	nextPrune uint64 // time of the next hourly removal of old activity, in ms
+	mu        sync.RWMutex
+	ids       map[string]uint32
+	firstSeen []uint64          // by actor id
+	active    map[uint64]bitmap // by day since the epoch
+}
+
+func newCohortStore(attribute string, retention uint64) *cohortStore {
+	return &cohortStore{
+		attribute: attribute,
+		retention: retention,
+		ids:       map[string]uint32{},
+		active:    map[uint64]bitmap{},
+	}
+}
+
+// add records the activity of event at now, the time in ms, unless it is
+// older than the retention.
+func (s *cohortStore) add(event *Event, now uint64) {
+	actor, found := event.Attributes[s.attribute]
+	if !found {
+		return
+	}
+	var cutoff uint64
+	if s.retention > 0 && now > s.retention {
+		cutoff = now - s.retention
+	}
+	if event.Timestamp < cutoff {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.retention > 0 && now >= s.nextPrune {
+		s.nextPrune = now + milliSecondsInHour
+		s.prune(cutoff)
+	}
+
+	id, found := s.ids[actor]
+	if !found {
+		id = uint32(len(s.firstSeen))
+		s.ids[actor] = id
+		s.firstSeen = append(s.firstSeen, event.Timestamp)
+	} else if event.Timestamp < s.firstSeen[id] {
+		s.firstSeen[id] = event.Timestamp
+	}
+	active := s.active[event.Timestamp/milliSecondsInDay]
+	active.set(id)
+	s.active[event.Timestamp/milliSecondsInDay] = active
+}
+
+// prune removes the activity of the days before the one of cutoff and the
+// actors without activity, giving the remaining actors new dense ids.
+func (s *cohortStore) prune(cutoff uint64) {
+	var kept bitmap
+	for day, active := range s.active {
+		if day < cutoff/milliSecondsInDay {
+			delete(s.active, day)
+		} else {
+			kept.or(active)
+		}
+	}
+	if kept.count() == uint64(len(s.firstSeen)) {
+		return
+	}
+
+	ids := make([]uint32, len(s.firstSeen)) // new id by old id
+	firstSeen := make([]uint64, 0, kept.count())
+	for id := range s.firstSeen {
+		if kept.contains(uint32(id)) {
+			ids[id] = uint32(len(firstSeen))
+			firstSeen = append(firstSeen, s.firstSeen[id])
+		}
+	}
+	for actor, id := range s.ids {
+		if kept.contains(id) {
+			s.ids[actor] = ids[id]
+		} else {
+			delete(s.ids, actor)
+		}
+	}
+	for day, active := range s.active {
+		var renumbered bitmap
+		for id := range s.firstSeen {
+			if active.contains(uint32(id)) {
+				renumbered.set(ids[id])
+			}
+		}
+		s.active[day] = renumbered
+	}
+	s.firstSeen = firstSeen
+}
+
+// cohortDump holds a cohort store in a snapshot, Actors and FirstSeen by actor
+// id and the words of the activity bitmaps by day.
+type cohortDump struct {
+	Attribute string              `json:"attribute"`
+	Actors    []string            `json:"actors"`
+	FirstSeen []uint64            `json:"firstSeen"`
+	Active    map[uint64][]uint64 `json:"active"`
+}
+
+func (s *cohortStore) dump() *cohortDump {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	dump := &cohortDump{
+		Attribute: s.attribute,
+		Actors:    make([]string, len(s.firstSeen)),
+		FirstSeen: append([]uint64{}, s.firstSeen...),
+		Active:    make(map[uint64][]uint64, len(s.active)),
+	}
+	for actor, id := range s.ids {
+		dump.Actors[id] = actor
+	}
+	for day, active := range s.active {
+		dump.Active[day] = append([]uint64{}, active...)
+	}
+	return dump
+}
+
+func (s *cohortStore) restore(dump *cohortDump) error {
+	if len(dump.Actors) != len(dump.FirstSeen) {
+		return fmt.Errorf("cohorts of %s have %d actors and %d first seen times", dump.Attribute, len(dump.Actors), len(dump.FirstSeen))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ids = make(map[string]uint32, len(dump.Actors))
+	for id, actor := range dump.Actors {
+		s.ids[actor] = uint32(id)
+	}
+	s.firstSeen = dump.FirstSeen
+	s.active = make(map[uint64]bitmap, len(dump.Active))
+	for day, active := range dump.Active {
+		s.active[day] = active
+	}
+	return nil
+}
+
+func (s *inMemoryStorage) Retention(ctx context.Context, query *RetentionQuery) (*RetentionResult, error) {
+	cohorts, found := s.cohorts[query.Actor]
+	if !found {
+		return nil, fmt.Errorf("events are not stored by actor %q, add it to the actor attributes", query.Actor)
+	}
+	if query.Period == 0 || query.Period%milliSecondsInDay != 0 {
+		return nil, errors.New("the retention period must be a multiple of a day")
+	}
+	start := query.StartTimestamp - query.StartTimestamp%milliSecondsInDay
+	if query.EndTimestamp < start {
+		return nil, errors.New("the end of the range is before its start")
+	}
+	periods := (query.EndTimestamp-start)/query.Period + 1
+	if periods > MaxRetentionPeriods {
+		return nil, fmt.Errorf("retention query exceeds %d periods, increase the period", MaxRetentionPeriods)
+	}
+
+	cohorts.mu.RLock()
+	defer cohorts.mu.RUnlock()
+
+	members := make([]bitmap, periods)
+	for id, firstSeen := range cohorts.firstSeen {
+		if firstSeen >= start && firstSeen <= query.EndTimestamp {
+			members[(firstSeen-start)/query.Period].set(uint32(id))
+		}
+	}
+	active := make([]bitmap, periods)
+	for i := range active {
+		if err := ctx.Err(); err != nil {
+			return nil, queryError(err)
+		}
+		from := (start + uint64(i)*query.Period) / milliSecondsInDay
+		for d := from; d < from+query.Period/milliSecondsInDay; d++ {
+			active[i].or(cohorts.active[d])
+		}
+	}
+
+	result := &RetentionResult{Id: query.Id, Cohorts: make([]Cohort, periods)}
+	for i := range result.Cohorts {
+		cohort := Cohort{
+			Timestamp: start + uint64(i)*query.Period,
+			Actors:    members[i].count(),
+			Retained:  make([]uint64, periods-uint64(i)),
+			Rates:     make([]float64, periods-uint64(i)),
+		}
+		for k := range cohort.Retained {
+			cohort.Retained[k] = members[i].andCount(active[i+k])
+			if cohort.Actors > 0 {
+				cohort.Rates[k] = float64(cohort.Retained[k]) / float64(cohort.Actors)
+			}
+		}
+		result.Cohorts[i] = cohort
+	}
+	return result, nil
+}
@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func Test_inMemoryStorage_Retention(t *testing.T) {
+	config := NewDefaultStorageConfiguration()
+	config.ActorAttributes = []string{"user"}
+	s := Create(config)
+	week := 7 * milliSecondsInDay
+	event := func(user string, ts uint64) Event {
+		return Event{Attributes: map[string]string{"user": user}, Timestamp: ts}
+	}
+	s.Write(&Events{Events: []Event{
+		event("a", 1), event("a", week+1), event("a", 2*week+milliSecondsInDay),
+		event("b", milliSecondsInDay), event("b", 2*week),
+		event("c", week), event("c", week+2*milliSecondsInDay), event("c", 2*week+3),
+		// first seen is the earliest event even if written later
+		event("d", 2*week), event("d", 3),
+		event("e", 3*week),
+	}})
+
+	tests := []struct {
+		name    string
+		query   RetentionQuery
+		want    []Cohort
+		wantErr bool
+	}{
+		{"Weekly triangle", RetentionQuery{Actor: "user", Period: week, StartTimestamp: 0, EndTimestamp: 3*week - 1}, []Cohort{
+			{Timestamp: 0, Actors: 3, Retained: []uint64{3, 1, 3}, Rates: []float64{1, 1.0 / 3, 1}},
+			{Timestamp: week, Actors: 1, Retained: []uint64{1, 1}, Rates: []float64{1, 1}},
+			{Timestamp: 2 * week, Actors: 0, Retained: []uint64{0}, Rates: []float64{0}},
+		}, false},
+		{"Start rounded to the day", RetentionQuery{Actor: "user", Period: week, StartTimestamp: week + 5, EndTimestamp: 2*week - 1}, []Cohort{
+			{Timestamp: week, Actors: 1, Retained: []uint64{1}, Rates: []float64{1}},
+		}, false},
+		{"Unknown actor", RetentionQuery{Actor: "session", Period: week}, nil, true},
+		{"Period not in days", RetentionQuery{Actor: "user", Period: 1000}, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.Retention(context.Background(), &tt.query)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Retention() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(got.Cohorts, tt.want) {
+				t.Errorf("Retention() = %+v, want %+v", got.Cohorts, tt.want)
+			}
+		})
+	}
+}
+
+func Test_cohortStore_prune(t *testing.T) {
+	s := newCohortStore("user", 2*milliSecondsInDay)
+	event := func(user string, ts uint64) *Event {
+		return &Event{Attributes: map[string]string{"user": user}, Timestamp: ts}
+	}
+	s.add(event("a", 1_000), 1_000)
+	s.add(event("b", 2_000), 2_000)
+	s.add(event("c", 3_000), 3_000)
+	s.add(event("c", 2*milliSecondsInDay), 2*milliSecondsInDay)
+	s.add(event("b", 3*milliSecondsInDay), 3*milliSecondsInDay)
+	// older than the retention
+	s.add(event("d", 1_000), 3*milliSecondsInDay)
+
+	// b was forgotten before its activity of the last day
+	want := &cohortDump{
+		Attribute: "user",
+		Actors:    []string{"c", "b"},
+		FirstSeen: []uint64{3_000, 3 * milliSecondsInDay},
+		Active:    map[uint64][]uint64{2: {0b01}, 3: {0b10}},
+	}
+	if got := s.dump(); !reflect.DeepEqual(got, want) {
+		t.Errorf("dump() = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// validateCompareTo returns an error if an offset of CompareTo is 0, is not
+// a multiple of the step or reaches before the epoch.
+func validateCompareTo(query *Query) error {
+	for _, offset := range query.CompareTo {
+		if offset == 0 {
+			return fmt.Errorf("compareTo offsets must be greater than 0")
+		}
+		if query.Step > 0 && offset%query.Step != 0 {
+			return fmt.Errorf("compareTo offset %d is not a multiple of the step %d", offset, query.Step)
+		}
+		if offset > query.StartTimestamp {
+			return fmt.Errorf("compareTo offset %d reaches before the epoch", offset)
+		}
+	}
+	return nil
+}
+
+// compareTo runs query over the window shifted back by every offset of
+// CompareTo and attaches the results as comparisons to the total, the groups
+// and the buckets of result. Groups which are only in a shifted window are
+// added with a value of 0.
+func (s *inMemoryStorage) compareTo(ctx context.Context, query *Query, result *ResultSet) error {
+	shifted := make([]Query, len(query.CompareTo))
+	previous := make([]*ResultSet, len(query.CompareTo))
+	keys := make(map[string]bool, len(result.Groups))
+	for _, group := range result.Groups {
+		keys[groupKey(group.Attributes)] = true
+	}
+	for i, offset := range query.CompareTo {
+		shifted[i] = *query
+		shifted[i].StartTimestamp -= offset
+		shifted[i].EndTimestamp -= offset
+		shifted[i].Explain = false
+		shifted[i].CompareTo = nil
+		var err error
+		if previous[i], err = s.query(ctx, &shifted[i]); err != nil {
+			return err
+		}
+		for _, group := range previous[i].Groups {
+			if key := groupKey(group.Attributes); !keys[key] {
+				keys[key] = true
+				result.Groups = append(result.Groups, *newGroup(query, group.Attributes))
+			}
+		}
+	}
+	sort.Slice(result.Groups, func(i, j int) bool {
+		return groupKey(result.Groups[i].Attributes) < groupKey(result.Groups[j].Attributes)
+	})
+
+	for i, offset := range query.CompareTo {
+		result.Comparisons = append(result.Comparisons, compare(offset, result.Value, result.Measures, previous[i].Value, previous[i].Measures))
+		compareBuckets(offset, result.Buckets, previous[i].Buckets)
+		previousGroups := make(map[string]*Group, len(previous[i].Groups))
+		for j := range previous[i].Groups {
+			previousGroups[groupKey(previous[i].Groups[j].Attributes)] = &previous[i].Groups[j]
+		}
+		for j := range result.Groups {
+			group := &result.Groups[j]
+			previousGroup, found := previousGroups[groupKey(group.Attributes)]
+			if !found {
+				previousGroup = newGroup(&shifted[i], group.Attributes)
+			}
+			group.Comparisons = append(group.Comparisons, compare(offset, group.Value, group.Measures, previousGroup.Value, previousGroup.Measures))
+			compareBuckets(offset, group.Buckets, previousGroup.Buckets)
+		}
+	}
+	return nil
+}
+
+// compareBuckets compares buckets with the ones of the shifted window, as the
+// offset is a multiple of the step both have the same length.
+func compareBuckets(offset uint64, buckets []Bucket, previous []Bucket) {
+	for i := range buckets {
+		if i < len(previous) {
+			buckets[i].Comparisons = append(buckets[i].Comparisons, compare(offset, buckets[i].Value, buckets[i].Measures, previous[i].Value, previous[i].Measures))
+		}
+	}
+}
+
+func compare(offset uint64, value uint64, measures map[string]float64, previousValue uint64, previousMeasures map[string]float64) Comparison {
+	comparison := Comparison{
+		Offset: offset,
+		Value:  previousValue,
+		Delta:  int64(value) - int64(previousValue),
+		Change: change(float64(value), float64(previousValue)),
+	}
+	if len(measures) > 0 {
+		comparison.Measures = make(map[string]MeasureComparison, len(measures))
+		for name, value := range measures {
+			previous := previousMeasures[name]
+			comparison.Measures[name] = MeasureComparison{
+				Value:  previous,
+				Delta:  value - previous,
+				Change: change(value, previous),
+			}
+		}
+	}
+	return comparison
+}
+
+// change returns the change from previous to value in percent, nil if previous
+// is 0.
+func change(value float64, previous float64) *float64 {
+	if previous == 0 {
+		return nil
+	}
+	percent := (value - previous) / previous * 100
+	return &percent
+}
+
+func groupKey(attributes map[string]string) string {
+	names := make([]string, 0, len(attributes))
+	for name := range attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	key := ""
+	for _, name := range names {
+		key += name + "\x00" + attributes[name] + "\x00"
+	}
+	return key
+}
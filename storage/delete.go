@@ -0,0 +1,221 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"sort"
+	"sync/atomic"
+)
+
+// Deletion removes the events which have Attributes and are accepted by
+// Filters from the minute of StartTimestamp to the minute of EndTimestamp,
+// both inclusive.
+type Deletion struct {
+	Attributes     map[string]string `json:"attributes"`
+	Filters        []Filter          `json:"filters,omitempty"`
+	StartTimestamp uint64            `json:"startTimestamp"`
+	EndTimestamp   uint64            `json:"endTimestamp"`
+}
+
+type DeleteResult struct {
+	Deleted uint64 `json:"deleted"` // events removed
+	Series  uint64 `json:"series"`  // series changed
+}
+
+// seriesDeletion holds what is subtracted from a series, by minute.
+type seriesDeletion struct {
+	series *timeSeriesAggregator
+	counts map[uint64]uint64
+	sums   map[string]map[uint64]float64
+}
+
+// Delete subtracts the matching events from every series, so that all
+// resolutions and all series containing them stay in agreement, and signals
+// every subscription. It also deletes from rollups which keep the attributes
+// of the deletion, while actors and cohorts keep the events. The deletion is
+// logged after the changes are computed, so a canceled deletion or one which
+// changes nothing is not logged. Writes wait until the deletion is applied, as
+// its replay computes the changes again from the series at its place in the
+// log.
+func (s *inMemoryStorage) Delete(ctx context.Context, deletion *Deletion) (*DeleteResult, error) {
+	matchers, err := deletion.matchers()
+	if err != nil {
+		return nil, err
+	}
+	s.changes.Lock()
+	defer s.changes.Unlock()
+	result, deletions, err := s.tree.deletions(ctx, matchers, deletion)
+	if err != nil {
+		return nil, queryError(err)
+	}
+	s.mu.RLock()
+	for _, r := range s.rollups {
+		if err := r.covers(&Query{Attributes: deletion.Attributes, Filters: deletion.Filters}); err != nil {
+			log.Printf("Kept deleted events in rollup: %v", err)
+			continue
+		}
+		_, rollupDeletions, err := r.tree.deletions(ctx, matchers, deletion)
+		if err != nil {
+			s.mu.RUnlock()
+			return nil, queryError(err)
+		}
+		deletions = append(deletions, rollupDeletions...)
+	}
+	s.mu.RUnlock()
+
+	if len(deletions) == 0 {
+		return result, nil
+	}
+	if s.wal != nil {
+		if err := s.wal.append(&walRecord{Deletion: deletion}); err != nil {
+			return nil, err
+		}
+		if err := s.wal.flush(); err != nil {
+			return nil, err
+		}
+	}
+	applyDeletions(deletions)
+	s.mu.RLock()
+	for sub := range s.subscriptions {
+		sub.signal()
+	}
+	s.mu.RUnlock()
+	log.Printf("Deleted %d events of %d series matching %v", result.Deleted, result.Series, *deletion)
+	return result, nil
+}
+
+// replayDeletion applies a deletion of the write-ahead log.
+func (s *inMemoryStorage) replayDeletion(deletion *Deletion) error {
+	matchers, err := deletion.matchers()
+	if err != nil {
+		return err
+	}
+	_, deletions, err := s.tree.deletions(context.Background(), matchers, deletion)
+	if err != nil {
+		return err
+	}
+	applyDeletions(deletions)
+	return nil
+}
+
+func (d *Deletion) matchers() ([]pathMatcher, error) {
+	if len(d.Attributes) == 0 && len(d.Filters) == 0 {
+		return nil, errors.New("the deletion needs attributes or filters")
+	}
+	if d.EndTimestamp < d.StartTimestamp {
+		return nil, errors.New("the deletion ends before it starts")
+	}
+	query := &Query{Attributes: d.Attributes, Filters: d.Filters}
+	return query.matchers()
+}
+
+// deletions returns what to subtract from the series to remove the events
+// matching matchers, the conditions of deletion. A series whose path has all
+// conditions loses its buckets in the range, a series lacking some loses the
+// buckets of the series extending its path by them, which hold exactly its
+// matching events. All changes are computed before they are applied, as the
+// series read are changed too.
+func (t *tree) deletions(ctx context.Context, matchers []pathMatcher, deletion *Deletion) (*DeleteResult, []*seriesDeletion, error) {
+	from := tsToMinuteBucket(deletion.StartTimestamp)
+	to := minuteBucketsEnd(deletion.EndTimestamp)
+	conditions := make(map[string]*pathMatcher, len(matchers))
+	for i := range matchers {
+		conditions[matchers[i].name] = &matchers[i]
+	}
+
+	result := &DeleteResult{}
+	var deletions []*seriesDeletion
+	err := t.walk(ctx, func(path []AttributeValue, series *timeSeriesAggregator) error {
+		extended := make([]pathMatcher, 0, len(path)+len(matchers))
+		for _, attribute := range path {
+			if condition, found := conditions[attribute.Name]; found && !condition.accepts(attribute.Value) {
+				return nil
+			}
+			value := attribute.Value
+			extended = append(extended, pathMatcher{name: attribute.Name, value: &value})
+		}
+		hasAll := true
+		for _, condition := range matchers {
+			if !hasPath(path, condition.name) {
+				extended = append(extended, condition)
+				hasAll = false
+			}
+		}
+
+		d := &seriesDeletion{series: series, counts: map[uint64]uint64{}, sums: map[string]map[uint64]float64{}}
+		collect := func(source *timeSeriesAggregator) {
+			source.level("minute").visitBuckets(from, to, nil, func(node *bucketNode) {
+				if count := atomic.LoadUint64(&node.value); count > 0 {
+					d.counts[node.ts] += count
+				}
+			})
+			source.measures.Range(func(name, measure interface{}) bool {
+				measure.(*timeSeriesAggregator).level("minute").visitBuckets(from, to, nil, func(node *bucketNode) {
+					if sum := math.Float64frombits(atomic.LoadUint64(&node.sum)); sum != 0 {
+						if d.sums[name.(string)] == nil {
+							d.sums[name.(string)] = map[uint64]float64{}
+						}
+						d.sums[name.(string)][node.ts] += sum
+					}
+				})
+				return true
+			})
+		}
+		if hasAll {
+			collect(series)
+		} else {
+			sort.Slice(extended, func(i, j int) bool {
+				return extended[i].name < extended[j].name
+			})
+			if err := t.match(ctx, extended, func(values []string, source *timeSeriesAggregator) error {
+				collect(source)
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+		if len(d.counts) == 0 && len(d.sums) == 0 {
+			return nil
+		}
+		deletions = append(deletions, d)
+		if hasAll && len(path) == len(matchers) {
+			for _, count := range d.counts {
+				result.Deleted += count
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	result.Series = uint64(len(deletions))
+	return result, deletions, nil
+}
+
+func applyDeletions(deletions []*seriesDeletion) {
+	for _, d := range deletions {
+		for ts, count := range d.counts {
+			d.series.subtract(ts, count)
+		}
+		for name, sums := range d.sums {
+			for ts, sum := range sums {
+				d.series.measure(name).addSum(ts, -sum)
+			}
+		}
+	}
+}
+
+func (m *pathMatcher) accepts(value string) bool {
+	return (m.value == nil || *m.value == value) && (m.accept == nil || m.accept(value))
+}
+
+func hasPath(path []AttributeValue, name string) bool {
+	for _, attribute := range path {
+		if attribute.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"context"
+	"math"
+	"sync"
+	"testing"
+)
+
+func writeDeleteEvents(s Storage) {
+	s.Write(&Events{Events: []Event{
+		{Attributes: map[string]string{"app": "checkout", "country": "de"}, Measures: map[string]float64{"bytes": 10}, Count: 2, Timestamp: 60_000},
+		{Attributes: map[string]string{"app": "checkout", "country": "fr", "browser": "chrome"}, Timestamp: 2 * milliSecondsInHour},
+		{Attributes: map[string]string{"app": "checkout", "country": "de"}, Timestamp: milliSecondsInDay},
+		{Attributes: map[string]string{"app": "search", "country": "de"}, Measures: map[string]float64{"bytes": 1}, Timestamp: 60_000},
+	}})
+}
+
+func Test_inMemoryStorage_Delete(t *testing.T) {
+	tests := []struct {
+		name        string
+		deletion    Deletion
+		query       Query
+		want        uint64
+		wantBytes   float64
+		wantDeleted uint64
+		wantErr     bool
+	}{
+		{"Deleted series", Deletion{Attributes: map[string]string{"app": "checkout"}, StartTimestamp: 0, EndTimestamp: 3 * milliSecondsInHour},
+			Query{Attributes: map[string]string{"app": "checkout"}, Measures: []string{"bytes"}}, 1, 0, 3, false},
+		{"Series containing deleted events", Deletion{Attributes: map[string]string{"app": "checkout"}, StartTimestamp: 0, EndTimestamp: 3 * milliSecondsInHour},
+			Query{Attributes: map[string]string{"country": "de"}, Measures: []string{"bytes"}}, 2, 1, 3, false},
+		{"Longer path", Deletion{Attributes: map[string]string{"app": "checkout"}, StartTimestamp: 0, EndTimestamp: 3 * milliSecondsInHour},
+			Query{Attributes: map[string]string{"browser": "chrome"}}, 0, 0, 3, false},
+		{"Two conditions", Deletion{Attributes: map[string]string{"app": "checkout", "country": "de"}, StartTimestamp: 0, EndTimestamp: 2 * milliSecondsInDay},
+			Query{Attributes: map[string]string{"app": "checkout"}}, 1, 0, 3, false},
+		{"Filter", Deletion{Filters: []Filter{{Attribute: "app", Operator: "=~", Values: []string{"check.*|search"}}}, StartTimestamp: 60_000, EndTimestamp: 60_000},
+			Query{Attributes: map[string]string{"country": "de"}, Measures: []string{"bytes"}}, 1, 0, 3, false},
+		{"Outside of the range", Deletion{Attributes: map[string]string{"app": "search"}, StartTimestamp: 120_000, EndTimestamp: milliSecondsInMonth},
+			Query{Attributes: map[string]string{"country": "de"}}, 4, 0, 0, false},
+		{"Until the last timestamp", Deletion{Attributes: map[string]string{"app": "checkout"}, StartTimestamp: 0, EndTimestamp: math.MaxUint64},
+			Query{Attributes: map[string]string{"app": "checkout"}}, 0, 0, 4, false},
+		{"No conditions", Deletion{StartTimestamp: 0, EndTimestamp: milliSecondsInMonth}, Query{}, 0, 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := Create(NewDefaultStorageConfiguration())
+			writeDeleteEvents(s)
+			result, err := s.Delete(context.Background(), &tt.deletion)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Delete() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if result.Deleted != tt.wantDeleted {
+				t.Errorf("Delete() deleted = %d, want %d", result.Deleted, tt.wantDeleted)
+			}
+
+			// whole months are read from the month buckets, single minutes from the minute buckets
+			for _, end := range []uint64{milliSecondsInMonth - 1, 2 * milliSecondsInDay} {
+				query := tt.query
+				query.StartTimestamp, query.EndTimestamp = 0, end
+				got, err := s.Query(context.Background(), &query)
+				if err != nil {
+					t.Fatalf("Query() error = %v", err)
+				}
+				if got.Value != tt.want || got.Measures["bytes"] != tt.wantBytes {
+					t.Errorf("Query() until %d = %d, bytes %v, want %d, bytes %v", end, got.Value, got.Measures["bytes"], tt.want, tt.wantBytes)
+				}
+			}
+		})
+	}
+}
+
+func Test_inMemoryStorage_DeleteRollupAndReplay(t *testing.T) {
+	dataFolder := t.TempDir()
+	s, err := Open(walConfiguration(dataFolder))
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	s.AddRollup(&Rollup{Name: "apps", GroupBy: []string{"app"}})
+	writeDeleteEvents(s)
+	deletion := &Deletion{Attributes: map[string]string{"app": "checkout"}, StartTimestamp: 0, EndTimestamp: 3 * milliSecondsInHour}
+	if _, err := s.Delete(context.Background(), deletion); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+
+	query := &Query{Rollup: "apps", Attributes: map[string]string{"app": "checkout"}, StartTimestamp: 0, EndTimestamp: milliSecondsInMonth}
+	if got, _ := s.Query(context.Background(), query); got.Value != 1 {
+		t.Errorf("Query() of the rollup = %d, want 1", got.Value)
+	}
+
+	replayed, err := Open(walConfiguration(dataFolder))
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	for _, attributes := range []map[string]string{{"app": "checkout"}, {"country": "de"}, {"country": "fr"}} {
+		if got, want := countOf(t, replayed, attributes), countOf(t, s, attributes); got != want {
+			t.Errorf("count of %v after replay = %d, want %d", attributes, got, want)
+		}
+	}
+}
+
+func Test_inMemoryStorage_DeleteWhileWriting(t *testing.T) {
+	dataFolder := t.TempDir()
+	config := walConfiguration(dataFolder)
+	config.WalSync = false
+	s, err := Open(config)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	stop := make(chan struct{})
+	var writers sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		writers.Add(1)
+		go func() {
+			defer writers.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				s.Write(&Events{Events: []Event{{Attributes: map[string]string{"app": "checkout", "country": "de"}, Timestamp: uint64(i%10)*milliSecondsInMinute + 1}}})
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		if _, err := s.Delete(context.Background(), &Deletion{Attributes: map[string]string{"country": "de"}, StartTimestamp: 0, EndTimestamp: milliSecondsInHour}); err != nil {
+			t.Fatalf("Delete() error = %v", err)
+		}
+	}
+	close(stop)
+	writers.Wait()
+
+	replayed, err := Open(config)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	for _, attributes := range []map[string]string{{"app": "checkout"}, {"country": "de"}} {
+		if got, want := countOf(t, replayed, attributes), countOf(t, s, attributes); got != want {
+			t.Errorf("count of %v after replay = %d, want %d", attributes, got, want)
+		}
+	}
+}
@@ -1,45 +1,301 @@
 package storage
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io.klector/klector/clock"
+	"math"
+	"time"
+)
+
+// MaxEventCount limits the occurrences a single event may represent, so that
+// bucket counts cannot overflow.
+const MaxEventCount uint64 = math.MaxUint32
+
 type Event struct {
-	Id         string            `json:"id"`
-	Attributes map[string]string `json:"attributes"`
-	Timestamp  uint64            `json:"timestamp"`
+	Id         string             `json:"id"`
+	Attributes map[string]string  `json:"attributes"`
+	Measures   map[string]float64 `json:"measures,omitempty"` // values of a single occurrence
+	Count      uint64             `json:"count,omitempty"`    // occurrences represented by the event, 0 means 1
+	Timestamp  uint64             `json:"timestamp"`
+}
+
+func (e *Event) Weight() uint64 {
+	if e.Count == 0 {
+		return 1
+	}
+	return e.Count
+}
+
+func (e *Event) Validate() error {
+	if len(e.Attributes) == 0 {
+		return errors.New("attributes are not defined in event")
+	}
+	if e.Timestamp == 0 {
+		return errors.New("timestamp cannot be 0")
+	}
+	if e.Count > MaxEventCount {
+		return fmt.Errorf("count %d exceeds the maximum of %d", e.Count, MaxEventCount)
+	}
+	for name, value := range e.Measures {
+		if math.IsNaN(value) || math.IsInf(value*float64(e.Weight()), 0) {
+			return fmt.Errorf("measure %s is not a finite number", name)
+		}
+	}
+	return nil
 }
 
 type Events struct {
 	Events []Event `json:"events"`
 }
 
+// EventError is the error of an event which was not written, Index is its
+// position in the written events.
+type EventError struct {
+	Index int
+	Err   error
+}
+
+// WriteErrors is returned by Write for the events which were not written, all
+// other events were.
+type WriteErrors []EventError
+
+func (e WriteErrors) Error() string {
+	if len(e) == 1 {
+		return fmt.Sprintf("event %d: %s", e[0].Index, e[0].Err.Error())
+	}
+	return fmt.Sprintf("%d events not written, event %d: %s", len(e), e[0].Index, e[0].Err.Error())
+}
+
+func (e WriteErrors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i := range e {
+		errs[i] = e[i].Err
+	}
+	return errs
+}
+
+// Filter restricts an attribute to values matching the operator, events
+// without the attribute never match.
+type Filter struct {
+	Attribute string   `json:"attribute"`
+	Operator  string   `json:"operator"` // one of =, !=, =~, !~, in, not in
+	Values    []string `json:"values"`
+}
+
 type Query struct {
 	Id             string            `json:"id"`
 	Attributes     map[string]string `json:"attributes"`
+	Filters        []Filter          `json:"filters,omitempty"`
+	GroupBy        []string          `json:"groupBy,omitempty"`
+	Measures       []string          `json:"measures,omitempty"`
 	StartTimestamp uint64            `json:"startTimestamp"`
 	EndTimestamp   uint64            `json:"endTimestamp"`
+	Step           uint64            `json:"step,omitempty"`      // bucket length in ms, no buckets if 0
+	Explain        bool              `json:"explain,omitempty"`   // return the plan with the result
+	CompareTo      []uint64          `json:"compareTo,omitempty"` // offsets in ms of earlier windows to compare with
+	Rollup         string            `json:"rollup,omitempty"`    // name of the rollup to read instead of all events
+}
+
+type Bucket struct {
+	Timestamp   uint64             `json:"timestamp"`
+	Value       uint64             `json:"value"`
+	Measures    map[string]float64 `json:"measures,omitempty"`
+	Comparisons []Comparison       `json:"comparisons,omitempty"`
+}
+
+type Group struct {
+	Attributes  map[string]string  `json:"attributes"`
+	Value       uint64             `json:"value"`
+	Measures    map[string]float64 `json:"measures,omitempty"`
+	Buckets     []Bucket           `json:"buckets,omitempty"`
+	Comparisons []Comparison       `json:"comparisons,omitempty"`
 }
 
 type ResultSet struct {
-	Id         string            `json:"id"`
-	Attributes map[string]string `json:"attributes"`
-	Value      uint64            `json:"value"`
+	Id          string             `json:"id"`
+	Attributes  map[string]string  `json:"attributes"`
+	Value       uint64             `json:"value"`
+	Measures    map[string]float64 `json:"measures,omitempty"`
+	Buckets     []Bucket           `json:"buckets,omitempty"`
+	Groups      []Group            `json:"groups,omitempty"`
+	Comparisons []Comparison       `json:"comparisons,omitempty"`
+	Plan        *Plan              `json:"plan,omitempty"`
+}
+
+// Comparison holds the value of the same attributes in the window shifted back
+// by Offset, and the change from it to the current value. Groups which are only
+// in a shifted window have a current value of 0.
+type Comparison struct {
+	Offset   uint64                       `json:"offset"`
+	Value    uint64                       `json:"value"`
+	Delta    int64                        `json:"delta"`
+	Change   *float64                     `json:"change"` // in percent, null if Value is 0
+	Measures map[string]MeasureComparison `json:"measures,omitempty"`
+}
+
+type MeasureComparison struct {
+	Value  float64  `json:"value"`
+	Delta  float64  `json:"delta"`
+	Change *float64 `json:"change"`
 }
 
+var (
+	ErrQueryTimeout  = errors.New("query timed out")
+	ErrQueryCanceled = errors.New("query canceled")
+	ErrQueryLimit    = errors.New("query limit exceeded")
+)
+
 type Storage interface {
+	// Write writes every event it can and returns WriteErrors for the others.
+	// Any other error means that the written events may not be durable.
 	Write(events *Events) error
-	Query(query *Query) (*ResultSet, error)
+	// Query stops with ErrQueryTimeout or ErrQueryCanceled when ctx is done.
+	Query(ctx context.Context, query *Query) (*ResultSet, error)
+	// Funnel needs the actor of the query in the actor attributes.
+	Funnel(ctx context.Context, query *FunnelQuery) (*FunnelResult, error)
+	// Retention needs the actor of the query in the actor attributes.
+	Retention(ctx context.Context, query *RetentionQuery) (*RetentionResult, error)
+	// Delete removes events from the series and rollups, see Deletion.
+	Delete(ctx context.Context, deletion *Deletion) (*DeleteResult, error)
+	// AddRollup adds a rollup with the events written before, see Rollup.
+	AddRollup(rollup *Rollup) error
+	// RemoveRollup returns ErrUnknownRollup if there is no rollup with name.
+	RemoveRollup(name string) error
+	Rollups() ([]Rollup, error)
+	// Subscribe signals writes which may change the result of query until
+	// the subscription is closed.
+	Subscribe(query *Query) (Subscription, error)
+	// Tail passes the written events which match query to a buffer of
+	// bufferSize events until the tail is closed.
+	Tail(query *Query, sampleRate float64, bufferSize int) (Tail, error)
+	// Export passes every series with its buckets to visit, stopping at the
+	// first error of visit or when ctx is done.
+	Export(ctx context.Context, visit func(*SeriesDump) error) error
+	// Import adds the buckets of an exported series.
+	Import(dump *SeriesDump) error
+	// Backup returns a reader of the last snapshot and the write-ahead log
+	// after it up to its current record, and the seq of the record. The log
+	// may grow while it is read. It returns ErrNoWal if the storage has no
+	// write-ahead log.
+	Backup() (io.ReadCloser, uint64, error)
+	// Snapshot writes the storage to a snapshot in the data folder, which
+	// replaces the write-ahead log up to its current record, and returns the
+	// seq of the record. It returns ErrNoWal if the storage has no
+	// write-ahead log.
+	Snapshot() (uint64, error)
+	// LateEvents counts the events which changed past minutes or were
+	// outside of the acceptance window.
+	LateEvents() (*LateEventStats, error)
+	// Quarantine returns the quarantined events, oldest first.
+	Quarantine() ([]QuarantinedEvent, error)
+	// ClearQuarantine drops the quarantined events and returns their number.
+	ClearQuarantine() (int, error)
+	Keys() ([]string, error)
+	Values(key string) ([]string, error)
+	// AttributeSets returns the distinct sorted attribute names which written
+	// events have, so that series of exactly these attributes can be told
+	// apart from the series of their subsets.
+	AttributeSets() ([][]string, error)
 }
 
 type StorageConfiguration struct {
-	DataFolder string `json:"dataFolder"`
+	DataFolder   string `json:"dataFolder"`
+	MaxQueryCost uint64 `json:"maxQueryCost"` // estimated buckets a query may read, 0 means unlimited
+	MaxSeries    uint64 `json:"maxSeries"`    // series a query may match, 0 means unlimited
+	MaxRows      uint64 `json:"maxRows"`      // groups times buckets of a result, 0 means unlimited
+	// ActorAttributes identify actors, e.g. user_id, whose events are kept
+	// in time order for funnels and whose activity is kept for retention.
+	ActorAttributes []string `json:"actorAttributes"`
+	// MaxActorEvents limits the events kept per actor, the oldest are
+	// dropped, and ActorRetention drops the events and the activity of actors
+	// which are older than it, 0 means unlimited. Funnels and retention only
+	// see the kept events, actors without activity since count as new.
+	MaxActorEvents int           `json:"maxActorEvents"`
+	ActorRetention time.Duration `json:"actorRetention"`
+	// MaxEventIds is the number of ids of written events which are remembered
+	// to drop events written again with the same id, 0 disables it. It is
+	// disabled by default, as clients may reuse ids for distinct events.
+	MaxEventIds uint64 `json:"maxEventIds"`
+	// Wal logs every change to a write-ahead log in DataFolder, which is
+	// replayed by Open after the last snapshot. The log holds every change
+	// since the snapshot, see Storage.Snapshot. The rollups are kept in
+	// DataFolder too and their series are rebuilt by Open.
+	Wal     bool `json:"wal"`
+	WalSync bool `json:"walSync"` // sync the log to disk before writes return
+	// MaxLateness and MaxFutureSkew limit how far before and after the time
+	// of writing the timestamp of an event may be, 0 means unlimited. Events
+	// outside of this window are handled by OutOfWindowPolicy: reject, clamp
+	// or quarantine.
+	MaxLateness       time.Duration `json:"maxLateness"`
+	MaxFutureSkew     time.Duration `json:"maxFutureSkew"`
+	OutOfWindowPolicy string        `json:"outOfWindowPolicy"`
+	MaxQuarantine     int           `json:"maxQuarantine"` // quarantined events kept, the oldest are dropped
 }
 
 func NewDefaultStorageConfiguration() *StorageConfiguration {
 	return &StorageConfiguration{
-		DataFolder: "./data",
+		DataFolder:        "./data",
+		MaxQueryCost:      100_000_000,
+		MaxSeries:         100_000,
+		MaxRows:           1_000_000,
+		WalSync:           true,
+		OutOfWindowPolicy: RejectOutOfWindow,
+		MaxQuarantine:     10_000,
+		MaxActorEvents:    10_000,
 	}
 }
 
+// Open creates the storage and, if config.Wal is set, replays the
+// write-ahead log of the data folder and logs further changes to it.
+func Open(config *StorageConfiguration) (Storage, error) {
+	if err := validateOutOfWindowPolicy(config.OutOfWindowPolicy); err != nil {
+		return nil, err
+	}
+	s := Create(config)
+	if !config.Wal {
+		return s, nil
+	}
+	memory := s.(*inMemoryStorage)
+	w, err := openWal(config.DataFolder, config.WalSync, memory.now, memory.replay)
+	if err != nil {
+		return nil, err
+	}
+	memory.wal = w
+	if err := memory.loadRollups(config.DataFolder); err != nil {
+		w.file.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Create creates an empty storage without write-ahead log. Events outside of
+// the acceptance window are rejected if the policy is unknown.
 func Create(config *StorageConfiguration) Storage {
+	actors := make(map[string]*actorStore, len(config.ActorAttributes))
+	cohorts := make(map[string]*cohortStore, len(config.ActorAttributes))
+	for _, attribute := range config.ActorAttributes {
+		actors[attribute] = newActorStore(attribute, config.MaxActorEvents, uint64(config.ActorRetention.Milliseconds()))
+		cohorts[attribute] = newCohortStore(attribute, uint64(config.ActorRetention.Milliseconds()))
+	}
+	var ids *eventIds
+	if config.MaxEventIds > 0 {
+		ids = newEventIds(config.MaxEventIds)
+	}
 	return &inMemoryStorage{
-		tree: newTree(),
+		tree:          newTree(),
+		ids:           ids,
+		window:        newAcceptanceWindow(config),
+		clock:         clock.System(),
+		actors:        actors,
+		cohorts:       cohorts,
+		rollups:       map[string]*rollup{},
+		subscriptions: map[*subscription]bool{},
+		tails:         map[*tail]bool{},
+		maxQueryCost:  config.MaxQueryCost,
+		maxSeries:     config.MaxSeries,
+		maxRows:       config.MaxRows,
 	}
 }
@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"sync"
+)
+
+// eventIds remembers the ids of the last written events, so that events which
+// are written again, e.g. by a client retrying a write whose response was
+// lost, are counted once.
+type eventIds struct {
+	mu    sync.Mutex
+	ids   map[string]bool
+	order []string // ring of the ids by age
+	next  int
+}
+
+func newEventIds(max uint64) *eventIds {
+	return &eventIds{
+		ids:   make(map[string]bool),
+		order: make([]string, max),
+	}
+}
+
+// add returns false if id was already added, the oldest id is forgotten when
+// the maximum is reached.
+func (e *eventIds) add(id string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.ids[id] {
+		return false
+	}
+	if oldest := e.order[e.next]; oldest != "" {
+		delete(e.ids, oldest)
+	}
+	e.order[e.next] = id
+	e.next = (e.next + 1) % len(e.order)
+	e.ids[id] = true
+	return true
+}
+
+// remove forgets a recently added id, e.g. of an event which could not be
+// written after all.
+func (e *eventIds) remove(id string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.ids[id] {
+		return
+	}
+	delete(e.ids, id)
+	for i := 1; i <= len(e.order); i++ {
+		slot := (e.next - i + len(e.order)) % len(e.order)
+		if e.order[slot] == id {
+			e.order[slot] = ""
+			return
+		}
+	}
+}
+
+// list returns the remembered ids, oldest first.
+func (e *eventIds) list() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ids := make([]string, 0, len(e.ids))
+	for i := range e.order {
+		if id := e.order[(e.next+i)%len(e.order)]; id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// reset forgets all ids and adds ids, oldest first.
+func (e *eventIds) reset(ids []string) {
+	e.mu.Lock()
+	e.ids = make(map[string]bool)
+	e.order = make([]string, len(e.order))
+	e.next = 0
+	e.mu.Unlock()
+	for _, id := range ids {
+		e.add(id)
+	}
+}
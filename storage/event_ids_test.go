@@ -0,0 +1,43 @@
+package storage
+
+import (
+	"testing"
+)
+
+func Test_eventIds_add(t *testing.T) {
+	ids := newEventIds(2)
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{"a", true},
+		{"a", false},
+		{"b", true},
+		{"c", true}, // forgets a
+		{"b", false},
+		{"a", true},
+	}
+
+	for _, tt := range tests {
+		if got := ids.add(tt.id); got != tt.want {
+			t.Errorf("add(%q) = %v, want %v", tt.id, got, tt.want)
+		}
+	}
+}
+
+func Test_eventIds_remove(t *testing.T) {
+	ids := newEventIds(2)
+	ids.add("a")
+	ids.add("b")
+	ids.remove("a")
+	if !ids.add("a") {
+		t.Errorf("add(%q) = false after remove, want true", "a")
+	}
+	ids.add("c") // forgets b, not the new a
+	if ids.add("a") {
+		t.Errorf("add(%q) = true, want false", "a")
+	}
+	if !ids.add("b") {
+		t.Errorf("add(%q) = false, want true", "b")
+	}
+}
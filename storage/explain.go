@@ -0,0 +1,76 @@
+package storage
+
+// Plan describes how a query reads the time series. It is returned with the
+// result of queries with Explain set.
+type Plan struct {
+	SeriesMatched uint64      `json:"seriesMatched"`
+	Levels        []LevelPlan `json:"levels"`
+	EstimatedCost uint64      `json:"estimatedCost"`     // buckets the query is expected to read
+	MaxCost       uint64      `json:"maxCost,omitempty"` // 0 means unlimited
+	Rejected      bool        `json:"rejected,omitempty"`
+}
+
+// LevelPlan holds the reads of one time series level, from month to minute.
+type LevelPlan struct {
+	Name             string `json:"name"`
+	EstimatedBuckets uint64 `json:"estimatedBuckets"`
+	Descents         uint64 `json:"descents"`       // bucket ranges read from the level
+	BucketsScanned   uint64 `json:"bucketsScanned"` // bucket nodes passed, including the ones before the range
+}
+
+// seriesLayout provides the levels of every time series to the estimation,
+// which only depends on their steps.
+var seriesLayout = newTimeSeries()
+
+func newPlan(query *Query, seriesMatched uint64, maxCost uint64) *Plan {
+	plan := &Plan{SeriesMatched: seriesMatched, MaxCost: maxCost}
+	for level := seriesLayout; level != nil; level = level.subRange {
+		plan.Levels = append(plan.Levels, LevelPlan{Name: level.name})
+	}
+
+	// every series reads the query range and each step bucket, once for the
+	// count and once per measure
+	estimate := func(start uint64, end uint64) {
+		seriesLayout.walk(tsToMinuteBucket(start), minuteBucketsEnd(end), func(level *timeSeriesAggregator, first uint64, last uint64) {
+			plan.level(level.name).EstimatedBuckets += (last - first) / level.timeStep
+		})
+	}
+	estimate(query.StartTimestamp, query.EndTimestamp)
+	query.forEachStep(func(ts uint64) {
+		start, end := ts, ts+query.Step-1
+		if start < query.StartTimestamp {
+			start = query.StartTimestamp
+		}
+		if end < ts || end > query.EndTimestamp {
+			end = query.EndTimestamp
+		}
+		estimate(start, end)
+	})
+
+	reads := seriesMatched * uint64(1+len(query.Measures))
+	for i := range plan.Levels {
+		plan.Levels[i].EstimatedBuckets *= reads
+		plan.EstimatedCost += plan.Levels[i].EstimatedBuckets
+	}
+	plan.Rejected = maxCost > 0 && plan.EstimatedCost > maxCost
+	return plan
+}
+
+func (p *Plan) level(name string) *LevelPlan {
+	for i := range p.Levels {
+		if p.Levels[i].Name == name {
+			return &p.Levels[i]
+		}
+	}
+	return nil
+}
+
+// record adds a range of buckets read from a level, a nil plan records nothing.
+func (p *Plan) record(level string, buckets uint64) {
+	if p == nil {
+		return
+	}
+	l := p.level(level)
+	l.Descents++
+	l.BucketsScanned += buckets
+}
@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync/atomic"
+)
+
+// SeriesDump holds one series of the tree with its minute buckets, from which
+// importing it rebuilds the buckets of the coarser resolutions.
+type SeriesDump struct {
+	Attributes []AttributeValue        `json:"attributes"`         // path of the series, sorted by name
+	Buckets    []BucketDump            `json:"buckets"`            // counts by minute
+	Measures   map[string][]BucketDump `json:"measures,omitempty"` // sums by minute
+	Complete   bool                    `json:"complete,omitempty"` // events had exactly the attributes, see AttributeSets
+}
+
+type AttributeValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type BucketDump struct {
+	Timestamp uint64  `json:"ts"`
+	Count     uint64  `json:"count,omitempty"`
+	Sum       float64 `json:"sum,omitempty"`
+}
+
+// Export calls visit for every series of the tree, in order of attribute
+// names and values. Rollups, actors and event ids are not exported. Each
+// series is read once, but an event written during the export may only be in
+// some of the series it belongs to.
+func (s *inMemoryStorage) Export(ctx context.Context, visit func(*SeriesDump) error) error {
+	return s.tree.walk(ctx, func(path []AttributeValue, series *timeSeriesAggregator) error {
+		dump := dumpSeries(path, series)
+		dump.Complete = s.tree.hasAttributeSet(path)
+		return visit(dump)
+	})
+}
+
+func dumpSeries(path []AttributeValue, series *timeSeriesAggregator) *SeriesDump {
+	dump := &SeriesDump{
+		Attributes: path,
+		Buckets:    dumpMinutes(series, false),
+	}
+	for _, name := range sortedKeys(series.measures) {
+		if dump.Measures == nil {
+			dump.Measures = map[string][]BucketDump{}
+		}
+		dump.Measures[name] = dumpMinutes(series.measure(name), true)
+	}
+	return dump
+}
+
+func dumpMinutes(series *timeSeriesAggregator, sums bool) []BucketDump {
+	buckets := []BucketDump{}
+	series.level("minute").visitBuckets(0, math.MaxUint64, nil, func(node *bucketNode) {
+		if sums {
+			buckets = append(buckets, BucketDump{Timestamp: node.ts, Sum: math.Float64frombits(atomic.LoadUint64(&node.sum))})
+		} else {
+			buckets = append(buckets, BucketDump{Timestamp: node.ts, Count: atomic.LoadUint64(&node.value)})
+		}
+	})
+	return buckets
+}
+
+// Import adds the minute buckets of dump to the series of its path and to the
+// coarser resolutions, whose sums may differ from the exported series by
+// rounding.
+func (s *inMemoryStorage) Import(dump *SeriesDump) error {
+	if len(dump.Attributes) == 0 {
+		return errors.New("series has no attributes")
+	}
+	for i := 1; i < len(dump.Attributes); i++ {
+		if dump.Attributes[i-1].Name >= dump.Attributes[i].Name {
+			return fmt.Errorf("attributes of series are not sorted by name at %q", dump.Attributes[i].Name)
+		}
+	}
+	if err := validateMinutes(dump.Buckets); err != nil {
+		return err
+	}
+	for name, buckets := range dump.Measures {
+		if err := validateMinutes(buckets); err != nil {
+			return fmt.Errorf("measure %s: %w", name, err)
+		}
+	}
+
+	s.changes.RLock()
+	defer s.changes.RUnlock()
+	if s.wal != nil {
+		if err := s.wal.append(&walRecord{Series: dump}); err != nil {
+			return err
+		}
+		if err := s.wal.flush(); err != nil {
+			return err
+		}
+	}
+	s.importSeries(dump)
+	return nil
+}
+
+func (s *inMemoryStorage) importSeries(dump *SeriesDump) {
+	if dump.Complete {
+		names := make([]string, len(dump.Attributes))
+		for i, attribute := range dump.Attributes {
+			names[i] = attribute.Name
+		}
+		s.tree.addAttributeSet(names)
+	}
+	series := s.tree.series(dump.Attributes)
+	for _, bucket := range dump.Buckets {
+		if bucket.Count > 0 {
+			series.add(bucket.Timestamp, bucket.Count)
+		}
+	}
+	for name, buckets := range dump.Measures {
+		for _, bucket := range buckets {
+			series.measure(name).addSum(bucket.Timestamp, bucket.Sum)
+		}
+	}
+}
+
+func validateMinutes(buckets []BucketDump) error {
+	for _, bucket := range buckets {
+		if tsToMinuteBucket(bucket.Timestamp) != bucket.Timestamp {
+			return fmt.Errorf("bucket %d is not aligned to a minute", bucket.Timestamp)
+		}
+		if math.IsNaN(bucket.Sum) || math.IsInf(bucket.Sum, 0) {
+			return fmt.Errorf("sum of bucket %d is not a finite number", bucket.Timestamp)
+		}
+	}
+	return nil
+}
+
+// series returns the series at the end of path, creating the nodes on the way.
+func (t *tree) series(path []AttributeValue) *timeSeriesAggregator {
+	n, attrValue := t.root, ""
+	for _, attribute := range path {
+		child, _ := n.children(attrValue).LoadOrStore(attribute.Name, newNode())
+		n, attrValue = child.(*node), attribute.Value
+	}
+	series, _ := n.tseriesByAttrValue.LoadOrStore(attrValue, newTimeSeries())
+	return series.(*timeSeriesAggregator)
+}
@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func exportAll(t *testing.T, s Storage) []*SeriesDump {
+	var dumps []*SeriesDump
+	if err := s.Export(context.Background(), func(dump *SeriesDump) error {
+		dumps = append(dumps, dump)
+		return nil
+	}); err != nil {
+		t.Fatalf("Export() error = %v", err)
+	}
+	return dumps
+}
+
+func Test_inMemoryStorage_ExportImport(t *testing.T) {
+	source := Create(NewDefaultStorageConfiguration())
+	source.Write(&Events{Events: []Event{
+		{Attributes: map[string]string{"app": "checkout", "country": "de"}, Measures: map[string]float64{"bytes": 0.1}, Timestamp: 1_000},
+		{Attributes: map[string]string{"app": "checkout", "country": "fr"}, Measures: map[string]float64{"bytes": 0.2}, Count: 3, Timestamp: 61_000},
+		{Attributes: map[string]string{"app": "search"}, Timestamp: milliSecondsInMonth + 5_000},
+	}})
+
+	dumps := exportAll(t, source)
+	if len(dumps) != 6 {
+		t.Fatalf("Export() got %d series, want 6", len(dumps))
+	}
+	if want := []AttributeValue{{Name: "app", Value: "checkout"}, {Name: "country", Value: "de"}}; !reflect.DeepEqual(dumps[1].Attributes, want) {
+		t.Errorf("Export() second series = %v, want %v", dumps[1].Attributes, want)
+	}
+
+	target := Create(NewDefaultStorageConfiguration())
+	for _, dump := range dumps {
+		if err := target.Import(dump); err != nil {
+			t.Fatalf("Import() error = %v", err)
+		}
+	}
+	if got := exportAll(t, target); !reflect.DeepEqual(got, dumps) {
+		t.Errorf("Export() after Import() differs from the imported series")
+	}
+
+	queries := []Query{
+		{Attributes: map[string]string{"app": "checkout"}, Measures: []string{"bytes"}, StartTimestamp: 0, EndTimestamp: 2 * milliSecondsInMonth},
+		{GroupBy: []string{"app", "country"}, Measures: []string{"bytes"}, StartTimestamp: 0, EndTimestamp: 2 * milliSecondsInMonth, Step: milliSecondsInDay},
+		{Attributes: map[string]string{"app": "search"}, StartTimestamp: milliSecondsInMonth, EndTimestamp: milliSecondsInMonth + 60_000},
+	}
+	for _, query := range queries {
+		want, err := source.Query(context.Background(), &query)
+		if err != nil {
+			t.Fatalf("Query() error = %v", err)
+		}
+		got, err := target.Query(context.Background(), &query)
+		if err != nil {
+			t.Fatalf("Query() error = %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Query() of imported series = %v, want %v", got, want)
+		}
+	}
+}
+
+func Test_inMemoryStorage_Import(t *testing.T) {
+	tests := []struct {
+		name    string
+		dump    SeriesDump
+		wantErr bool
+	}{
+		{"Valid", SeriesDump{Attributes: []AttributeValue{{"app", "a"}}, Buckets: []BucketDump{{Timestamp: 60_000, Count: 1}}}, false},
+		{"No attributes", SeriesDump{Buckets: []BucketDump{{Timestamp: 60_000, Count: 1}}}, true},
+		{"Unsorted attributes", SeriesDump{Attributes: []AttributeValue{{"b", "1"}, {"a", "1"}}}, true},
+		{"Unaligned bucket", SeriesDump{Attributes: []AttributeValue{{"app", "a"}}, Buckets: []BucketDump{{Timestamp: 1_000, Count: 1}}}, true},
+		{"Unaligned measure bucket", SeriesDump{Attributes: []AttributeValue{{"app", "a"}}, Measures: map[string][]BucketDump{"bytes": {{Timestamp: 1, Sum: 1}}}}, true},
+		{"Sum is not finite", SeriesDump{Attributes: []AttributeValue{{"app", "a"}}, Measures: map[string][]BucketDump{"bytes": {{Timestamp: 60_000, Sum: math.Inf(1)}}}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := Create(NewDefaultStorageConfiguration())
+			if err := s.Import(&tt.dump); (err != nil) != tt.wantErr {
+				t.Errorf("Import() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if keys, _ := s.Keys(); tt.wantErr && len(keys) > 0 {
+				t.Errorf("Import() of an invalid series added keys %v", keys)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+// MaxQueryBuckets limits the number of buckets a query with a step may return.
+const MaxQueryBuckets = 11000
+
+func (f *Filter) compile() (func(string) bool, error) {
+	switch f.Operator {
+	case "=", "!=", "in", "not in":
+		if (f.Operator == "=" || f.Operator == "!=") && len(f.Values) != 1 {
+			return nil, fmt.Errorf("filter %s %s needs exactly one value", f.Attribute, f.Operator)
+		}
+		values := make(map[string]bool, len(f.Values))
+		for _, value := range f.Values {
+			values[value] = true
+		}
+		negate := f.Operator == "!=" || f.Operator == "not in"
+		return func(value string) bool {
+			return values[value] != negate
+		}, nil
+	case "=~", "!~":
+		if len(f.Values) != 1 {
+			return nil, fmt.Errorf("filter %s %s needs exactly one value", f.Attribute, f.Operator)
+		}
+		re, err := regexp.Compile("^(?:" + f.Values[0] + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("filter %s: %s", f.Attribute, err.Error())
+		}
+		negate := f.Operator == "!~"
+		return func(value string) bool {
+			return re.MatchString(value) != negate
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported filter operator %q", f.Operator)
+}
+
+// matchers returns the tree path of the query: its attributes, filtered and
+// grouped attributes sorted by name.
+func (q *Query) matchers() ([]pathMatcher, error) {
+	byName := map[string]*pathMatcher{}
+	matcher := func(name string) *pathMatcher {
+		m, found := byName[name]
+		if !found {
+			m = &pathMatcher{name: name}
+			byName[name] = m
+		}
+		return m
+	}
+
+	for name, value := range q.Attributes {
+		value := value
+		matcher(name).value = &value
+	}
+	for _, name := range q.GroupBy {
+		matcher(name)
+	}
+	for i := range q.Filters {
+		accept, err := q.Filters[i].compile()
+		if err != nil {
+			return nil, err
+		}
+		m := matcher(q.Filters[i].Attribute)
+		if previous := m.accept; previous != nil {
+			m.accept = func(value string) bool {
+				return previous(value) && accept(value)
+			}
+		} else {
+			m.accept = accept
+		}
+	}
+
+	matchers := make([]pathMatcher, 0, len(byName))
+	for _, m := range byName {
+		matchers = append(matchers, *m)
+	}
+	sort.Slice(matchers, func(i, j int) bool {
+		return matchers[i].name < matchers[j].name
+	})
+	return matchers, nil
+}
+
+// attributesMatcher returns whether the attributes of an event have all of
+// attributes and are accepted by filters.
+func attributesMatcher(attributes map[string]string, filters []Filter) (func(map[string]string) bool, error) {
+	accepts := make(map[string]func(string) bool, len(filters))
+	for i := range filters {
+		accept, err := filters[i].compile()
+		if err != nil {
+			return nil, err
+		}
+		if previous := accepts[filters[i].Attribute]; previous != nil {
+			accepts[filters[i].Attribute] = func(value string) bool {
+				return previous(value) && accept(value)
+			}
+		} else {
+			accepts[filters[i].Attribute] = accept
+		}
+	}
+	return func(eventAttributes map[string]string) bool {
+		for name, value := range attributes {
+			if eventAttributes[name] != value {
+				return false
+			}
+		}
+		for name, accept := range accepts {
+			value, found := eventAttributes[name]
+			if !found || !accept(value) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// eventMatcher returns whether the attributes of an event have the attributes
+// and GroupBy attributes of the query and are accepted by its filters.
+func (q *Query) eventMatcher() (func(map[string]string) bool, error) {
+	match, err := attributesMatcher(q.Attributes, q.Filters)
+	if err != nil {
+		return nil, err
+	}
+	groupBy := q.GroupBy
+	return func(attributes map[string]string) bool {
+		for _, name := range groupBy {
+			if _, found := attributes[name]; !found {
+				return false
+			}
+		}
+		return match(attributes)
+	}, nil
+}
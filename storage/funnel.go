@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// MaxFunnelSteps limits the steps of a funnel query.
+const MaxFunnelSteps = 32
+
+// FunnelQuery counts the actors which completed the steps in order, starting
+// with a first step between StartTimestamp and EndTimestamp and reaching every
+// further step within Window milliseconds of the first one.
+type FunnelQuery struct {
+	Id             string       `json:"id"`
+	Actor          string       `json:"actor"` // attribute identifying the actor, e.g. user_id
+	Steps          []FunnelStep `json:"steps"`
+	Window         uint64       `json:"window"`
+	StartTimestamp uint64       `json:"startTimestamp"`
+	EndTimestamp   uint64       `json:"endTimestamp"`
+}
+
+// FunnelStep matches the events with all of its attributes and filters.
+type FunnelStep struct {
+	Name       string            `json:"name,omitempty"`
+	Attributes map[string]string `json:"attributes"`
+	Filters    []Filter          `json:"filters,omitempty"`
+}
+
+type FunnelResult struct {
+	Id    string             `json:"id"`
+	Steps []FunnelStepResult `json:"steps"`
+}
+
+type FunnelStepResult struct {
+	Name           string  `json:"name,omitempty"`
+	Actors         uint64  `json:"actors"`
+	Conversion     float64 `json:"conversion"`     // share of the actors of the first step
+	StepConversion float64 `json:"stepConversion"` // share of the actors of the previous step
+}
+
+func (s *inMemoryStorage) Funnel(ctx context.Context, query *FunnelQuery) (*FunnelResult, error) {
+	actors, found := s.actors[query.Actor]
+	if !found {
+		return nil, fmt.Errorf("events are not stored by actor %q, add it to the actor attributes", query.Actor)
+	}
+	if len(query.Steps) == 0 || len(query.Steps) > MaxFunnelSteps {
+		return nil, fmt.Errorf("a funnel needs between 1 and %d steps", MaxFunnelSteps)
+	}
+	if query.Window == 0 {
+		return nil, errors.New("the funnel window must be greater than 0")
+	}
+	matchers := make([]func(map[string]string) bool, len(query.Steps))
+	for i := range query.Steps {
+		matcher, err := attributesMatcher(query.Steps[i].Attributes, query.Steps[i].Filters)
+		if err != nil {
+			return nil, err
+		}
+		matchers[i] = matcher
+	}
+
+	completed := make([]uint64, len(query.Steps))
+	err := actors.timelines(func(actor string, timeline *actorTimeline) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if level := funnelLevel(query, matchers, timeline); level > 0 {
+			for i := 0; i < level; i++ {
+				completed[i]++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, queryError(err)
+	}
+
+	result := &FunnelResult{Id: query.Id, Steps: make([]FunnelStepResult, len(query.Steps))}
+	for i, step := range query.Steps {
+		result.Steps[i] = FunnelStepResult{Name: step.Name, Actors: completed[i]}
+		if completed[0] > 0 {
+			result.Steps[i].Conversion = float64(completed[i]) / float64(completed[0])
+		}
+		if i == 0 && completed[0] > 0 {
+			result.Steps[i].StepConversion = 1
+		} else if i > 0 && completed[i-1] > 0 {
+			result.Steps[i].StepConversion = float64(completed[i]) / float64(completed[i-1])
+		}
+	}
+	return result, nil
+}
+
+// funnelLevel returns the number of steps the actor completed in order.
+// started[i] holds the latest first step timestamp from which step i was
+// reached, so that later attempts get the longest remaining window.
+func funnelLevel(query *FunnelQuery, matchers []func(map[string]string) bool, timeline *actorTimeline) int {
+	started := make([]uint64, len(matchers))
+	reached := make([]bool, len(matchers))
+	level := 0
+	timeline.visit(query.StartTimestamp, query.EndTimestamp+query.Window, func(event *actorEvent) {
+		// later steps first, so that one event does not complete two steps
+		for i := len(matchers) - 1; i > 0; i-- {
+			if reached[i-1] && event.ts-started[i-1] <= query.Window && matchers[i](event.attributes) {
+				started[i], reached[i] = started[i-1], true
+				if i+1 > level {
+					level = i + 1
+				}
+			}
+		}
+		if event.ts <= query.EndTimestamp && matchers[0](event.attributes) {
+			started[0], reached[0] = event.ts, true
+			if level == 0 {
+				level = 1
+			}
+		}
+	})
+	return level
+}
@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func Test_inMemoryStorage_Funnel(t *testing.T) {
+	config := NewDefaultStorageConfiguration()
+	config.ActorAttributes = []string{"user"}
+	s := Create(config)
+	event := func(user string, page string, ts uint64) Event {
+		return Event{Attributes: map[string]string{"user": user, "page": page}, Timestamp: ts}
+	}
+	s.Write(&Events{Events: []Event{
+		// completes all steps
+		event("a", "home", 1_000), event("a", "cart", 2_000), event("a", "checkout", 3_000),
+		// steps out of order
+		event("b", "cart", 1_000), event("b", "home", 2_000), event("b", "checkout", 3_000),
+		// checkout outside of the window of the first home
+		event("c", "home", 1_000), event("c", "cart", 5_000), event("c", "checkout", 20_000),
+		// a later home restarts the window, written out of order
+		event("d", "checkout", 19_000), event("d", "home", 1_000), event("d", "cart", 12_000), event("d", "home", 10_000),
+		// first step after the range
+		event("e", "home", 50_000), event("e", "cart", 51_000),
+		{Attributes: map[string]string{"page": "home"}, Timestamp: 1_000},
+	}})
+	steps := []FunnelStep{
+		{Name: "home", Attributes: map[string]string{"page": "home"}},
+		{Name: "cart", Attributes: map[string]string{"page": "cart"}},
+		{Name: "checkout", Filters: []Filter{{Attribute: "page", Operator: "in", Values: []string{"checkout", "payment"}}}},
+	}
+
+	tests := []struct {
+		name    string
+		query   FunnelQuery
+		want    []FunnelStepResult
+		wantErr bool
+	}{
+		{"Ordered steps within the window", FunnelQuery{Actor: "user", Steps: steps, Window: 10_000, StartTimestamp: 0, EndTimestamp: 40_000}, []FunnelStepResult{
+			{Name: "home", Actors: 4, Conversion: 1, StepConversion: 1},
+			{Name: "cart", Actors: 3, Conversion: 0.75, StepConversion: 0.75},
+			{Name: "checkout", Actors: 2, Conversion: 0.5, StepConversion: 2.0 / 3},
+		}, false},
+		{"Unknown actor", FunnelQuery{Actor: "session", Steps: steps, Window: 10_000}, nil, true},
+		{"Missing window", FunnelQuery{Actor: "user", Steps: steps}, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.Funnel(context.Background(), &tt.query)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Funnel() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(got.Steps, tt.want) {
+				t.Errorf("Funnel() = %+v, want %+v", got.Steps, tt.want)
+			}
+		})
+	}
+}
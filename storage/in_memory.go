@@ -1,48 +1,425 @@
 package storage
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"io"
+	"io.klector/klector/clock"
 	"log"
+	"math"
+	"sort"
+	"sync"
 )
 
 type inMemoryStorage struct {
-	tree *tree
+	tree          *tree
+	wal           *wal
+	ids           *eventIds
+	window        *acceptanceWindow
+	clock         clock.Clock
+	actors        map[string]*actorStore
+	cohorts       map[string]*cohortStore
+	mu            sync.RWMutex
+	rollups       map[string]*rollup
+	rollupsPath   string // saved rollups, none without a data folder
+	subscriptions map[*subscription]bool
+	tails         map[*tail]bool
+	maxQueryCost  uint64
+	maxSeries     uint64
+	maxRows       uint64
+	// changes is held for reading while a change is logged and applied, and
+	// for writing by deletions, so that the series a deletion reads are the
+	// ones its replay reads, by snapshots, so that they hold exactly the
+	// logged changes, and by added rollups, so that no event is left out of
+	// or added twice to their series.
+	changes sync.RWMutex
 }
 
 func (s *inMemoryStorage) Write(events *Events) error {
-	for _, event := range events.Events {
+	var errs WriteErrors
+	for i, event := range events.Events {
 		if err := s.writeEvent(&event); err != nil {
-			return err
+			errs = append(errs, EventError{Index: i, Err: err})
 		}
 	}
+	if err := s.flushWal(); err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return errs
+	}
 	return nil
 }
 
+func (s *inMemoryStorage) flushWal() error {
+	if s.wal == nil {
+		return nil
+	}
+	return s.wal.flush()
+}
+
 func (s *inMemoryStorage) writeEvent(event *Event) error {
-	if len(event.Attributes) == 0 {
-		return errors.New("attributes are not defined in event")
+	if err := event.Validate(); err != nil {
+		s.publishRejected(event, err)
+		return err
+	}
+	if event.Id != "" && s.ids != nil && !s.ids.add(event.Id) {
+		log.Printf("Dropped event %s written before", event.Id)
+		return nil
 	}
-	if event.Timestamp == 0 {
-		return errors.New("timestamp cannot be 0")
+	if s.window != nil {
+		if quarantined, err := s.window.check(event, s.now()); err != nil {
+			s.publishRejected(event, err)
+			if quarantined != nil {
+				s.changes.RLock()
+				err = s.quarantineEvent(quarantined)
+				s.changes.RUnlock()
+			}
+			if err != nil {
+				s.forgetId(event)
+			}
+			return err
+		}
 	}
 
+	s.changes.RLock()
+	defer s.changes.RUnlock()
+	if s.wal != nil {
+		if err := s.wal.append(&walRecord{Event: event}); err != nil {
+			s.forgetId(event)
+			return err
+		}
+	}
 	log.Printf("Received event %v", *event)
+	s.addEvent(event)
+	return nil
+}
+
+// forgetId forgets the id of an event which was not written, so that a retry
+// of the event is not dropped.
+func (s *inMemoryStorage) forgetId(event *Event) {
+	if event.Id != "" && s.ids != nil {
+		s.ids.remove(event.Id)
+	}
+}
+
+func (s *inMemoryStorage) publishRejected(event *Event, err error) {
+	s.mu.RLock()
+	for t := range s.tails {
+		t.publish(event, err)
+	}
+	s.mu.RUnlock()
+}
+
+// addEvent adds a valid event to the tree and the stores which keep events.
+func (s *inMemoryStorage) addEvent(event *Event) {
 	s.tree.addEvent(event)
+	if len(s.actors) > 0 {
+		now := s.now()
+		for _, actors := range s.actors {
+			actors.add(event, now)
+		}
+		for _, cohorts := range s.cohorts {
+			cohorts.add(event, now)
+		}
+	}
+	s.mu.RLock()
+	for _, r := range s.rollups {
+		r.add(event)
+	}
+	for sub := range s.subscriptions {
+		sub.notify(event)
+	}
+	for t := range s.tails {
+		t.publish(event, nil)
+	}
+	s.mu.RUnlock()
+}
 
+// replay applies a record of the write-ahead log.
+func (s *inMemoryStorage) replay(record *walRecord) error {
+	switch {
+	case record.Event != nil:
+		if record.Event.Id != "" && s.ids != nil {
+			s.ids.add(record.Event.Id)
+		}
+		s.addEvent(record.Event)
+	case record.Series != nil:
+		s.importSeries(record.Series)
+	case record.Deletion != nil:
+		return s.replayDeletion(record.Deletion)
+	case record.Quarantined != nil:
+		if record.Quarantined.Event.Id != "" && s.ids != nil {
+			s.ids.add(record.Quarantined.Event.Id)
+		}
+		s.window.quarantine.add(*record.Quarantined, noRecord)
+	case record.ClearQuarantine:
+		s.window.quarantine.clear(noRecord)
+	case record.Actor != nil:
+		if actors, found := s.actors[record.Actor.Attribute]; found {
+			actors.restore(record.Actor, s.now())
+		}
+	case record.Cohort != nil:
+		if cohorts, found := s.cohorts[record.Cohort.Attribute]; found {
+			return cohorts.restore(record.Cohort)
+		}
+	case record.EventIds != nil:
+		if s.ids != nil {
+			s.ids.reset(record.EventIds)
+		}
+	}
 	return nil
 }
 
-func (s *inMemoryStorage) Query(query *Query) (*ResultSet, error) {
-	var count uint64 = 0
+// now returns the time of the storage clock in ms since the epoch.
+func (s *inMemoryStorage) now() uint64 {
+	return clock.Milliseconds(s.clock.Now())
+}
+
+func (s *inMemoryStorage) Backup() (io.ReadCloser, uint64, error) {
+	if s.wal == nil {
+		return nil, 0, ErrNoWal
+	}
+	return s.wal.backup()
+}
 
-	series := s.tree.find(query)
-	if series != nil {
-		count = series.getCount(query.StartTimestamp, query.EndTimestamp)
+// Query runs query and, for every offset of CompareTo, the same query over the
+// window shifted back by the offset, see compareTo.
+func (s *inMemoryStorage) Query(ctx context.Context, query *Query) (*ResultSet, error) {
+	if err := validateCompareTo(query); err != nil {
+		return nil, err
 	}
+	result, err := s.query(ctx, query)
+	if err != nil || result.Plan != nil && result.Plan.Rejected {
+		return result, err
+	}
+	if err := s.compareTo(ctx, query, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
 
-	return &ResultSet{
+// query runs query without its comparisons.
+func (s *inMemoryStorage) query(ctx context.Context, query *Query) (*ResultSet, error) {
+	source, err := s.source(query)
+	if err != nil {
+		return nil, err
+	}
+	matchers, err := query.matchers()
+	if err != nil {
+		return nil, err
+	}
+	buckets := uint64(1)
+	if query.Step > 0 && query.EndTimestamp >= query.StartTimestamp {
+		buckets = (query.EndTimestamp-query.StartTimestamp)/query.Step + 1
+		if buckets > MaxQueryBuckets {
+			return nil, fmt.Errorf("query exceeds %d buckets, increase the step", MaxQueryBuckets)
+		}
+	}
+
+	type matchedSeries struct {
+		key    string
+		values []string
+		series *timeSeriesAggregator
+	}
+	var matched []matchedSeries
+	positions := groupByPositions(query, matchers)
+	keys := map[string]bool{}
+	err = source.match(ctx, matchers, func(values []string, series *timeSeriesAggregator) error {
+		if s.maxSeries > 0 && uint64(len(matched)) >= s.maxSeries {
+			return fmt.Errorf("%w: the query matches more than %d series", ErrQueryLimit, s.maxSeries)
+		}
+		key := ""
+		for _, i := range positions {
+			key += values[i] + "\x00"
+		}
+		keys[key] = true
+		matched = append(matched, matchedSeries{key, append([]string(nil), values...), series})
+		return nil
+	})
+	if err != nil {
+		return nil, queryError(err)
+	}
+	if rows := uint64(len(keys)) * buckets; s.maxRows > 0 && rows > s.maxRows {
+		return nil, fmt.Errorf("%w: the query returns %d rows, the maximum is %d", ErrQueryLimit, rows, s.maxRows)
+	}
+
+	plan := newPlan(query, uint64(len(matched)), s.maxQueryCost)
+	if plan.Rejected {
+		if query.Explain {
+			return &ResultSet{Id: query.Id, Attributes: query.Attributes, Plan: plan}, nil
+		}
+		return nil, fmt.Errorf("query cost %d exceeds the maximum of %d, narrow the time range or the attributes", plan.EstimatedCost, plan.MaxCost)
+	}
+	if !query.Explain {
+		plan = nil
+	}
+
+	total := newGroup(query, nil)
+	groups := map[string]*Group{}
+	for _, m := range matched {
+		group := total
+		if len(positions) > 0 {
+			var found bool
+			if group, found = groups[m.key]; !found {
+				attributes := make(map[string]string, len(positions))
+				for _, i := range positions {
+					attributes[matchers[i].name] = m.values[i]
+				}
+				group = newGroup(query, attributes)
+				groups[m.key] = group
+			}
+		}
+		if err := group.collect(ctx, query, m.series, plan); err != nil {
+			return nil, queryError(err)
+		}
+	}
+
+	result := &ResultSet{
 		Id:         query.Id,
 		Attributes: query.Attributes,
-		Value:      count,
-	}, nil
+		Plan:       plan,
+	}
+	if len(positions) > 0 {
+		keys := make([]string, 0, len(groups))
+		for key := range groups {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		result.Groups = make([]Group, 0, len(keys))
+		for _, key := range keys {
+			total.add(groups[key])
+			result.Groups = append(result.Groups, *groups[key])
+		}
+	}
+	result.Value = total.Value
+	result.Measures = total.Measures
+	result.Buckets = total.Buckets
+	return result, nil
+}
+
+func (s *inMemoryStorage) Keys() ([]string, error) {
+	return s.tree.keys(), nil
+}
+
+func (s *inMemoryStorage) Values(key string) ([]string, error) {
+	return s.tree.values(key), nil
+}
+
+func (s *inMemoryStorage) AttributeSets() ([][]string, error) {
+	return s.tree.attributeSets(), nil
+}
+
+// queryError replaces errors of a done context with ErrQueryTimeout or
+// ErrQueryCanceled.
+func queryError(err error) error {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrQueryTimeout
+	case errors.Is(err, context.Canceled):
+		return ErrQueryCanceled
+	}
+	return err
+}
+
+// groupByPositions returns the position of every GroupBy attribute in matchers.
+func groupByPositions(query *Query, matchers []pathMatcher) []int {
+	var positions []int
+	for i, m := range matchers {
+		for _, name := range query.GroupBy {
+			if m.name == name {
+				positions = append(positions, i)
+				break
+			}
+		}
+	}
+	return positions
+}
+
+func newGroup(query *Query, attributes map[string]string) *Group {
+	group := &Group{
+		Attributes: attributes,
+		Measures:   newMeasures(query),
+	}
+	query.forEachStep(func(ts uint64) {
+		group.Buckets = append(group.Buckets, Bucket{
+			Timestamp: ts,
+			Measures:  newMeasures(query),
+		})
+	})
+	return group
+}
+
+// forEachStep calls f with the start of every step bucket of the query, if it
+// has a step. The last bucket may be the one before the timestamps wrap around.
+func (q *Query) forEachStep(f func(ts uint64)) {
+	if q.Step == 0 {
+		return
+	}
+	for ts := q.StartTimestamp - q.StartTimestamp%q.Step; ts <= q.EndTimestamp; ts += q.Step {
+		f(ts)
+		if ts > math.MaxUint64-q.Step {
+			return
+		}
+	}
+}
+
+func newMeasures(query *Query) map[string]float64 {
+	if len(query.Measures) == 0 {
+		return nil
+	}
+	measures := make(map[string]float64, len(query.Measures))
+	for _, name := range query.Measures {
+		measures[name] = 0
+	}
+	return measures
+}
+
+// collect adds the values of series within the query's range to the group, it
+// stops with the context's error when ctx is done.
+func (g *Group) collect(ctx context.Context, query *Query, series *timeSeriesAggregator, plan *Plan) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	g.Value += series.getCount(query.StartTimestamp, query.EndTimestamp, plan)
+	for name := range g.Measures {
+		if _, found := series.measures.Load(name); found {
+			g.Measures[name] += series.measure(name).getSum(query.StartTimestamp, query.EndTimestamp, plan)
+		}
+	}
+
+	for i := range g.Buckets {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		bucket := &g.Buckets[i]
+		start, end := bucket.Timestamp, bucket.Timestamp+query.Step-1
+		if start < query.StartTimestamp {
+			start = query.StartTimestamp
+		}
+		if end < bucket.Timestamp || end > query.EndTimestamp {
+			end = query.EndTimestamp
+		}
+		bucket.Value += series.getCount(start, end, plan)
+		for name := range bucket.Measures {
+			if _, found := series.measures.Load(name); found {
+				bucket.Measures[name] += series.measure(name).getSum(start, end, plan)
+			}
+		}
+	}
+	return nil
+}
+
+func (g *Group) add(other *Group) {
+	g.Value += other.Value
+	for name, value := range other.Measures {
+		g.Measures[name] += value
+	}
+	for i := range g.Buckets {
+		g.Buckets[i].Value += other.Buckets[i].Value
+		for name, value := range other.Buckets[i].Measures {
+			g.Buckets[i].Measures[name] += value
+		}
+	}
 }
@@ -1,8 +1,12 @@
 package storage
 
 import (
+	"context"
+	"errors"
+	"math"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func Test_inMemoryStorage_Write(t *testing.T) {
@@ -231,6 +235,142 @@ func Test_inMemoryStorage_Write(t *testing.T) {
 				Value:      3,
 			},
 		}, false},
+		{"Composite attributes with different values are counted apart", args{
+			[]Event{
+				{
+					Attributes: map[string]string{"a": "a1", "b": "b"},
+					Timestamp:  1_000,
+				},
+				{
+					Attributes: map[string]string{"a": "a2", "b": "b"},
+					Timestamp:  1_000,
+				},
+				{
+					Attributes: map[string]string{"a": "a2", "b": "b"},
+					Timestamp:  1_000,
+				},
+			},
+			&Query{
+				Attributes:     map[string]string{"a": "a1", "b": "b"},
+				StartTimestamp: 1_000,
+				EndTimestamp:   1_000,
+			},
+			&ResultSet{
+				Attributes: map[string]string{"a": "a1", "b": "b"},
+				Value:      1,
+			},
+		}, false},
+		{"Measures summed over the query's range", args{
+			[]Event{
+				{
+					Attributes: map[string]string{"a": "a"},
+					Measures:   map[string]float64{"bytes": 100, "latency": 0.5},
+					Timestamp:  1_000,
+				},
+				{
+					Attributes: map[string]string{"a": "a"},
+					Measures:   map[string]float64{"bytes": 20.5},
+					Timestamp:  110_000,
+				},
+				{
+					Attributes: map[string]string{"a": "a"},
+					Measures:   map[string]float64{"bytes": 7},
+					Timestamp:  150_000,
+				},
+			},
+			&Query{
+				Attributes:     map[string]string{"a": "a"},
+				Measures:       []string{"bytes", "latency", "missing"},
+				StartTimestamp: 1_000,
+				EndTimestamp:   110_000,
+			},
+			&ResultSet{
+				Attributes: map[string]string{"a": "a"},
+				Value:      2,
+				Measures:   map[string]float64{"bytes": 120.5, "latency": 0.5, "missing": 0},
+			},
+		}, false},
+		{"Weighted events count as many occurrences", args{
+			[]Event{
+				{
+					Attributes: map[string]string{"a": "a"},
+					Measures:   map[string]float64{"bytes": 10},
+					Count:      5,
+					Timestamp:  1_000,
+				},
+				{
+					Attributes: map[string]string{"a": "a"},
+					Measures:   map[string]float64{"bytes": 10},
+					Timestamp:  2*milliSecondsInMonth + 1_000,
+				},
+			},
+			&Query{
+				Attributes:     map[string]string{"a": "a"},
+				Measures:       []string{"bytes"},
+				StartTimestamp: 1_000,
+				EndTimestamp:   3 * milliSecondsInMonth,
+			},
+			&ResultSet{
+				Attributes: map[string]string{"a": "a"},
+				Value:      6,
+				Measures:   map[string]float64{"bytes": 60},
+			},
+		}, false},
+		{"Same minute of different days is counted apart", args{
+			[]Event{
+				{
+					Attributes: map[string]string{"a": "a"},
+					Timestamp:  milliSecondsInMinute,
+				},
+				{
+					Attributes: map[string]string{"a": "a"},
+					Timestamp:  milliSecondsInDay,
+				},
+			},
+			&Query{
+				Attributes:     map[string]string{"a": "a"},
+				StartTimestamp: milliSecondsInMinute,
+				EndTimestamp:   milliSecondsInMinute,
+			},
+			&ResultSet{
+				Attributes: map[string]string{"a": "a"},
+				Value:      1,
+			},
+		}, false},
+		{"Range over whole months, days and hours with partial edges", args{
+			[]Event{
+				{
+					Attributes: map[string]string{"a": "a"},
+					Timestamp:  milliSecondsInMonth - milliSecondsInMinute,
+				},
+				{
+					Attributes: map[string]string{"a": "a"},
+					Timestamp:  milliSecondsInMonth - 2*milliSecondsInMinute,
+				},
+				{
+					Attributes: map[string]string{"a": "a"},
+					Count:      3,
+					Timestamp:  milliSecondsInMonth + 5*milliSecondsInDay,
+				},
+				{
+					Attributes: map[string]string{"a": "a"},
+					Timestamp:  2*milliSecondsInMonth + 2*milliSecondsInHour,
+				},
+				{
+					Attributes: map[string]string{"a": "a"},
+					Timestamp:  2*milliSecondsInMonth + 2*milliSecondsInHour + milliSecondsInMinute,
+				},
+			},
+			&Query{
+				Attributes:     map[string]string{"a": "a"},
+				StartTimestamp: milliSecondsInMonth - milliSecondsInMinute,
+				EndTimestamp:   2*milliSecondsInMonth + 2*milliSecondsInHour,
+			},
+			&ResultSet{
+				Attributes: map[string]string{"a": "a"},
+				Value:      5,
+			},
+		}, false},
 	}
 
 	for _, tt := range tests {
@@ -241,7 +381,7 @@ func Test_inMemoryStorage_Write(t *testing.T) {
 			if err := s.Write(&Events{Events: tt.args.events}); (err != nil) != tt.wantErr {
 				t.Errorf("Write() error = %v, wantErr %v", err, tt.wantErr)
 			}
-			result, err := s.Query(tt.args.query)
+			result, err := s.Query(context.Background(), tt.args.query)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("Query() error = %v, wantErr %v", err, tt.wantErr)
 			}
@@ -251,3 +391,415 @@ func Test_inMemoryStorage_Write(t *testing.T) {
 		})
 	}
 }
+
+func Test_inMemoryStorage_Write_invalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		event Event
+	}{
+		{"No attributes", Event{Timestamp: 1_000}},
+		{"No timestamp", Event{Attributes: map[string]string{"a": "a"}}},
+		{"Count over the maximum", Event{
+			Attributes: map[string]string{"a": "a"},
+			Count:      MaxEventCount + 1,
+			Timestamp:  1_000,
+		}},
+		{"Weighted measure is not finite", Event{
+			Attributes: map[string]string{"a": "a"},
+			Measures:   map[string]float64{"bytes": 1e308},
+			Count:      10,
+			Timestamp:  1_000,
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &inMemoryStorage{
+				tree: newTree(),
+			}
+			if err := s.Write(&Events{Events: []Event{tt.event}}); err == nil {
+				t.Errorf("Write() error = nil, want error")
+			}
+		})
+	}
+}
+
+func Test_inMemoryStorage_Write_partial(t *testing.T) {
+	s := &inMemoryStorage{
+		tree: newTree(),
+	}
+	err := s.Write(&Events{Events: []Event{
+		{Attributes: map[string]string{"a": "a"}, Timestamp: 1_000},
+		{Attributes: map[string]string{"a": "a"}},
+		{Attributes: map[string]string{"a": "a"}, Timestamp: 2_000},
+	}})
+	var writeErrors WriteErrors
+	if !errors.As(err, &writeErrors) || len(writeErrors) != 1 || writeErrors[0].Index != 1 {
+		t.Fatalf("Write() error = %v, want an error of event 1", err)
+	}
+	result, err := s.Query(context.Background(), &Query{Attributes: map[string]string{"a": "a"}, StartTimestamp: 1_000, EndTimestamp: 2_000})
+	if err != nil {
+		t.Fatalf("Query() error = %v", err)
+	}
+	if result.Value != 2 {
+		t.Errorf("Query() = %d, want 2", result.Value)
+	}
+}
+
+func Test_inMemoryStorage_Query(t *testing.T) {
+	events := []Event{
+		{Attributes: map[string]string{"country": "de", "browser": "firefox"}, Timestamp: 1_000},
+		{Attributes: map[string]string{"country": "de", "browser": "chrome"}, Timestamp: 61_000, Count: 2},
+		{Attributes: map[string]string{"country": "fr", "browser": "chrome"}, Timestamp: 121_000},
+		{Attributes: map[string]string{"country": "us", "browser": "chrome"}, Timestamp: 121_000},
+	}
+	tests := []struct {
+		name    string
+		query   *Query
+		want    *ResultSet
+		wantErr bool
+	}{
+		{"Group by attribute", &Query{
+			GroupBy:        []string{"country"},
+			StartTimestamp: 1_000,
+			EndTimestamp:   180_000,
+		}, &ResultSet{
+			Value: 5,
+			Groups: []Group{
+				{Attributes: map[string]string{"country": "de"}, Value: 3},
+				{Attributes: map[string]string{"country": "fr"}, Value: 1},
+				{Attributes: map[string]string{"country": "us"}, Value: 1},
+			},
+		}, false},
+		{"Filter and group by another attribute", &Query{
+			Filters:        []Filter{{Attribute: "country", Operator: "in", Values: []string{"de", "fr"}}},
+			GroupBy:        []string{"browser"},
+			StartTimestamp: 1_000,
+			EndTimestamp:   180_000,
+		}, &ResultSet{
+			Value: 4,
+			Groups: []Group{
+				{Attributes: map[string]string{"browser": "chrome"}, Value: 3},
+				{Attributes: map[string]string{"browser": "firefox"}, Value: 1},
+			},
+		}, false},
+		{"Regular expression filter", &Query{
+			Attributes:     map[string]string{"browser": "chrome"},
+			Filters:        []Filter{{Attribute: "country", Operator: "!~", Values: []string{"d.|f."}}},
+			StartTimestamp: 1_000,
+			EndTimestamp:   180_000,
+		}, &ResultSet{
+			Attributes: map[string]string{"browser": "chrome"},
+			Value:      1,
+		}, false},
+		{"Buckets per step", &Query{
+			Attributes:     map[string]string{"browser": "chrome"},
+			StartTimestamp: 30_000,
+			EndTimestamp:   150_000,
+			Step:           60_000,
+		}, &ResultSet{
+			Attributes: map[string]string{"browser": "chrome"},
+			Value:      4,
+			Buckets: []Bucket{
+				{Timestamp: 0, Value: 0},
+				{Timestamp: 60_000, Value: 2},
+				{Timestamp: 120_000, Value: 2},
+			},
+		}, false},
+		{"Invalid regular expression", &Query{
+			Filters:        []Filter{{Attribute: "country", Operator: "=~", Values: []string{"("}}},
+			StartTimestamp: 1_000,
+			EndTimestamp:   180_000,
+		}, nil, true},
+		{"Too many buckets", &Query{
+			Attributes:     map[string]string{"browser": "chrome"},
+			StartTimestamp: 1_000,
+			EndTimestamp:   milliSecondsInMonth,
+			Step:           1,
+		}, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &inMemoryStorage{
+				tree: newTree(),
+			}
+			if err := s.Write(&Events{Events: events}); err != nil {
+				t.Fatalf("Write() error = %v", err)
+			}
+			result, err := s.Query(context.Background(), tt.query)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Query() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(result, tt.want) {
+				t.Errorf("ResultSet = %+v, want %+v", result, tt.want)
+			}
+		})
+	}
+}
+
+func Test_inMemoryStorage_KeysValues(t *testing.T) {
+	s := &inMemoryStorage{
+		tree: newTree(),
+	}
+	s.Write(&Events{Events: []Event{
+		{Attributes: map[string]string{"country": "de", "browser": "firefox"}, Timestamp: 1_000},
+		{Attributes: map[string]string{"country": "fr"}, Timestamp: 1_000},
+	}})
+
+	keys, _ := s.Keys()
+	if want := []string{"browser", "country"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("Keys() = %v, want %v", keys, want)
+	}
+	values, _ := s.Values("country")
+	if want := []string{"de", "fr"}; !reflect.DeepEqual(values, want) {
+		t.Errorf("Values() = %v, want %v", values, want)
+	}
+}
+
+func Test_inMemoryStorage_Query_explain(t *testing.T) {
+	events := []Event{
+		{Attributes: map[string]string{"browser": "chrome", "country": "de"}, Timestamp: milliSecondsInMinute},
+		{Attributes: map[string]string{"browser": "chrome", "country": "fr"}, Timestamp: 2*milliSecondsInHour + milliSecondsInMinute},
+	}
+	query := func(explain bool) *Query {
+		return &Query{
+			Attributes:     map[string]string{"browser": "chrome"},
+			StartTimestamp: 0,
+			EndTimestamp:   2*milliSecondsInHour + 30*milliSecondsInMinute,
+			Explain:        explain,
+		}
+	}
+	plan := &Plan{
+		SeriesMatched: 1,
+		Levels: []LevelPlan{
+			{Name: "month"},
+			{Name: "day"},
+			{Name: "hour", EstimatedBuckets: 2, Descents: 1, BucketsScanned: 1},
+			{Name: "minute", EstimatedBuckets: 31, Descents: 1, BucketsScanned: 2},
+		},
+		EstimatedCost: 33,
+	}
+
+	tests := []struct {
+		name         string
+		maxQueryCost uint64
+		query        *Query
+		want         *ResultSet
+		wantErr      bool
+	}{
+		{"Without explain", 0, query(false), &ResultSet{Attributes: query(false).Attributes, Value: 2}, false},
+		{"Explain", 0, query(true), &ResultSet{Attributes: query(false).Attributes, Value: 2, Plan: plan}, false},
+		{"Rejected", 32, query(false), nil, true},
+		{"Explain rejected", 32, query(true), &ResultSet{Attributes: query(false).Attributes, Plan: &Plan{
+			SeriesMatched: 1,
+			Levels: []LevelPlan{
+				{Name: "month"},
+				{Name: "day"},
+				{Name: "hour", EstimatedBuckets: 2},
+				{Name: "minute", EstimatedBuckets: 31},
+			},
+			EstimatedCost: 33,
+			MaxCost:       32,
+			Rejected:      true,
+		}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &inMemoryStorage{
+				tree:         newTree(),
+				maxQueryCost: tt.maxQueryCost,
+			}
+			if err := s.Write(&Events{Events: events}); err != nil {
+				t.Fatalf("Write() error = %v", err)
+			}
+			result, err := s.Query(context.Background(), tt.query)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Query() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(result, tt.want) {
+				t.Errorf("ResultSet = %+v, want %+v", result, tt.want)
+			}
+		})
+	}
+}
+
+func Test_inMemoryStorage_Query_limits(t *testing.T) {
+	s := &inMemoryStorage{
+		tree:      newTree(),
+		maxSeries: 2,
+		maxRows:   6,
+	}
+	s.Write(&Events{Events: []Event{
+		{Attributes: map[string]string{"country": "de"}, Timestamp: 1_000},
+		{Attributes: map[string]string{"country": "fr"}, Timestamp: 1_000},
+		{Attributes: map[string]string{"country": "us"}, Timestamp: 1_000},
+	}})
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancel := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		query   *Query
+		wantErr error
+	}{
+		{"Within limits", context.Background(), &Query{
+			Filters:      []Filter{{Attribute: "country", Operator: "in", Values: []string{"de", "fr"}}},
+			GroupBy:      []string{"country"},
+			EndTimestamp: 60_000,
+			Step:         30_000,
+		}, nil},
+		{"Too many series", context.Background(), &Query{
+			GroupBy:      []string{"country"},
+			EndTimestamp: 60_000,
+		}, ErrQueryLimit},
+		{"Too many rows", context.Background(), &Query{
+			Filters:      []Filter{{Attribute: "country", Operator: "in", Values: []string{"de", "fr"}}},
+			GroupBy:      []string{"country"},
+			EndTimestamp: 60_000,
+			Step:         20_000,
+		}, ErrQueryLimit},
+		{"Canceled", canceled, &Query{Attributes: map[string]string{"country": "de"}, EndTimestamp: 60_000}, ErrQueryCanceled},
+		{"Timed out", expired, &Query{Attributes: map[string]string{"country": "de"}, EndTimestamp: 60_000}, ErrQueryTimeout},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.Query(tt.ctx, tt.query)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Query() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_inMemoryStorage_Query_lastTimestamp(t *testing.T) {
+	s := Create(NewDefaultStorageConfiguration())
+	query := &Query{StartTimestamp: math.MaxUint64 - 10, EndTimestamp: math.MaxUint64, Step: 100, Explain: true}
+	result, err := s.Query(context.Background(), query)
+	if err != nil {
+		t.Fatalf("Query() error = %v", err)
+	}
+	if len(result.Buckets) != 1 || result.Buckets[0].Timestamp != math.MaxUint64-math.MaxUint64%100 {
+		t.Errorf("Query() buckets = %v, want the one of the last timestamp", result.Buckets)
+	}
+}
+
+func Test_inMemoryStorage_Query_untilLastTimestamp(t *testing.T) {
+	s := &inMemoryStorage{tree: newTree()}
+	s.Write(&Events{Events: []Event{
+		{Attributes: map[string]string{"app": "a"}, Measures: map[string]float64{"bytes": 2}, Timestamp: 1_000},
+		{Attributes: map[string]string{"app": "a"}, Measures: map[string]float64{"bytes": 3}, Timestamp: math.MaxUint64},
+	}})
+
+	tests := []struct {
+		name  string
+		start uint64
+		want  uint64
+	}{
+		{"All", 0, 2},
+		{"Last month", math.MaxUint64 - milliSecondsInMonth, 1},
+		{"Last minute", math.MaxUint64, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := s.Query(context.Background(), &Query{
+				Attributes:     map[string]string{"app": "a"},
+				Measures:       []string{"bytes"},
+				StartTimestamp: tt.start,
+				EndTimestamp:   math.MaxUint64,
+			})
+			if err != nil {
+				t.Fatalf("Query() error = %v", err)
+			}
+			if result.Value != tt.want {
+				t.Errorf("Query() = %d, want %d", result.Value, tt.want)
+			}
+		})
+	}
+}
+
+func Test_inMemoryStorage_Query_compareTo(t *testing.T) {
+	s := &inMemoryStorage{
+		tree: newTree(),
+	}
+	s.Write(&Events{Events: []Event{
+		{Attributes: map[string]string{"country": "de"}, Measures: map[string]float64{"bytes": 5}, Timestamp: milliSecondsInMinute},
+		{Attributes: map[string]string{"country": "de"}, Measures: map[string]float64{"bytes": 10}, Count: 2, Timestamp: milliSecondsInDay + milliSecondsInMinute},
+		{Attributes: map[string]string{"country": "fr"}, Timestamp: milliSecondsInDay + milliSecondsInMinute},
+		{Attributes: map[string]string{"country": "it"}, Timestamp: milliSecondsInMinute},
+	}})
+	percent := func(value float64) *float64 {
+		return &value
+	}
+
+	result, err := s.Query(context.Background(), &Query{
+		GroupBy:        []string{"country"},
+		Measures:       []string{"bytes"},
+		StartTimestamp: milliSecondsInDay,
+		EndTimestamp:   milliSecondsInDay + 2*milliSecondsInMinute - 1,
+		Step:           milliSecondsInMinute,
+		CompareTo:      []uint64{milliSecondsInDay},
+	})
+	if err != nil {
+		t.Fatalf("Query() error = %v", err)
+	}
+
+	want := []Comparison{{Offset: milliSecondsInDay, Value: 2, Delta: 1, Change: percent(50), Measures: map[string]MeasureComparison{
+		"bytes": {Value: 5, Delta: 15, Change: percent(300)},
+	}}}
+	if !reflect.DeepEqual(result.Comparisons, want) {
+		t.Errorf("Comparisons = %+v, want %+v", result.Comparisons, want)
+	}
+	want = []Comparison{{Offset: milliSecondsInDay, Value: 1, Delta: -1, Change: percent(-100), Measures: map[string]MeasureComparison{
+		"bytes": {},
+	}}}
+	if len(result.Groups) != 3 {
+		t.Fatalf("Groups = %+v, want the group only in the earlier window too", result.Groups)
+	}
+	if it := result.Groups[2]; it.Attributes["country"] != "it" || it.Value != 0 || !reflect.DeepEqual(it.Comparisons, want) || !reflect.DeepEqual(it.Buckets[1].Comparisons, want) {
+		t.Errorf("it group = %+v, want a value of 0 and Comparisons %+v", it, want)
+	}
+	want = []Comparison{{Offset: milliSecondsInDay, Value: 0, Delta: 1, Measures: map[string]MeasureComparison{
+		"bytes": {},
+	}}}
+	if fr := result.Groups[1]; !reflect.DeepEqual(fr.Comparisons, want) || !reflect.DeepEqual(fr.Buckets[1].Comparisons, want) {
+		t.Errorf("fr Comparisons = %+v and %+v, want %+v", fr.Comparisons, fr.Buckets[1].Comparisons, want)
+	}
+	want = []Comparison{{Offset: milliSecondsInDay, Value: 0, Delta: 0, Measures: map[string]MeasureComparison{
+		"bytes": {},
+	}}}
+	if de := result.Groups[0]; !reflect.DeepEqual(de.Buckets[0].Comparisons, want) {
+		t.Errorf("de first bucket Comparisons = %+v, want %+v", de.Buckets[0].Comparisons, want)
+	}
+
+	for _, query := range []*Query{
+		{Attributes: map[string]string{"country": "de"}, StartTimestamp: 1_000, EndTimestamp: 2_000, CompareTo: []uint64{milliSecondsInDay}},
+		{Attributes: map[string]string{"country": "de"}, StartTimestamp: milliSecondsInDay, EndTimestamp: milliSecondsInDay, Step: milliSecondsInHour, CompareTo: []uint64{milliSecondsInMinute}},
+	} {
+		if _, err := s.Query(context.Background(), query); err == nil {
+			t.Errorf("Query() error = nil for compareTo %v", query.CompareTo)
+		}
+	}
+}
+
+func Test_inMemoryStorage_AttributeSets(t *testing.T) {
+	s := Create(NewDefaultStorageConfiguration())
+	s.Write(&Events{Events: []Event{
+		{Attributes: map[string]string{"b": "b", "a": "a"}, Timestamp: 1_000},
+		{Attributes: map[string]string{"a": "a"}, Timestamp: 1_000},
+		{Attributes: map[string]string{"a": "b", "b": "a"}, Timestamp: 1_000},
+	}})
+
+	sets, err := s.AttributeSets()
+	if err != nil {
+		t.Fatalf("AttributeSets() error = %v", err)
+	}
+	if want := [][]string{{"a"}, {"a", "b"}}; !reflect.DeepEqual(sets, want) {
+		t.Errorf("AttributeSets() = %v, want %v", sets, want)
+	}
+}
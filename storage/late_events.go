@@ -0,0 +1,222 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// Policies for events whose timestamp is outside of the acceptance window.
+const (
+	RejectOutOfWindow     = "reject"     // fail the write
+	ClampOutOfWindow      = "clamp"      // move the timestamp to the closest accepted one
+	QuarantineOutOfWindow = "quarantine" // keep and log the event apart from the series
+)
+
+// ErrOutOfWindow is returned by Write for a rejected event whose timestamp is
+// outside of the acceptance window.
+var ErrOutOfWindow = errors.New("timestamp is outside of the acceptance window")
+
+// OutOfWindowCounts counts the events outside of the acceptance window by
+// their handling.
+type OutOfWindowCounts struct {
+	Rejected    uint64 `json:"rejected"`
+	Clamped     uint64 `json:"clamped"`
+	Quarantined uint64 `json:"quarantined"`
+}
+
+// LateEventStats counts the events written since the start which changed past
+// minutes, and the events outside of the acceptance window. Reports of minutes
+// before OldestLate have not changed.
+type LateEventStats struct {
+	Late       uint64            `json:"late"`       // accepted events of a minute which had passed
+	OldestLate uint64            `json:"oldestLate"` // earliest timestamp of a late event, 0 if there is none
+	TooLate    OutOfWindowCounts `json:"tooLate"`
+	TooEarly   OutOfWindowCounts `json:"tooEarly"` // events from the future
+}
+
+// QuarantinedEvent is an event outside of the acceptance window with the
+// time, in ms since the epoch, it was written at.
+type QuarantinedEvent struct {
+	Event     Event  `json:"event"`
+	WrittenAt uint64 `json:"writtenAt"`
+	Reason    string `json:"reason"`
+}
+
+// acceptanceWindow checks the timestamps of events against the time they are
+// written at.
+type acceptanceWindow struct {
+	maxLateness   uint64 // ms, 0 means unlimited
+	maxFutureSkew uint64 // ms, 0 means unlimited
+	policy        string
+	stats         LateEventStats // accessed atomically
+	quarantine    *quarantine
+}
+
+func newAcceptanceWindow(config *StorageConfiguration) *acceptanceWindow {
+	return &acceptanceWindow{
+		maxLateness:   uint64(config.MaxLateness.Milliseconds()),
+		maxFutureSkew: uint64(config.MaxFutureSkew.Milliseconds()),
+		policy:        config.OutOfWindowPolicy,
+		quarantine:    &quarantine{max: config.MaxQuarantine},
+	}
+}
+
+func validateOutOfWindowPolicy(policy string) error {
+	switch policy {
+	case RejectOutOfWindow, ClampOutOfWindow, QuarantineOutOfWindow:
+		return nil
+	}
+	return fmt.Errorf("unknown out of window policy %q, use reject, clamp or quarantine", policy)
+}
+
+// check handles an event written at now whose timestamp is outside of the
+// window by the policy. It returns nil if the event is accepted, possibly with
+// a clamped timestamp, otherwise an ErrOutOfWindow and, if the event is to be
+// quarantined, the quarantined event.
+func (w *acceptanceWindow) check(event *Event, now uint64) (*QuarantinedEvent, error) {
+	var counts *OutOfWindowCounts
+	var bound uint64
+	var reason string
+	switch {
+	case w.maxLateness > 0 && now > w.maxLateness && event.Timestamp < now-w.maxLateness:
+		counts, bound = &w.stats.TooLate, now-w.maxLateness
+		reason = fmt.Sprintf("timestamp %d is more than %d ms before %d", event.Timestamp, w.maxLateness, now)
+	case w.maxFutureSkew > 0 && event.Timestamp > now+w.maxFutureSkew:
+		counts, bound = &w.stats.TooEarly, now+w.maxFutureSkew
+		reason = fmt.Sprintf("timestamp %d is more than %d ms after %d", event.Timestamp, w.maxFutureSkew, now)
+	default:
+		w.countLate(event.Timestamp, now)
+		return nil, nil
+	}
+
+	switch w.policy {
+	case ClampOutOfWindow:
+		atomic.AddUint64(&counts.Clamped, 1)
+		event.Timestamp = bound
+		w.countLate(event.Timestamp, now)
+		return nil, nil
+	case QuarantineOutOfWindow:
+		atomic.AddUint64(&counts.Quarantined, 1)
+		return &QuarantinedEvent{Event: *event, WrittenAt: now, Reason: reason}, fmt.Errorf("%w, quarantined: %s", ErrOutOfWindow, reason)
+	}
+	atomic.AddUint64(&counts.Rejected, 1)
+	return nil, fmt.Errorf("%w: %s", ErrOutOfWindow, reason)
+}
+
+// countLate counts an accepted event of a minute before the one of now.
+func (w *acceptanceWindow) countLate(ts uint64, now uint64) {
+	if tsToMinuteBucket(ts) >= tsToMinuteBucket(now) {
+		return
+	}
+	atomic.AddUint64(&w.stats.Late, 1)
+	for {
+		oldest := atomic.LoadUint64(&w.stats.OldestLate)
+		if oldest != 0 && oldest <= ts || atomic.CompareAndSwapUint64(&w.stats.OldestLate, oldest, ts) {
+			return
+		}
+	}
+}
+
+func (w *acceptanceWindow) lateEvents() *LateEventStats {
+	load := func(counts *OutOfWindowCounts) OutOfWindowCounts {
+		return OutOfWindowCounts{
+			Rejected:    atomic.LoadUint64(&counts.Rejected),
+			Clamped:     atomic.LoadUint64(&counts.Clamped),
+			Quarantined: atomic.LoadUint64(&counts.Quarantined),
+		}
+	}
+	return &LateEventStats{
+		Late:       atomic.LoadUint64(&w.stats.Late),
+		OldestLate: atomic.LoadUint64(&w.stats.OldestLate),
+		TooLate:    load(&w.stats.TooLate),
+		TooEarly:   load(&w.stats.TooEarly),
+	}
+}
+
+// quarantine keeps the last max quarantined events in memory.
+type quarantine struct {
+	mu     sync.Mutex
+	max    int
+	events []QuarantinedEvent
+}
+
+// noRecord is passed to quarantine changes which are not logged.
+func noRecord() error {
+	return nil
+}
+
+// add keeps event unless record, which logs the change, fails. Changes are
+// logged in the order they are made.
+func (q *quarantine) add(event QuarantinedEvent, record func() error) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := record(); err != nil {
+		return err
+	}
+	if q.max <= 0 {
+		return nil
+	}
+	if len(q.events) == q.max {
+		copy(q.events, q.events[1:])
+		q.events = q.events[:q.max-1]
+	}
+	q.events = append(q.events, event)
+	return nil
+}
+
+func (q *quarantine) list() []QuarantinedEvent {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]QuarantinedEvent{}, q.events...)
+}
+
+func (q *quarantine) clear(record func() error) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := record(); err != nil {
+		return 0, err
+	}
+	n := len(q.events)
+	q.events = nil
+	return n, nil
+}
+
+// quarantineEvent logs and keeps an event outside of the acceptance window,
+// so that it survives a restart like the written events.
+func (s *inMemoryStorage) quarantineEvent(event *QuarantinedEvent) error {
+	if err := s.window.quarantine.add(*event, func() error {
+		if s.wal == nil {
+			return nil
+		}
+		return s.wal.append(&walRecord{Quarantined: event})
+	}); err != nil {
+		return err
+	}
+	log.Printf("Quarantined event %v", event.Event)
+	return nil
+}
+
+func (s *inMemoryStorage) LateEvents() (*LateEventStats, error) {
+	return s.window.lateEvents(), nil
+}
+
+func (s *inMemoryStorage) Quarantine() ([]QuarantinedEvent, error) {
+	return s.window.quarantine.list(), nil
+}
+
+func (s *inMemoryStorage) ClearQuarantine() (int, error) {
+	s.changes.RLock()
+	defer s.changes.RUnlock()
+	return s.window.quarantine.clear(func() error {
+		if s.wal == nil {
+			return nil
+		}
+		if err := s.wal.append(&walRecord{ClearQuarantine: true}); err != nil {
+			return err
+		}
+		return s.wal.flush()
+	})
+}
@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io.klector/klector/clock"
+	"testing"
+	"time"
+)
+
+func Test_inMemoryStorage_AcceptanceWindow(t *testing.T) {
+	now := 10 * milliSecondsInDay
+	events := []Event{
+		{Attributes: map[string]string{"app": "a"}, Timestamp: now},
+		{Attributes: map[string]string{"app": "a"}, Timestamp: now - milliSecondsInHour},
+		{Attributes: map[string]string{"app": "a"}, Timestamp: now - 2*milliSecondsInDay},
+		{Attributes: map[string]string{"app": "a"}, Timestamp: now + milliSecondsInHour},
+	}
+
+	tests := []struct {
+		name           string
+		policy         string
+		wantErr        bool
+		wantCount      uint64
+		wantStats      LateEventStats
+		wantQuarantine int
+	}{
+		{"Reject", RejectOutOfWindow, true, 2,
+			LateEventStats{Late: 1, OldestLate: now - milliSecondsInHour, TooLate: OutOfWindowCounts{Rejected: 1}, TooEarly: OutOfWindowCounts{Rejected: 1}}, 0},
+		{"Clamp", ClampOutOfWindow, false, 4,
+			LateEventStats{Late: 2, OldestLate: now - milliSecondsInDay, TooLate: OutOfWindowCounts{Clamped: 1}, TooEarly: OutOfWindowCounts{Clamped: 1}}, 0},
+		{"Quarantine", QuarantineOutOfWindow, false, 2,
+			LateEventStats{Late: 1, OldestLate: now - milliSecondsInHour, TooLate: OutOfWindowCounts{Quarantined: 1}, TooEarly: OutOfWindowCounts{Quarantined: 1}}, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := NewDefaultStorageConfiguration()
+			config.MaxLateness = 24 * time.Hour
+			config.MaxFutureSkew = time.Minute
+			config.OutOfWindowPolicy = tt.policy
+			s := Create(config)
+			s.(*inMemoryStorage).clock = clock.Fixed(time.Unix(int64(now/1000), 0))
+
+			err := s.Write(&Events{Events: events})
+			if (err != nil) != tt.wantErr || err != nil && !errors.Is(err, ErrOutOfWindow) {
+				t.Fatalf("Write() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			result, err := s.Query(context.Background(), &Query{Attributes: map[string]string{"app": "a"}, StartTimestamp: now - 3*milliSecondsInDay, EndTimestamp: now + milliSecondsInDay})
+			if err != nil {
+				t.Fatalf("Query() error = %v", err)
+			}
+			if result.Value != tt.wantCount {
+				t.Errorf("Query() = %d, want %d", result.Value, tt.wantCount)
+			}
+			if stats, _ := s.LateEvents(); *stats != tt.wantStats {
+				t.Errorf("LateEvents() = %+v, want %+v", *stats, tt.wantStats)
+			}
+			quarantined, _ := s.Quarantine()
+			if len(quarantined) != tt.wantQuarantine {
+				t.Errorf("Quarantine() has %d events, want %d", len(quarantined), tt.wantQuarantine)
+			}
+			if n, _ := s.ClearQuarantine(); n != tt.wantQuarantine {
+				t.Errorf("ClearQuarantine() = %d, want %d", n, tt.wantQuarantine)
+			}
+		})
+	}
+}
+
+func Test_quarantine_add(t *testing.T) {
+	q := &quarantine{max: 2}
+	for ts := uint64(1); ts <= 3; ts++ {
+		q.add(QuarantinedEvent{Event: Event{Timestamp: ts}}, noRecord)
+	}
+	events := q.list()
+	if len(events) != 2 || events[0].Event.Timestamp != 2 || events[1].Event.Timestamp != 3 {
+		t.Errorf("list() = %v, want the events 2 and 3", events)
+	}
+}
+
+func Test_inMemoryStorage_Quarantine_restart(t *testing.T) {
+	dataFolder := t.TempDir()
+	config := walConfiguration(dataFolder)
+	config.MaxLateness = time.Hour
+	config.OutOfWindowPolicy = QuarantineOutOfWindow
+	open := func() Storage {
+		s, err := Open(config)
+		if err != nil {
+			t.Fatalf("Open() error = %v", err)
+		}
+		s.(*inMemoryStorage).clock = clock.Fixed(time.Unix(int64(milliSecondsInDay/1000), 0))
+		return s
+	}
+	s := open()
+	late := Event{Id: "1", Attributes: map[string]string{"app": "a"}, Timestamp: 1_000}
+	if err := s.Write(&Events{Events: []Event{late}}); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	s.(*inMemoryStorage).wal.flush()
+
+	s = open()
+	if quarantined, _ := s.Quarantine(); len(quarantined) != 1 || quarantined[0].Event.Id != "1" {
+		t.Fatalf("Quarantine() after restart = %v, want the late event", quarantined)
+	}
+	s.Write(&Events{Events: []Event{late}})
+	if stats, _ := s.LateEvents(); stats.TooLate.Quarantined != 0 {
+		t.Errorf("retry of a quarantined event counted %d times, want a dropped duplicate", stats.TooLate.Quarantined)
+	}
+	if n, err := s.ClearQuarantine(); n != 1 || err != nil {
+		t.Fatalf("ClearQuarantine() = %d, %v, want 1", n, err)
+	}
+
+	s = open()
+	if quarantined, _ := s.Quarantine(); len(quarantined) != 0 {
+		t.Errorf("Quarantine() after a clear and restart = %v, want none", quarantined)
+	}
+}
+
+func Test_inMemoryStorage_AcceptanceWindow_duplicates(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    string
+		wantStats OutOfWindowCounts
+	}{
+		{"Rejected retries are checked again", RejectOutOfWindow, OutOfWindowCounts{Rejected: 2}},
+		{"Quarantined retries are dropped", QuarantineOutOfWindow, OutOfWindowCounts{Quarantined: 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := NewDefaultStorageConfiguration()
+			config.MaxEventIds = 10
+			config.MaxLateness = time.Hour
+			config.OutOfWindowPolicy = tt.policy
+			s := Create(config)
+			s.(*inMemoryStorage).clock = clock.Fixed(time.Unix(int64(milliSecondsInDay/1000), 0))
+
+			late := Event{Id: "1", Attributes: map[string]string{"app": "a"}, Timestamp: 1_000}
+			for i := 0; i < 2; i++ {
+				s.Write(&Events{Events: []Event{late}})
+			}
+			if stats, _ := s.LateEvents(); stats.TooLate != tt.wantStats {
+				t.Errorf("LateEvents().TooLate = %+v, want %+v", stats.TooLate, tt.wantStats)
+			}
+		})
+	}
+}
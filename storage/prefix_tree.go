@@ -1,55 +1,82 @@
 package storage
 
 import (
+	"context"
 	"sort"
+	"strings"
 	"sync"
 )
 
 type node struct {
 	mu                 sync.RWMutex
 	tseriesByAttrValue *sync.Map //map[string]*timeSeries where string is attribute value
-	childNodes         *sync.Map //map[string]*node where string is attribute key
+	childNodes         *sync.Map //map[string]*sync.Map where string is attribute value of this node, inner map[string]*node where string is attribute key
 }
 
 type tree struct {
-	root *node
+	root     *node
+	attrSets *sync.Map // map[string][]string where string is the joined attribute names of events
 }
 
 func (t *tree) addEvent(event *Event) {
-	names := sortAttributes(event.Attributes)
+	t.add(event.Attributes, func(series *timeSeriesAggregator) {
+		series.add(event.Timestamp, event.Weight())
+		series.addMeasures(event.Timestamp, event.Measures, event.Weight())
+	})
+}
+
+// add calls add with the series of every subset of attributes, creating them.
+func (t *tree) add(attributes map[string]string, add func(series *timeSeriesAggregator)) {
+	names := sortAttributes(attributes)
+	t.addAttributeSet(names)
 
 	for len(names) > 0 {
-		t.root.addChildNode(event, names)
+		t.root.addChildNode(attributes, "", names, add)
 		names = names[1:]
 	}
 }
 
-func (n *node) addChildNode(event *Event, names []string) {
+// children returns child nodes of events which have attrValue as value of this
+// node's attribute, the root node has only the "" value.
+func (n *node) children(attrValue string) *sync.Map {
+	children, found := n.childNodes.Load(attrValue)
+	if !found {
+		n.mu.Lock()
+		children, found = n.childNodes.Load(attrValue)
+		if !found {
+			children = &sync.Map{}
+			n.childNodes.Store(attrValue, children)
+		}
+		n.mu.Unlock()
+	}
+	return children.(*sync.Map)
+}
+
+func (n *node) addChildNode(attributes map[string]string, attrValue string, names []string, add func(*timeSeriesAggregator)) {
 	if len(names) == 0 {
 		return
 	}
 
 	name := names[0]
-	child, found := n.childNodes.Load(name)
+	children := n.children(attrValue)
+	child, found := children.Load(name)
 	if !found {
 		n.mu.Lock()
-		child, found = n.childNodes.Load(name)
+		child, found = children.Load(name)
 		if !found {
-			child = &node{
-				tseriesByAttrValue: &sync.Map{},
-				childNodes:         &sync.Map{},
-			}
-			n.childNodes.Store(name, child)
+			child = newNode()
+			children.Store(name, child)
 		}
 		n.mu.Unlock()
 	}
-	child.(*node).addToSeries(event.Timestamp, event.Attributes[name], 1)
+	value := attributes[name]
+	child.(*node).addToSeries(value, add)
 	for i := 1; i < len(names); i++ {
-		child.(*node).addChildNode(event, names[i:])
+		child.(*node).addChildNode(attributes, value, names[i:], add)
 	}
 }
 
-func (n *node) addToSeries(ts uint64, attrValue string, count uint64) {
+func (n *node) addToSeries(attrValue string, add func(*timeSeriesAggregator)) {
 	series, found := n.tseriesByAttrValue.Load(attrValue)
 	if !found {
 		n.mu.Lock()
@@ -60,40 +87,172 @@ func (n *node) addToSeries(ts uint64, attrValue string, count uint64) {
 		}
 		n.mu.Unlock()
 	}
-	series.(*timeSeriesAggregator).add(ts, count)
+	add(series.(*timeSeriesAggregator))
 }
 
-func findTimeSeries(n *node, names []string, query *Query) *timeSeriesAggregator {
-	if len(names) == 0 {
+// pathMatcher selects the values of one attribute on a tree path. value is
+// looked up directly, otherwise every value accepted by accept is visited, a
+// nil accept accepts all values.
+type pathMatcher struct {
+	name   string
+	value  *string
+	accept func(string) bool
+}
+
+// match calls visit for every series on the paths described by matchers, which
+// must be sorted by name. values holds the attribute value for every matcher
+// and is only valid during the call. Matching stops at the first error of visit
+// or when ctx is done.
+func (t *tree) match(ctx context.Context, matchers []pathMatcher, visit func(values []string, series *timeSeriesAggregator) error) error {
+	if len(matchers) == 0 {
 		return nil
 	}
+	return matchNode(ctx, t.root, "", matchers, make([]string, 0, len(matchers)), visit)
+}
 
-	child, found := n.childNodes.Load(names[0])
+func matchNode(ctx context.Context, n *node, attrValue string, matchers []pathMatcher, values []string, visit func([]string, *timeSeriesAggregator) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	children, found := n.childNodes.Load(attrValue)
+	if !found {
+		return nil
+	}
+	child, found := children.(*sync.Map).Load(matchers[0].name)
 	if !found {
 		return nil
 	}
 
-	series, found := child.(*node).tseriesByAttrValue.Load(query.Attributes[names[0]])
+	visitValue := func(value string, series *timeSeriesAggregator) error {
+		if matchers[0].accept != nil && !matchers[0].accept(value) {
+			return nil
+		}
+		if len(matchers) == 1 {
+			return visit(append(values, value), series)
+		}
+		return matchNode(ctx, child.(*node), value, matchers[1:], append(values, value), visit)
+	}
+
+	if matchers[0].value != nil {
+		series, found := child.(*node).tseriesByAttrValue.Load(*matchers[0].value)
+		if found {
+			return visitValue(*matchers[0].value, series.(*timeSeriesAggregator))
+		}
+		return nil
+	}
+	var err error
+	child.(*node).tseriesByAttrValue.Range(func(value, series interface{}) bool {
+		err = visitValue(value.(string), series.(*timeSeriesAggregator))
+		return err == nil
+	})
+	return err
+}
+
+// walk calls visit for every series of the tree and its path, in order of
+// attribute names and values. Walking stops at the first error of visit or
+// when ctx is done.
+func (t *tree) walk(ctx context.Context, visit func(path []AttributeValue, series *timeSeriesAggregator) error) error {
+	return walkNode(ctx, t.root, "", nil, visit)
+}
+
+func walkNode(ctx context.Context, n *node, attrValue string, path []AttributeValue, visit func([]AttributeValue, *timeSeriesAggregator) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	children, found := n.childNodes.Load(attrValue)
 	if !found {
 		return nil
 	}
-	if len(names) == 1 {
-		return series.(*timeSeriesAggregator)
+	for _, name := range sortedKeys(children.(*sync.Map)) {
+		child, _ := children.(*sync.Map).Load(name)
+		for _, value := range sortedKeys(child.(*node).tseriesByAttrValue) {
+			series, _ := child.(*node).tseriesByAttrValue.Load(value)
+			seriesPath := append(path[:len(path):len(path)], AttributeValue{Name: name, Value: value})
+			if err := visit(seriesPath, series.(*timeSeriesAggregator)); err != nil {
+				return err
+			}
+			if err := walkNode(ctx, child.(*node), value, seriesPath, visit); err != nil {
+				return err
+			}
+		}
 	}
+	return nil
+}
+
+func sortedKeys(m *sync.Map) []string {
+	var keys []string
+	m.Range(func(key, value interface{}) bool {
+		keys = append(keys, key.(string))
+		return true
+	})
+	sort.Strings(keys)
+	return keys
+}
 
-	return findTimeSeries(child.(*node), names[1:], query)
+// keys returns all attribute names, as every attribute starts a path from the
+// root they are the root's children.
+func (t *tree) keys() []string {
+	var keys []string
+	t.root.children("").Range(func(key, child interface{}) bool {
+		keys = append(keys, key.(string))
+		return true
+	})
+	sort.Strings(keys)
+	return keys
 }
 
-func (t *tree) find(query *Query) *timeSeriesAggregator {
-	names := sortAttributes(query.Attributes)
-	return findTimeSeries(t.root, names, query)
+func (t *tree) values(key string) []string {
+	var values []string
+	child, found := t.root.children("").Load(key)
+	if !found {
+		return values
+	}
+	child.(*node).tseriesByAttrValue.Range(func(value, series interface{}) bool {
+		values = append(values, value.(string))
+		return true
+	})
+	sort.Strings(values)
+	return values
+}
+
+// addAttributeSet records the sorted attribute names of an event.
+func (t *tree) addAttributeSet(names []string) {
+	key := strings.Join(names, "\x00")
+	if _, found := t.attrSets.Load(key); !found {
+		t.attrSets.Store(key, names)
+	}
+}
+
+func (t *tree) hasAttributeSet(path []AttributeValue) bool {
+	names := make([]string, len(path))
+	for i, attribute := range path {
+		names[i] = attribute.Name
+	}
+	_, found := t.attrSets.Load(strings.Join(names, "\x00"))
+	return found
+}
+
+// attributeSets returns the distinct attribute names of the events, in order.
+func (t *tree) attributeSets() [][]string {
+	var sets [][]string
+	for _, key := range sortedKeys(t.attrSets) {
+		names, _ := t.attrSets.Load(key)
+		sets = append(sets, names.([]string))
+	}
+	return sets
+}
+
+func newNode() *node {
+	return &node{
+		tseriesByAttrValue: &sync.Map{},
+		childNodes:         &sync.Map{},
+	}
 }
 
 func newTree() *tree {
 	return &tree{
-		root: &node{
-			childNodes: &sync.Map{},
-		},
+		root:     newNode(),
+		attrSets: &sync.Map{},
 	}
 }
 
@@ -0,0 +1,294 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+var ErrUnknownRollup = errors.New("unknown rollup")
+
+// rollupsFile keeps the rollups of a storage with a write-ahead log in its
+// data folder.
+const rollupsFile = "rollups.json"
+
+// Rollup is a continuous query. Every event which matches Attributes and
+// Filters and has all GroupBy attributes is also added, reduced to the GroupBy
+// attributes and Measures, to the series of the rollup. A Query with the name
+// of the rollup reads these few series instead of all series of the matching
+// attribute values. The events written before the rollup was added are added
+// from the series when it is added or the storage is opened.
+type Rollup struct {
+	Name       string            `json:"name"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Filters    []Filter          `json:"filters,omitempty"`
+	GroupBy    []string          `json:"groupBy"`
+	Measures   []string          `json:"measures,omitempty"`
+}
+
+type rollup struct {
+	Rollup
+	match func(attributes map[string]string) bool
+	tree  *tree
+}
+
+func newRollup(definition *Rollup) (*rollup, error) {
+	if definition.Name == "" {
+		return nil, errors.New("the rollup needs a name")
+	}
+	if len(definition.GroupBy) == 0 {
+		return nil, errors.New("the rollup needs at least one group by attribute")
+	}
+	match, err := attributesMatcher(definition.Attributes, definition.Filters)
+	if err != nil {
+		return nil, err
+	}
+	return &rollup{Rollup: *definition, match: match, tree: newTree()}, nil
+}
+
+func (r *rollup) add(event *Event) {
+	if !r.match(event.Attributes) {
+		return
+	}
+	reduced := &Event{
+		Attributes: make(map[string]string, len(r.GroupBy)),
+		Count:      event.Count,
+		Timestamp:  event.Timestamp,
+	}
+	for _, name := range r.GroupBy {
+		value, found := event.Attributes[name]
+		if !found {
+			return
+		}
+		reduced.Attributes[name] = value
+	}
+	for _, name := range r.Measures {
+		if value, found := event.Measures[name]; found {
+			if reduced.Measures == nil {
+				reduced.Measures = make(map[string]float64, len(r.Measures))
+			}
+			reduced.Measures[name] = value
+		}
+	}
+	r.tree.addEvent(reduced)
+}
+
+// backfill adds the events of t to the rollup. They are read from the series
+// of the attributes, filters and group by attributes of the rollup, which
+// hold the events that have all of them.
+func (r *rollup) backfill(t *tree) error {
+	kept := map[string]bool{}
+	for name := range r.Attributes {
+		kept[name] = true
+	}
+	for _, filter := range r.Filters {
+		kept[filter.Attribute] = true
+	}
+	for _, name := range r.GroupBy {
+		kept[name] = true
+	}
+	matchers := make([]pathMatcher, 0, len(kept))
+	for name := range kept {
+		matchers = append(matchers, pathMatcher{name: name})
+	}
+	sort.Slice(matchers, func(i, j int) bool {
+		return matchers[i].name < matchers[j].name
+	})
+
+	return t.match(context.Background(), matchers, func(values []string, series *timeSeriesAggregator) error {
+		attributes := make(map[string]string, len(values))
+		for i, value := range values {
+			attributes[matchers[i].name] = value
+		}
+		if !r.match(attributes) {
+			return nil
+		}
+		reduced := make(map[string]string, len(r.GroupBy))
+		for _, name := range r.GroupBy {
+			reduced[name] = attributes[name]
+		}
+		counts := dumpMinutes(series, false)
+		sums := map[string][]BucketDump{}
+		for _, name := range r.Measures {
+			if _, found := series.measures.Load(name); found {
+				sums[name] = dumpMinutes(series.measure(name), true)
+			}
+		}
+		r.tree.add(reduced, func(rollupSeries *timeSeriesAggregator) {
+			for _, bucket := range counts {
+				if bucket.Count > 0 {
+					rollupSeries.add(bucket.Timestamp, bucket.Count)
+				}
+			}
+			for name, buckets := range sums {
+				for _, bucket := range buckets {
+					rollupSeries.measure(name).addSum(bucket.Timestamp, bucket.Sum)
+				}
+			}
+		})
+		return nil
+	})
+}
+
+// covers returns an error if query needs attributes or measures which are not
+// kept by the rollup.
+func (r *rollup) covers(query *Query) error {
+	kept := func(names []string, name string) bool {
+		for _, n := range names {
+			if n == name {
+				return true
+			}
+		}
+		return false
+	}
+	for name := range query.Attributes {
+		if !kept(r.GroupBy, name) {
+			return fmt.Errorf("rollup %q does not keep the attribute %q", r.Name, name)
+		}
+	}
+	for _, filter := range query.Filters {
+		if !kept(r.GroupBy, filter.Attribute) {
+			return fmt.Errorf("rollup %q does not keep the attribute %q", r.Name, filter.Attribute)
+		}
+	}
+	for _, name := range query.GroupBy {
+		if !kept(r.GroupBy, name) {
+			return fmt.Errorf("rollup %q does not keep the attribute %q", r.Name, name)
+		}
+	}
+	for _, name := range query.Measures {
+		if !kept(r.Measures, name) {
+			return fmt.Errorf("rollup %q does not keep the measure %q", r.Name, name)
+		}
+	}
+	return nil
+}
+
+// AddRollup adds the rollup with the events written before, which wait until
+// it is added, and saves the rollups.
+func (s *inMemoryStorage) AddRollup(definition *Rollup) error {
+	r, err := newRollup(definition)
+	if err != nil {
+		return err
+	}
+
+	s.changes.Lock()
+	defer s.changes.Unlock()
+	s.mu.RLock()
+	_, found := s.rollups[r.Name]
+	s.mu.RUnlock()
+	if found {
+		return fmt.Errorf("rollup %q already exists", r.Name)
+	}
+	if err := r.backfill(s.tree); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rollups[r.Name] = r
+	if err := s.saveRollups(); err != nil {
+		delete(s.rollups, r.Name)
+		return err
+	}
+	return nil
+}
+
+func (s *inMemoryStorage) RemoveRollup(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous, found := s.rollups[name]
+	if !found {
+		return fmt.Errorf("%w %q", ErrUnknownRollup, name)
+	}
+	delete(s.rollups, name)
+	if err := s.saveRollups(); err != nil {
+		s.rollups[name] = previous
+		return err
+	}
+	return nil
+}
+
+func (s *inMemoryStorage) Rollups() ([]Rollup, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.sortedRollups(), nil
+}
+
+func (s *inMemoryStorage) sortedRollups() []Rollup {
+	rollups := make([]Rollup, 0, len(s.rollups))
+	for _, r := range s.rollups {
+		rollups = append(rollups, r.Rollup)
+	}
+	sort.Slice(rollups, func(i, j int) bool {
+		return rollups[i].Name < rollups[j].Name
+	})
+	return rollups
+}
+
+// loadRollups adds the rollups saved in dataFolder, whose events are read
+// from the series, and saves further changes to them there.
+func (s *inMemoryStorage) loadRollups(dataFolder string) error {
+	path := filepath.Join(dataFolder, rollupsFile)
+	s.rollupsPath = path
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var definitions []Rollup
+	if err := json.Unmarshal(data, &definitions); err != nil {
+		return fmt.Errorf("invalid %s: %w", rollupsFile, err)
+	}
+	for i := range definitions {
+		r, err := newRollup(&definitions[i])
+		if err != nil {
+			return fmt.Errorf("invalid rollup %q in %s: %w", definitions[i].Name, rollupsFile, err)
+		}
+		if err := r.backfill(s.tree); err != nil {
+			return err
+		}
+		s.rollups[r.Name] = r
+	}
+	return nil
+}
+
+// saveRollups writes the rollups to a temporary file which replaces the
+// rollups file, so that a failed write keeps the previous rollups. Rollups
+// of a storage without data folder are not saved.
+func (s *inMemoryStorage) saveRollups() error {
+	if s.rollupsPath == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.sortedRollups(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(s.rollupsPath+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(s.rollupsPath+".tmp", s.rollupsPath)
+}
+
+// source returns the tree query reads, the one of its rollup if it names one.
+func (s *inMemoryStorage) source(query *Query) (*tree, error) {
+	if query.Rollup == "" {
+		return s.tree, nil
+	}
+	s.mu.RLock()
+	r, found := s.rollups[query.Rollup]
+	s.mu.RUnlock()
+	if !found {
+		return nil, fmt.Errorf("%w %q", ErrUnknownRollup, query.Rollup)
+	}
+	if err := r.covers(query); err != nil {
+		return nil, err
+	}
+	return r.tree, nil
+}
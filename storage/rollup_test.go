@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func Test_inMemoryStorage_Rollup(t *testing.T) {
+	s := Create(NewDefaultStorageConfiguration())
+	s.Write(&Events{Events: []Event{
+		{Attributes: map[string]string{"country": "de", "browser": "chrome"}, Timestamp: 1_000},
+	}})
+	if err := s.AddRollup(&Rollup{Name: "checkout", Attributes: map[string]string{"app": "checkout"}, GroupBy: []string{"country"}, Measures: []string{"bytes"}}); err != nil {
+		t.Fatalf("AddRollup() error = %v", err)
+	}
+	if err := s.AddRollup(&Rollup{Name: "checkout", GroupBy: []string{"country"}}); err == nil {
+		t.Fatalf("AddRollup() of an existing name succeeded")
+	}
+	s.Write(&Events{Events: []Event{
+		{Attributes: map[string]string{"app": "checkout", "country": "de", "browser": "chrome"}, Measures: map[string]float64{"bytes": 10, "ms": 5}, Timestamp: 1_000},
+		{Attributes: map[string]string{"app": "checkout", "country": "de", "browser": "firefox"}, Measures: map[string]float64{"bytes": 20}, Count: 2, Timestamp: 61_000},
+		{Attributes: map[string]string{"app": "checkout", "country": "fr"}, Timestamp: 61_000},
+		{Attributes: map[string]string{"app": "checkout", "browser": "chrome"}, Timestamp: 61_000},
+		{Attributes: map[string]string{"app": "search", "country": "fr"}, Timestamp: 61_000},
+	}})
+
+	tests := []struct {
+		name    string
+		query   Query
+		want    []Group
+		wantErr bool
+	}{
+		{"Group by", Query{Rollup: "checkout", GroupBy: []string{"country"}, Measures: []string{"bytes"}, StartTimestamp: 0, EndTimestamp: 120_000}, []Group{
+			{Attributes: map[string]string{"country": "de"}, Value: 3, Measures: map[string]float64{"bytes": 50}},
+			{Attributes: map[string]string{"country": "fr"}, Value: 1, Measures: map[string]float64{"bytes": 0}},
+		}, false},
+		{"Filter", Query{Rollup: "checkout", Attributes: map[string]string{"country": "fr"}, GroupBy: []string{"country"}, StartTimestamp: 0, EndTimestamp: 120_000}, []Group{
+			{Attributes: map[string]string{"country": "fr"}, Value: 1},
+		}, false},
+		{"Attribute not kept", Query{Rollup: "checkout", GroupBy: []string{"browser"}, StartTimestamp: 0, EndTimestamp: 120_000}, nil, true},
+		{"Measure not kept", Query{Rollup: "checkout", GroupBy: []string{"country"}, Measures: []string{"ms"}, StartTimestamp: 0, EndTimestamp: 120_000}, nil, true},
+		{"Unknown rollup", Query{Rollup: "search", GroupBy: []string{"country"}, StartTimestamp: 0, EndTimestamp: 120_000}, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.Query(context.Background(), &tt.query)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Query() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(got.Groups, tt.want) {
+				t.Errorf("Query() = %+v, want %+v", got.Groups, tt.want)
+			}
+		})
+	}
+
+	if err := s.RemoveRollup("checkout"); err != nil {
+		t.Fatalf("RemoveRollup() error = %v", err)
+	}
+	if rollups, _ := s.Rollups(); len(rollups) != 0 {
+		t.Errorf("Rollups() = %v, want none", rollups)
+	}
+}
+
+func Test_inMemoryStorage_AddRollup_writtenBefore(t *testing.T) {
+	dataFolder := t.TempDir()
+	s, err := Open(walConfiguration(dataFolder))
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	s.Write(&Events{Events: []Event{
+		{Attributes: map[string]string{"app": "checkout", "country": "de", "browser": "chrome"}, Measures: map[string]float64{"bytes": 10}, Timestamp: 1_000},
+		{Attributes: map[string]string{"app": "checkout", "country": "de"}, Measures: map[string]float64{"bytes": 20}, Count: 2, Timestamp: 61_000},
+		{Attributes: map[string]string{"app": "checkout", "browser": "chrome"}, Timestamp: 61_000},
+		{Attributes: map[string]string{"app": "search", "country": "fr"}, Timestamp: 61_000},
+	}})
+	if err := s.AddRollup(&Rollup{Name: "checkout", Attributes: map[string]string{"app": "checkout"}, GroupBy: []string{"country"}, Measures: []string{"bytes"}}); err != nil {
+		t.Fatalf("AddRollup() error = %v", err)
+	}
+	s.AddRollup(&Rollup{Name: "search", Attributes: map[string]string{"app": "search"}, GroupBy: []string{"country"}})
+	s.Write(&Events{Events: []Event{
+		{Attributes: map[string]string{"app": "checkout", "country": "fr"}, Timestamp: 61_000},
+	}})
+	s.RemoveRollup("search")
+	want := []Group{
+		{Attributes: map[string]string{"country": "de"}, Value: 3, Measures: map[string]float64{"bytes": 50}},
+		{Attributes: map[string]string{"country": "fr"}, Value: 1, Measures: map[string]float64{"bytes": 0}},
+	}
+	query := &Query{Rollup: "checkout", GroupBy: []string{"country"}, Measures: []string{"bytes"}, StartTimestamp: 0, EndTimestamp: 120_000}
+
+	for _, name := range []string{"Added", "Reopened"} {
+		t.Run(name, func(t *testing.T) {
+			got, err := s.Query(context.Background(), query)
+			if err != nil {
+				t.Fatalf("Query() error = %v", err)
+			}
+			if !reflect.DeepEqual(got.Groups, want) {
+				t.Errorf("Query() = %+v, want %+v", got.Groups, want)
+			}
+			if rollups, _ := s.Rollups(); len(rollups) != 1 {
+				t.Errorf("Rollups() = %v, want the checkout rollup", rollups)
+			}
+		})
+		if s, err = Open(walConfiguration(dataFolder)); err != nil {
+			t.Fatalf("Open() error = %v", err)
+		}
+	}
+}
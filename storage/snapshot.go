@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"context"
+	"log"
+	"sort"
+)
+
+// Snapshot writes the state of the storage to the snapshot file of the data
+// folder and starts an empty write-ahead log, so that replay and backups do
+// not grow with every change. Changes wait until the snapshot is written. It
+// returns the seq of the last record in the snapshot.
+func (s *inMemoryStorage) Snapshot() (uint64, error) {
+	if s.wal == nil {
+		return 0, ErrNoWal
+	}
+	s.changes.Lock()
+	defer s.changes.Unlock()
+	seq, err := s.wal.compact(s.dump)
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("Snapshot up to record %d written", seq)
+	return seq, nil
+}
+
+// dump passes the state of the storage as records to record: the series, the
+// events of actors, the cohorts, the quarantined events and the event ids.
+// Rollups, which are rebuilt from the series, and the counts of late events
+// are not dumped.
+func (s *inMemoryStorage) dump(record func(*walRecord) error) error {
+	if err := s.Export(context.Background(), func(dump *SeriesDump) error {
+		return record(&walRecord{Series: dump})
+	}); err != nil {
+		return err
+	}
+	for _, attribute := range sortedActorAttributes(s.actors) {
+		if err := s.actors[attribute].timelines(func(actor string, timeline *actorTimeline) error {
+			return record(&walRecord{Actor: timeline.dump(attribute, actor)})
+		}); err != nil {
+			return err
+		}
+		if err := record(&walRecord{Cohort: s.cohorts[attribute].dump()}); err != nil {
+			return err
+		}
+	}
+	for _, event := range s.window.quarantine.list() {
+		event := event
+		if err := record(&walRecord{Quarantined: &event}); err != nil {
+			return err
+		}
+	}
+	if s.ids != nil {
+		// after the quarantined events, whose replay adds their ids
+		if err := record(&walRecord{EventIds: s.ids.list()}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sortedActorAttributes(actors map[string]*actorStore) []string {
+	attributes := make([]string, 0, len(actors))
+	for attribute := range actors {
+		attributes = append(attributes, attribute)
+	}
+	sort.Strings(attributes)
+	return attributes
+}
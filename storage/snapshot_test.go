@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io.klector/klector/clock"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// snapshotState returns what a snapshot has to keep of s.
+func snapshotState(t *testing.T, s Storage) []interface{} {
+	retention, err := s.Retention(context.Background(), &RetentionQuery{Actor: "user", Period: milliSecondsInDay, StartTimestamp: 0, EndTimestamp: 2*milliSecondsInDay - 1})
+	if err != nil {
+		t.Fatalf("Retention() error = %v", err)
+	}
+	funnel, err := s.Funnel(context.Background(), &FunnelQuery{
+		Actor:        "user",
+		Steps:        []FunnelStep{{Attributes: map[string]string{"page": "home"}}, {Attributes: map[string]string{"page": "cart"}}},
+		Window:       milliSecondsInDay,
+		EndTimestamp: 2 * milliSecondsInDay,
+	})
+	if err != nil {
+		t.Fatalf("Funnel() error = %v", err)
+	}
+	quarantined, _ := s.Quarantine()
+	// deletions leave empty buckets, which are not part of the snapshot
+	counts := map[string]uint64{}
+	for _, dump := range exportAll(t, s) {
+		for _, bucket := range dump.Buckets {
+			counts[fmt.Sprint(dump.Attributes, bucket.Timestamp)] += bucket.Count
+		}
+		for name, buckets := range dump.Measures {
+			for _, bucket := range buckets {
+				counts[fmt.Sprint(dump.Attributes, name, bucket.Timestamp, bucket.Sum)]++
+			}
+		}
+	}
+	for key, count := range counts {
+		if count == 0 {
+			delete(counts, key)
+		}
+	}
+	return []interface{}{counts, *retention, *funnel, quarantined}
+}
+
+func Test_inMemoryStorage_Snapshot(t *testing.T) {
+	dataFolder := t.TempDir()
+	open := func(dataFolder string) Storage {
+		config := walConfiguration(dataFolder)
+		config.ActorAttributes = []string{"user"}
+		config.MaxLateness = time.Duration(milliSecondsInDay) * time.Millisecond
+		config.OutOfWindowPolicy = QuarantineOutOfWindow
+		s, err := Open(config)
+		if err != nil {
+			t.Fatalf("Open() error = %v", err)
+		}
+		s.(*inMemoryStorage).clock = clock.Fixed(time.Unix(int64(milliSecondsInDay/1000), 0))
+		return s
+	}
+	s := open(dataFolder)
+	s.Write(&Events{Events: []Event{
+		{Id: "1", Attributes: map[string]string{"user": "a", "page": "home"}, Measures: map[string]float64{"ms": 0.5}, Timestamp: 1_000},
+		{Id: "2", Attributes: map[string]string{"user": "a", "page": "cart"}, Timestamp: 61_000},
+		{Id: "3", Attributes: map[string]string{"user": "b", "page": "home"}, Timestamp: milliSecondsInDay},
+		{Id: "4", Attributes: map[string]string{"user": "c", "page": "cart"}, Timestamp: milliSecondsInDay},
+	}})
+	s.Delete(context.Background(), &Deletion{Attributes: map[string]string{"user": "c"}, EndTimestamp: milliSecondsInDay})
+	// quarantined when written at the end of the second day
+	s.(*inMemoryStorage).clock = clock.Fixed(time.Unix(int64(3*milliSecondsInDay/1000), 0))
+	s.Write(&Events{Events: []Event{{Id: "5", Attributes: map[string]string{"user": "b", "page": "cart"}, Timestamp: 1_000}}})
+	logged, _ := os.ReadFile(filepath.Join(dataFolder, WalFile))
+	want := snapshotState(t, s)
+
+	seq, err := s.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot() error = %v", err)
+	}
+	if seq != 6 {
+		t.Errorf("Snapshot() = %d, want the seq of the last record, 6", seq)
+	}
+	if info, _ := os.Stat(filepath.Join(dataFolder, WalFile)); info.Size() != 0 {
+		t.Errorf("write-ahead log has %d bytes after the snapshot, want none", info.Size())
+	}
+	if got := snapshotState(t, open(dataFolder)); !reflect.DeepEqual(got, want) {
+		t.Errorf("state after the snapshot =\n%v\nwant\n%v", got, want)
+	}
+
+	// a crash after the snapshot replaced the old one, before the log was replaced
+	os.WriteFile(filepath.Join(dataFolder, WalFile), logged, 0644)
+	s = open(dataFolder)
+	if got := snapshotState(t, s); !reflect.DeepEqual(got, want) {
+		t.Errorf("state with the records of the snapshot left in the log =\n%v\nwant\n%v", got, want)
+	}
+
+	s.Write(&Events{Events: []Event{
+		{Id: "1", Attributes: map[string]string{"user": "a", "page": "home"}, Timestamp: 1_000},
+		{Id: "6", Attributes: map[string]string{"user": "a", "page": "home"}, Timestamp: 2 * milliSecondsInDay},
+	}})
+	if got := countOf(t, s, map[string]string{"user": "a"}); got != 2 {
+		t.Errorf("count = %d, want 2, the event ids are kept by the snapshot", got)
+	}
+	reader, position, err := s.Backup()
+	if err != nil {
+		t.Fatalf("Backup() error = %v", err)
+	}
+	backup, _ := io.ReadAll(reader)
+	reader.Close()
+	if position != 7 {
+		t.Errorf("Backup() position = %d, want 7", position)
+	}
+
+	tests := []struct {
+		name      string
+		until     uint64
+		wantSeq   uint64
+		wantCount uint64
+		wantErr   bool
+	}{
+		{"All", math.MaxUint64, 7, 2, false},
+		{"Before the snapshot", 0, 0, 0, true},
+		{"Cut off snapshot", math.MaxUint64, 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			restored := t.TempDir()
+			data := string(backup)
+			if tt.name == "Cut off snapshot" {
+				data = data[:strings.Index(data, `"snapshotEnd"`)]
+			}
+			seq, err := Restore(strings.NewReader(data), restored, tt.until)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Restore() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if seq != tt.wantSeq {
+				t.Errorf("Restore() = %d, want %d", seq, tt.wantSeq)
+			}
+			if got := countOf(t, open(restored), map[string]string{"user": "a"}); got != tt.wantCount {
+				t.Errorf("count after restore = %d, want %d", got, tt.wantCount)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package storage
+
+// Subscription signals writes of events which may change the result of a
+// query, and deletions.
+type Subscription interface {
+	// Updates receives a value after matching events were written or events
+	// were deleted, changes until the value is received are coalesced into it.
+	Updates() <-chan struct{}
+	Close()
+}
+
+type subscription struct {
+	storage *inMemoryStorage
+	match   func(attributes map[string]string) bool
+	updates chan struct{}
+}
+
+// Subscribe returns a subscription to the events with the attributes of
+// query, which are accepted by its filters and have its GroupBy attributes.
+func (s *inMemoryStorage) Subscribe(query *Query) (Subscription, error) {
+	match, err := query.eventMatcher()
+	if err != nil {
+		return nil, err
+	}
+	sub := &subscription{
+		storage: s,
+		match:   match,
+		updates: make(chan struct{}, 1),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subscriptions[sub] = true
+	return sub, nil
+}
+
+func (sub *subscription) Updates() <-chan struct{} {
+	return sub.updates
+}
+
+func (sub *subscription) Close() {
+	sub.storage.mu.Lock()
+	defer sub.storage.mu.Unlock()
+	delete(sub.storage.subscriptions, sub)
+}
+
+// notify signals event to the subscription without blocking the writer.
+func (sub *subscription) notify(event *Event) {
+	if !sub.match(event.Attributes) {
+		return
+	}
+	sub.signal()
+}
+
+// signal signals a change without blocking.
+func (sub *subscription) signal() {
+	select {
+	case sub.updates <- struct{}{}:
+	default:
+	}
+}
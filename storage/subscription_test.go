@@ -0,0 +1,43 @@
+package storage
+
+import (
+	"context"
+	"testing"
+)
+
+func Test_inMemoryStorage_Subscribe(t *testing.T) {
+	s := Create(NewDefaultStorageConfiguration())
+	sub, err := s.Subscribe(&Query{Attributes: map[string]string{"app": "checkout"}, GroupBy: []string{"country"}})
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+
+	s.Write(&Events{Events: []Event{
+		{Attributes: map[string]string{"app": "search", "country": "de"}, Timestamp: 1_000},
+		{Attributes: map[string]string{"app": "checkout"}, Timestamp: 1_000},
+	}})
+	if len(sub.Updates()) != 0 {
+		t.Fatalf("update for events which do not match")
+	}
+	for i := 0; i < 3; i++ {
+		s.Write(&Events{Events: []Event{{Attributes: map[string]string{"app": "checkout", "country": "de"}, Timestamp: 1_000}}})
+	}
+	if len(sub.Updates()) != 1 {
+		t.Fatalf("updates = %d, want 1 for coalesced writes", len(sub.Updates()))
+	}
+	<-sub.Updates()
+
+	if _, err := s.Delete(context.Background(), &Deletion{Attributes: map[string]string{"country": "de"}, EndTimestamp: 60_000}); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if len(sub.Updates()) != 1 {
+		t.Fatalf("no update after a deletion")
+	}
+	<-sub.Updates()
+
+	sub.Close()
+	s.Write(&Events{Events: []Event{{Attributes: map[string]string{"app": "checkout", "country": "de"}, Timestamp: 1_000}}})
+	if len(sub.Updates()) != 0 {
+		t.Errorf("update after Close()")
+	}
+}
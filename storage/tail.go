@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// TailEvent is an event as it was written, with the reason of its rejection.
+type TailEvent struct {
+	Event    Event  `json:"event"`
+	Accepted bool   `json:"accepted"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Tail receives the written events which match a query. Writers never wait for
+// a tail, events which do not fit into its buffer are dropped.
+type Tail interface {
+	Events() <-chan TailEvent
+	// Dropped returns the number of events dropped because the buffer was full.
+	Dropped() uint64
+	Close()
+}
+
+type tail struct {
+	storage    *inMemoryStorage
+	match      func(attributes map[string]string) bool
+	sampleRate float64
+	matched    uint64
+	dropped    uint64
+	events     chan TailEvent
+}
+
+// Tail returns a tail of the accepted and rejected events which match the
+// attributes, filters and GroupBy attributes of query. sampleRate is the share
+// of these events which is kept, all of them if 1.
+func (s *inMemoryStorage) Tail(query *Query, sampleRate float64, bufferSize int) (Tail, error) {
+	if sampleRate <= 0 || sampleRate > 1 {
+		return nil, errors.New("the sample rate must be greater than 0 and at most 1")
+	}
+	if bufferSize <= 0 {
+		return nil, errors.New("the buffer size must be greater than 0")
+	}
+	match, err := query.eventMatcher()
+	if err != nil {
+		return nil, err
+	}
+	t := &tail{
+		storage:    s,
+		match:      match,
+		sampleRate: sampleRate,
+		events:     make(chan TailEvent, bufferSize),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tails[t] = true
+	return t, nil
+}
+
+func (t *tail) Events() <-chan TailEvent {
+	return t.events
+}
+
+func (t *tail) Dropped() uint64 {
+	return atomic.LoadUint64(&t.dropped)
+}
+
+func (t *tail) Close() {
+	t.storage.mu.Lock()
+	defer t.storage.mu.Unlock()
+	delete(t.storage.tails, t)
+}
+
+// publish passes every 1/sampleRate-th matching event to the buffer.
+func (t *tail) publish(event *Event, err error) {
+	if !t.match(event.Attributes) {
+		return
+	}
+	n := atomic.AddUint64(&t.matched, 1)
+	if uint64(float64(n)*t.sampleRate) == uint64(float64(n-1)*t.sampleRate) {
+		return
+	}
+
+	tailEvent := TailEvent{Event: *event, Accepted: err == nil}
+	if err != nil {
+		tailEvent.Error = err.Error()
+	}
+	select {
+	case t.events <- tailEvent:
+	default:
+		atomic.AddUint64(&t.dropped, 1)
+	}
+}
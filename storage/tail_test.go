@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"testing"
+)
+
+func Test_inMemoryStorage_Tail(t *testing.T) {
+	tests := []struct {
+		name        string
+		sampleRate  float64
+		bufferSize  int
+		wantEvents  int
+		wantDropped uint64
+	}{
+		{"All events", 1, 10, 6, 0},
+		{"Sampled", 0.5, 10, 3, 0},
+		{"Full buffer", 1, 4, 4, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := Create(NewDefaultStorageConfiguration())
+			tail, err := s.Tail(&Query{Attributes: map[string]string{"app": "checkout"}}, tt.sampleRate, tt.bufferSize)
+			if err != nil {
+				t.Fatalf("Tail() error = %v", err)
+			}
+			defer tail.Close()
+
+			for i := 0; i < 5; i++ {
+				s.Write(&Events{Events: []Event{
+					{Attributes: map[string]string{"app": "checkout"}, Timestamp: 1_000},
+					{Attributes: map[string]string{"app": "search"}, Timestamp: 1_000},
+				}})
+			}
+			s.Write(&Events{Events: []Event{{Attributes: map[string]string{"app": "checkout"}}}})
+
+			var events []TailEvent
+			for len(tail.Events()) > 0 {
+				events = append(events, <-tail.Events())
+			}
+			if len(events) != tt.wantEvents || tail.Dropped() != tt.wantDropped {
+				t.Fatalf("events = %d, dropped = %d, want %d, %d", len(events), tail.Dropped(), tt.wantEvents, tt.wantDropped)
+			}
+			if last := events[len(events)-1]; tt.wantDropped == 0 && (last.Accepted || last.Error != "timestamp cannot be 0") {
+				t.Errorf("last event = %+v, want the rejected event", last)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"math"
 	"sync"
 	"sync/atomic"
 )
@@ -9,6 +10,7 @@ type bucketNode struct {
 	ts    uint64
 	next  *bucketNode
 	value uint64
+	sum   uint64 // float64 bits of the measure sum, used by measure aggregators only
 }
 
 type timeSeriesAggregator struct {
@@ -19,6 +21,7 @@ type timeSeriesAggregator struct {
 	formatTs func(uint64) uint64 // format ts to bucket ts, assumes bucket ts <= input ts
 	timeStep uint64
 	subRange *timeSeriesAggregator
+	measures *sync.Map //map[string]*timeSeriesAggregator where string is measure name
 }
 
 func newRootBucketNode() *bucketNode {
@@ -30,11 +33,13 @@ func newRootBucketNode() *bucketNode {
 }
 
 func newTimeSeries() *timeSeriesAggregator {
-	return newTimeSeriesWithFormatter("month", milliSecondsInMonth, tsToMonthBucket,
+	series := newTimeSeriesWithFormatter("month", milliSecondsInMonth, tsToMonthBucket,
 		newTimeSeriesWithFormatter("day", milliSecondsInDay, tsToDayBucket,
 			newTimeSeriesWithFormatter("hour", milliSecondsInHour, tsToHourBucket,
 				newTimeSeriesWithFormatter("minute", milliSecondsInMinute, tsToMinuteBucket,
 					nil))))
+	series.measures = &sync.Map{}
+	return series
 }
 
 func newTimeSeriesWithFormatter(name string,
@@ -52,29 +57,38 @@ func newTimeSeriesWithFormatter(name string,
 }
 
 func tsToMinuteBucket(ts uint64) uint64 {
-	return ts/milliSecondsInDay + (ts%milliSecondsInDay)/milliSecondsInMinute
+	return ts - ts%milliSecondsInMinute
+}
+
+// minuteBucketsEnd returns the exclusive end of the minute of ts, or the
+// largest timestamp in the last minute, whose end cannot be represented.
+func minuteBucketsEnd(ts uint64) uint64 {
+	end := tsToMinuteBucket(ts) + milliSecondsInMinute
+	if end < ts {
+		return math.MaxUint64
+	}
+	return end
 }
 
 func tsToHourBucket(ts uint64) uint64 {
-	return ts/milliSecondsInDay + (ts%milliSecondsInDay)/milliSecondsInHour
+	return ts - ts%milliSecondsInHour
 }
 
 func tsToDayBucket(ts uint64) uint64 {
-	return ts / milliSecondsInDay
+	return ts - ts%milliSecondsInDay
 }
 
 func tsToMonthBucket(ts uint64) uint64 {
-	return ts / milliSecondsInMonth
+	return ts - ts%milliSecondsInMonth
 }
 
-func (aggregator *timeSeriesAggregator) add(ts uint64, value uint64) {
-	tsFormatted := aggregator.formatTs(ts)
+func (aggregator *timeSeriesAggregator) bucket(tsFormatted uint64) *bucketNode {
 	cachedNode, found := aggregator.nodes.Load(tsFormatted)
 	if !found {
 		aggregator.mu.Lock()
 		cachedNode, found = aggregator.nodes.Load(tsFormatted)
 		if !found {
-			node := aggregator.findPrevBucketNode(tsFormatted)
+			node, _ := aggregator.findPrevBucketNode(tsFormatted)
 
 			prevNext := node.next
 			node.next = &bucketNode{
@@ -87,53 +101,139 @@ func (aggregator *timeSeriesAggregator) add(ts uint64, value uint64) {
 		}
 		aggregator.mu.Unlock()
 	}
-	atomic.AddUint64(&cachedNode.(*bucketNode).value, value)
+	return cachedNode.(*bucketNode)
+}
+
+func (aggregator *timeSeriesAggregator) add(ts uint64, value uint64) {
+	atomic.AddUint64(&aggregator.bucket(aggregator.formatTs(ts)).value, value)
 	if aggregator.subRange != nil {
 		aggregator.subRange.add(ts, value)
 	}
 }
 
-func (aggregator *timeSeriesAggregator) getCount(startTs uint64, endTs uint64) uint64 {
-	var leftBucketTs uint64 = aggregator.formatTs(startTs)
-	var rightBucketTs uint64 = aggregator.formatTs(endTs)
+// subtract removes value from the buckets of ts, which must hold at least
+// value.
+func (aggregator *timeSeriesAggregator) subtract(ts uint64, value uint64) {
+	aggregator.add(ts, ^(value - 1)) // two's complement of value
+}
 
-	if aggregator.subRange != nil && rightBucketTs-leftBucketTs < aggregator.timeStep {
-		return aggregator.subRange.getCount(startTs, endTs)
+func (aggregator *timeSeriesAggregator) addSum(ts uint64, value float64) {
+	addFloat(&aggregator.bucket(aggregator.formatTs(ts)).sum, value)
+	if aggregator.subRange != nil {
+		aggregator.subRange.addSum(ts, value)
 	}
+}
 
-	var result uint64 = aggregator.countInBuckets(leftBucketTs, rightBucketTs)
-	if aggregator.subRange != nil {
-		if leftBucketTs < startTs {
-			result -= aggregator.subRange.getCount(leftBucketTs, startTs)
+// addFloat atomically adds value to the float64 bits at addr.
+func addFloat(addr *uint64, value float64) {
+	for {
+		old := atomic.LoadUint64(addr)
+		if atomic.CompareAndSwapUint64(addr, old, math.Float64bits(math.Float64frombits(old)+value)) {
+			return
 		}
+	}
+}
 
-		if rightBucketTs < endTs {
-			result += aggregator.subRange.getCount(rightBucketTs, endTs)
+// level returns the aggregator of the resolution name, nil if there is none.
+func (aggregator *timeSeriesAggregator) level(name string) *timeSeriesAggregator {
+	for level := aggregator; level != nil; level = level.subRange {
+		if level.name == name {
+			return level
 		}
 	}
-	return result
+	return nil
+}
+
+func (aggregator *timeSeriesAggregator) measure(name string) *timeSeriesAggregator {
+	series, found := aggregator.measures.Load(name)
+	if !found {
+		series, _ = aggregator.measures.LoadOrStore(name, newTimeSeries())
+	}
+	return series.(*timeSeriesAggregator)
+}
+
+// addMeasures adds measures of count occurrences, each occurrence having the
+// given measure values.
+func (aggregator *timeSeriesAggregator) addMeasures(ts uint64, measures map[string]float64, count uint64) {
+	for name, value := range measures {
+		aggregator.measure(name).addSum(ts, value*float64(count))
+	}
+}
+
+// getCount returns the number of events from the minute of startTs to the
+// minute of endTs, both inclusive. plan, if not nil, records the buckets read.
+func (aggregator *timeSeriesAggregator) getCount(startTs uint64, endTs uint64, plan *Plan) uint64 {
+	var count uint64 = 0
+	aggregator.walk(tsToMinuteBucket(startTs), minuteBucketsEnd(endTs), func(level *timeSeriesAggregator, first uint64, last uint64) {
+		level.visitBuckets(first, last, plan, func(node *bucketNode) {
+			count += atomic.LoadUint64(&node.value)
+		})
+	})
+	return count
+}
+
+// getSum is getCount for measure aggregators.
+func (aggregator *timeSeriesAggregator) getSum(startTs uint64, endTs uint64, plan *Plan) float64 {
+	var sum float64 = 0
+	aggregator.walk(tsToMinuteBucket(startTs), minuteBucketsEnd(endTs), func(level *timeSeriesAggregator, first uint64, last uint64) {
+		level.visitBuckets(first, last, plan, func(node *bucketNode) {
+			sum += math.Float64frombits(atomic.LoadUint64(&node.sum))
+		})
+	})
+	return sum
+}
+
+// walk splits [from, to), both aligned to the finest level, into the smallest
+// set of bucket ranges [first, last) and calls visit with each range and its
+// level. Buckets fully inside the range are taken from this level, the partial
+// ones at the edges from the sub ranges.
+func (aggregator *timeSeriesAggregator) walk(from uint64, to uint64, visit func(level *timeSeriesAggregator, first uint64, last uint64)) {
+	if from >= to {
+		return
+	}
+	if aggregator.subRange == nil {
+		visit(aggregator, from, to)
+		return
+	}
+
+	first := aggregator.formatTs(from + aggregator.timeStep - 1)
+	last := aggregator.formatTs(to)
+	if first >= last || first < from {
+		aggregator.subRange.walk(from, to, visit)
+		return
+	}
+
+	aggregator.subRange.walk(from, first, visit)
+	visit(aggregator, first, last)
+	aggregator.subRange.walk(last, to, visit)
 }
 
 /**
-	Calculate sum of all buckets in range, endBucket is exclusive.
+	Visit all buckets in range, endBucket is exclusive.
 **/
-func (aggregator *timeSeriesAggregator) countInBuckets(startBucket uint64, endBucket uint64) uint64 {
+func (aggregator *timeSeriesAggregator) visitBuckets(startBucket uint64, endBucket uint64, plan *Plan, visit func(*bucketNode)) {
 	aggregator.mu.RLock()
 	defer aggregator.mu.RUnlock()
 
-	var sum uint64 = 0
-	node := aggregator.findPrevBucketNode(startBucket).next
-	for node != nil && node.ts <= endBucket {
-		sum += node.value
+	node, skipped := aggregator.findPrevBucketNode(startBucket)
+	node = node.next
+	var visited uint64
+	for node != nil && node.ts < endBucket {
+		visit(node)
+		visited++
 		node = node.next
 	}
-	return sum
+	plan.record(aggregator.name, skipped+visited)
 }
 
-func (aggregator *timeSeriesAggregator) findPrevBucketNode(ts uint64) *bucketNode {
+// findPrevBucketNode returns the last node before ts and the number of nodes
+// passed to find it.
+func (aggregator *timeSeriesAggregator) findPrevBucketNode(ts uint64) (*bucketNode, uint64) {
+	var passed uint64
 	node := aggregator.first
 	for node.next != nil && node.next.ts < ts {
 		node = node.next
+		passed++
 	}
-	return node
+	return node, passed
 }
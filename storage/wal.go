@@ -0,0 +1,380 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// WalFile is the name of the write-ahead log in the data folder.
+const WalFile = "klector.wal"
+
+// SnapshotFile is the name of the snapshot in the data folder, the
+// write-ahead log holds the changes after it.
+const SnapshotFile = "klector.snapshot"
+
+// ErrNoWal is returned by Backup if the storage has no write-ahead log.
+var ErrNoWal = errors.New("write-ahead log is disabled")
+
+// errStopReading stops readWal without an error.
+var errStopReading = errors.New("stop reading")
+
+// walRecord is a line of the write-ahead log, it holds one change of the
+// storage.
+type walRecord struct {
+	Seq      uint64      `json:"seq"`
+	Time     uint64      `json:"time"` // ms since the epoch when the record was written
+	Event    *Event      `json:"event,omitempty"`
+	Series   *SeriesDump `json:"series,omitempty"`   // imported series
+	Deletion *Deletion   `json:"deletion,omitempty"` // tombstone of deleted events
+	// Quarantined is an event outside of the acceptance window, ClearQuarantine
+	// drops the quarantined events.
+	Quarantined     *QuarantinedEvent `json:"quarantined,omitempty"`
+	ClearQuarantine bool              `json:"clearQuarantine,omitempty"`
+	// SnapshotStart and SnapshotEnd enclose the records of a snapshot, which
+	// hold the storage up to the record Seq. Besides series and quarantined
+	// events, these are the events of an actor, the cohorts of an actor
+	// attribute and the remembered event ids.
+	SnapshotStart bool        `json:"snapshotStart,omitempty"`
+	SnapshotEnd   bool        `json:"snapshotEnd,omitempty"`
+	Actor         *actorDump  `json:"actor,omitempty"`
+	Cohort        *cohortDump `json:"cohort,omitempty"`
+	EventIds      []string    `json:"eventIds,omitempty"`
+}
+
+// wal appends records to the write-ahead log, the file holds every record
+// after the snapshot up to seq. compact replaces both with a new snapshot and
+// an empty log.
+type wal struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+	size int64
+	seq  uint64
+	sync bool
+	now  func() uint64 // ms since the epoch, the time of records
+}
+
+func (w *wal) append(record *walRecord) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	record.Seq = w.seq + 1
+	record.Time = w.now()
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := w.file.Write(append(line, '\n')); err != nil {
+		// drops a partly written record
+		w.file.Truncate(w.size)
+		w.file.Seek(w.size, io.SeekStart)
+		return fmt.Errorf("write-ahead log: %w", err)
+	}
+	w.size += int64(len(line)) + 1
+	w.seq = record.Seq
+	return nil
+}
+
+// flush syncs the file if the log is configured to, so that appended
+// records survive a crash of the machine.
+func (w *wal) flush() error {
+	if !w.sync {
+		return nil
+	}
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("write-ahead log: %w", err)
+	}
+	return nil
+}
+
+// backup returns a reader of the snapshot, if there is one, and the log up to
+// the current record, and the seq of the record. The log is only appended to
+// and compact replaces the files instead of changing them, so the reader stays
+// consistent while records are added.
+func (w *wal) backup() (io.ReadCloser, uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	reader := &walReader{}
+	snapshot, err := os.Open(w.snapshotPath())
+	if err == nil {
+		info, err := snapshot.Stat()
+		if err != nil {
+			snapshot.Close()
+			return nil, 0, err
+		}
+		reader.files = append(reader.files, snapshot)
+		reader.readers = append(reader.readers, io.NewSectionReader(snapshot, 0, info.Size()))
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, 0, err
+	}
+	file, err := os.Open(w.path)
+	if err != nil {
+		reader.Close()
+		return nil, 0, err
+	}
+	reader.files = append(reader.files, file)
+	reader.readers = append(reader.readers, io.NewSectionReader(file, 0, w.size))
+	reader.Reader = io.MultiReader(reader.readers...)
+	return reader, w.seq, nil
+}
+
+type walReader struct {
+	io.Reader
+	readers []io.Reader
+	files   []*os.File
+}
+
+func (r *walReader) Close() error {
+	var err error
+	for _, file := range r.files {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func (w *wal) snapshotPath() string {
+	return filepath.Join(filepath.Dir(w.path), SnapshotFile)
+}
+
+// compact writes a snapshot of the records passed to record by dump, which
+// hold the storage up to the current record, and replaces the log by an empty
+// one. No records may be appended meanwhile. It returns the seq of the
+// snapshot.
+func (w *wal) compact(dump func(record func(*walRecord) error) error) (uint64, error) {
+	seq, now := w.seq, w.now()
+	snapshotPath := w.snapshotPath()
+	if err := writeFile(snapshotPath+".tmp", func(encoder *json.Encoder) error {
+		write := func(record *walRecord) error {
+			record.Seq, record.Time = seq, now
+			return encoder.Encode(record)
+		}
+		if err := write(&walRecord{SnapshotStart: true}); err != nil {
+			return err
+		}
+		if err := dump(write); err != nil {
+			return err
+		}
+		return write(&walRecord{SnapshotEnd: true})
+	}); err != nil {
+		os.Remove(snapshotPath + ".tmp")
+		return 0, fmt.Errorf("snapshot: %w", err)
+	}
+	file, err := os.OpenFile(w.path+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		os.Remove(snapshotPath + ".tmp")
+		return 0, fmt.Errorf("snapshot: %w", err)
+	}
+
+	// records up to seq which are left in the log by a crash after the
+	// snapshot replaced the old one are skipped by openWal
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := os.Rename(snapshotPath+".tmp", snapshotPath); err != nil {
+		file.Close()
+		os.Remove(w.path + ".tmp")
+		return 0, fmt.Errorf("snapshot: %w", err)
+	}
+	if err := os.Rename(w.path+".tmp", w.path); err != nil {
+		file.Close()
+		return 0, fmt.Errorf("snapshot: %w", err)
+	}
+	w.file.Close()
+	w.file, w.size = file, 0
+	return seq, nil
+}
+
+// writeFile writes the records encoded by write to path and syncs it.
+func writeFile(path string, write func(encoder *json.Encoder) error) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	writer := bufio.NewWriterSize(file, 64<<10)
+	if err := write(json.NewEncoder(writer)); err != nil {
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// readWal calls apply for every record of r until apply returns
+// errStopReading, and returns the size of the records applied. A last record
+// cut off by a crash is ignored.
+func readWal(r io.Reader, apply func(*walRecord) error) (int64, error) {
+	reader := bufio.NewReaderSize(r, 64<<10)
+	var size int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(bytes.TrimSpace(line)) > 0 {
+				log.Printf("Ignored incomplete record at the end of the write-ahead log")
+			}
+			return size, nil
+		}
+		if err != nil {
+			return size, err
+		}
+
+		var record walRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return size, fmt.Errorf("record at offset %d: %w", size, err)
+		}
+		if err := apply(&record); err == errStopReading {
+			return size, nil
+		} else if err != nil {
+			return size, fmt.Errorf("record %d: %w", record.Seq, err)
+		}
+		size += int64(len(line))
+	}
+}
+
+// openWal replays the snapshot and the write-ahead log of dataFolder with
+// apply and opens the log to append further records at the times of now.
+func openWal(dataFolder string, sync bool, now func() uint64, apply func(*walRecord) error) (*wal, error) {
+	if err := os.MkdirAll(dataFolder, 0755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dataFolder, WalFile)
+	w := &wal{path: path, sync: sync, now: now}
+	snapshotRecords, err := readSnapshot(w.snapshotPath(), func(record *walRecord) error {
+		w.seq = record.Seq
+		return apply(record)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", w.snapshotPath(), err)
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	w.file = file
+	snapshotSeq := w.seq
+	records := 0
+	w.size, err = readWal(file, func(record *walRecord) error {
+		if record.Seq <= snapshotSeq && snapshotRecords > 0 {
+			// left by a crash while the snapshot was taken
+			return nil
+		}
+		records++
+		w.seq = record.Seq
+		return apply(record)
+	})
+	if err == nil {
+		// drops an incomplete last record
+		err = file.Truncate(w.size)
+	}
+	if err == nil {
+		_, err = file.Seek(w.size, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	log.Printf("Replayed a snapshot of %d records and %d records of the write-ahead log", snapshotRecords, records)
+	return w, nil
+}
+
+// readSnapshot calls apply for every record of the snapshot at path, if there
+// is one, and returns their number.
+func readSnapshot(path string, apply func(*walRecord) error) (int, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	records, complete := 0, false
+	if _, err := readWal(file, func(record *walRecord) error {
+		if records == 0 && !record.SnapshotStart {
+			return errors.New("the snapshot does not start with its first record")
+		}
+		records++
+		complete = record.SnapshotEnd
+		return apply(record)
+	}); err != nil {
+		return 0, err
+	}
+	if !complete {
+		return 0, errors.New("the snapshot is incomplete")
+	}
+	return records, nil
+}
+
+// Restore writes the snapshot and the records of backup up to the first one
+// written after the timestamp in ms to the snapshot and the write-ahead log of
+// dataFolder, which must not have them. Later records are left out even if the
+// clock stepped back, so the restored log is a prefix of the backup. It
+// returns the seq of the last restored record, a backup whose snapshot was
+// taken after the timestamp cannot be restored.
+func Restore(backup io.Reader, dataFolder string, until uint64) (uint64, error) {
+	if err := os.MkdirAll(dataFolder, 0755); err != nil {
+		return 0, err
+	}
+	path := filepath.Join(dataFolder, WalFile)
+	snapshotPath := filepath.Join(dataFolder, SnapshotFile)
+	for _, p := range []string{path, snapshotPath} {
+		if _, err := os.Stat(p); err == nil {
+			return 0, fmt.Errorf("%s exists already", p)
+		}
+	}
+
+	var seq, snapshotSeq uint64
+	inSnapshot, hasSnapshot := false, false
+	err := writeFile(snapshotPath+".tmp", func(snapshot *json.Encoder) error {
+		return writeFile(path+".tmp", func(changes *json.Encoder) error {
+			_, err := readWal(backup, func(record *walRecord) error {
+				switch {
+				case record.SnapshotStart:
+					if seq > 0 || hasSnapshot {
+						return errors.New("snapshot after the first record")
+					}
+					if record.Time > until {
+						return fmt.Errorf("the backup starts with a snapshot taken at %d, after %d", record.Time, until)
+					}
+					inSnapshot, hasSnapshot = true, true
+					return snapshot.Encode(record)
+				case inSnapshot:
+					inSnapshot = !record.SnapshotEnd
+					seq, snapshotSeq = record.Seq, record.Seq
+					return snapshot.Encode(record)
+				case hasSnapshot && record.Seq <= snapshotSeq:
+					return nil
+				case record.Time > until:
+					return errStopReading
+				}
+				seq = record.Seq
+				return changes.Encode(record)
+			})
+			if err == nil && inSnapshot {
+				err = errors.New("the snapshot of the backup is incomplete")
+			}
+			return err
+		})
+	})
+	defer os.Remove(snapshotPath + ".tmp")
+	defer os.Remove(path + ".tmp")
+	if err != nil {
+		return 0, err
+	}
+	if hasSnapshot {
+		if err := os.Rename(snapshotPath+".tmp", snapshotPath); err != nil {
+			return 0, err
+		}
+	}
+	return seq, os.Rename(path+".tmp", path)
+}
@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io.klector/klector/clock"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func walConfiguration(dataFolder string) *StorageConfiguration {
+	config := NewDefaultStorageConfiguration()
+	config.DataFolder = dataFolder
+	config.Wal = true
+	config.MaxEventIds = 1_000
+	return config
+}
+
+func countOf(t *testing.T, s Storage, attributes map[string]string) uint64 {
+	result, err := s.Query(context.Background(), &Query{Attributes: attributes, StartTimestamp: 0, EndTimestamp: 600_000})
+	if err != nil {
+		t.Fatalf("Query() error = %v", err)
+	}
+	return result.Value
+}
+
+func Test_Open(t *testing.T) {
+	dataFolder := t.TempDir()
+	s, err := Open(walConfiguration(dataFolder))
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	s.Write(&Events{Events: []Event{
+		{Id: "1", Attributes: map[string]string{"app": "checkout"}, Count: 2, Timestamp: 1_000},
+		{Id: "2", Attributes: map[string]string{"app": "checkout"}, Timestamp: 61_000},
+		{Id: "3", Attributes: map[string]string{}, Timestamp: 61_000},
+		{Id: "4", Attributes: map[string]string{"app": "checkout"}, Timestamp: 61_000},
+	}})
+	s.Import(&SeriesDump{Attributes: []AttributeValue{{Name: "app", Value: "search"}}, Buckets: []BucketDump{{Timestamp: 60_000, Count: 5}}})
+
+	// a crash while a record is written
+	file, _ := os.OpenFile(filepath.Join(dataFolder, WalFile), os.O_WRONLY|os.O_APPEND, 0644)
+	file.WriteString(`{"seq":5,"time":1,"event":{"attrib`)
+	file.Close()
+
+	s, err = Open(walConfiguration(dataFolder))
+	if err != nil {
+		t.Fatalf("Open() of the log error = %v", err)
+	}
+	if got := countOf(t, s, map[string]string{"app": "checkout"}); got != 4 {
+		t.Errorf("count after replay = %d, want 4", got)
+	}
+	if got := countOf(t, s, map[string]string{"app": "search"}); got != 5 {
+		t.Errorf("count of imported series after replay = %d, want 5", got)
+	}
+
+	s.Write(&Events{Events: []Event{
+		{Id: "2", Attributes: map[string]string{"app": "checkout"}, Timestamp: 61_000},
+		{Id: "5", Attributes: map[string]string{"app": "checkout"}, Timestamp: 61_000},
+	}})
+	reader, position, err := s.Backup()
+	if err != nil {
+		t.Fatalf("Backup() error = %v", err)
+	}
+	defer reader.Close()
+	if position != 5 {
+		t.Errorf("Backup() position = %d, want 5", position)
+	}
+	backup, _ := io.ReadAll(reader)
+	if lines := strings.Count(string(backup), "\n"); lines != 5 {
+		t.Errorf("Backup() has %d records, want 5", lines)
+	}
+}
+
+func Test_Restore(t *testing.T) {
+	backup := `{"seq":1,"time":1000,"event":{"attributes":{"app":"checkout"},"timestamp":1000}}
+{"seq":2,"time":2000,"event":{"attributes":{"app":"checkout"},"timestamp":1000}}
+{"seq":3,"time":3000,"event":{"attributes":{"app":"checkout"},"timestamp":1000}}
+{"seq":4,"time":1500,"event":{"attributes":{"app":"checkout"},"timestamp":1000}}
+`
+	tests := []struct {
+		name      string
+		until     uint64
+		wantSeq   uint64
+		wantCount uint64
+	}{
+		{"All", 3000, 4, 4},
+		{"Point in time before the clock stepped back", 2999, 2, 2},
+		{"Before the first record", 0, 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dataFolder := t.TempDir()
+			seq, err := Restore(strings.NewReader(backup), dataFolder, tt.until)
+			if err != nil {
+				t.Fatalf("Restore() error = %v", err)
+			}
+			if seq != tt.wantSeq {
+				t.Errorf("Restore() = %d, want %d", seq, tt.wantSeq)
+			}
+			s, err := Open(walConfiguration(dataFolder))
+			if err != nil {
+				t.Fatalf("Open() error = %v", err)
+			}
+			if got := countOf(t, s, map[string]string{"app": "checkout"}); got != tt.wantCount {
+				t.Errorf("count after restore = %d, want %d", got, tt.wantCount)
+			}
+			if _, err := Restore(bytes.NewReader(nil), dataFolder, tt.until); err == nil {
+				t.Errorf("Restore() to a data folder with a log succeeded")
+			}
+		})
+	}
+}
+
+func Test_inMemoryStorage_Write_walFailure(t *testing.T) {
+	dataFolder := t.TempDir()
+	s, err := Open(walConfiguration(dataFolder))
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	events := &Events{Events: []Event{{Id: "1", Attributes: map[string]string{"app": "checkout"}, Timestamp: 1_000}}}
+	w := s.(*inMemoryStorage).wal
+	w.file.Close()
+	if err := s.Write(events); err == nil {
+		t.Fatalf("Write() error = nil, want an error of the closed log")
+	}
+
+	w.file, _ = os.OpenFile(filepath.Join(dataFolder, WalFile), os.O_WRONLY|os.O_APPEND, 0644)
+	if err := s.Write(events); err != nil {
+		t.Fatalf("Write() of the retry error = %v", err)
+	}
+	if got := countOf(t, s, map[string]string{"app": "checkout"}); got != 1 {
+		t.Errorf("count = %d, want 1", got)
+	}
+}
+
+func Test_Restore_untilStorageClock(t *testing.T) {
+	s, err := Open(walConfiguration(t.TempDir()))
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	for _, written := range []int64{1_000, 2_000} {
+		s.(*inMemoryStorage).clock = clock.Fixed(time.Unix(written, 0))
+		s.Write(&Events{Events: []Event{{Attributes: map[string]string{"app": "checkout"}, Timestamp: 1_000}}})
+	}
+	reader, _, err := s.Backup()
+	if err != nil {
+		t.Fatalf("Backup() error = %v", err)
+	}
+	defer reader.Close()
+
+	seq, err := Restore(reader, t.TempDir(), 1_500_000)
+	if err != nil {
+		t.Fatalf("Restore() error = %v", err)
+	}
+	if seq != 1 {
+		t.Errorf("Restore() = %d, want the record written at 1000 s only", seq)
+	}
+}